@@ -0,0 +1,127 @@
+/*
+   Copyright 2016 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package audit writes a structured record of every auth decision.
+package audit
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+type Config struct {
+	File   *FileConfig   `yaml:"file,omitempty"`
+	Syslog *SyslogConfig `yaml:"syslog,omitempty"`
+	HTTP   *HTTPConfig   `yaml:"http,omitempty"`
+}
+
+// Record describes the outcome of a single auth request.
+type Record struct {
+	Time        time.Time     `json:"time"`
+	RemoteAddr  string        `json:"remote_addr"`
+	RealIP      string        `json:"real_ip,omitempty"`
+	Account     string        `json:"account"`
+	Login       string        `json:"login,omitempty"`
+	Service     string        `json:"service,omitempty"`
+	Outcome     string        `json:"outcome"`
+	Error       string        `json:"error,omitempty"`
+	Authn       string        `json:"authn,omitempty"`
+	Scopes      []ScopeRecord `json:"scopes,omitempty"`
+	TokenID     string        `json:"token_id,omitempty"`
+	TokenExpiry *time.Time    `json:"token_expiry,omitempty"`
+}
+
+type ScopeRecord struct {
+	Type       string   `json:"type"`
+	Name       string   `json:"name"`
+	Requested  []string `json:"requested"`
+	Granted    []string `json:"granted"`
+	Authorizer string   `json:"authorizer,omitempty"`
+	Comment    string   `json:"comment,omitempty"`
+}
+
+type sink interface {
+	Write(data []byte) error
+	Close() error
+	Name() string
+}
+
+// Logger sends audit records to all the configured sinks.
+type Logger struct {
+	sinks []sink
+}
+
+func (c *Config) Validate() error {
+	if c.File == nil && c.Syslog == nil && c.HTTP == nil {
+		return errors.New("at least one of file, syslog or http must be configured")
+	}
+	if c.File != nil {
+		if err := c.File.validate(); err != nil {
+			return fmt.Errorf("file: %s", err)
+		}
+	}
+	if c.HTTP != nil {
+		if err := c.HTTP.validate(); err != nil {
+			return fmt.Errorf("http: %s", err)
+		}
+	}
+	return nil
+}
+
+func New(c *Config) (*Logger, error) {
+	l := &Logger{}
+	if c.File != nil {
+		l.sinks = append(l.sinks, newFileSink(c.File))
+	}
+	if c.Syslog != nil {
+		s, err := newSyslogSink(c.Syslog)
+		if err != nil {
+			l.Close()
+			return nil, fmt.Errorf("failed to connect to syslog: %s", err)
+		}
+		l.sinks = append(l.sinks, s)
+	}
+	if c.HTTP != nil {
+		l.sinks = append(l.sinks, newHTTPSink(c.HTTP))
+	}
+	return l, nil
+}
+
+// Log writes the record to every sink. Failures are logged but otherwise ignored.
+func (l *Logger) Log(r *Record) {
+	data, err := json.Marshal(r)
+	if err != nil {
+		glog.Errorf("Failed to marshal audit record: %s", err)
+		return
+	}
+	for _, s := range l.sinks {
+		if err := s.Write(data); err != nil {
+			glog.Errorf("Failed to write audit record to %s: %s", s.Name(), err)
+		}
+	}
+}
+
+func (l *Logger) Close() {
+	for _, s := range l.sinks {
+		if err := s.Close(); err != nil {
+			glog.Errorf("Failed to close audit %s: %s", s.Name(), err)
+		}
+	}
+}
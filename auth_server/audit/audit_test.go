@@ -0,0 +1,71 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func readRecords(t *testing.T, path string) []Record {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var recs []Record
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		var r Record
+		if err := json.Unmarshal(s.Bytes(), &r); err != nil {
+			t.Fatalf("line %q: %s", s.Text(), err)
+		}
+		recs = append(recs, r)
+	}
+	return recs
+}
+
+func TestFileSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c := &Config{File: &FileConfig{Path: filepath.Join(dir, "audit.log")}}
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	l1, err := New(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l1.Log(&Record{Account: "alice", Outcome: "ok"})
+
+	// A reload with the same path shares the file with the old logger.
+	l2, err := New(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l1.sinks[0].(*fileSink).f != l2.sinks[0].(*fileSink).f {
+		t.Errorf("file is not shared")
+	}
+	l1.Log(&Record{Account: "bob", Outcome: "authn_fail"})
+	l1.Close()
+	l2.Log(&Record{Account: "carol", Outcome: "ok"})
+	l2.Close()
+	if len(files) != 0 {
+		t.Errorf("files not released: %v", files)
+	}
+
+	recs := readRecords(t, c.File.Path)
+	if len(recs) != 3 {
+		t.Fatalf("expected 3 records, got %+v", recs)
+	}
+	for i, account := range []string{"alice", "bob", "carol"} {
+		if recs[i].Account != account {
+			t.Errorf("record %d: expected %s, got %+v", i, account, recs[i])
+		}
+	}
+}
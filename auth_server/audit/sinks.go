@@ -0,0 +1,232 @@
+/*
+   Copyright 2016 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package audit
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/syslog"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+type FileConfig struct {
+	Path string `yaml:"path,omitempty"`
+	// Rotation settings, see https://godoc.org/gopkg.in/natefinch/lumberjack.v2#Logger
+	MaxSize    int  `yaml:"max_size,omitempty"`
+	MaxBackups int  `yaml:"max_backups,omitempty"`
+	MaxAge     int  `yaml:"max_age,omitempty"`
+	Compress   bool `yaml:"compress,omitempty"`
+}
+
+type SyslogConfig struct {
+	// Empty network and address means local syslog.
+	Network string `yaml:"network,omitempty"`
+	Addr    string `yaml:"addr,omitempty"`
+	Tag     string `yaml:"tag,omitempty"`
+}
+
+type HTTPConfig struct {
+	URL       string        `yaml:"url,omitempty"`
+	Timeout   time.Duration `yaml:"timeout,omitempty"`
+	QueueSize int           `yaml:"queue_size,omitempty"`
+}
+
+func (c *FileConfig) validate() error {
+	if c.Path == "" {
+		return errors.New("path is required")
+	}
+	if c.MaxSize < 0 || c.MaxBackups < 0 || c.MaxAge < 0 {
+		return errors.New("rotation settings must not be negative")
+	}
+	return nil
+}
+
+func (c *HTTPConfig) validate() error {
+	if c.URL == "" {
+		return errors.New("url is required")
+	}
+	if _, err := url.Parse(c.URL); err != nil {
+		return fmt.Errorf("invalid url: %s", err)
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = 5 * time.Second
+	}
+	if c.QueueSize <= 0 {
+		c.QueueSize = 1000
+	}
+	return nil
+}
+
+// Files are shared by all loggers writing to the same path. During a reload the loggers of the
+// old and the new config both write to the file for a while, and must not rotate it independently.
+var (
+	filesLock sync.Mutex
+	files     = map[string]*sharedFile{}
+)
+
+type sharedFile struct {
+	lock   sync.Mutex
+	config FileConfig
+	l      *lumberjack.Logger
+	refs   int
+}
+
+func newLumberjack(c *FileConfig) *lumberjack.Logger {
+	return &lumberjack.Logger{
+		Filename:   c.Path,
+		MaxSize:    c.MaxSize,
+		MaxBackups: c.MaxBackups,
+		MaxAge:     c.MaxAge,
+		Compress:   c.Compress,
+	}
+}
+
+type fileSink struct {
+	f *sharedFile
+}
+
+func newFileSink(c *FileConfig) *fileSink {
+	filesLock.Lock()
+	defer filesLock.Unlock()
+	f := files[c.Path]
+	if f == nil {
+		f = &sharedFile{config: *c, l: newLumberjack(c)}
+		files[c.Path] = f
+	} else if f.config != *c {
+		// Rotation settings changed, they apply to all loggers of the file from now on.
+		f.lock.Lock()
+		f.l.Close()
+		f.config, f.l = *c, newLumberjack(c)
+		f.lock.Unlock()
+	}
+	f.refs++
+	return &fileSink{f: f}
+}
+
+func (fs *fileSink) Write(data []byte) error {
+	fs.f.lock.Lock()
+	defer fs.f.lock.Unlock()
+	_, err := fs.f.l.Write(append(data, '\n'))
+	return err
+}
+
+func (fs *fileSink) Close() error {
+	filesLock.Lock()
+	defer filesLock.Unlock()
+	if fs.f.refs--; fs.f.refs > 0 {
+		return nil
+	}
+	delete(files, fs.f.config.Path)
+	fs.f.lock.Lock()
+	defer fs.f.lock.Unlock()
+	return fs.f.l.Close()
+}
+
+func (fs *fileSink) Name() string {
+	return fs.f.config.Path
+}
+
+type syslogSink struct {
+	w *syslog.Writer
+}
+
+func newSyslogSink(c *SyslogConfig) (*syslogSink, error) {
+	tag := c.Tag
+	if tag == "" {
+		tag = "docker_auth"
+	}
+	w, err := syslog.Dial(c.Network, c.Addr, syslog.LOG_INFO|syslog.LOG_AUTH, tag)
+	if err != nil {
+		return nil, err
+	}
+	return &syslogSink{w: w}, nil
+}
+
+func (ss *syslogSink) Write(data []byte) error {
+	return ss.w.Info(string(data))
+}
+
+func (ss *syslogSink) Close() error {
+	return ss.w.Close()
+}
+
+func (ss *syslogSink) Name() string {
+	return "syslog"
+}
+
+// httpSink posts records asynchronously so that a slow collector does not hold up auth requests.
+// If the queue is full, records are dropped.
+type httpSink struct {
+	url    string
+	client *http.Client
+	queue  chan []byte
+	done   chan struct{}
+}
+
+func newHTTPSink(c *HTTPConfig) *httpSink {
+	hs := &httpSink{
+		url:    c.URL,
+		client: &http.Client{Timeout: c.Timeout},
+		queue:  make(chan []byte, c.QueueSize),
+		done:   make(chan struct{}),
+	}
+	go hs.run()
+	return hs
+}
+
+func (hs *httpSink) run() {
+	defer close(hs.done)
+	for data := range hs.queue {
+		resp, err := hs.client.Post(hs.url, "application/json", bytes.NewReader(data))
+		if err != nil {
+			glog.Errorf("Failed to post audit record: %s", err)
+			continue
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			glog.Errorf("Failed to post audit record: %s", resp.Status)
+		}
+	}
+}
+
+func (hs *httpSink) Write(data []byte) error {
+	select {
+	case hs.queue <- data:
+		return nil
+	default:
+		return errors.New("queue is full, record dropped")
+	}
+}
+
+func (hs *httpSink) Close() error {
+	close(hs.queue)
+	<-hs.done
+	return nil
+}
+
+func (hs *httpSink) Name() string {
+	return hs.url
+}
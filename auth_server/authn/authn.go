@@ -25,8 +25,10 @@ type Authenticator interface {
 	// A special NoMatch error is returned if the authorizer could not reach a decision,
 	// e.g. none of the rules matched.
 	// Another special WrongPass error is returned if the authorizer failed to authenticate.
+	// On success, the authenticator may also return a set of labels describing the user
+	// (e.g. groups it belongs to), these are made available to the token issuer.
 	// Implementations must be goroutine-safe.
-	Authenticate(user string, password PasswordString) (bool, error)
+	Authenticate(user string, password PasswordString) (bool, Labels, error)
 
 	// Finalize resources in preparation for shutdown.
 	// When this call is made there are guaranteed to be no Authenticate requests in flight
@@ -37,10 +39,22 @@ type Authenticator interface {
 	Name() string
 }
 
+// AccountChecker is implemented by password authenticators that can tell whether an account may still be used,
+// e.g. by passwords issued after MFA sign in. NoMatch is returned if the user is not known to the authenticator.
+type AccountChecker interface {
+	// CheckAccount returns false if the account is disabled or expired.
+	CheckAccount(user string) (bool, error)
+}
+
 var NoMatch = errors.New("did not match any rule")
 var WrongPass = errors.New("wrong password for user")
 
-//go:generate go-bindata -pkg authn -modtime 1 -mode 420 data/
+// Labels are arbitrary named lists of values attached to an authenticated user, e.g. "groups".
+type Labels map[string][]string
+
+// AccountLabel, if returned by an authenticator with a single value, replaces the name the user logged in with.
+// It is used by authenticators that know the canonical account name, e.g. from a directory.
+const AccountLabel = "account"
 
 type PasswordString string
 
@@ -0,0 +1,186 @@
+/*
+   Copyright 2016 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package authn
+
+import (
+	"container/list"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+type CacheConfig struct {
+	// How long successful authentications are remembered.
+	TTL time.Duration `yaml:"ttl,omitempty"`
+	// How long failed authentications are remembered. Not cached by default.
+	NegativeTTL time.Duration `yaml:"negative_ttl,omitempty"`
+	// Maximum number of entries, least recently used are evicted.
+	MaxSize int `yaml:"max_size,omitempty"`
+}
+
+func (c *CacheConfig) Validate() error {
+	if c.TTL <= 0 {
+		return errors.New("ttl must be positive")
+	}
+	if c.NegativeTTL < 0 {
+		return errors.New("negative_ttl must not be negative")
+	}
+	if c.MaxSize < 0 {
+		return errors.New("max_size must not be negative")
+	}
+	if c.MaxSize == 0 {
+		c.MaxSize = 10000
+	}
+	return nil
+}
+
+type cacheEntry struct {
+	key     string
+	user    string
+	result  bool
+	labels  Labels
+	err     error
+	expires time.Time
+}
+
+// cachingAuthenticator remembers results of another authenticator.
+// Entries are keyed by account and a keyed hash of the password, the key is random and never leaves the process.
+// Errors other than NoMatch are never cached.
+type cachingAuthenticator struct {
+	a       Authenticator
+	config  *CacheConfig
+	hashKey []byte
+	lock    sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+// healthCheckingCache is a cachingAuthenticator for authenticators that support health checks.
+type healthCheckingCache struct {
+	*cachingAuthenticator
+	hc interface {
+		HealthCheck() error
+	}
+}
+
+func (hcc *healthCheckingCache) HealthCheck() error {
+	return hcc.hc.HealthCheck()
+}
+
+func NewCachingAuthenticator(a Authenticator, c *CacheConfig) (Authenticator, error) {
+	hashKey := make([]byte, 32)
+	if _, err := rand.Read(hashKey); err != nil {
+		return nil, err
+	}
+	ca := &cachingAuthenticator{
+		a:       a,
+		config:  c,
+		hashKey: hashKey,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+	glog.Infof("Caching %s authentication results for %s", a.Name(), c.TTL)
+	if hc, ok := a.(interface {
+		HealthCheck() error
+	}); ok {
+		return &healthCheckingCache{ca, hc}, nil
+	}
+	return ca, nil
+}
+
+func (ca *cachingAuthenticator) cacheKey(user string, password PasswordString) string {
+	mac := hmac.New(sha256.New, ca.hashKey)
+	mac.Write([]byte(password))
+	return user + "\x00" + string(mac.Sum(nil))
+}
+
+func (ca *cachingAuthenticator) Authenticate(user string, password PasswordString) (bool, Labels, error) {
+	key := ca.cacheKey(user, password)
+	now := time.Now()
+	ca.lock.Lock()
+	if el := ca.entries[key]; el != nil {
+		e := el.Value.(*cacheEntry)
+		if now.Before(e.expires) {
+			ca.lru.MoveToFront(el)
+			ca.lock.Unlock()
+			glog.V(2).Infof("%s: cached result for %s: %t, %v", ca.a.Name(), user, e.result, e.err)
+			return e.result, e.labels, e.err
+		}
+		ca.remove(el)
+	}
+	ca.lock.Unlock()
+
+	result, labels, err := ca.a.Authenticate(user, password)
+	ttl := ca.config.TTL
+	if !result {
+		ttl = ca.config.NegativeTTL
+	}
+	if ttl <= 0 || (err != nil && err != NoMatch) {
+		return result, labels, err
+	}
+	ca.lock.Lock()
+	defer ca.lock.Unlock()
+	if el := ca.entries[key]; el != nil {
+		ca.remove(el)
+	}
+	ca.entries[key] = ca.lru.PushFront(&cacheEntry{
+		key: key, user: user, result: result, labels: labels, err: err, expires: now.Add(ttl),
+	})
+	for ca.lru.Len() > ca.config.MaxSize {
+		ca.remove(ca.lru.Back())
+	}
+	return result, labels, err
+}
+
+// Forget drops cached results for the user, so that the next attempt is checked by the authenticator.
+func (ca *cachingAuthenticator) Forget(user string) {
+	ca.lock.Lock()
+	defer ca.lock.Unlock()
+	for el := ca.lru.Front(); el != nil; {
+		next := el.Next()
+		if el.Value.(*cacheEntry).user == user {
+			ca.remove(el)
+		}
+		el = next
+	}
+}
+
+func (ca *cachingAuthenticator) remove(el *list.Element) {
+	ca.lru.Remove(el)
+	delete(ca.entries, el.Value.(*cacheEntry).key)
+}
+
+// CheckAccount asks the authenticator, accounts of authenticators that cannot tell are always active.
+func (ca *cachingAuthenticator) CheckAccount(user string) (bool, error) {
+	if ac, ok := ca.a.(AccountChecker); ok {
+		return ac.CheckAccount(user)
+	}
+	return true, nil
+}
+
+func (ca *cachingAuthenticator) Stop() {
+	ca.a.Stop()
+}
+
+func (ca *cachingAuthenticator) Name() string {
+	return ca.a.Name()
+}
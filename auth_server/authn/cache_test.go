@@ -0,0 +1,59 @@
+package authn
+
+import (
+	"testing"
+	"time"
+)
+
+type countingAuth struct {
+	calls int
+	pass  PasswordString
+}
+
+func (ca *countingAuth) Authenticate(user string, password PasswordString) (bool, Labels, error) {
+	ca.calls++
+	if user != "john" {
+		return false, nil, NoMatch
+	}
+	return password == ca.pass, Labels{"group": []string{"dev"}}, nil
+}
+
+func (ca *countingAuth) Stop() {}
+
+func (ca *countingAuth) Name() string { return "counting" }
+
+func TestCachingAuthenticator(t *testing.T) {
+	backend := &countingAuth{pass: "secret"}
+	c := &CacheConfig{TTL: time.Hour, MaxSize: 2}
+	if err := c.Validate(); err != nil {
+		t.Fatalf("validation failed: %s", err)
+	}
+	a, err := NewCachingAuthenticator(backend, c)
+	if err != nil {
+		t.Fatalf("failed to create cache: %s", err)
+	}
+	check := func(user string, password PasswordString, result bool, calls int) {
+		r, labels, _ := a.Authenticate(user, password)
+		if r != result || backend.calls != calls {
+			t.Errorf("%s/%s: expected %t after %d calls, got %t after %d", user, password, result, calls, r, backend.calls)
+		}
+		if r && len(labels["group"]) != 1 {
+			t.Errorf("%s: labels were not preserved: %v", user, labels)
+		}
+	}
+	check("john", "secret", true, 1)
+	check("john", "secret", true, 1)
+	// Different password must not hit the cached entry, failures are not cached by default.
+	check("john", "wrong", false, 2)
+	check("john", "wrong", false, 3)
+
+	c.NegativeTTL = time.Hour
+	check("jane", "x", false, 4)
+	check("jane", "x", false, 4)
+	// Cache is full, the least recently used entry is evicted.
+	check("jim", "x", false, 5)
+	check("john", "secret", true, 6)
+	check("john", "secret", true, 6)
+	a.(*cachingAuthenticator).Forget("john")
+	check("john", "secret", true, 7)
+}
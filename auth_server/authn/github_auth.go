@@ -21,7 +21,6 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"html/template"
 	"io/ioutil"
 	"net/http"
 	"net/url"
@@ -39,6 +38,12 @@ type GitHubAuthConfig struct {
 	TokenDB          string        `yaml:"token_db,omitempty"`
 	HTTPTimeout      time.Duration `yaml:"http_timeout,omitempty"`
 	RevalidateAfter  time.Duration `yaml:"revalidate_after,omitempty"`
+	// URL of /github_auth as seen by the browser. If not set, the callback URL of the GitHub application is used.
+	RedirectURI string `yaml:"redirect_uri,omitempty"`
+
+	TokenStore        *TokenStoreConfig      `yaml:"token_store,omitempty"`
+	TokenEncryption   *TokenEncryptionConfig `yaml:"token_encryption,omitempty"`
+	PurgeExpiredAfter time.Duration          `yaml:"purge_expired_after,omitempty"`
 }
 
 type GitHubAuthRequest struct {
@@ -52,65 +57,127 @@ type GitHubTokenUser struct {
 	Email string `json:"email,omitempty"`
 }
 
+// Validate checks settings that are specific to GitHub.
+func (c *GitHubAuthConfig) Validate(configKey string) error {
+	if c.RedirectURI != "" {
+		if err := validateRedirectURI(c.RedirectURI, "/github_auth"); err != nil {
+			return fmt.Errorf("%s.redirect_uri: %s", configKey, err)
+		}
+	}
+	return nil
+}
+
 type GitHubAuth struct {
-	config *GitHubAuthConfig
-	db     TokenDB
-	client *http.Client
-	tmpl   *template.Template
+	config  *GitHubAuthConfig
+	db      TokenDB
+	client  *http.Client
+	onLogin LoginHandler
+	web     *WebSecurity
+	stop    chan struct{}
 }
 
 func NewGitHubAuth(c *GitHubAuthConfig) (*GitHubAuth, error) {
-	db, err := NewTokenDB(c.TokenDB)
+	db, err := NewTokenDB(c.TokenDB, c.TokenStore, c.TokenEncryption)
 	if err != nil {
 		return nil, err
 	}
-	glog.Infof("GitHub auth token DB at %s", c.TokenDB)
-	return &GitHubAuth{
-		config: c,
-		db:     db,
-		client: &http.Client{Timeout: 10 * time.Second},
-		tmpl:   template.Must(template.New("github_auth").Parse(string(MustAsset("data/github_auth.tmpl")))),
-	}, nil
+	if c.TokenStore != nil {
+		glog.Infof("GitHub auth token DB in %s", c.TokenStore)
+	} else {
+		glog.Infof("GitHub auth token DB at %s", c.TokenDB)
+	}
+	gha := &GitHubAuth{
+		config:  c,
+		db:      db,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		onLogin: textLoginHandler,
+		web:     newRandomWebSecurity(),
+		stop:    make(chan struct{}),
+	}
+	if c.PurgeExpiredAfter > 0 {
+		go purgeExpiredTokens(db, "GitHub auth", c.PurgeExpiredAfter, gha.stop)
+	}
+	return gha, nil
+}
+
+// TokenDB returns the database of tokens issued to users.
+func (gha *GitHubAuth) TokenDB() TokenDB {
+	return gha.db
 }
 
-func (gha *GitHubAuth) doGitHubAuthPage(rw http.ResponseWriter, req *http.Request) {
-	if err := gha.tmpl.Execute(rw, struct{ ClientId string }{ClientId: gha.config.ClientId}); err != nil {
-		http.Error(rw, fmt.Sprintf("Template error: %s", err), http.StatusInternalServerError)
+// SetLoginHandler sets the handler that presents the Docker password once a user has signed in.
+func (gha *GitHubAuth) SetLoginHandler(h LoginHandler) {
+	gha.onLogin = h
+}
+
+// SetWebSecurity sets the key OAuth state and CSRF tokens are signed with.
+func (gha *GitHubAuth) SetWebSecurity(ws *WebSecurity) {
+	gha.web = ws
+}
+
+// doGitHubAuthStart sends the user to GitHub to sign in, GitHub then redirects back with a code.
+// Unless configured, redirect_uri is not sent and GitHub uses the callback URL of the application.
+func (gha *GitHubAuth) doGitHubAuthStart(rw http.ResponseWriter, req *http.Request) {
+	state, verifier := gha.web.startOAuth(rw, req, "github_auth", gha.config.RedirectURI)
+	params := url.Values{
+		"client_id":             []string{gha.config.ClientId},
+		"scope":                 []string{"user:email"},
+		"state":                 []string{state},
+		"code_challenge":        []string{pkceChallenge(verifier)},
+		"code_challenge_method": []string{"S256"},
+	}
+	if gha.config.RedirectURI != "" {
+		params.Set("redirect_uri", gha.config.RedirectURI)
 	}
+	http.Redirect(rw, req, "https://github.com/login/oauth/authorize?"+params.Encode(), http.StatusFound)
 }
 
 func (gha *GitHubAuth) DoGitHubAuth(rw http.ResponseWriter, req *http.Request) {
-	code := req.URL.Query().Get("code")
-
-	if code != "" {
-		gha.doGitHubAuthCreateToken(rw, code)
-	} else if req.Method == "GET" {
-		gha.doGitHubAuthPage(rw, req)
-		return
+	q := req.URL.Query()
+	switch {
+	case q.Get("code") != "":
+		s, err := gha.web.finishOAuth(rw, req, "github_auth", gha.config.RedirectURI)
+		if err != nil {
+			glog.Warningf("GitHub sign in rejected: %s", err)
+			http.Error(rw, "Sign in failed, please try again.", http.StatusBadRequest)
+			return
+		}
+		gha.doGitHubAuthCreateToken(rw, req, q.Get("code"), s.RedirectURI, gha.web.pkceVerifier(s.Nonce))
+	case q.Get("error") != "":
+		http.Error(rw, fmt.Sprintf("GitHub sign in failed: %s", q.Get("error")), http.StatusBadRequest)
+	case req.Method == "GET":
+		gha.doGitHubAuthStart(rw, req)
+	default:
+		http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
 	}
 }
 
-func (gha *GitHubAuth) doGitHubAuthCreateToken(rw http.ResponseWriter, code string) {
+func (gha *GitHubAuth) doGitHubAuthCreateToken(rw http.ResponseWriter, req *http.Request, code, redirectURI, verifier string) {
 	data := url.Values{
 		"code":          []string{string(code)},
 		"client_id":     []string{gha.config.ClientId},
 		"client_secret": []string{gha.config.ClientSecret},
+		"code_verifier": []string{verifier},
 	}
-	req, err := http.NewRequest("POST", "https://github.com/login/oauth/access_token", bytes.NewBufferString(data.Encode()))
+	if redirectURI != "" {
+		data.Set("redirect_uri", redirectURI)
+	}
+	treq, err := http.NewRequest("POST", "https://github.com/login/oauth/access_token", bytes.NewBufferString(data.Encode()))
 	if err != nil {
 		http.Error(rw, fmt.Sprintf("Error creating request to GitHub auth backend: %s", err), http.StatusServiceUnavailable)
 		return
 	}
-	req.Header.Add("Accept", "application/json")
+	treq.Header.Add("Accept", "application/json")
 
-	resp, err := gha.client.Do(req)
+	resp, err := gha.client.Do(treq)
 	if err != nil {
 		http.Error(rw, fmt.Sprintf("Error talking to GitHub auth backend: %s", err), http.StatusServiceUnavailable)
 		return
 	}
 	codeResp, _ := ioutil.ReadAll(resp.Body)
 	resp.Body.Close()
-	glog.V(2).Infof("Code to token resp: %s", strings.Replace(string(codeResp), "\n", " ", -1))
+	// Response contains tokens, do not log it.
+	glog.V(2).Infof("Code to token resp: %d bytes", len(codeResp))
 
 	var c2t CodeToTokenResponse
 	err = json.Unmarshal(codeResp, &c2t)
@@ -127,7 +194,7 @@ func (gha *GitHubAuth) doGitHubAuthCreateToken(rw http.ResponseWriter, code stri
 
 	user, err := gha.validateAccessToken(c2t.AccessToken)
 	if err != nil {
-		glog.Errorf("Newly-acquired token is invalid: %+v %s", c2t, err)
+		glog.Errorf("Newly-acquired token is invalid: %s", err)
 		http.Error(rw, "Newly-acquired token is invalid", http.StatusInternalServerError)
 		return
 	}
@@ -146,13 +213,13 @@ func (gha *GitHubAuth) doGitHubAuthCreateToken(rw http.ResponseWriter, code stri
 		return
 	}
 
-	fmt.Fprintf(rw, `Server logged in; now run "docker login", use %s as login and %s as password.`, user, dp)
+	gha.onLogin(rw, req, user, dp)
 }
 
 func (gha *GitHubAuth) validateAccessToken(token string) (user string, err error) {
 	req, err := http.NewRequest("GET", "https://api.github.com/user", nil)
 	if err != nil {
-		err = fmt.Errorf("could not create request to get information for token %s: %s", token, err)
+		err = fmt.Errorf("could not create request to get token information: %s", err)
 		return
 	}
 	req.Header.Add("Authorization", fmt.Sprintf("token %s", token))
@@ -160,7 +227,7 @@ func (gha *GitHubAuth) validateAccessToken(token string) (user string, err error
 
 	resp, err := gha.client.Do(req)
 	if err != nil {
-		err = fmt.Errorf("could not verify token %s: %s", token, err)
+		err = fmt.Errorf("could not verify token: %s", err)
 		return
 	}
 	body, _ := ioutil.ReadAll(resp.Body)
@@ -206,7 +273,7 @@ func (gha *GitHubAuth) checkOrganization(token, user string) (err error) {
 	case http.StatusNotFound:
 		return fmt.Errorf("%s is not a member of organization %s", user, gha.config.Organization)
 	case http.StatusFound:
-		return fmt.Errorf("token %s could not get membership for organization %s", token, gha.config.Organization)
+		return fmt.Errorf("token could not get membership for organization %s", gha.config.Organization)
 	}
 
 	return fmt.Errorf("Unknown status for membership of organization %s: %s", gha.config.Organization, resp.Status)
@@ -230,25 +297,36 @@ func (gha *GitHubAuth) validateServerToken(user string) (*TokenDBValue, error) {
 		return nil, fmt.Errorf("found token for wrong user")
 	}
 	v.ValidUntil = time.Now().Add(gha.config.RevalidateAfter)
+	if _, err = gha.db.StoreToken(user, v, false); err != nil {
+		glog.Errorf("Failed to record revalidated token: %s", err)
+		return nil, fmt.Errorf("failed to record revalidated token: %s", err)
+	}
 	texp := v.ValidUntil.Sub(time.Now())
 	glog.V(1).Infof("Validated GitHub auth token for %s (exp %d)", user, int(texp.Seconds()))
 	return v, nil
 }
 
-func (gha *GitHubAuth) Authenticate(user string, password PasswordString) (bool, error) {
+func (gha *GitHubAuth) Authenticate(user string, password PasswordString) (bool, Labels, error) {
 	err := gha.db.ValidateToken(user, password)
 	if err == ExpiredToken {
 		_, err = gha.validateServerToken(user)
 		if err != nil {
-			return false, err
+			return false, nil, err
 		}
 	} else if err != nil {
-		return false, err
+		return false, nil, err
 	}
-	return true, nil
+	return true, nil, nil
+}
+
+// HealthCheck verifies that the token DB can be read.
+func (gha *GitHubAuth) HealthCheck() error {
+	_, err := gha.db.GetValue("")
+	return err
 }
 
 func (gha *GitHubAuth) Stop() {
+	close(gha.stop)
 	gha.db.Close()
 	glog.Info("Token DB closed")
 }
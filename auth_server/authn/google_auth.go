@@ -20,7 +20,6 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"html/template"
 	"io/ioutil"
 	"net/http"
 	"net/url"
@@ -37,12 +36,19 @@ type GoogleAuthConfig struct {
 	ClientSecretFile string `yaml:"client_secret_file,omitempty"`
 	TokenDB          string `yaml:"token_db,omitempty"`
 	HTTPTimeout      int    `yaml:"http_timeout,omitempty"`
+	// URL of /google_auth as seen by the browser, must be registered with Google. Derived from requests if not set.
+	RedirectURI string `yaml:"redirect_uri,omitempty"`
+
+	TokenStore        *TokenStoreConfig      `yaml:"token_store,omitempty"`
+	TokenEncryption   *TokenEncryptionConfig `yaml:"token_encryption,omitempty"`
+	PurgeExpiredAfter time.Duration          `yaml:"purge_expired_after,omitempty"`
 }
 
 type GoogleAuthRequest struct {
-	Action string `json:"action,omitempty"`
-	Code   string `json:"code,omitempty"`
-	Token  string `json:"token,omitempty"`
+	Action    string `json:"action,omitempty"`
+	Code      string `json:"code,omitempty"`
+	Token     string `json:"token,omitempty"`
+	CSRFToken string `json:"csrf_token,omitempty"`
 }
 
 // From github.com/google-api-go-client/oauth2/v2/oauth2-gen.go
@@ -117,43 +123,99 @@ type ProfileResponse struct {
 	// There are more fields, but we only need email.
 }
 
+// Validate checks settings that are specific to Google.
+func (c *GoogleAuthConfig) Validate(configKey string) error {
+	if c.RedirectURI != "" {
+		if err := validateRedirectURI(c.RedirectURI, "/google_auth"); err != nil {
+			return fmt.Errorf("%s.redirect_uri: %s", configKey, err)
+		}
+	}
+	return nil
+}
+
 type GoogleAuth struct {
-	config *GoogleAuthConfig
-	db     TokenDB
-	client *http.Client
-	tmpl   *template.Template
+	config  *GoogleAuthConfig
+	db      TokenDB
+	client  *http.Client
+	onLogin LoginHandler
+	web     *WebSecurity
+	stop    chan struct{}
 }
 
 func NewGoogleAuth(c *GoogleAuthConfig) (*GoogleAuth, error) {
-	db, err := NewTokenDB(c.TokenDB)
+	db, err := NewTokenDB(c.TokenDB, c.TokenStore, c.TokenEncryption)
 	if err != nil {
 		return nil, err
 	}
-	glog.Infof("Google auth token DB at %s", c.TokenDB)
-	return &GoogleAuth{
-		config: c,
-		db:     db,
-		client: &http.Client{Timeout: 10 * time.Second},
-		tmpl:   template.Must(template.New("google_auth").Parse(string(MustAsset("data/google_auth.tmpl")))),
-	}, nil
+	if c.TokenStore != nil {
+		glog.Infof("Google auth token DB in %s", c.TokenStore)
+	} else {
+		glog.Infof("Google auth token DB at %s", c.TokenDB)
+	}
+	ga := &GoogleAuth{
+		config:  c,
+		db:      db,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		onLogin: textLoginHandler,
+		web:     newRandomWebSecurity(),
+		stop:    make(chan struct{}),
+	}
+	if c.PurgeExpiredAfter > 0 {
+		go purgeExpiredTokens(db, "Google auth", c.PurgeExpiredAfter, ga.stop)
+	}
+	return ga, nil
+}
+
+// TokenDB returns the database of tokens issued to users.
+func (ga *GoogleAuth) TokenDB() TokenDB {
+	return ga.db
+}
+
+// SetLoginHandler sets the handler that presents the Docker password once a user has signed in.
+func (ga *GoogleAuth) SetLoginHandler(h LoginHandler) {
+	ga.onLogin = h
+}
+
+// SetWebSecurity sets the key OAuth state and CSRF tokens are signed with.
+func (ga *GoogleAuth) SetWebSecurity(ws *WebSecurity) {
+	ga.web = ws
 }
 
 func (ga *GoogleAuth) DoGoogleAuth(rw http.ResponseWriter, req *http.Request) {
 	if req.Method == "GET" {
-		ga.doGoogleAuthPage(rw, req)
+		q := req.URL.Query()
+		switch {
+		case q.Get("code") != "":
+			s, err := ga.web.finishOAuth(rw, req, "google_auth", ga.config.RedirectURI)
+			if err != nil {
+				glog.Warningf("Google sign in rejected: %s", err)
+				http.Error(rw, "Sign in failed, please try again.", http.StatusBadRequest)
+				return
+			}
+			ga.doGoogleAuthCreateToken(rw, req, q.Get("code"), s.RedirectURI, ga.web.pkceVerifier(s.Nonce))
+		case q.Get("error") != "":
+			http.Error(rw, fmt.Sprintf("Google sign in failed: %s", q.Get("error")), http.StatusBadRequest)
+		default:
+			ga.doGoogleAuthStart(rw, req)
+		}
 		return
 	}
 	gauthRequest, _ := ioutil.ReadAll(req.Body)
-	glog.V(2).Infof("gauth request: %s", string(gauthRequest))
 	var gar GoogleAuthRequest
 	err := json.Unmarshal(gauthRequest, &gar)
 	if err != nil {
 		http.Error(rw, "Invalid auth request", http.StatusBadRequest)
 		return
 	}
+	// The request carries the authorization code or token, only the action is logged.
+	glog.V(2).Infof("gauth request: %s", gar.Action)
+	if !ga.web.CheckCSRFToken(req, gar.CSRFToken) {
+		http.Error(rw, "Invalid CSRF token", http.StatusForbidden)
+		return
+	}
 	switch {
 	case gar.Action == "sign_in" && gar.Code != "":
-		ga.doGoogleAuthCreateToken(rw, gar.Code)
+		ga.doGoogleAuthCreateToken(rw, req, gar.Code, "postmessage", "")
 	case gar.Action == "check" && gar.Token != "":
 		ga.doGoogleAuthCheck(rw, gar.Token)
 	case gar.Action == "sign_out" && gar.Token != "":
@@ -163,30 +225,50 @@ func (ga *GoogleAuth) DoGoogleAuth(rw http.ResponseWriter, req *http.Request) {
 	}
 }
 
-func (ga *GoogleAuth) doGoogleAuthPage(rw http.ResponseWriter, req *http.Request) {
-	if err := ga.tmpl.Execute(rw, struct{ ClientId string }{ClientId: ga.config.ClientId}); err != nil {
-		http.Error(rw, fmt.Sprintf("Template error: %s", err), http.StatusInternalServerError)
-	}
+// doGoogleAuthStart sends the user to Google to sign in, Google then redirects back with a code.
+// Offline access and consent are requested so that Google returns a refresh token every time.
+func (ga *GoogleAuth) doGoogleAuthStart(rw http.ResponseWriter, req *http.Request) {
+	ru := ga.web.redirectURI(req, ga.config.RedirectURI, "/google_auth")
+	state, verifier := ga.web.startOAuth(rw, req, "google_auth", ru)
+	params := url.Values{
+		"client_id":             []string{ga.config.ClientId},
+		"redirect_uri":          []string{ru},
+		"response_type":         []string{"code"},
+		"scope":                 []string{"openid email"},
+		"access_type":           []string{"offline"},
+		"prompt":                []string{"consent"},
+		"state":                 []string{state},
+		"code_challenge":        []string{pkceChallenge(verifier)},
+		"code_challenge_method": []string{"S256"},
+	}
+	if ga.config.Domain != "" {
+		params.Set("hd", ga.config.Domain)
+	}
+	http.Redirect(rw, req, "https://accounts.google.com/o/oauth2/v2/auth?"+params.Encode(), http.StatusFound)
 }
 
 // https://developers.google.com/identity/protocols/OAuth2WebServer#handlingtheresponse
-func (ga *GoogleAuth) doGoogleAuthCreateToken(rw http.ResponseWriter, code string) {
-	resp, err := ga.client.PostForm(
-		"https://www.googleapis.com/oauth2/v3/token",
-		url.Values{
-			"code":          []string{string(code)},
-			"client_id":     []string{ga.config.ClientId},
-			"client_secret": []string{ga.config.ClientSecret},
-			"redirect_uri":  []string{"postmessage"},
-			"grant_type":    []string{"authorization_code"},
-		})
+// verifier is the PKCE code verifier, empty if the flow did not use PKCE.
+func (ga *GoogleAuth) doGoogleAuthCreateToken(rw http.ResponseWriter, req *http.Request, code, redirectURI, verifier string) {
+	params := url.Values{
+		"code":          []string{string(code)},
+		"client_id":     []string{ga.config.ClientId},
+		"client_secret": []string{ga.config.ClientSecret},
+		"redirect_uri":  []string{redirectURI},
+		"grant_type":    []string{"authorization_code"},
+	}
+	if verifier != "" {
+		params.Set("code_verifier", verifier)
+	}
+	resp, err := ga.client.PostForm("https://www.googleapis.com/oauth2/v3/token", params)
 	if err != nil {
 		http.Error(rw, fmt.Sprintf("Error talking to Google auth backend: %s", err), http.StatusServiceUnavailable)
 		return
 	}
 	codeResp, _ := ioutil.ReadAll(resp.Body)
 	resp.Body.Close()
-	glog.V(2).Infof("Code to token resp: %s", strings.Replace(string(codeResp), "\n", " ", -1))
+	// Response contains tokens, do not log it.
+	glog.V(2).Infof("Code to token resp: %d bytes", len(codeResp))
 
 	var c2t CodeToTokenResponse
 	err = json.Unmarshal(codeResp, &c2t)
@@ -213,7 +295,7 @@ func (ga *GoogleAuth) doGoogleAuthCreateToken(rw http.ResponseWriter, code strin
 
 	ti, err := ga.getIDTokenInfo(c2t.IDToken)
 	if err != nil {
-		glog.Errorf("Newly-acquired token is invalid: %+v %s", c2t, err)
+		glog.Errorf("Newly-acquired token is invalid: %s", err)
 		http.Error(rw, "Newly-acquired token is invalid", http.StatusInternalServerError)
 		return
 	}
@@ -234,14 +316,14 @@ func (ga *GoogleAuth) doGoogleAuthCreateToken(rw http.ResponseWriter, code strin
 		return
 	}
 
-	fmt.Fprintf(rw, `Server logged in; now run "docker login", use %s as login and %s as password.`, user, dp)
+	ga.onLogin(rw, req, user, dp)
 }
 
 func (ga *GoogleAuth) getIDTokenInfo(token string) (*GoogleTokenInfo, error) {
 	// There is no Go auth library yet, using the tokeninfo endpoint.
 	resp, err := http.Get(fmt.Sprintf("https://www.googleapis.com/oauth2/v2/tokeninfo?id_token=%s", token))
 	if err != nil {
-		return nil, fmt.Errorf("could not verify token %s: %s", token, err)
+		return nil, fmt.Errorf("could not verify token: %s", err)
 	}
 	body, _ := ioutil.ReadAll(resp.Body)
 	resp.Body.Close()
@@ -299,7 +381,7 @@ func (ga *GoogleAuth) refreshAccessToken(refreshToken string) (rtr RefreshTokenR
 		return
 	}
 	respStr, _ := ioutil.ReadAll(resp.Body)
-	glog.V(2).Infof("Refresh token resp: %s", strings.Replace(string(respStr), "\n", " ", -1))
+	glog.V(2).Infof("Refresh token resp: %d bytes", len(respStr))
 
 	err = json.Unmarshal(respStr, &rtr)
 	if err == nil && rtr.Error != "" || rtr.ErrorDescription != "" {
@@ -399,20 +481,27 @@ func (ga *GoogleAuth) doGoogleAuthSignOut(rw http.ResponseWriter, token string)
 	fmt.Fprint(rw, "signed out")
 }
 
-func (ga *GoogleAuth) Authenticate(user string, password PasswordString) (bool, error) {
+func (ga *GoogleAuth) Authenticate(user string, password PasswordString) (bool, Labels, error) {
 	err := ga.db.ValidateToken(user, password)
 	if err == ExpiredToken {
 		_, err = ga.validateServerToken(user)
 		if err != nil {
-			return false, err
+			return false, nil, err
 		}
 	} else if err != nil {
-		return false, err
+		return false, nil, err
 	}
-	return true, nil
+	return true, nil, nil
+}
+
+// HealthCheck verifies that the token DB can be read.
+func (ga *GoogleAuth) HealthCheck() error {
+	_, err := ga.db.GetValue("")
+	return err
 }
 
 func (ga *GoogleAuth) Stop() {
+	close(ga.stop)
 	ga.db.Close()
 	glog.Info("Token DB closed")
 }
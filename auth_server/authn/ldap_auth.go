@@ -19,81 +19,217 @@ package authn
 import (
 	"bytes"
 	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"strings"
+	"time"
 
 	"github.com/go-ldap/ldap"
 	"github.com/golang/glog"
 )
 
 type LDAPAuthConfig struct {
-	Addr                  string `yaml:"addr,omitempty"`
-	TLS                   string `yaml:"tls,omitempty"`
-	InsecureTLSSkipVerify bool   `yaml:"insecure_tls_skip_verify,omitempty"`
-	Base                  string `yaml:"base,omitempty"`
-	Filter                string `yaml:"filter,omitempty"`
-	BindDN                string `yaml:"bind_dn,omitempty"`
-	BindPasswordFile      string `yaml:"bind_password_file,omitempty"`
-	GroupBaseDN           string `yaml:"group_base_dn,omitempty"`
-	GroupFilter           string `yaml:"group_filter,omitempty"`
+	Addr                  string        `yaml:"addr,omitempty"`
+	Addrs                 []string      `yaml:"addrs,omitempty"`
+	TLS                   string        `yaml:"tls,omitempty"`
+	InsecureTLSSkipVerify bool          `yaml:"insecure_tls_skip_verify,omitempty"`
+	CAFile                string        `yaml:"ca_file,omitempty"`
+	ClientCertFile        string        `yaml:"client_certificate,omitempty"`
+	ClientKeyFile         string        `yaml:"client_key,omitempty"`
+	ServerName            string        `yaml:"server_name,omitempty"`
+	MinTLSVersion         string        `yaml:"min_tls_version,omitempty"`
+	ConnectTimeout        time.Duration `yaml:"connect_timeout,omitempty"`
+	Timeout               time.Duration `yaml:"timeout,omitempty"`
+	PoolSize              int           `yaml:"pool_size,omitempty"`
+	Base                  string        `yaml:"base,omitempty"`
+	Filter                string        `yaml:"filter,omitempty"`
+	BindDN                string        `yaml:"bind_dn,omitempty"`
+	BindPasswordFile      string        `yaml:"bind_password_file,omitempty"`
+	GroupBaseDN           string        `yaml:"group_base_dn,omitempty"`
+	GroupFilter           string        `yaml:"group_filter,omitempty"`
+	// Login name normalization, applied before searching.
+	LowercaseLogin bool `yaml:"lowercase_login,omitempty"`
+	StripDomain    bool `yaml:"strip_domain,omitempty"`
+	// If set, account name used for authorization and in tokens is taken from this attribute of the user entry.
+	AccountAttribute string `yaml:"account_attribute,omitempty"`
+
+	tlsConfig *tls.Config
+}
+
+func (c *LDAPAuthConfig) addrs() []string {
+	if c.Addr != "" {
+		return []string{c.Addr}
+	}
+	return c.Addrs
+}
+
+func (c *LDAPAuthConfig) Validate() error {
+	if c.Addr != "" && len(c.Addrs) > 0 {
+		return errors.New("addr and addrs are mutually exclusive")
+	}
+	addrs := c.addrs()
+	if len(addrs) == 0 {
+		return errors.New("addr is required")
+	}
+	if c.TLS == "" && strings.HasSuffix(addrs[0], ":636") {
+		c.TLS = "always"
+	}
+	switch c.TLS {
+	case "", "none", "always", "starttls":
+	default:
+		return fmt.Errorf("unknown tls mode %q", c.TLS)
+	}
+	if c.TLS == "always" || c.TLS == "starttls" {
+		tlsConfig, err := c.buildTLSConfig()
+		if err != nil {
+			return err
+		}
+		c.tlsConfig = tlsConfig
+	}
+	if c.ConnectTimeout <= 0 {
+		c.ConnectTimeout = 10 * time.Second
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = 30 * time.Second
+	}
+	if c.PoolSize <= 0 {
+		c.PoolSize = 10
+	}
+	return nil
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func (c *LDAPAuthConfig) buildTLSConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: c.InsecureTLSSkipVerify,
+		ServerName:         c.ServerName,
+	}
+	if c.CAFile != "" {
+		pem, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read %s: %s", c.CAFile, err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", c.CAFile)
+		}
+	}
+	if c.ClientCertFile != "" || c.ClientKeyFile != "" {
+		if c.ClientCertFile == "" || c.ClientKeyFile == "" {
+			return nil, errors.New("client_certificate and client_key must be specified together")
+		}
+		cert, err := tls.LoadX509KeyPair(c.ClientCertFile, c.ClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %s", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if c.MinTLSVersion != "" {
+		v, ok := tlsVersions[c.MinTLSVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown min_tls_version %q", c.MinTLSVersion)
+		}
+		tlsConfig.MinVersion = v
+	}
+	return tlsConfig, nil
 }
 
 type LDAPAuth struct {
 	config *LDAPAuthConfig
+	pool   *ldapPool
 }
 
 func NewLDAPAuth(c *LDAPAuthConfig) (*LDAPAuth, error) {
-	if c.TLS == "" && strings.HasSuffix(c.Addr, ":636") {
-		c.TLS = "always"
-	}
-	return &LDAPAuth{
+	la := &LDAPAuth{
 		config: c,
-	}, nil
+	}
+	la.pool = newLDAPPool(la)
+	return la, nil
 }
 
 //How to authenticate user, please refer to https://github.com/go-ldap/ldap/blob/master/example_test.go#L166
-func (la *LDAPAuth) Authenticate(account string, password PasswordString) (bool, error) {
-	if account == "" {
-		return false, NoMatch
+func (la *LDAPAuth) Authenticate(account string, password PasswordString) (bool, Labels, error) {
+	login := la.normalizeLogin(account)
+	if login == "" {
+		return false, nil, NoMatch
 	}
-	l, err := la.ldapConnection()
-	if err != nil {
-		return false, err
+	filter := la.getFilter(la.escapeAccountInput(login))
+	attrs := []string{}
+	if la.config.AccountAttribute != "" {
+		attrs = append(attrs, la.config.AccountAttribute)
 	}
-	defer l.Close()
 
-	// First bind with a read only user, to prevent the following search won't perform any write action
-	if bindErr := la.bindReadOnlyUser(l); bindErr != nil {
-		return false, bindErr
+	result, canonical := false, login
+	err := la.pool.withConn(func(l *ldap.Conn) error {
+		entry, uSearchErr := la.ldapSearchEntry(l, la.config.Base, filter, attrs)
+		if uSearchErr != nil {
+			return uSearchErr
+		}
+		if entry == nil {
+			return NoMatch // User does not exist
+		}
+		if la.config.AccountAttribute != "" {
+			canonical = entry.GetAttributeValue(la.config.AccountAttribute)
+			if canonical == "" {
+				return fmt.Errorf("%s has no %s attribute", entry.DN, la.config.AccountAttribute)
+			}
+			if la.config.LowercaseLogin {
+				canonical = strings.ToLower(canonical)
+			}
+		}
+		// Bind as the user to verify their password
+		err := l.Bind(entry.DN, string(password))
+		if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return err
+		}
+		result = err == nil
+		// Rebind as the read only user, the connection goes back to the pool
+		return la.rebindReadOnlyUser(l)
+	})
+	if err == NoMatch {
+		return false, nil, NoMatch
 	}
-
-	account = la.escapeAccountInput(account)
-
-	filter := la.getFilter(account)
-	accountEntryDN, uSearchErr := la.ldapSearch(l, &la.config.Base, &filter, &[]string{})
-	if uSearchErr != nil {
-		return false, uSearchErr
+	if err != nil {
+		return false, nil, err
 	}
-	if accountEntryDN == "" {
-		return false, NoMatch // User does not exist
+	var labels Labels
+	if result && canonical != account {
+		labels = Labels{AccountLabel: []string{canonical}}
 	}
-	// Bind as the user to verify their password
-	if len(accountEntryDN) > 0 {
-		err := l.Bind(accountEntryDN, string(password))
-		if err != nil {
-			if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
-				return false, nil
-			}
-			return false, err
+	return result, labels, nil
+}
+
+// normalizeLogin applies configured normalization to the name user logged in with.
+// With strip_domain, both "user@domain" and "DOMAIN\user" become "user".
+func (la *LDAPAuth) normalizeLogin(account string) string {
+	if la.config.StripDomain {
+		if i := strings.LastIndex(account, "@"); i >= 0 {
+			account = account[:i]
+		}
+		if i := strings.LastIndex(account, `\`); i >= 0 {
+			account = account[i+1:]
 		}
 	}
-	// Rebind as the read only user for any futher queries
-	if bindErr := la.bindReadOnlyUser(l); bindErr != nil {
-		return false, bindErr
+	if la.config.LowercaseLogin {
+		account = strings.ToLower(account)
 	}
+	return account
+}
 
-	return true, nil
+// rebindReadOnlyUser restores read-only user's identity after binding as another user.
+func (la *LDAPAuth) rebindReadOnlyUser(l *ldap.Conn) error {
+	if la.config.BindDN == "" {
+		return l.UnauthenticatedBind("")
+	}
+	return la.bindReadOnlyUser(l)
 }
 
 func (la *LDAPAuth) bindReadOnlyUser(l *ldap.Conn) error {
@@ -133,76 +269,85 @@ func (la *LDAPAuth) escapeAccountInput(account string) string {
 	return r.Replace(account)
 }
 
-func (la *LDAPAuth) ldapConnection() (*ldap.Conn, error) {
-	var l *ldap.Conn
-	var err error
-	if la.config.TLS == "" || la.config.TLS == "none" || la.config.TLS == "starttls" {
-		glog.V(2).Infof("Dial: starting...%s", la.config.Addr)
-		l, err = ldap.Dial("tcp", fmt.Sprintf("%s", la.config.Addr))
-		if err == nil && la.config.TLS == "starttls" {
-			glog.V(2).Infof("StartTLS...")
-			if tlserr := l.StartTLS(&tls.Config{InsecureSkipVerify: la.config.InsecureTLSSkipVerify}); tlserr != nil {
-				return nil, tlserr
-			}
-		}
-	} else if la.config.TLS == "always" {
-		glog.V(2).Infof("DialTLS: starting...%s", la.config.Addr)
-		l, err = ldap.DialTLS("tcp", fmt.Sprintf("%s", la.config.Addr), &tls.Config{InsecureSkipVerify: la.config.InsecureTLSSkipVerify})
-	}
-	if err != nil {
-		return nil, err
-	}
-	return l, nil
-}
-
 func (la *LDAPAuth) getFilter(account string) string {
 	filter := strings.NewReplacer("${account}", account).Replace(la.config.Filter)
 	glog.V(2).Infof("search filter is %s", filter)
 	return filter
 }
 
-//ldap search and return required attributes' value from searched entries
-//default return entry's DN value if you leave attrs array empty
-func (la *LDAPAuth) ldapSearch(l *ldap.Conn, baseDN *string, filter *string, attrs *[]string) (string, error) {
+// ldapSearchEntry returns the only entry matching the filter, nil if there are none.
+func (la *LDAPAuth) ldapSearchEntry(l *ldap.Conn, baseDN string, filter string, attrs []string) (*ldap.Entry, error) {
 	if l == nil {
-		return "", fmt.Errorf("No ldap connection!")
+		return nil, fmt.Errorf("No ldap connection!")
 	}
-	glog.V(2).Infof("Searching...basedDN:%s, filter:%s", *baseDN, *filter)
+	glog.V(2).Infof("Searching...basedDN:%s, filter:%s", baseDN, filter)
 	searchRequest := ldap.NewSearchRequest(
-		*baseDN,
+		baseDN,
 		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
-		*filter,
-		*attrs,
+		filter,
+		attrs,
 		nil)
 	sr, err := l.Search(searchRequest)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	if len(sr.Entries) == 0 {
-		return "", nil // User does not exist
+		return nil, nil // User does not exist
 	} else if len(sr.Entries) > 1 {
-		return "", fmt.Errorf("Too many entries returned.")
+		return nil, fmt.Errorf("Too many entries returned.")
 	}
+	glog.V(2).Infof("Entry DN = %s", sr.Entries[0].DN)
+	return sr.Entries[0], nil
+}
 
+//ldap search and return required attributes' value from searched entries
+//default return entry's DN value if you leave attrs array empty
+func (la *LDAPAuth) ldapSearch(l *ldap.Conn, baseDN *string, filter *string, attrs *[]string) (string, error) {
+	entry, err := la.ldapSearchEntry(l, *baseDN, *filter, *attrs)
+	if err != nil || entry == nil {
+		return "", err
+	}
+	if len(*attrs) == 0 {
+		return entry.DN, nil
+	}
 	var buffer bytes.Buffer
-	for _, entry := range sr.Entries {
-		if len(*attrs) == 0 {
-			glog.V(2).Infof("Entry DN = %s", entry.DN)
-			buffer.WriteString(entry.DN)
-		} else {
-			for _, attr := range *attrs {
-				values := strings.Join(entry.GetAttributeValues(attr), " ")
-				glog.V(2).Infof("Entry %s = %s", attr, values)
-				buffer.WriteString(values)
-			}
-		}
+	for _, attr := range *attrs {
+		values := strings.Join(entry.GetAttributeValues(attr), " ")
+		glog.V(2).Infof("Entry %s = %s", attr, values)
+		buffer.WriteString(values)
 	}
-
 	return buffer.String(), nil
 }
 
+// Search runs a search as the read-only user, on one of the pooled connections.
+func (la *LDAPAuth) Search(baseDN, filter string, attrs []string) ([]*ldap.Entry, error) {
+	var entries []*ldap.Entry
+	err := la.pool.withConn(func(l *ldap.Conn) error {
+		glog.V(2).Infof("Searching...basedDN:%s, filter:%s", baseDN, filter)
+		sr, err := l.Search(ldap.NewSearchRequest(
+			baseDN,
+			ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+			filter,
+			attrs,
+			nil))
+		if err != nil {
+			return err
+		}
+		entries = sr.Entries
+		return nil
+	})
+	return entries, err
+}
+
+// HealthCheck verifies that servers can be reached and the read-only user can bind.
+// It succeeds if at least one of the servers is usable.
+func (la *LDAPAuth) HealthCheck() error {
+	return la.pool.check()
+}
+
 func (la *LDAPAuth) Stop() {
+	la.pool.close()
 }
 
 func (la *LDAPAuth) Name() string {
@@ -0,0 +1,22 @@
+package authn
+
+import "testing"
+
+func TestLDAPNormalizeLogin(t *testing.T) {
+	la := &LDAPAuth{config: &LDAPAuthConfig{LowercaseLogin: true, StripDomain: true}}
+	for login, expected := range map[string]string{
+		"jdoe":              "jdoe",
+		"John.Doe":          "john.doe",
+		"jdoe@corp.example": "jdoe",
+		`CORP\JDoe`:         "jdoe",
+		"@corp.example":     "",
+	} {
+		if res := la.normalizeLogin(login); res != expected {
+			t.Errorf("%q: expected %q, got %q", login, expected, res)
+		}
+	}
+	la.config.StripDomain = false
+	if res := la.normalizeLogin("JDoe@Corp.Example"); res != "jdoe@corp.example" {
+		t.Errorf("domain should have been kept, got %q", res)
+	}
+}
@@ -0,0 +1,274 @@
+/*
+   Copyright 2016 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package authn
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/go-ldap/ldap"
+	"github.com/golang/glog"
+)
+
+// Servers that failed to connect are not tried again for this long, unless all of them are down.
+const ldapServerRetryInterval = 30 * time.Second
+
+type ldapServer struct {
+	addr      string
+	downUntil time.Time
+}
+
+type ldapConn struct {
+	*ldap.Conn
+	server *ldapServer
+}
+
+// ldapPool keeps connections bound as the read-only user, at most pool_size of them are open at any time.
+type ldapPool struct {
+	la      *LDAPAuth
+	lock    sync.Mutex
+	servers []*ldapServer
+	idle    chan *ldapConn
+	sem     chan struct{}
+	closed  bool
+}
+
+func newLDAPPool(la *LDAPAuth) *ldapPool {
+	p := &ldapPool{
+		la:   la,
+		idle: make(chan *ldapConn, la.config.PoolSize),
+		sem:  make(chan struct{}, la.config.PoolSize),
+	}
+	for _, addr := range la.config.addrs() {
+		p.servers = append(p.servers, &ldapServer{addr: addr})
+	}
+	return p
+}
+
+func isLDAPNetworkError(err error) bool {
+	return ldap.IsErrorWithCode(err, ldap.ErrorNetwork)
+}
+
+// withConn runs f with a pooled connection bound as the read-only user.
+// f must leave the connection bound as the read-only user, unless it returns an error.
+// If the connection turns out to be closed by the server, f is retried once with a new one.
+func (p *ldapPool) withConn(f func(l *ldap.Conn) error) error {
+	for attempt := 0; ; attempt++ {
+		lc, err := p.get()
+		if err != nil {
+			return err
+		}
+		err = f(lc.Conn)
+		p.put(lc, err)
+		if err == nil || !isLDAPNetworkError(err) || attempt > 0 {
+			return err
+		}
+		glog.V(1).Infof("Lost connection to %s, retrying: %s", lc.server.addr, err)
+	}
+}
+
+func (p *ldapPool) get() (*ldapConn, error) {
+	select {
+	case p.sem <- struct{}{}:
+	case <-time.After(p.la.config.Timeout):
+		return nil, errors.New("timed out waiting for an LDAP connection")
+	}
+	for {
+		select {
+		case lc := <-p.idle:
+			if lc.IsClosing() {
+				lc.Close()
+				continue
+			}
+			return lc, nil
+		default:
+		}
+		break
+	}
+	lc, err := p.connect()
+	if err != nil {
+		<-p.sem
+		return nil, err
+	}
+	return lc, nil
+}
+
+// put returns the connection to the pool. Connections that saw an error are closed, their state is unknown.
+func (p *ldapPool) put(lc *ldapConn, err error) {
+	defer func() { <-p.sem }()
+	if err != nil && err != NoMatch {
+		if isLDAPNetworkError(err) {
+			p.markDown(lc.server, err)
+		}
+		lc.Close()
+		return
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.closed {
+		lc.Close()
+		return
+	}
+	select {
+	case p.idle <- lc:
+	default:
+		lc.Close()
+	}
+}
+
+// candidates returns servers in the order they should be tried: healthy ones first, in the configured order.
+func (p *ldapPool) candidates() []*ldapServer {
+	now := time.Now()
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	var up, down []*ldapServer
+	for _, s := range p.servers {
+		if now.Before(s.downUntil) {
+			down = append(down, s)
+		} else {
+			up = append(up, s)
+		}
+	}
+	return append(up, down...)
+}
+
+func (p *ldapPool) markDown(s *ldapServer, err error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if time.Now().After(s.downUntil) {
+		glog.Warningf("LDAP server %s is down: %s", s.addr, err)
+	}
+	s.downUntil = time.Now().Add(ldapServerRetryInterval)
+}
+
+func (p *ldapPool) markUp(s *ldapServer) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if !s.downUntil.IsZero() {
+		glog.Infof("LDAP server %s is up", s.addr)
+		s.downUntil = time.Time{}
+	}
+}
+
+// connect establishes a new connection to the first server that is reachable.
+func (p *ldapPool) connect() (*ldapConn, error) {
+	var err error
+	for _, s := range p.candidates() {
+		var l *ldap.Conn
+		l, err = p.connectTo(s)
+		if err == nil {
+			p.markUp(s)
+			return &ldapConn{Conn: l, server: s}, nil
+		}
+		if !isLDAPNetworkError(err) {
+			// Server responded, there is no point trying others.
+			return nil, err
+		}
+		p.markDown(s, err)
+	}
+	return nil, err
+}
+
+func (p *ldapPool) connectTo(s *ldapServer) (*ldap.Conn, error) {
+	l, err := p.dial(s.addr)
+	if err != nil {
+		return nil, err
+	}
+	if err = p.la.bindReadOnlyUser(l); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+func (p *ldapPool) dial(addr string) (*ldap.Conn, error) {
+	c := p.la.config
+	dialer := &net.Dialer{Timeout: c.ConnectTimeout}
+	var conn net.Conn
+	var err error
+	var tlsConfig *tls.Config
+	if c.tlsConfig != nil {
+		tlsConfig = c.tlsConfig.Clone()
+		if tlsConfig.ServerName == "" {
+			// Needed for verification with StartTLS, tls.Dial would do the same.
+			if host, _, err := net.SplitHostPort(addr); err == nil {
+				tlsConfig.ServerName = host
+			}
+		}
+	}
+	if c.TLS == "always" {
+		glog.V(2).Infof("DialTLS: starting...%s", addr)
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+	} else {
+		glog.V(2).Infof("Dial: starting...%s", addr)
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, ldap.NewError(ldap.ErrorNetwork, err)
+	}
+	l := ldap.NewConn(conn, c.TLS == "always")
+	l.Start()
+	l.SetTimeout(c.Timeout)
+	if c.TLS == "starttls" {
+		glog.V(2).Infof("StartTLS...")
+		if err := l.StartTLS(tlsConfig); err != nil {
+			l.Close()
+			return nil, ldap.NewError(ldap.ErrorNetwork, err)
+		}
+	}
+	return l, nil
+}
+
+// check connects to every server, updating their status. It succeeds if at least one is usable.
+func (p *ldapPool) check() error {
+	var err error
+	ok := false
+	for _, s := range p.candidates() {
+		l, cerr := p.connectTo(s)
+		if cerr != nil {
+			if isLDAPNetworkError(cerr) {
+				p.markDown(s, cerr)
+			}
+			err = cerr
+			continue
+		}
+		l.Close()
+		p.markUp(s)
+		ok = true
+	}
+	if ok {
+		return nil
+	}
+	return err
+}
+
+func (p *ldapPool) close() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.closed = true
+	for {
+		select {
+		case lc := <-p.idle:
+			lc.Close()
+		default:
+			return
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package authn
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestLDAPPoolFailover(t *testing.T) {
+	down, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	downAddr := down.Addr().String()
+	down.Close()
+	up, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer up.Close()
+	go func() {
+		for {
+			if _, err := up.Accept(); err != nil {
+				return
+			}
+		}
+	}()
+
+	c := &LDAPAuthConfig{Addrs: []string{downAddr, up.Addr().String()}, ConnectTimeout: time.Second, PoolSize: 1}
+	if err := c.Validate(); err != nil {
+		t.Fatalf("validation failed: %s", err)
+	}
+	la, err := NewLDAPAuth(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer la.Stop()
+	p := la.pool
+	lc, err := p.get()
+	if err != nil {
+		t.Fatalf("failed to connect: %s", err)
+	}
+	if lc.server.addr != up.Addr().String() {
+		t.Errorf("expected to fail over to %s, got %s", up.Addr(), lc.server.addr)
+	}
+	if cs := p.candidates(); cs[0].addr != up.Addr().String() {
+		t.Errorf("failed server should be tried last, got %s first", cs[0].addr)
+	}
+	// Pool is exhausted until the connection is returned.
+	c.Timeout = 10 * time.Millisecond
+	if _, err := p.get(); err == nil {
+		t.Errorf("pool size should have been enforced")
+	}
+	p.put(lc, nil)
+	lc2, err := p.get()
+	if err != nil || lc2 != lc {
+		t.Errorf("expected idle connection to be reused, got %v, %v", lc2, err)
+	}
+	p.put(lc2, nil)
+}
@@ -0,0 +1,404 @@
+/*
+   Copyright 2016 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package authn
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// MFAConfig enables a TOTP second factor for users of password authenticators (users, mongo_auth and sql_auth).
+// Users sign in to the portal with their password and a code from an authenticator app and receive
+// a short-lived Docker password, which is kept in a token DB like those of the OAuth providers.
+// Accounts matching RequiredAccounts cannot use their password with docker login at all. The policy
+// does not apply to other authenticators (LDAP, ext_auth, Google, GitHub).
+type MFAConfig struct {
+	// Patterns as in ACL account matches: glob, or regular expression between slashes.
+	RequiredAccounts  []string               `yaml:"required_accounts,omitempty"`
+	PasswordTTL       time.Duration          `yaml:"password_ttl,omitempty"`
+	TokenDB           string                 `yaml:"token_db,omitempty"`
+	TokenStore        *TokenStoreConfig      `yaml:"token_store,omitempty"`
+	EnrollmentDB      string                 `yaml:"enrollment_db,omitempty"`
+	EnrollmentStore   *TokenStoreConfig      `yaml:"enrollment_store,omitempty"`
+	Encryption        *TokenEncryptionConfig `yaml:"encryption,omitempty"`
+	PurgeExpiredAfter time.Duration          `yaml:"purge_expired_after,omitempty"`
+	// Name of the account in authenticator apps. Default is token.issuer.
+	Issuer string `yaml:"issuer,omitempty"`
+	// Consecutive wrong codes after which sign in is refused for LockoutDuration.
+	MaxFailures     int           `yaml:"max_failures,omitempty"`
+	LockoutDuration time.Duration `yaml:"lockout_duration,omitempty"`
+}
+
+var (
+	// MFALocked is returned when there have been too many wrong codes.
+	MFALocked = errors.New("too many failed attempts")
+	// NotEnrolled is returned when the user has no authenticator app enrolled.
+	NotEnrolled = errors.New("not enrolled")
+)
+
+func (c *MFAConfig) Validate(configKey string) error {
+	for _, p := range c.RequiredAccounts {
+		if len(p) > 2 && p[0] == '/' && p[len(p)-1] == '/' {
+			if _, err := regexp.Compile(p[1 : len(p)-1]); err != nil {
+				return fmt.Errorf("%s.required_accounts: invalid regex pattern %q: %s", configKey, p, err)
+			}
+		} else if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("%s.required_accounts: invalid pattern %q: %s", configKey, p, err)
+		}
+	}
+	if (c.TokenDB == "") == (c.TokenStore == nil) {
+		return fmt.Errorf("exactly one of %s.token_db and %s.token_store is required", configKey, configKey)
+	}
+	if c.TokenStore != nil {
+		if err := c.TokenStore.Validate(configKey + ".token_store"); err != nil {
+			return err
+		}
+	}
+	if (c.EnrollmentDB == "") == (c.EnrollmentStore == nil) {
+		return fmt.Errorf("exactly one of %s.enrollment_db and %s.enrollment_store is required", configKey, configKey)
+	}
+	if c.EnrollmentStore != nil {
+		if err := c.EnrollmentStore.Validate(configKey + ".enrollment_store"); err != nil {
+			return err
+		}
+	}
+	if c.Encryption != nil {
+		if err := c.Encryption.Validate(configKey + ".encryption"); err != nil {
+			return err
+		}
+	}
+	if c.PasswordTTL == 0 {
+		c.PasswordTTL = 12 * time.Hour
+	} else if c.PasswordTTL < 0 {
+		return fmt.Errorf("%s.password_ttl must be positive, got %s", configKey, c.PasswordTTL)
+	}
+	if c.PurgeExpiredAfter == 0 {
+		c.PurgeExpiredAfter = 24 * time.Hour
+	}
+	if c.MaxFailures == 0 {
+		c.MaxFailures = 5
+	}
+	if c.LockoutDuration == 0 {
+		c.LockoutDuration = 15 * time.Minute
+	}
+	return nil
+}
+
+// mfaEnrollment is kept in the enrollment store by user name.
+type mfaEnrollment struct {
+	// TOTP secret, in Encrypted if encryption is configured.
+	Secret    string           `json:"secret,omitempty"`
+	Encrypted *EncryptedTokens `json:"encrypted,omitempty"`
+	// Enrollment is pending until the user has entered a valid code.
+	Confirmed bool `json:"confirmed"`
+	// Hashes of unused recovery codes.
+	RecoveryCodes []string  `json:"recovery_codes,omitempty"`
+	LastCounter   int64     `json:"last_counter,omitempty"`
+	Failures      int       `json:"failures,omitempty"`
+	LastFailure   time.Time `json:"last_failure,omitempty"`
+	Created       time.Time `json:"created"`
+}
+
+// MFA keeps TOTP enrollments and authenticates Docker passwords issued after MFA sign in.
+type MFA struct {
+	config      *MFAConfig
+	db          TokenDB
+	enrollments TokenStore
+	// Serializes updates of enrollments, e.g. to not accept a code twice.
+	// Instances sharing the enrollment store are not coordinated.
+	lock sync.Mutex
+	stop chan struct{}
+}
+
+func NewMFA(c *MFAConfig) (*MFA, error) {
+	db, err := NewTokenDB(c.TokenDB, c.TokenStore, nil)
+	if err != nil {
+		return nil, err
+	}
+	enrollments, err := OpenTokenStore(c.EnrollmentDB, c.EnrollmentStore)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	m := &MFA{config: c, db: db, enrollments: enrollments, stop: make(chan struct{})}
+	if c.PurgeExpiredAfter > 0 {
+		go purgeExpiredTokens(db, "MFA", c.PurgeExpiredAfter, m.stop)
+	}
+	return m, nil
+}
+
+// TokenDB returns the database of passwords issued after MFA sign in.
+func (m *MFA) TokenDB() TokenDB {
+	return m.db
+}
+
+// Required returns true if the account may only use passwords issued after MFA sign in.
+func (m *MFA) Required(account string) bool {
+	for _, p := range m.config.RequiredAccounts {
+		var matched bool
+		if len(p) > 2 && p[0] == '/' && p[len(p)-1] == '/' {
+			matched, _ = regexp.MatchString(p[1:len(p)-1], account)
+		} else {
+			matched, _ = path.Match(p, account)
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Authenticate accepts passwords issued by IssuePassword. Anything else falls through to other authenticators,
+// which check whether MFA is required. The server checks that the account is still active with the password
+// authenticator it belongs to.
+func (m *MFA) Authenticate(user string, password PasswordString) (bool, Labels, error) {
+	v, err := m.db.GetValue(user)
+	if err != nil {
+		return false, nil, err
+	} else if v == nil {
+		return false, nil, NoMatch
+	}
+	if err := m.db.ValidateToken(user, password); err != nil {
+		return false, nil, NoMatch
+	}
+	return true, v.Labels, nil
+}
+
+// IssuePassword issues a Docker password valid for password_ttl, replacing the previous one.
+func (m *MFA) IssuePassword(user string, labels Labels) (string, error) {
+	v := &TokenDBValue{TokenType: "mfa", ValidUntil: time.Now().Add(m.config.PasswordTTL), Labels: labels}
+	return m.db.StoreToken(user, v, true)
+}
+
+func (m *MFA) getEnrollment(user string) (*mfaEnrollment, error) {
+	data, err := m.enrollments.Get(user)
+	if err != nil || data == nil {
+		return nil, err
+	}
+	var e mfaEnrollment
+	if err := json.Unmarshal(data, &e); err != nil {
+		return nil, fmt.Errorf("bad enrollment of %s: %s", user, err)
+	}
+	if e.Encrypted != nil {
+		if m.config.Encryption == nil {
+			return nil, fmt.Errorf("enrollment of %s is encrypted, but encryption is not configured", user)
+		}
+		secret, err := m.config.Encryption.unseal(e.Encrypted, []byte("mfa:"+user))
+		if err != nil {
+			return nil, fmt.Errorf("enrollment of %s: %s", user, err)
+		}
+		e.Secret = string(secret)
+	}
+	return &e, nil
+}
+
+func (m *MFA) putEnrollment(user string, e *mfaEnrollment) error {
+	stored := *e
+	if m.config.Encryption != nil {
+		et, err := m.config.Encryption.seal([]byte(e.Secret), []byte("mfa:"+user))
+		if err != nil {
+			return err
+		}
+		stored.Secret, stored.Encrypted = "", et
+	}
+	data, err := json.Marshal(&stored)
+	if err != nil {
+		return err
+	}
+	return m.enrollments.Put(user, data)
+}
+
+// Enrolled returns true if the user has confirmed enrollment of an authenticator app.
+func (m *MFA) Enrolled(user string) (bool, error) {
+	e, err := m.getEnrollment(user)
+	if err != nil {
+		return false, err
+	}
+	return e != nil && e.Confirmed, nil
+}
+
+// BeginEnrollment returns the otpauth URI and secret for the user to add to an authenticator app.
+// The same secret is returned until enrollment is confirmed.
+func (m *MFA) BeginEnrollment(user string) (uri, secret string, err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	e, err := m.getEnrollment(user)
+	if err != nil {
+		return "", "", err
+	}
+	if e != nil && e.Confirmed {
+		return "", "", errors.New("already enrolled")
+	}
+	if e == nil {
+		e = &mfaEnrollment{Created: time.Now()}
+		if e.Secret, err = newTOTPSecret(); err != nil {
+			return "", "", err
+		}
+		if err := m.putEnrollment(user, e); err != nil {
+			return "", "", err
+		}
+	}
+	return totpURI(m.config.Issuer, user, e.Secret), e.Secret, nil
+}
+
+// ConfirmEnrollment completes enrollment with a code from the app and returns recovery codes.
+func (m *MFA) ConfirmEnrollment(user, code string) ([]string, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	e, err := m.getEnrollment(user)
+	if err != nil {
+		return nil, err
+	}
+	if e == nil || e.Confirmed {
+		return nil, NotEnrolled
+	}
+	if err := m.checkLockout(e); err != nil {
+		return nil, err
+	}
+	counter, ok := validateTOTP(e.Secret, code, time.Now(), e.LastCounter)
+	if !ok {
+		return nil, m.recordFailure(user, e)
+	}
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	e.Confirmed, e.RecoveryCodes, e.LastCounter, e.Failures = true, hashes, counter, 0
+	if err := m.putEnrollment(user, e); err != nil {
+		return nil, err
+	}
+	glog.Infof("MFA: %s enrolled an authenticator app", user)
+	return codes, nil
+}
+
+// Verify checks a TOTP code or a recovery code, which is used up.
+func (m *MFA) Verify(user, code string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	e, err := m.getEnrollment(user)
+	if err != nil {
+		return err
+	}
+	if e == nil || !e.Confirmed {
+		return NotEnrolled
+	}
+	if err := m.checkLockout(e); err != nil {
+		return err
+	}
+	if counter, ok := validateTOTP(e.Secret, code, time.Now(), e.LastCounter); ok {
+		e.LastCounter, e.Failures = counter, 0
+		return m.putEnrollment(user, e)
+	}
+	h := hashRecoveryCode(code)
+	for i, rc := range e.RecoveryCodes {
+		if subtle.ConstantTimeCompare([]byte(rc), []byte(h)) == 1 {
+			e.RecoveryCodes = append(e.RecoveryCodes[:i], e.RecoveryCodes[i+1:]...)
+			e.Failures = 0
+			glog.Infof("MFA: %s used a recovery code, %d left", user, len(e.RecoveryCodes))
+			return m.putEnrollment(user, e)
+		}
+	}
+	return m.recordFailure(user, e)
+}
+
+func (m *MFA) checkLockout(e *mfaEnrollment) error {
+	if e.Failures >= m.config.MaxFailures && time.Since(e.LastFailure) < m.config.LockoutDuration {
+		return MFALocked
+	}
+	return nil
+}
+
+func (m *MFA) recordFailure(user string, e *mfaEnrollment) error {
+	if time.Since(e.LastFailure) >= m.config.LockoutDuration {
+		e.Failures = 0
+	}
+	e.Failures++
+	e.LastFailure = time.Now()
+	if e.Failures == m.config.MaxFailures {
+		glog.Warningf("MFA: %s locked out for %s after %d wrong codes", user, m.config.LockoutDuration, e.Failures)
+	}
+	if err := m.putEnrollment(user, e); err != nil {
+		return err
+	}
+	return WrongPass
+}
+
+// NewRecoveryCodes replaces recovery codes of an enrolled user.
+func (m *MFA) NewRecoveryCodes(user string) ([]string, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	e, err := m.getEnrollment(user)
+	if err != nil {
+		return nil, err
+	}
+	if e == nil || !e.Confirmed {
+		return nil, NotEnrolled
+	}
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	e.RecoveryCodes = hashes
+	if err := m.putEnrollment(user, e); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// RecoveryCodesLeft returns the number of unused recovery codes of the user.
+func (m *MFA) RecoveryCodesLeft(user string) (int, error) {
+	e, err := m.getEnrollment(user)
+	if err != nil || e == nil {
+		return 0, err
+	}
+	return len(e.RecoveryCodes), nil
+}
+
+// Reset deletes the enrollment and the Docker password of the user, who will have to enroll again.
+func (m *MFA) Reset(user string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	e, err := m.getEnrollment(user)
+	if err != nil {
+		return err
+	} else if e == nil {
+		return NoMatch
+	}
+	if err := m.enrollments.Delete(user); err != nil {
+		return err
+	}
+	glog.Infof("MFA: enrollment of %s has been reset", user)
+	return m.db.DeleteToken(user)
+}
+
+func (m *MFA) Stop() {
+	close(m.stop)
+	m.db.Close()
+	m.enrollments.Close()
+}
+
+func (m *MFA) Name() string {
+	return "MFA"
+}
@@ -0,0 +1,141 @@
+package authn
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTOTP(t *testing.T) {
+	// RFC 6238 test vectors for SHA-1, truncated to 6 digits.
+	secret := totpEncoding.EncodeToString([]byte("12345678901234567890"))
+	for ts, code := range map[int64]string{59: "287082", 1111111109: "081804", 1234567890: "005924", 2000000000: "279037"} {
+		if c, ok := validateTOTP(secret, code, time.Unix(ts, 0), 0); !ok || c != ts/totpPeriod {
+			t.Errorf("%d: code %s rejected", ts, code)
+		}
+	}
+	now := time.Unix(1111111109, 0)
+	if _, ok := validateTOTP(secret, "081 804", now.Add(totpPeriod*time.Second), 0); !ok {
+		t.Errorf("code of the previous step rejected")
+	}
+	if _, ok := validateTOTP(secret, "081804", now.Add(3*totpPeriod*time.Second), 0); ok {
+		t.Errorf("old code accepted")
+	}
+	if _, ok := validateTOTP(secret, "081804", now, now.Unix()/totpPeriod); ok {
+		t.Errorf("code accepted twice")
+	}
+	if uri := totpURI("Acme auth", "alice", secret); !strings.HasPrefix(uri, "otpauth://totp/Acme%20auth:alice?") || !strings.Contains(uri, "secret="+secret) {
+		t.Errorf("unexpected URI: %s", uri)
+	}
+}
+
+func currentTOTP(t *testing.T, secret string) string {
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return totpCode(key, time.Now().Unix()/totpPeriod)
+}
+
+func TestMFA(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mfa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c := &MFAConfig{
+		RequiredAccounts: []string{"admin", "/^ci-/"},
+		TokenDB:          filepath.Join(dir, "tokens.ldb"),
+		EnrollmentDB:     filepath.Join(dir, "enrollments.ldb"),
+		Encryption:       &TokenEncryptionConfig{KeyFile: writeTokenKey(t, dir, "key")},
+		Issuer:           "Acme auth",
+		MaxFailures:      3,
+	}
+	if err := c.Validate("mfa"); err != nil {
+		t.Fatal(err)
+	}
+	m, err := NewMFA(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+
+	for account, required := range map[string]bool{"admin": true, "ci-deploy": true, "alice": false, "my-ci-": false} {
+		if m.Required(account) != required {
+			t.Errorf("%s: expected required=%t", account, required)
+		}
+	}
+
+	if err := m.Verify("alice", "123456"); err != NotEnrolled {
+		t.Errorf("expected NotEnrolled, got %v", err)
+	}
+	_, secret, err := m.BeginEnrollment("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, again, _ := m.BeginEnrollment("alice"); again != secret {
+		t.Errorf("secret changed before enrollment was confirmed")
+	}
+	if raw, _ := m.enrollments.Get("alice"); bytes.Contains(raw, []byte(secret)) {
+		t.Errorf("secret stored in plain text: %s", raw)
+	}
+	if _, err := m.ConfirmEnrollment("alice", "000000"); err != WrongPass {
+		t.Errorf("expected WrongPass, got %v", err)
+	}
+	code := currentTOTP(t, secret)
+	recoveryCodes, err := m.ConfirmEnrollment("alice", code)
+	if err != nil || len(recoveryCodes) != recoveryCodeCount {
+		t.Fatalf("failed to confirm enrollment: %v %v", recoveryCodes, err)
+	}
+	if enrolled, _ := m.Enrolled("alice"); !enrolled {
+		t.Errorf("not enrolled")
+	}
+	if _, _, err := m.BeginEnrollment("alice"); err == nil {
+		t.Errorf("enrollment replaced")
+	}
+	if err := m.Verify("alice", code); err != WrongPass {
+		t.Errorf("code accepted twice: %v", err)
+	}
+	if err := m.Verify("alice", strings.ToUpper(recoveryCodes[0])); err != nil {
+		t.Errorf("recovery code rejected: %s", err)
+	}
+	if err := m.Verify("alice", recoveryCodes[0]); err != WrongPass {
+		t.Errorf("recovery code accepted twice: %v", err)
+	}
+	if left, _ := m.RecoveryCodesLeft("alice"); left != recoveryCodeCount-1 {
+		t.Errorf("expected %d recovery codes left, got %d", recoveryCodeCount-1, left)
+	}
+	m.Verify("alice", "000000")
+	m.Verify("alice", "111111")
+	if err := m.Verify("alice", recoveryCodes[1]); err != MFALocked {
+		t.Errorf("expected MFALocked, got %v", err)
+	}
+
+	password, err := m.IssuePassword("alice", Labels{"group": {"dev"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, labels, err := m.Authenticate("alice", PasswordString(password)); !ok || err != nil || labels["group"][0] != "dev" {
+		t.Errorf("issued password rejected: %t %v %v", ok, labels, err)
+	}
+	if _, _, err := m.Authenticate("alice", "static password"); err != NoMatch {
+		t.Errorf("expected NoMatch for other passwords, got %v", err)
+	}
+	if _, _, err := m.Authenticate("bob", "whatever"); err != NoMatch {
+		t.Errorf("expected NoMatch for other users, got %v", err)
+	}
+
+	if err := m.Reset("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := m.Authenticate("alice", PasswordString(password)); err != NoMatch {
+		t.Errorf("password valid after reset: %v", err)
+	}
+	if enrolled, _ := m.Enrolled("alice"); enrolled {
+		t.Errorf("still enrolled after reset")
+	}
+}
@@ -24,7 +24,6 @@ import (
 
 	"github.com/cesanta/docker_auth/auth_server/mgo_session"
 	"github.com/golang/glog"
-	"golang.org/x/crypto/bcrypt"
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 )
@@ -34,15 +33,26 @@ type MongoAuthConfig struct {
 	Collection  string              `yaml:"collection,omitempty"`
 }
 
+// MongoAuthName is the name of the mongo_auth authenticator.
+const MongoAuthName = "MongoDB"
+
 type MongoAuth struct {
 	config     *MongoAuthConfig
 	session    *mgo.Session
 	Collection string `yaml:"collection,omitempty"`
+	hashPolicy *PasswordHashConfig
 }
 
+// authUserEntry is a user document. Fields other than username and password are optional.
+// Per-user ACL entries in the "acl" field are read by the authorizer (authz.NewMongoUserACLAuthorizer).
 type authUserEntry struct {
-	Username *string `yaml:"username,omitempty" json:"username,omitempty"`
-	Password *string `yaml:"password,omitempty" json:"password,omitempty"`
+	Username  *string    `yaml:"username,omitempty" json:"username,omitempty"`
+	Password  *string    `yaml:"password,omitempty" json:"password,omitempty"`
+	Disabled  bool       `yaml:"disabled,omitempty" json:"disabled,omitempty"`
+	ExpiresAt *time.Time `yaml:"expires_at,omitempty" json:"expires_at,omitempty" bson:"expires_at,omitempty"`
+	// Labels are passed on to authorization and the token issuer, groups go into the "groups" label.
+	Labels Labels   `yaml:"labels,omitempty" json:"labels,omitempty"`
+	Groups []string `yaml:"groups,omitempty" json:"groups,omitempty"`
 }
 
 func NewMongoAuth(c *MongoAuthConfig) (*MongoAuth, error) {
@@ -82,21 +92,26 @@ func NewMongoAuth(c *MongoAuthConfig) (*MongoAuth, error) {
 	}, nil
 }
 
-func (mauth *MongoAuth) Authenticate(account string, password PasswordString) (bool, error) {
+// SetPasswordHashPolicy sets the policy password hashes are upgraded to when users log in.
+func (mauth *MongoAuth) SetPasswordHashPolicy(p *PasswordHashConfig) {
+	mauth.hashPolicy = p
+}
+
+func (mauth *MongoAuth) Authenticate(account string, password PasswordString) (bool, Labels, error) {
 	for true {
-		result, err := mauth.authenticate(account, password)
+		result, labels, err := mauth.authenticate(account, password)
 		if err == io.EOF {
 			glog.Warningf("EOF error received from Mongo. Retrying connection")
 			time.Sleep(time.Second)
 			continue
 		}
-		return result, err
+		return result, labels, err
 	}
 
-	return false, errors.New("Unable to communicate with Mongo.")
+	return false, nil, errors.New("Unable to communicate with Mongo.")
 }
 
-func (mauth *MongoAuth) authenticate(account string, password PasswordString) (bool, error) {
+func (mauth *MongoAuth) authenticate(account string, password PasswordString) (bool, Labels, error) {
 	// Copy our session
 	tmp_session := mauth.session.Copy()
 	// Close up when we are done
@@ -111,20 +126,209 @@ func (mauth *MongoAuth) authenticate(account string, password PasswordString) (b
 
 	// If we connect and get no results we return a NoMatch so auth can fall-through
 	if err == mgo.ErrNotFound {
-		return false, NoMatch
+		return false, nil, NoMatch
 	} else if err != nil {
-		return false, err
+		return false, nil, err
 	}
 
 	// Validate db password against passed password
 	if dbUserRecord.Password != nil {
-		if bcrypt.CompareHashAndPassword([]byte(*dbUserRecord.Password), []byte(password)) != nil {
-			return false, nil
+		ok, weak := mauth.hashPolicy.checkPassword("mongo_auth", account, *dbUserRecord.Password, password)
+		if !ok {
+			return false, nil, nil
+		}
+		if weak {
+			mauth.rehash(collection, account, *dbUserRecord.Password, password)
 		}
 	}
 
+	if dbUserRecord.Disabled {
+		glog.Warningf("User %s is disabled", account)
+		return false, nil, nil
+	}
+	if dbUserRecord.ExpiresAt != nil && time.Now().After(*dbUserRecord.ExpiresAt) {
+		glog.Warningf("User %s expired at %s", account, dbUserRecord.ExpiresAt)
+		return false, nil, nil
+	}
+
 	// Auth success
-	return true, nil
+	return true, dbUserRecord.labels(), nil
+}
+
+// active returns false if the user is disabled or expired.
+func (e *authUserEntry) active() bool {
+	return !e.Disabled && (e.ExpiresAt == nil || time.Now().Before(*e.ExpiresAt))
+}
+
+// CheckAccount tells whether the user exists and is neither disabled nor expired.
+func (mauth *MongoAuth) CheckAccount(account string) (bool, error) {
+	for true {
+		result, err := mauth.checkAccount(account)
+		if err == io.EOF {
+			glog.Warningf("EOF error received from Mongo. Retrying connection")
+			time.Sleep(time.Second)
+			continue
+		}
+		return result, err
+	}
+	return false, errors.New("Unable to communicate with Mongo.")
+}
+
+func (mauth *MongoAuth) checkAccount(account string) (bool, error) {
+	tmp_session := mauth.session.Copy()
+	defer tmp_session.Close()
+	var dbUserRecord authUserEntry
+	err := mauth.users(tmp_session).Find(bson.M{"username": account}).Select(bson.M{"disabled": 1, "expires_at": 1}).One(&dbUserRecord)
+	if err == mgo.ErrNotFound {
+		return false, NoMatch
+	} else if err != nil {
+		return false, err
+	}
+	return dbUserRecord.active(), nil
+}
+
+func (e *authUserEntry) labels() Labels {
+	if len(e.Groups) == 0 {
+		return e.Labels
+	}
+	labels := Labels{}
+	for k, v := range e.Labels {
+		labels[k] = v
+	}
+	labels["groups"] = append(append([]string{}, labels["groups"]...), e.Groups...)
+	return labels
+}
+
+// rehash replaces the hash of a user with one made according to the policy. The old hash is part
+// of the query, so a password changed in the meantime is not overwritten. Failure is not fatal,
+// the user can log in with the old hash and it is tried again next time.
+func (mauth *MongoAuth) rehash(collection *mgo.Collection, account, oldHash string, password PasswordString) {
+	newHash, err := mauth.hashPolicy.Hash(password)
+	if err == nil {
+		err = collection.Update(bson.M{"username": account, "password": oldHash}, bson.M{"$set": bson.M{"password": newHash}})
+	}
+	if err == mgo.ErrNotFound {
+		return
+	} else if err != nil {
+		glog.Warningf("Failed to rehash password of %s: %s", account, err)
+		return
+	}
+	glog.Infof("Rehashed password of %s with %s", account, mauth.hashPolicy.Scheme)
+}
+
+// MongoUser is a user document as managed through the admin API. Password hashes are never returned,
+// per-user ACL entries are left alone.
+type MongoUser struct {
+	Username  string     `json:"username" bson:"username"`
+	Disabled  bool       `json:"disabled,omitempty" bson:"disabled,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty" bson:"expires_at,omitempty"`
+	Labels    Labels     `json:"labels,omitempty" bson:"labels,omitempty"`
+	Groups    []string   `json:"groups,omitempty" bson:"groups,omitempty"`
+}
+
+var UserExists = errors.New("user already exists")
+
+func (mauth *MongoAuth) users(s *mgo.Session) *mgo.Collection {
+	return s.DB(mauth.config.MongoConfig.DialInfo.Database).C(mauth.config.Collection)
+}
+
+// ListUsers returns all users, sorted by name.
+func (mauth *MongoAuth) ListUsers() ([]MongoUser, error) {
+	tmp_session := mauth.session.Copy()
+	defer tmp_session.Close()
+	users := []MongoUser{}
+	err := mauth.users(tmp_session).Find(bson.M{}).Select(bson.M{"password": 0, "acl": 0}).Sort("username").All(&users)
+	return users, err
+}
+
+// GetUser returns the user, nil if there is none.
+func (mauth *MongoAuth) GetUser(username string) (*MongoUser, error) {
+	tmp_session := mauth.session.Copy()
+	defer tmp_session.Close()
+	var u MongoUser
+	err := mauth.users(tmp_session).Find(bson.M{"username": username}).Select(bson.M{"password": 0, "acl": 0}).One(&u)
+	if err == mgo.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// CreateUser adds a user with the password hash, UserExists is returned if the name is taken.
+func (mauth *MongoAuth) CreateUser(u *MongoUser, passwordHash string) error {
+	tmp_session := mauth.session.Copy()
+	defer tmp_session.Close()
+	doc := bson.M{"username": u.Username, "password": passwordHash}
+	for k, v := range u.fields() {
+		if v != nil {
+			doc[k] = v
+		}
+	}
+	err := mauth.users(tmp_session).Insert(doc)
+	if mgo.IsDup(err) {
+		return UserExists
+	}
+	return err
+}
+
+// UpdateUser replaces attributes of the user, and the password hash unless it is empty.
+// NoMatch is returned if there is no such user.
+func (mauth *MongoAuth) UpdateUser(u *MongoUser, passwordHash string) error {
+	tmp_session := mauth.session.Copy()
+	defer tmp_session.Close()
+	set, unset := bson.M{}, bson.M{}
+	for k, v := range u.fields() {
+		if v != nil {
+			set[k] = v
+		} else {
+			unset[k] = ""
+		}
+	}
+	if passwordHash != "" {
+		set["password"] = passwordHash
+	}
+	update := bson.M{}
+	if len(set) > 0 {
+		update["$set"] = set
+	}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+	err := mauth.users(tmp_session).Update(bson.M{"username": u.Username}, update)
+	if err == mgo.ErrNotFound {
+		return NoMatch
+	}
+	return err
+}
+
+// DeleteUser removes the user. NoMatch is returned if there is no such user.
+func (mauth *MongoAuth) DeleteUser(username string) error {
+	tmp_session := mauth.session.Copy()
+	defer tmp_session.Close()
+	err := mauth.users(tmp_session).Remove(bson.M{"username": username})
+	if err == mgo.ErrNotFound {
+		return NoMatch
+	}
+	return err
+}
+
+// fields returns optional attributes of the user, nil for those that are not set.
+func (u *MongoUser) fields() map[string]interface{} {
+	f := map[string]interface{}{"disabled": nil, "expires_at": nil, "labels": nil, "groups": nil}
+	if u.Disabled {
+		f["disabled"] = true
+	}
+	if u.ExpiresAt != nil {
+		f["expires_at"] = *u.ExpiresAt
+	}
+	if len(u.Labels) > 0 {
+		f["labels"] = u.Labels
+	}
+	if len(u.Groups) > 0 {
+		f["groups"] = u.Groups
+	}
+	return f
 }
 
 // Validate ensures that any custom config options
@@ -143,6 +347,12 @@ func (c *MongoAuthConfig) Validate(configKey string) error {
 	return nil
 }
 
+func (ma *MongoAuth) HealthCheck() error {
+	tmp_session := ma.session.Copy()
+	defer tmp_session.Close()
+	return tmp_session.Ping()
+}
+
 func (ma *MongoAuth) Stop() {
 	// Close connection to MongoDB database (if any)
 	if ma.session != nil {
@@ -151,5 +361,5 @@ func (ma *MongoAuth) Stop() {
 }
 
 func (ga *MongoAuth) Name() string {
-	return "MongoDB"
+	return MongoAuthName
 }
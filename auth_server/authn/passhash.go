@@ -0,0 +1,340 @@
+/*
+   Copyright 2016 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package authn
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/cesanta/docker_auth/auth_server/metrics"
+	"github.com/golang/glog"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Password hashes of users, mongo_auth and sql_auth can be in any of these formats, detected by prefix:
+//
+//	bcrypt         $2a$10$...  ($2b$, $2y$)
+//	argon2id       $argon2id$v=19$m=65536,t=3,p=4$<salt>$<hash>  (PHC string format, also argon2i)
+//	scrypt         $scrypt$ln=15,r=8,p=1$<salt>$<hash>           (passlib)
+//	pbkdf2-sha256  $pbkdf2-sha256$600000$<salt>$<hash>           (passlib, also pbkdf2-sha512 and pbkdf2 for SHA-1)
+//	               pbkdf2_sha256$600000$<salt>$<hash>            (Django)
+//	sha512-crypt   $6$rounds=656000$<salt>$<hash>                (crypt(3), /etc/shadow)
+
+// PasswordHashConfig is the policy for password hashes: hashes in another scheme or with weaker parameters
+// are reported when users log in, and mongo_auth replaces them with a hash made according to the policy.
+type PasswordHashConfig struct {
+	// Scheme of new hashes: argon2id, bcrypt, scrypt, pbkdf2-sha256 or pbkdf2-sha512. Default is argon2id.
+	Scheme           string `yaml:"scheme,omitempty"`
+	BcryptCost       int    `yaml:"bcrypt_cost,omitempty"`
+	Argon2Memory     uint32 `yaml:"argon2_memory,omitempty"` // KiB.
+	Argon2Time       uint32 `yaml:"argon2_time,omitempty"`
+	Argon2Threads    uint8  `yaml:"argon2_threads,omitempty"`
+	ScryptLogN       int    `yaml:"scrypt_log_n,omitempty"`
+	PBKDF2Iterations int    `yaml:"pbkdf2_iterations,omitempty"`
+}
+
+// passwordHash is a parsed hash. Parameters not used by the scheme are zero.
+type passwordHash struct {
+	scheme string
+	cost   int    // bcrypt cost, scrypt log2(N), PBKDF2 iterations or sha512-crypt rounds.
+	memory uint32 // argon2 memory (KiB).
+	time   uint32 // argon2 passes.
+}
+
+// ab64 is the base64 variant of passlib: standard alphabet with "." instead of "+", no padding.
+var ab64 = base64.NewEncoding("ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789./").WithPadding(base64.NoPadding)
+
+func (c *PasswordHashConfig) Validate(configKey string) error {
+	switch c.Scheme {
+	case "":
+		c.Scheme = "argon2id"
+	case "argon2id", "bcrypt", "scrypt", "pbkdf2-sha256", "pbkdf2-sha512":
+	default:
+		return fmt.Errorf("%s.scheme: unsupported scheme %q", configKey, c.Scheme)
+	}
+	if c.BcryptCost == 0 {
+		c.BcryptCost = 12
+	} else if c.BcryptCost < bcrypt.MinCost || c.BcryptCost > bcrypt.MaxCost {
+		return fmt.Errorf("%s.bcrypt_cost must be between %d and %d", configKey, bcrypt.MinCost, bcrypt.MaxCost)
+	}
+	// Defaults are the second recommended option of RFC 9106.
+	if c.Argon2Memory == 0 {
+		c.Argon2Memory = 64 * 1024
+	}
+	if c.Argon2Time == 0 {
+		c.Argon2Time = 3
+	}
+	if c.Argon2Threads == 0 {
+		c.Argon2Threads = 4
+	}
+	if c.ScryptLogN == 0 {
+		c.ScryptLogN = 15
+	} else if c.ScryptLogN < 10 || c.ScryptLogN > 30 {
+		return fmt.Errorf("%s.scrypt_log_n must be between 10 and 30", configKey)
+	}
+	if c.PBKDF2Iterations == 0 {
+		c.PBKDF2Iterations = 600000
+		if c.Scheme == "pbkdf2-sha512" {
+			c.PBKDF2Iterations = 210000
+		}
+	}
+	return nil
+}
+
+func salt() ([]byte, error) {
+	s := make([]byte, 16)
+	_, err := rand.Read(s)
+	return s, err
+}
+
+// Hash returns a hash of the password according to the policy.
+func (c *PasswordHashConfig) Hash(password PasswordString) (string, error) {
+	if c.Scheme == "bcrypt" {
+		h, err := bcrypt.GenerateFromPassword([]byte(password), c.BcryptCost)
+		return string(h), err
+	}
+	s, err := salt()
+	if err != nil {
+		return "", err
+	}
+	switch c.Scheme {
+	case "argon2id":
+		h := argon2.IDKey([]byte(password), s, c.Argon2Time, c.Argon2Memory, c.Argon2Threads, 32)
+		return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, c.Argon2Memory, c.Argon2Time, c.Argon2Threads,
+			base64.RawStdEncoding.EncodeToString(s), base64.RawStdEncoding.EncodeToString(h)), nil
+	case "scrypt":
+		h, err := scrypt.Key([]byte(password), s, 1<<uint(c.ScryptLogN), 8, 1, 32)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("$scrypt$ln=%d,r=8,p=1$%s$%s", c.ScryptLogN, ab64.EncodeToString(s), ab64.EncodeToString(h)), nil
+	case "pbkdf2-sha256", "pbkdf2-sha512":
+		hf, size := sha256.New, sha256.Size
+		if c.Scheme == "pbkdf2-sha512" {
+			hf, size = sha512.New, sha512.Size
+		}
+		h := pbkdf2.Key([]byte(password), s, c.PBKDF2Iterations, size, hf)
+		return fmt.Sprintf("$%s$%d$%s$%s", c.Scheme, c.PBKDF2Iterations, ab64.EncodeToString(s), ab64.EncodeToString(h)), nil
+	}
+	return "", fmt.Errorf("unsupported scheme %q", c.Scheme)
+}
+
+// NeedsRehash returns true if the hash is in another scheme than that of the policy, or weaker.
+// A nil policy accepts any hash.
+func (c *PasswordHashConfig) NeedsRehash(hash string) bool {
+	if c == nil {
+		return false
+	}
+	ph, err := parsePasswordHash(hash)
+	if err != nil || ph.scheme != c.Scheme {
+		return true
+	}
+	switch ph.scheme {
+	case "bcrypt":
+		return ph.cost < c.BcryptCost
+	case "argon2id":
+		return ph.memory < c.Argon2Memory || ph.time < c.Argon2Time
+	case "scrypt":
+		return ph.cost < c.ScryptLogN
+	default:
+		return ph.cost < c.PBKDF2Iterations
+	}
+}
+
+// PasswordHashScheme returns the scheme of a hash, empty if it is not supported.
+func PasswordHashScheme(hash string) string {
+	ph, err := parsePasswordHash(hash)
+	if err != nil {
+		return ""
+	}
+	return ph.scheme
+}
+
+func parsePasswordHash(hash string) (*passwordHash, error) {
+	parts := strings.Split(hash, "$")
+	switch {
+	case strings.HasPrefix(hash, "$2"):
+		cost, err := bcrypt.Cost([]byte(hash))
+		if err != nil {
+			return nil, err
+		}
+		return &passwordHash{scheme: "bcrypt", cost: cost}, nil
+	case strings.HasPrefix(hash, "$argon2id$"), strings.HasPrefix(hash, "$argon2i$"):
+		// "", scheme, v=19, m=..,t=..,p=.., salt, hash
+		if len(parts) != 6 {
+			return nil, errors.New("bad argon2 hash")
+		}
+		var m, t uint32
+		var p uint8
+		if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &m, &t, &p); err != nil {
+			return nil, errors.New("bad argon2 parameters")
+		}
+		return &passwordHash{scheme: parts[1], memory: m, time: t}, nil
+	case strings.HasPrefix(hash, "$scrypt$"):
+		var ln, r, p int
+		if len(parts) != 5 {
+			return nil, errors.New("bad scrypt hash")
+		}
+		if _, err := fmt.Sscanf(parts[2], "ln=%d,r=%d,p=%d", &ln, &r, &p); err != nil {
+			return nil, errors.New("bad scrypt parameters")
+		}
+		return &passwordHash{scheme: "scrypt", cost: ln}, nil
+	case strings.HasPrefix(hash, "$pbkdf2"), strings.HasPrefix(hash, "pbkdf2_"):
+		if len(parts) == 4 {
+			// Django: pbkdf2_sha256$iterations$salt$hash
+			parts = append([]string{""}, parts...)
+			parts[1] = strings.Replace(parts[1], "_", "-", 1)
+		}
+		if len(parts) != 5 {
+			return nil, errors.New("bad pbkdf2 hash")
+		}
+		if pbkdf2Hash(parts[1]) == nil {
+			return nil, fmt.Errorf("unsupported digest %q", parts[1])
+		}
+		iterations, err := strconv.Atoi(parts[2])
+		if err != nil || iterations <= 0 {
+			return nil, errors.New("bad pbkdf2 iterations")
+		}
+		scheme := parts[1]
+		if scheme == "pbkdf2" {
+			scheme = "pbkdf2-sha1"
+		}
+		return &passwordHash{scheme: scheme, cost: iterations}, nil
+	case strings.HasPrefix(hash, "$6$"):
+		rounds, _, _, err := parseSHA512Crypt(hash)
+		if err != nil {
+			return nil, err
+		}
+		return &passwordHash{scheme: "sha512-crypt", cost: rounds}, nil
+	}
+	return nil, errors.New("unknown password hash format")
+}
+
+func pbkdf2Hash(scheme string) func() hash.Hash {
+	switch scheme {
+	case "pbkdf2", "pbkdf2-sha1":
+		return sha1.New
+	case "pbkdf2-sha256":
+		return sha256.New
+	case "pbkdf2-sha512":
+		return sha512.New
+	}
+	return nil
+}
+
+// decodeB64 decodes salts and hashes, which come in various flavours of base64.
+func decodeB64(s string) ([]byte, error) {
+	s = strings.TrimRight(s, "=")
+	if strings.ContainsAny(s, "-_") {
+		return base64.RawURLEncoding.DecodeString(s)
+	}
+	return base64.RawStdEncoding.DecodeString(strings.Replace(s, ".", "+", -1))
+}
+
+// VerifyPassword checks the password against a hash in any of the supported formats.
+func VerifyPassword(hash string, password PasswordString) (bool, error) {
+	parts := strings.Split(hash, "$")
+	var computed, expected []byte
+	switch ph, err := parsePasswordHash(hash); {
+	case err != nil:
+		return false, err
+	case ph.scheme == "bcrypt":
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil, nil
+	case ph.scheme == "argon2id" || ph.scheme == "argon2i":
+		var m, t uint32
+		var p uint8
+		fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &m, &t, &p)
+		s, err1 := decodeB64(parts[4])
+		expected, err = decodeB64(parts[5])
+		if err1 != nil || err != nil || p == 0 || len(expected) == 0 {
+			return false, errors.New("bad argon2 hash")
+		}
+		if ph.scheme == "argon2id" {
+			computed = argon2.IDKey([]byte(password), s, t, m, p, uint32(len(expected)))
+		} else {
+			computed = argon2.Key([]byte(password), s, t, m, p, uint32(len(expected)))
+		}
+	case ph.scheme == "scrypt":
+		var ln, r, p int
+		fmt.Sscanf(parts[2], "ln=%d,r=%d,p=%d", &ln, &r, &p)
+		s, err1 := decodeB64(parts[3])
+		expected, err = decodeB64(parts[4])
+		if err1 != nil || err != nil || len(expected) == 0 || ln <= 0 || ln > 30 {
+			return false, errors.New("bad scrypt hash")
+		}
+		if computed, err = scrypt.Key([]byte(password), s, 1<<uint(ln), r, p, len(expected)); err != nil {
+			return false, err
+		}
+	case strings.HasPrefix(ph.scheme, "pbkdf2"):
+		var s []byte
+		if len(parts) == 4 {
+			// Django uses the salt as is and standard base64 for the hash.
+			s = []byte(parts[2])
+			expected, err = base64.StdEncoding.DecodeString(parts[3])
+		} else {
+			var err1 error
+			s, err1 = decodeB64(parts[3])
+			expected, err = decodeB64(parts[4])
+			if err1 != nil {
+				err = err1
+			}
+		}
+		if err != nil || len(expected) == 0 {
+			return false, errors.New("bad pbkdf2 hash")
+		}
+		computed = pbkdf2.Key([]byte(password), s, ph.cost, len(expected), pbkdf2Hash(ph.scheme))
+	case ph.scheme == "sha512-crypt":
+		rounds, s, sum, _ := parseSHA512Crypt(hash)
+		computed, expected = []byte(sha512CryptSum([]byte(password), []byte(s), rounds)), []byte(sum)
+	}
+	return subtle.ConstantTimeCompare(computed, expected) == 1, nil
+}
+
+// weakHashesReported remembers users whose weak hashes have been logged, to not log them on every login.
+var weakHashesReported sync.Map
+
+// checkPassword verifies the password of a user of backend. If it is correct, but the hash is weaker
+// than the policy, this is reported and weak is true.
+func (c *PasswordHashConfig) checkPassword(backend, user, hash string, password PasswordString) (ok, weak bool) {
+	ok, err := VerifyPassword(hash, password)
+	if err != nil {
+		glog.Errorf("%s: bad password hash of %s: %s", backend, user, err)
+		return false, false
+	}
+	if !ok || !c.NeedsRehash(hash) {
+		return ok, false
+	}
+	scheme := PasswordHashScheme(hash)
+	metrics.WeakPasswordHash(backend, scheme)
+	if _, reported := weakHashesReported.LoadOrStore(backend+"/"+user, true); !reported {
+		glog.Warningf("%s: password hash of %s (%s) is weaker than the policy (%s)", backend, user, scheme, c.Scheme)
+	}
+	return true, true
+}
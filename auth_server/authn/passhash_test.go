@@ -0,0 +1,83 @@
+package authn
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestVerifyPassword(t *testing.T) {
+	for _, tc := range []struct {
+		password, hash string
+	}{
+		// Examples from the SHA-crypt specification.
+		{"Hello world!", "$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1"},
+		{"Hello world!", "$6$rounds=10000$saltstringsaltstring$OW1/O6BYHV6BcXZu8QVeXbDWra3Oeqh0sbHbbMCVNSnCM/UrjmM0Dp8vOuZeHBy/YTBmSK6H9qs/y3RnOaw5v."},
+		// From the argon2 reference implementation.
+		{"password", "$argon2i$v=19$m=65536,t=2,p=4$c29tZXNhbHQ$RdescudvJCsgt3ub+b+dWRWJTmaaJObG"},
+		{"secret", "pbkdf2_sha256$1000$seasalt$+hs9qSCcGyNSGDNojIEbomuX9WI/mzTF5yfwAXqyKOo="},
+		{"secret", "$pbkdf2-sha512$1000$MDEyMzQ1Njc4OWFiY2RlZg$vgFvU7zWIDgDAUi7d8ayt.cfRiPWVVWfv8iQRsGZaZviWzsSNgWYXEE5PmvI/VELMsOmEbqLz0PKuePNjOk41A"},
+		{"secret", "$pbkdf2$1000$MDEyMzQ1Njc4OWFiY2RlZg$21EupWTmSOvnK3Sp99FL7THUyuQ"},
+		{"secret", "$scrypt$ln=10,r=8,p=1$MDEyMzQ1Njc4OWFiY2RlZg$S7FwBvpu.z8K0PUVUagFRTUAB2dAxIZpzVHvLZir.98"},
+	} {
+		if ok, err := VerifyPassword(tc.hash, PasswordString(tc.password)); !ok || err != nil {
+			t.Errorf("%s: correct password rejected: %v", tc.hash, err)
+		}
+		if ok, _ := VerifyPassword(tc.hash, "wrong"); ok {
+			t.Errorf("%s: wrong password accepted", tc.hash)
+		}
+	}
+	if _, err := VerifyPassword("plaintext", "plaintext"); err == nil {
+		t.Errorf("unknown format accepted")
+	}
+}
+
+func TestPasswordHashPolicy(t *testing.T) {
+	for _, scheme := range []string{"argon2id", "bcrypt", "scrypt", "pbkdf2-sha256", "pbkdf2-sha512"} {
+		// Cheap parameters, to keep the test fast.
+		c := &PasswordHashConfig{Scheme: scheme, BcryptCost: 4, Argon2Memory: 64, Argon2Time: 1, ScryptLogN: 10, PBKDF2Iterations: 1000}
+		if err := c.Validate("password_hash"); err != nil {
+			t.Fatal(err)
+		}
+		h, err := c.Hash("secret")
+		if err != nil {
+			t.Fatalf("%s: %s", scheme, err)
+		}
+		if PasswordHashScheme(h) != scheme {
+			t.Errorf("%s: hash %s detected as %q", scheme, h, PasswordHashScheme(h))
+		}
+		if ok, err := VerifyPassword(h, "secret"); !ok || err != nil {
+			t.Errorf("%s: correct password rejected: %v", scheme, err)
+		}
+		if ok, _ := VerifyPassword(h, "wrong"); ok {
+			t.Errorf("%s: wrong password accepted", scheme)
+		}
+		if c.NeedsRehash(h) {
+			t.Errorf("%s: own hash needs rehash", scheme)
+		}
+		stronger := *c
+		stronger.BcryptCost, stronger.Argon2Time, stronger.ScryptLogN, stronger.PBKDF2Iterations = 5, 2, 11, 2000
+		if !stronger.NeedsRehash(h) {
+			t.Errorf("%s: weaker hash does not need rehash", scheme)
+		}
+	}
+
+	c := &PasswordHashConfig{}
+	if err := c.Validate("password_hash"); err != nil || c.Scheme != "argon2id" {
+		t.Fatalf("unexpected defaults: %+v, %v", c, err)
+	}
+	sha512Crypt := "$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1"
+	if !c.NeedsRehash(sha512Crypt) {
+		t.Errorf("hash in another scheme does not need rehash")
+	}
+	ok, weak := c.checkPassword("test", "alice", sha512Crypt, "Hello world!")
+	if !ok || !weak {
+		t.Errorf("checkPassword = %v, %v", ok, weak)
+	}
+	var none *PasswordHashConfig
+	if ok, weak := none.checkPassword("test", "alice", sha512Crypt, "Hello world!"); !ok || weak {
+		t.Errorf("checkPassword without policy = %v, %v", ok, weak)
+	}
+	if err := (&PasswordHashConfig{Scheme: "sha512-crypt"}).Validate("password_hash"); err == nil || !strings.Contains(err.Error(), "unsupported") {
+		t.Errorf("verify-only scheme accepted as policy: %v", err)
+	}
+}
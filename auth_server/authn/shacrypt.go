@@ -0,0 +1,155 @@
+/*
+   Copyright 2016 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package authn
+
+import (
+	"crypto/sha512"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// SHA-512 based crypt(3) ("$6$"), as specified in https://www.akkadia.org/drepper/SHA-crypt.txt.
+// Only verification is supported, for hashes imported from /etc/shadow and the like.
+
+const (
+	shaCryptDefaultRounds = 5000
+	shaCryptMinRounds     = 1000
+	shaCryptMaxRounds     = 999999999
+	cryptAlphabet         = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+)
+
+// parseSHA512Crypt splits a hash into rounds, salt and the encoded checksum.
+func parseSHA512Crypt(hash string) (rounds int, salt, sum string, err error) {
+	rest := strings.TrimPrefix(hash, "$6$")
+	rounds = shaCryptDefaultRounds
+	if strings.HasPrefix(rest, "rounds=") {
+		i := strings.IndexByte(rest, '$')
+		if i < 0 {
+			return 0, "", "", errors.New("bad sha512-crypt hash")
+		}
+		if rounds, err = strconv.Atoi(rest[len("rounds="):i]); err != nil {
+			return 0, "", "", errors.New("bad sha512-crypt rounds")
+		}
+		if rounds < shaCryptMinRounds {
+			rounds = shaCryptMinRounds
+		} else if rounds > shaCryptMaxRounds {
+			rounds = shaCryptMaxRounds
+		}
+		rest = rest[i+1:]
+	}
+	i := strings.LastIndexByte(rest, '$')
+	if i < 0 {
+		return 0, "", "", errors.New("bad sha512-crypt hash")
+	}
+	salt, sum = rest[:i], rest[i+1:]
+	if len(salt) > 16 {
+		salt = salt[:16]
+	}
+	return rounds, salt, sum, nil
+}
+
+func sha512CryptSum(password, salt []byte, rounds int) string {
+	h := sha512.New()
+	h.Write(password)
+	h.Write(salt)
+	h.Write(password)
+	b := h.Sum(nil)
+
+	h.Reset()
+	h.Write(password)
+	h.Write(salt)
+	for n := len(password); n > 0; n -= 64 {
+		if n > 64 {
+			h.Write(b)
+		} else {
+			h.Write(b[:n])
+		}
+	}
+	for n := len(password); n > 0; n >>= 1 {
+		if n&1 != 0 {
+			h.Write(b)
+		} else {
+			h.Write(password)
+		}
+	}
+	a := h.Sum(nil)
+
+	h.Reset()
+	for i := 0; i < len(password); i++ {
+		h.Write(password)
+	}
+	dp := h.Sum(nil)
+	p := make([]byte, 0, len(password))
+	for len(p) < len(password) {
+		n := len(password) - len(p)
+		if n > 64 {
+			n = 64
+		}
+		p = append(p, dp[:n]...)
+	}
+
+	h.Reset()
+	for i := 0; i < 16+int(a[0]); i++ {
+		h.Write(salt)
+	}
+	s := h.Sum(nil)[:len(salt)]
+
+	c := a
+	for i := 0; i < rounds; i++ {
+		h.Reset()
+		if i&1 != 0 {
+			h.Write(p)
+		} else {
+			h.Write(c)
+		}
+		if i%3 != 0 {
+			h.Write(s)
+		}
+		if i%7 != 0 {
+			h.Write(p)
+		}
+		if i&1 != 0 {
+			h.Write(c)
+		} else {
+			h.Write(p)
+		}
+		c = h.Sum(nil)
+	}
+
+	var out []byte
+	encode := func(b2, b1, b0 byte, n int) {
+		w := uint(b2)<<16 | uint(b1)<<8 | uint(b0)
+		for ; n > 0; n-- {
+			out = append(out, cryptAlphabet[w&0x3f])
+			w >>= 6
+		}
+	}
+	// Bytes are encoded in groups of three, rotated: (0, 21, 42), (22, 43, 1), (44, 2, 23), (3, 24, 45), ...
+	for i := 0; i < 21; i++ {
+		switch i % 3 {
+		case 0:
+			encode(c[i], c[i+21], c[i+42], 4)
+		case 1:
+			encode(c[i+21], c[i+42], c[i], 4)
+		case 2:
+			encode(c[i+42], c[i], c[i+21], 4)
+		}
+	}
+	encode(0, 0, c[63], 2)
+	return string(out)
+}
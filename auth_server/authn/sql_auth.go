@@ -0,0 +1,193 @@
+/*
+   Copyright 2016 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package authn
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/cesanta/docker_auth/auth_server/sql_session"
+	"github.com/golang/glog"
+)
+
+type SQLAuthConfig struct {
+	SQLConfig *sql_session.Config `yaml:"database,omitempty"`
+	// Users are looked up in the table by username column. Optional disabled column is a boolean.
+	Table          string `yaml:"table,omitempty"`
+	UsernameColumn string `yaml:"username_column,omitempty"`
+	PasswordColumn string `yaml:"password_column,omitempty"`
+	DisabledColumn string `yaml:"disabled_column,omitempty"`
+	// Alternatively, a query that takes the user name as the only parameter and returns
+	// the password hash and, optionally, the disabled flag.
+	Query string `yaml:"query,omitempty"`
+	// Create the table if it does not exist, with the configured table and column names.
+	CreateSchema bool `yaml:"create_schema,omitempty"`
+}
+
+type SQLAuth struct {
+	config     *SQLAuthConfig
+	db         *sql.DB
+	query      string
+	hashPolicy *PasswordHashConfig
+}
+
+// Validate ensures that any custom config options
+// in a Config are set correctly.
+func (c *SQLAuthConfig) Validate(configKey string) error {
+	if c.SQLConfig == nil {
+		return fmt.Errorf("%s.database is required", configKey)
+	}
+	if err := c.SQLConfig.Validate(configKey); err != nil {
+		return err
+	}
+	if c.Query != "" {
+		if c.CreateSchema {
+			return fmt.Errorf("%s.create_schema cannot be used with a custom query", configKey)
+		}
+		return nil
+	}
+	if c.Table == "" {
+		return fmt.Errorf("%s.{table,query} is required", configKey)
+	}
+	if c.UsernameColumn == "" {
+		c.UsernameColumn = "username"
+	}
+	if c.PasswordColumn == "" {
+		c.PasswordColumn = "password"
+	}
+	for _, name := range []string{c.Table, c.UsernameColumn, c.PasswordColumn, c.DisabledColumn} {
+		if name == "" {
+			continue
+		}
+		if err := sql_session.ValidateIdentifier(name); err != nil {
+			return fmt.Errorf("%s: %s", configKey, err)
+		}
+	}
+	return nil
+}
+
+func NewSQLAuth(c *SQLAuthConfig) (*SQLAuth, error) {
+	db, err := sql_session.New(c.SQLConfig)
+	if err != nil {
+		return nil, err
+	}
+	sa := &SQLAuth{config: c, db: db, query: c.Query}
+	if sa.query == "" {
+		columns := c.PasswordColumn
+		if c.DisabledColumn != "" {
+			columns += ", " + c.DisabledColumn
+		}
+		sa.query = c.SQLConfig.Rebind(fmt.Sprintf("SELECT %s FROM %s WHERE %s = ?", columns, c.Table, c.UsernameColumn))
+	}
+	if c.CreateSchema {
+		if err := sa.createSchema(); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("failed to create schema: %s", err)
+		}
+	}
+	return sa, nil
+}
+
+func (sa *SQLAuth) createSchema() error {
+	c := sa.config
+	columns := fmt.Sprintf("%s VARCHAR(255) NOT NULL PRIMARY KEY, %s VARCHAR(255)", c.UsernameColumn, c.PasswordColumn)
+	if c.DisabledColumn != "" {
+		columns += fmt.Sprintf(", %s BOOLEAN NOT NULL DEFAULT FALSE", c.DisabledColumn)
+	}
+	_, err := sa.db.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s)", c.Table, columns))
+	return err
+}
+
+func (sa *SQLAuth) Authenticate(account string, password PasswordString) (bool, Labels, error) {
+	glog.V(2).Infof("Checking user %s against SQL database", account)
+	hash, disabled, err := sa.lookup(account)
+	if err != nil {
+		return false, nil, err
+	}
+
+	// Users without a password cannot log in.
+	if !hash.Valid || hash.String == "" {
+		return false, nil, nil
+	}
+	if ok, _ := sa.hashPolicy.checkPassword("sql_auth", account, hash.String, password); !ok {
+		return false, nil, nil
+	}
+	if disabled.Valid && disabled.Bool {
+		glog.Warningf("User %s is disabled", account)
+		return false, nil, nil
+	}
+	return true, nil, nil
+}
+
+// CheckAccount tells whether the user exists, has a password and is not disabled.
+func (sa *SQLAuth) CheckAccount(account string) (bool, error) {
+	hash, disabled, err := sa.lookup(account)
+	if err != nil {
+		return false, err
+	}
+	return hash.Valid && hash.String != "" && !(disabled.Valid && disabled.Bool), nil
+}
+
+// lookup returns the password hash and the disabled flag of the user, NoMatch if there is no such user.
+func (sa *SQLAuth) lookup(account string) (hash sql.NullString, disabled sql.NullBool, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), sa.config.SQLConfig.Timeout)
+	defer cancel()
+	rows, err := sa.db.QueryContext(ctx, sa.query, account)
+	if err != nil {
+		return hash, disabled, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return hash, disabled, err
+		}
+		// If we connect and get no results we return a NoMatch so auth can fall-through
+		return hash, disabled, NoMatch
+	}
+	columns, err := rows.Columns()
+	if err != nil {
+		return hash, disabled, err
+	}
+	switch len(columns) {
+	case 1:
+		err = rows.Scan(&hash)
+	case 2:
+		err = rows.Scan(&hash, &disabled)
+	default:
+		err = fmt.Errorf("query returned %d columns, expected password and optionally disabled flag", len(columns))
+	}
+	return hash, disabled, err
+}
+
+// SetPasswordHashPolicy sets the policy weak hashes are reported against.
+// Hashes are not upgraded, the table may be shared with other applications.
+func (sa *SQLAuth) SetPasswordHashPolicy(p *PasswordHashConfig) {
+	sa.hashPolicy = p
+}
+
+func (sa *SQLAuth) HealthCheck() error {
+	return sa.db.Ping()
+}
+
+func (sa *SQLAuth) Stop() {
+	sa.db.Close()
+}
+
+func (sa *SQLAuth) Name() string {
+	return "SQL"
+}
@@ -0,0 +1,75 @@
+package authn
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cesanta/docker_auth/auth_server/sql_session"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestSQLAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sql_auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c := &SQLAuthConfig{
+		SQLConfig:      &sql_session.Config{Driver: "sqlite3", DSN: filepath.Join(dir, "users.db")},
+		Table:          "users",
+		DisabledColumn: "disabled",
+		CreateSchema:   true,
+	}
+	if err := c.Validate("sql_auth"); err != nil {
+		t.Fatalf("validation failed: %s", err)
+	}
+	sa, err := NewSQLAuth(c)
+	if err != nil {
+		t.Fatalf("failed to create authenticator: %s", err)
+	}
+	defer sa.Stop()
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	for _, u := range []struct {
+		name     string
+		hash     interface{}
+		disabled bool
+	}{
+		{"john", string(hash), false},
+		{"jane", string(hash), true},
+		{"jim", nil, false},
+	} {
+		if _, err := sa.db.Exec("INSERT INTO users (username, password, disabled) VALUES (?, ?, ?)", u.name, u.hash, u.disabled); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cases := []struct {
+		user, password string
+		result         bool
+		err            error
+	}{
+		{"john", "secret", true, nil},
+		{"john", "wrong", false, nil},
+		{"jane", "secret", false, nil},
+		{"jim", "", false, nil},
+		{"nobody", "secret", false, NoMatch},
+	}
+	for _, tc := range cases {
+		result, _, err := sa.Authenticate(tc.user, PasswordString(tc.password))
+		if result != tc.result || err != tc.err {
+			t.Errorf("%s: expected %t, %v, got %t, %v", tc.user, tc.result, tc.err, result, err)
+		}
+	}
+
+	// Custom query.
+	c.Query, c.Table, c.CreateSchema = "SELECT password FROM users WHERE username = ? AND NOT disabled", "", false
+	sa2, err := NewSQLAuth(c)
+	if err != nil {
+		t.Fatalf("failed to create authenticator: %s", err)
+	}
+	defer sa2.Stop()
+	if result, _, err := sa2.Authenticate("jane", "secret"); result || err != NoMatch {
+		t.Errorf("expected disabled user to be filtered out by the query, got %t, %v", result, err)
+	}
+}
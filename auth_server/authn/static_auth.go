@@ -18,15 +18,16 @@ package authn
 
 import (
 	"encoding/json"
-	"golang.org/x/crypto/bcrypt"
 )
 
 type Requirements struct {
 	Password *PasswordString `yaml:"password,omitempty" json:"password,omitempty"`
+	Labels   Labels          `yaml:"labels,omitempty" json:"labels,omitempty"`
 }
 
 type staticUsersAuth struct {
-	users map[string]*Requirements
+	users      map[string]*Requirements
+	hashPolicy *PasswordHashConfig
 }
 
 func (r Requirements) String() string {
@@ -44,16 +45,28 @@ func NewStaticUserAuth(users map[string]*Requirements) *staticUsersAuth {
 	return &staticUsersAuth{users: users}
 }
 
-func (sua *staticUsersAuth) Authenticate(user string, password PasswordString) (bool, error) {
+// SetPasswordHashPolicy sets the policy weak hashes are reported against.
+func (sua *staticUsersAuth) SetPasswordHashPolicy(p *PasswordHashConfig) {
+	sua.hashPolicy = p
+}
+
+func (sua *staticUsersAuth) Authenticate(user string, password PasswordString) (bool, Labels, error) {
 	reqs := sua.users[user]
 	if reqs == nil {
-		return false, NoMatch
+		return false, nil, NoMatch
 	}
 	if reqs.Password != nil {
-		if bcrypt.CompareHashAndPassword([]byte(*reqs.Password), []byte(password)) != nil {
-			return false, nil
+		if ok, _ := sua.hashPolicy.checkPassword("static", user, string(*reqs.Password), password); !ok {
+			return false, nil, nil
 		}
 	}
+	return true, reqs.Labels, nil
+}
+
+func (sua *staticUsersAuth) CheckAccount(user string) (bool, error) {
+	if sua.users[user] == nil {
+		return false, NoMatch
+	}
 	return true, nil
 }
 
@@ -17,25 +17,25 @@
 package authn
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"sort"
 	"time"
 
 	"golang.org/x/crypto/bcrypt"
 
+	"github.com/cesanta/docker_auth/auth_server/metrics"
 	"github.com/dchest/uniuri"
 	"github.com/golang/glog"
-	"github.com/syndtr/goleveldb/leveldb"
-)
-
-const (
-	tokenDBPrefix = "t:" // Keys in the database are t:email@example.com
 )
 
 var ExpiredToken = errors.New("expired token")
 
-// TokenDB stores tokens using LevelDB
+const tokenPurgeInterval = 1 * time.Hour
+
+// TokenDB stores tokens issued by OAuth providers and temporary Docker passwords derived from them.
 type TokenDB interface {
 	// GetValue takes a username returns the corresponding token
 	GetValue(string) (*TokenDBValue, error)
@@ -52,13 +52,29 @@ type TokenDB interface {
 	// and deletes the corresponding token from the DB
 	DeleteToken(string) error
 
-	// Composed from leveldb.DB
+	// ListTokens returns information about all stored tokens, sorted by user name.
+	ListTokens() ([]TokenInfo, error)
+
+	// ExpireToken marks the token of a user as expired,
+	// forcing revalidation with the provider on the next login.
+	ExpireToken(string) error
+
+	// PurgeExpired deletes tokens that expired more than maxAge ago
+	// and returns the number of deleted entries.
+	PurgeExpired(maxAge time.Duration) (int, error)
+
+	// Reencrypt encrypts tokens stored in plain text or with an old key with the current key
+	// and returns the number of changed entries.
+	Reencrypt() (int, error)
+
+	// Close releases the underlying store.
 	Close() error
 }
 
-// TokenDB stores tokens using LevelDB
+// TokenDBImpl implements TokenDB on top of a TokenStore.
 type TokenDBImpl struct {
-	*leveldb.DB
+	store TokenStore
+	enc   *TokenEncryptionConfig // nil if tokens are stored in plain text.
 }
 
 // TokenDBValue is stored in the database, JSON-serialized.
@@ -70,34 +86,179 @@ type TokenDBValue struct {
 	// DockerPassword is the temporary password we use to authenticate Docker users.
 	// Generated at the time of token creation, stored here as a BCrypt hash.
 	DockerPassword string `json:"docker_password,omitempty"`
+	// Labels of the user, returned when the password is validated. Set for passwords issued after MFA sign in.
+	Labels Labels `json:"labels,omitempty"`
+	// Encrypted holds AccessToken and RefreshToken if token encryption is enabled,
+	// they are decrypted when the value is read.
+	Encrypted *EncryptedTokens `json:"encrypted,omitempty"`
 }
 
-// NewTokenDB returns a new TokenDB structure
-func NewTokenDB(file string) (TokenDB, error) {
-	db, err := leveldb.OpenFile(file, nil)
-	return &TokenDBImpl{
-		DB: db,
-	}, err
+// TokenInfo describes a stored token without revealing any secrets.
+type TokenInfo struct {
+	User            string    `json:"user"`
+	TokenType       string    `json:"token_type,omitempty"`
+	ValidUntil      time.Time `json:"valid_until"`
+	Expired         bool      `json:"expired"`
+	HasRefreshToken bool      `json:"has_refresh_token"`
+	// ID of the key the tokens are encrypted with, empty if they are not encrypted.
+	KeyID string `json:"key_id,omitempty"`
+}
+
+func (v *TokenDBValue) Info(user string) TokenInfo {
+	ti := TokenInfo{
+		User:            user,
+		TokenType:       v.TokenType,
+		ValidUntil:      v.ValidUntil,
+		Expired:         time.Now().After(v.ValidUntil),
+		HasRefreshToken: v.RefreshToken != "",
+	}
+	if v.Encrypted != nil {
+		ti.KeyID = v.Encrypted.KeyID
+	}
+	return ti
+}
+
+// NewTokenDB returns a new TokenDB structure.
+// Tokens are stored in the configured store, or in LevelDB at file if none is configured.
+// If ec is not nil, upstream tokens are encrypted; ec must have been validated.
+func NewTokenDB(file string, sc *TokenStoreConfig, ec *TokenEncryptionConfig) (TokenDB, error) {
+	if ec != nil && len(ec.keys) == 0 {
+		return nil, errors.New("token encryption keys are not loaded")
+	}
+	store, err := OpenTokenStore(file, sc)
+	if err != nil {
+		return nil, err
+	}
+	return &TokenDBImpl{store: store, enc: ec}, nil
+}
+
+// Close releases the underlying store.
+func (db *TokenDBImpl) Close() error {
+	return db.store.Close()
 }
 
 func (db *TokenDBImpl) GetValue(user string) (*TokenDBValue, error) {
-	valueStr, err := db.Get(getDBKey(user), nil)
+	valueStr, err := db.store.Get(user)
 	switch {
-	case err == leveldb.ErrNotFound:
+	case err == nil && valueStr == nil:
+		metrics.TokenDBOp("get", "not_found")
 		return nil, nil
 	case err != nil:
+		metrics.TokenDBOp("get", "error")
 		glog.Errorf("error accessing token db: %s", err)
 		return nil, fmt.Errorf("error accessing token db: %s", err)
 	}
-	var dbv TokenDBValue
-	err = json.Unmarshal(valueStr, &dbv)
+	metrics.TokenDBOp("get", "ok")
+	dbv, err := db.decode(user, valueStr)
+	if err != nil {
+		glog.Errorf("bad DB value for %q: %s", user, err)
+		return nil, fmt.Errorf("bad DB value: %s", err)
+	}
+	if db.needsReencryption(dbv) {
+		// Values in plain text or encrypted with an old key migrate as they are read.
+		// Failure is not fatal, the value is tried again on the next read.
+		if _, err := db.reencrypt(user, valueStr, dbv); err != nil {
+			glog.Warningf("failed to re-encrypt token for %s: %s", user, err)
+		}
+	}
+	return dbv, nil
+}
+
+// needsReencryption tells whether a value is stored in plain text or with an old key.
+func (db *TokenDBImpl) needsReencryption(dbv *TokenDBValue) bool {
+	return db.enc != nil && (dbv.Encrypted == nil || dbv.Encrypted.KeyID != db.enc.currentKeyID())
+}
+
+// reencrypt stores a value that was read as data with the current key, unless it has changed in the meantime,
+// i.e. it has been stored with the current key already.
+func (db *TokenDBImpl) reencrypt(user string, data []byte, dbv *TokenDBValue) (bool, error) {
+	if cur, err := db.store.Get(user); err != nil {
+		return false, err
+	} else if !bytes.Equal(cur, data) {
+		return false, nil
+	}
+	if err := db.put(user, dbv); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Reencrypt encrypts all values stored in plain text or with an old key with the current key,
+// and returns the number of values changed. Values are also re-encrypted when they are read,
+// this migrates those of users who have not signed in since.
+func (db *TokenDBImpl) Reencrypt() (int, error) {
+	var users []string
+	err := db.store.ForEach(func(user string, data []byte) error {
+		users = append(users, user)
+		return nil
+	})
 	if err != nil {
-		glog.Errorf("bad DB value for %q (%q): %s", user, string(valueStr), err)
-		return nil, fmt.Errorf("bad DB value", err)
+		return 0, err
+	}
+	n := 0
+	for _, user := range users {
+		data, err := db.store.Get(user)
+		if err != nil {
+			return n, err
+		} else if data == nil {
+			continue
+		}
+		dbv, err := db.decode(user, data)
+		if err != nil {
+			return n, fmt.Errorf("%s: %s", user, err)
+		}
+		if !db.needsReencryption(dbv) {
+			continue
+		}
+		changed, err := db.reencrypt(user, data, dbv)
+		if err != nil {
+			return n, fmt.Errorf("failed to re-encrypt token for %s: %s", user, err)
+		} else if changed {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// decode parses a stored value and decrypts its secrets. On decryption error, the value is returned as well.
+func (db *TokenDBImpl) decode(user string, data []byte) (*TokenDBValue, error) {
+	var dbv TokenDBValue
+	if err := json.Unmarshal(data, &dbv); err != nil {
+		return nil, err
+	}
+	if dbv.Encrypted != nil {
+		if db.enc == nil {
+			return &dbv, errors.New("tokens are encrypted but token encryption is not configured")
+		}
+		if err := db.enc.decrypt(user, &dbv); err != nil {
+			return &dbv, err
+		}
 	}
 	return &dbv, nil
 }
 
+// put stores the value, encrypting its secrets if configured.
+func (db *TokenDBImpl) put(user string, v *TokenDBValue) error {
+	sv := *v
+	sv.Encrypted = nil
+	if db.enc != nil {
+		et, err := db.enc.encrypt(user, v)
+		if err != nil {
+			return fmt.Errorf("failed to encrypt tokens: %s", err)
+		}
+		sv.AccessToken, sv.RefreshToken, sv.Encrypted = "", "", et
+	}
+	data, err := json.Marshal(&sv)
+	if err != nil {
+		return err
+	}
+	if err = db.store.Put(user, data); err != nil {
+		return err
+	}
+	v.Encrypted = sv.Encrypted
+	return nil
+}
+
 func (db *TokenDBImpl) StoreToken(user string, v *TokenDBValue, updatePassword bool) (dp string, err error) {
 	if updatePassword {
 		dp = uniuri.New()
@@ -105,43 +266,129 @@ func (db *TokenDBImpl) StoreToken(user string, v *TokenDBValue, updatePassword b
 		v.DockerPassword = string(dph)
 	}
 
-	data, err := json.Marshal(v)
-	if err != nil {
-		return "", err
-	}
-	err = db.Put(getDBKey(user), data, nil)
+	err = db.put(user, v)
 	if err != nil {
+		metrics.TokenDBOp("store", "error")
 		glog.Errorf("failed to set token data for %s: %s", user, err)
+	} else {
+		metrics.TokenDBOp("store", "ok")
+		glog.V(2).Infof("Stored server tokens for %s, valid until %s", user, v.ValidUntil)
 	}
-	glog.V(2).Infof("Server tokens for %s: %s", user, string(data))
 	return
 }
 
 func (db *TokenDBImpl) ValidateToken(user string, password PasswordString) error {
 	dbv, err := db.GetValue(user)
 	if err != nil {
+		metrics.TokenDBOp("validate", "error")
 		return err
 	}
 	if dbv == nil {
+		metrics.TokenDBOp("validate", "no_match")
 		return NoMatch
 	}
 	if bcrypt.CompareHashAndPassword([]byte(dbv.DockerPassword), []byte(password)) != nil {
+		metrics.TokenDBOp("validate", "wrong_pass")
 		return WrongPass
 	}
 	if time.Now().After(dbv.ValidUntil) {
+		metrics.TokenDBOp("validate", "expired")
 		return ExpiredToken
 	}
+	metrics.TokenDBOp("validate", "ok")
 	return nil
 }
 
 func (db *TokenDBImpl) DeleteToken(user string) error {
 	glog.V(1).Infof("deleting token for %s", user)
-	if err := db.Delete(getDBKey(user), nil); err != nil {
+	if err := db.store.Delete(user); err != nil {
+		metrics.TokenDBOp("delete", "error")
 		return fmt.Errorf("failed to delete %s: %s", user, err)
 	}
+	metrics.TokenDBOp("delete", "ok")
 	return nil
 }
 
-func getDBKey(user string) []byte {
-	return []byte(fmt.Sprintf("%s%s", tokenDBPrefix, user))
+func (db *TokenDBImpl) ListTokens() ([]TokenInfo, error) {
+	var res []TokenInfo
+	err := db.store.ForEach(func(user string, data []byte) error {
+		dbv, err := db.decode(user, data)
+		if err != nil {
+			glog.Warningf("bad DB value for %q: %s", user, err)
+		}
+		if dbv != nil {
+			res = append(res, dbv.Info(user))
+		}
+		return nil
+	})
+	if err != nil {
+		metrics.TokenDBOp("list", "error")
+		return nil, fmt.Errorf("failed to list tokens: %s", err)
+	}
+	metrics.TokenDBOp("list", "ok")
+	sort.Slice(res, func(i, j int) bool { return res[i].User < res[j].User })
+	return res, nil
+}
+
+func (db *TokenDBImpl) ExpireToken(user string) error {
+	dbv, err := db.GetValue(user)
+	if err != nil {
+		return err
+	}
+	if dbv == nil {
+		return NoMatch
+	}
+	glog.V(1).Infof("expiring token for %s", user)
+	// Not the zero time, so that the entry is not purged right away.
+	dbv.ValidUntil = time.Now()
+	_, err = db.StoreToken(user, dbv, false)
+	return err
+}
+
+func (db *TokenDBImpl) PurgeExpired(maxAge time.Duration) (int, error) {
+	cutoff := time.Now().Add(-maxAge)
+	var users []string
+	err := db.store.ForEach(func(user string, data []byte) error {
+		var dbv TokenDBValue
+		if err := json.Unmarshal(data, &dbv); err != nil {
+			// Cannot be used anyway.
+			users = append(users, user)
+		} else if dbv.ValidUntil.Before(cutoff) {
+			users = append(users, user)
+		}
+		return nil
+	})
+	if err != nil {
+		metrics.TokenDBOp("purge", "error")
+		return 0, fmt.Errorf("failed to list tokens: %s", err)
+	}
+	n := 0
+	for _, user := range users {
+		if err := db.DeleteToken(user); err != nil {
+			metrics.TokenDBOp("purge", "error")
+			return n, err
+		}
+		n++
+	}
+	metrics.TokenDBOp("purge", "ok")
+	return n, nil
+}
+
+// purgeExpiredTokens periodically deletes tokens that expired more than maxAge ago, until stop is closed.
+func purgeExpiredTokens(db TokenDB, name string, maxAge time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(tokenPurgeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			n, err := db.PurgeExpired(maxAge)
+			if err != nil {
+				glog.Errorf("%s: failed to purge expired tokens: %s", name, err)
+			} else if n > 0 {
+				glog.Infof("%s: purged %d expired tokens", name, n)
+			}
+		case <-stop:
+			return
+		}
+	}
 }
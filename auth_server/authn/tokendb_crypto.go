@@ -0,0 +1,191 @@
+/*
+   Copyright 2016 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package authn
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// TokenEncryptionConfig enables encryption of upstream OAuth tokens in the token DB.
+// Key files contain 32 random bytes, base64-encoded. Values are encrypted with KeyFile,
+// OldKeyFiles are only used to decrypt values that have not been re-encrypted yet.
+type TokenEncryptionConfig struct {
+	KeyFile     string   `yaml:"key_file,omitempty"`
+	OldKeyFiles []string `yaml:"old_key_files,omitempty"`
+
+	keys []*tokenKey // Current key first.
+}
+
+// EncryptedTokens holds secrets of a TokenDBValue, encrypted with a random data key
+// which is in turn encrypted with the master key.
+type EncryptedTokens struct {
+	KeyID      string `json:"key_id"`
+	DataKey    []byte `json:"data_key"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+type tokenSecrets struct {
+	AccessToken  string `json:"access_token,omitempty"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+}
+
+type tokenKey struct {
+	id   string
+	aead cipher.AEAD
+}
+
+func (c *TokenEncryptionConfig) Validate(configKey string) error {
+	if c.KeyFile == "" {
+		return fmt.Errorf("%s.key_file is required", configKey)
+	}
+	c.keys = nil
+	for _, file := range append([]string{c.KeyFile}, c.OldKeyFiles...) {
+		k, err := loadTokenKey(file)
+		if err != nil {
+			return fmt.Errorf("%s: %s", configKey, err)
+		}
+		c.keys = append(c.keys, k)
+	}
+	return nil
+}
+
+func loadTokenKey(file string) (*tokenKey, error) {
+	contents, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("could not read %s: %s", file, err)
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(contents)))
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("%s must contain 32 bytes, base64-encoded", file)
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	id := sha256.Sum256(key)
+	return &tokenKey{id: hex.EncodeToString(id[:4]), aead: aead}, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts plaintext with a random nonce, which is prepended to the result.
+func seal(aead cipher.AEAD, plaintext, aad []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, aad), nil
+}
+
+func unseal(aead cipher.AEAD, data, aad []byte) ([]byte, error) {
+	if len(data) < aead.NonceSize() {
+		return nil, errors.New("ciphertext is too short")
+	}
+	return aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], aad)
+}
+
+func (c *TokenEncryptionConfig) currentKeyID() string {
+	return c.keys[0].id
+}
+
+// encrypt returns secrets of v encrypted with the current key.
+// Ciphertext is bound to the user, so values cannot be swapped between users.
+func (c *TokenEncryptionConfig) encrypt(user string, v *TokenDBValue) (*EncryptedTokens, error) {
+	plaintext, err := json.Marshal(&tokenSecrets{AccessToken: v.AccessToken, RefreshToken: v.RefreshToken})
+	if err != nil {
+		return nil, err
+	}
+	return c.seal(plaintext, []byte(user))
+}
+
+// seal encrypts plaintext with a random data key, which is in turn encrypted with the current key.
+func (c *TokenEncryptionConfig) seal(plaintext, aad []byte) (*EncryptedTokens, error) {
+	k := c.keys[0]
+	dataKey := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	et := &EncryptedTokens{KeyID: k.id}
+	if et.Ciphertext, err = seal(aead, plaintext, aad); err != nil {
+		return nil, err
+	}
+	if et.DataKey, err = seal(k.aead, dataKey, []byte(k.id)); err != nil {
+		return nil, err
+	}
+	return et, nil
+}
+
+// decrypt fills in secrets of v from v.Encrypted.
+func (c *TokenEncryptionConfig) decrypt(user string, v *TokenDBValue) error {
+	plaintext, err := c.unseal(v.Encrypted, []byte(user))
+	if err != nil {
+		return err
+	}
+	var ts tokenSecrets
+	if err := json.Unmarshal(plaintext, &ts); err != nil {
+		return fmt.Errorf("bad decrypted value: %s", err)
+	}
+	v.AccessToken, v.RefreshToken = ts.AccessToken, ts.RefreshToken
+	return nil
+}
+
+func (c *TokenEncryptionConfig) unseal(et *EncryptedTokens, aad []byte) ([]byte, error) {
+	var k *tokenKey
+	for _, kk := range c.keys {
+		if kk.id == et.KeyID {
+			k = kk
+			break
+		}
+	}
+	if k == nil {
+		return nil, fmt.Errorf("encrypted with unknown key %s", et.KeyID)
+	}
+	dataKey, err := unseal(k.aead, et.DataKey, []byte(k.id))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt data key: %s", err)
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := unseal(aead, et.Ciphertext, aad)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt tokens: %s", err)
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,131 @@
+package authn
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeTokenKey(t *testing.T, dir, name string) string {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(file, []byte(base64.StdEncoding.EncodeToString(key)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestTokenEncryption(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tokendb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := NewLevelDBTokenStore(filepath.Join(dir, "tokens.ldb"))
+	if err != nil {
+		t.Fatalf("failed to open LevelDB: %s", err)
+	}
+	defer store.Close()
+	key1, key2 := writeTokenKey(t, dir, "key1"), writeTokenKey(t, dir, "key2")
+
+	raw := func(user string) []byte {
+		data, err := store.Get(user)
+		if err != nil || data == nil {
+			t.Fatalf("%s: no value: %v", user, err)
+		}
+		return data
+	}
+	keyID := func(user string) string {
+		var v TokenDBValue
+		if err := json.Unmarshal(raw(user), &v); err != nil {
+			t.Fatal(err)
+		}
+		if v.Encrypted == nil {
+			return ""
+		}
+		return v.Encrypted.KeyID
+	}
+	check := func(db *TokenDBImpl, user string) {
+		v, err := db.GetValue(user)
+		if err != nil || v == nil || v.AccessToken != "at-"+user || v.RefreshToken != "rt-"+user {
+			t.Errorf("%s: unexpected value %+v, %v", user, v, err)
+		}
+	}
+
+	// Existing value in plain text.
+	plain := &TokenDBImpl{store: store}
+	if _, err := plain.StoreToken("old", &TokenDBValue{AccessToken: "at-old", RefreshToken: "rt-old", ValidUntil: time.Now()}, true); err != nil {
+		t.Fatal(err)
+	}
+
+	ec1 := &TokenEncryptionConfig{KeyFile: key1}
+	if err := ec1.Validate("token_encryption"); err != nil {
+		t.Fatalf("validation failed: %s", err)
+	}
+	db1 := &TokenDBImpl{store: store, enc: ec1}
+	if _, err := db1.StoreToken("new", &TokenDBValue{AccessToken: "at-new", RefreshToken: "rt-new", ValidUntil: time.Now()}, true); err != nil {
+		t.Fatal(err)
+	}
+	if data := raw("new"); bytes.Contains(data, []byte("at-new")) || bytes.Contains(data, []byte("rt-new")) {
+		t.Errorf("tokens are stored in plain text: %s", data)
+	}
+	check(db1, "new")
+	// Plain text value is readable, and encrypted on read.
+	check(db1, "old")
+	if n, err := db1.Reencrypt(); n != 0 || err != nil {
+		t.Errorf("Reencrypt = %d, %v", n, err)
+	}
+	check(db1, "old")
+	if data := raw("old"); bytes.Contains(data, []byte("at-old")) || keyID("old") != ec1.currentKeyID() {
+		t.Errorf("value was not re-encrypted: %s", data)
+	}
+	// Values cannot be moved between users.
+	if err := store.Put("moved", raw("new")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db1.GetValue("moved"); err == nil {
+		t.Errorf("value of another user was decrypted")
+	}
+	store.Delete("moved")
+
+	// Rotation: values are re-encrypted with the new key when read, the rest by Reencrypt.
+	ec2 := &TokenEncryptionConfig{KeyFile: key2, OldKeyFiles: []string{key1}}
+	if err := ec2.Validate("token_encryption"); err != nil {
+		t.Fatalf("validation failed: %s", err)
+	}
+	db2 := &TokenDBImpl{store: store, enc: ec2}
+	check(db2, "new")
+	if keyID("new") != ec2.currentKeyID() || keyID("new") == ec1.currentKeyID() {
+		t.Errorf("value was not re-encrypted with the new key")
+	}
+	if keyID("old") != ec1.currentKeyID() {
+		t.Errorf("value was re-encrypted without being read")
+	}
+	if n, err := db2.Reencrypt(); n != 1 || err != nil {
+		t.Errorf("Reencrypt = %d, %v", n, err)
+	}
+	check(db2, "old")
+	if keyID("old") != ec2.currentKeyID() {
+		t.Errorf("value was not re-encrypted with the new key")
+	}
+	if tokens, err := db2.ListTokens(); err != nil || len(tokens) != 2 || !tokens[0].HasRefreshToken || tokens[0].KeyID == "" {
+		t.Errorf("unexpected tokens: %+v, %v", tokens, err)
+	}
+
+	// Without the key, encrypted values cannot be read.
+	if _, err := (&TokenDBImpl{store: store, enc: ec1}).GetValue("new"); err == nil {
+		t.Errorf("value encrypted with an unknown key was decrypted")
+	}
+	if _, err := plain.GetValue("new"); err == nil {
+		t.Errorf("encrypted value was read without encryption configured")
+	}
+}
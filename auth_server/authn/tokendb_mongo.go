@@ -0,0 +1,119 @@
+/*
+   Copyright 2016 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package authn
+
+import (
+	"fmt"
+
+	"github.com/cesanta/docker_auth/auth_server/mgo_session"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// MongoTokenStoreConfig configures a token store in a MongoDB collection.
+// Documents have the user name as _id and the serialized token as value.
+type MongoTokenStoreConfig struct {
+	MongoConfig *mgo_session.Config `yaml:"dial_info,omitempty"`
+	Collection  string              `yaml:"collection,omitempty"`
+}
+
+func (c *MongoTokenStoreConfig) Validate(configKey string) error {
+	if c.MongoConfig == nil {
+		return fmt.Errorf("%s.dial_info is required", configKey)
+	}
+	if err := c.MongoConfig.Validate(configKey); err != nil {
+		return err
+	}
+	if c.Collection == "" {
+		c.Collection = "tokens"
+	}
+	return nil
+}
+
+type mongoTokenDoc struct {
+	User  string `bson:"_id"`
+	Value string `bson:"value"`
+}
+
+type mongoTokenStore struct {
+	config  *MongoTokenStoreConfig
+	session *mgo.Session
+}
+
+func NewMongoTokenStore(c *MongoTokenStoreConfig) (TokenStore, error) {
+	session, err := mgo_session.New(c.MongoConfig)
+	if err != nil {
+		return nil, err
+	}
+	return &mongoTokenStore{config: c, session: session}, nil
+}
+
+// withCollection runs f with a copy of the session, as the rest of MongoDB code does.
+func (s *mongoTokenStore) withCollection(f func(c *mgo.Collection) error) error {
+	tmp_session := s.session.Copy()
+	defer tmp_session.Close()
+	return f(tmp_session.DB(s.config.MongoConfig.DialInfo.Database).C(s.config.Collection))
+}
+
+func (s *mongoTokenStore) Get(user string) ([]byte, error) {
+	var doc mongoTokenDoc
+	err := s.withCollection(func(c *mgo.Collection) error {
+		return c.FindId(user).One(&doc)
+	})
+	if err == mgo.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return []byte(doc.Value), nil
+}
+
+func (s *mongoTokenStore) Put(user string, data []byte) error {
+	return s.withCollection(func(c *mgo.Collection) error {
+		_, err := c.UpsertId(user, bson.M{"$set": bson.M{"value": string(data)}})
+		return err
+	})
+}
+
+func (s *mongoTokenStore) Delete(user string) error {
+	err := s.withCollection(func(c *mgo.Collection) error {
+		return c.RemoveId(user)
+	})
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+func (s *mongoTokenStore) ForEach(f func(user string, data []byte) error) error {
+	return s.withCollection(func(c *mgo.Collection) error {
+		it := c.Find(nil).Iter()
+		var doc mongoTokenDoc
+		for it.Next(&doc) {
+			if err := f(doc.User, []byte(doc.Value)); err != nil {
+				it.Close()
+				return err
+			}
+		}
+		return it.Close()
+	})
+}
+
+func (s *mongoTokenStore) Close() error {
+	s.session.Close()
+	return nil
+}
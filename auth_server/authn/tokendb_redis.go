@@ -0,0 +1,156 @@
+/*
+   Copyright 2016 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package authn
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// RedisTokenStoreConfig configures a token store in Redis or any server speaking its protocol.
+type RedisTokenStoreConfig struct {
+	Addr         string        `yaml:"addr,omitempty"`
+	PasswordFile string        `yaml:"password_file,omitempty"`
+	DB           int           `yaml:"db,omitempty"`
+	KeyPrefix    string        `yaml:"key_prefix,omitempty"`
+	Timeout      time.Duration `yaml:"timeout,omitempty"`
+	MaxIdleConns int           `yaml:"max_idle_conns,omitempty"`
+}
+
+func (c *RedisTokenStoreConfig) Validate(configKey string) error {
+	if c.Addr == "" {
+		return fmt.Errorf("%s.addr is required", configKey)
+	}
+	if c.KeyPrefix == "" {
+		c.KeyPrefix = "docker_auth:token:"
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = 10 * time.Second
+	}
+	if c.MaxIdleConns <= 0 {
+		c.MaxIdleConns = 10
+	}
+	return nil
+}
+
+type redisTokenStore struct {
+	config *RedisTokenStoreConfig
+	pool   *redis.Pool
+}
+
+func NewRedisTokenStore(c *RedisTokenStoreConfig) (TokenStore, error) {
+	opts := []redis.DialOption{
+		redis.DialDatabase(c.DB),
+		redis.DialConnectTimeout(c.Timeout),
+		redis.DialReadTimeout(c.Timeout),
+		redis.DialWriteTimeout(c.Timeout),
+	}
+	if c.PasswordFile != "" {
+		passBuf, err := ioutil.ReadFile(c.PasswordFile)
+		if err != nil {
+			return nil, fmt.Errorf(`Failed to read password file "%s": %s`, c.PasswordFile, err)
+		}
+		opts = append(opts, redis.DialPassword(strings.TrimSpace(string(passBuf))))
+	}
+	s := &redisTokenStore{
+		config: c,
+		pool: &redis.Pool{
+			MaxIdle:     c.MaxIdleConns,
+			IdleTimeout: 5 * time.Minute,
+			Dial: func() (redis.Conn, error) {
+				return redis.Dial("tcp", c.Addr, opts...)
+			},
+			TestOnBorrow: func(conn redis.Conn, t time.Time) error {
+				if time.Since(t) < time.Minute {
+					return nil
+				}
+				_, err := conn.Do("PING")
+				return err
+			},
+		},
+	}
+	// Fail early if the server cannot be reached.
+	conn := s.pool.Get()
+	defer conn.Close()
+	if _, err := conn.Do("PING"); err != nil {
+		s.pool.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *redisTokenStore) do(cmd string, args ...interface{}) (interface{}, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+	return conn.Do(cmd, args...)
+}
+
+func (s *redisTokenStore) Get(user string) ([]byte, error) {
+	data, err := redis.Bytes(s.do("GET", s.config.KeyPrefix+user))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	return data, err
+}
+
+func (s *redisTokenStore) Put(user string, data []byte) error {
+	_, err := s.do("SET", s.config.KeyPrefix+user, data)
+	return err
+}
+
+func (s *redisTokenStore) Delete(user string) error {
+	_, err := s.do("DEL", s.config.KeyPrefix+user)
+	return err
+}
+
+func (s *redisTokenStore) ForEach(f func(user string, data []byte) error) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+	cursor := "0"
+	for {
+		res, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", s.config.KeyPrefix+"*", "COUNT", 100))
+		if err != nil {
+			return err
+		}
+		var keys []string
+		if _, err := redis.Scan(res, &cursor, &keys); err != nil {
+			return err
+		}
+		for _, key := range keys {
+			data, err := redis.Bytes(conn.Do("GET", key))
+			if err == redis.ErrNil {
+				continue // Deleted in the meantime.
+			} else if err != nil {
+				return err
+			}
+			if err := f(strings.TrimPrefix(key, s.config.KeyPrefix), data); err != nil {
+				return err
+			}
+		}
+		if cursor == "0" {
+			return nil
+		}
+	}
+}
+
+func (s *redisTokenStore) Close() error {
+	return s.pool.Close()
+}
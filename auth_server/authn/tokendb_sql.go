@@ -0,0 +1,133 @@
+/*
+   Copyright 2016 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package authn
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/cesanta/docker_auth/auth_server/sql_session"
+)
+
+// SQLTokenStoreConfig configures a token store in a SQL table with "username" and "value" columns.
+type SQLTokenStoreConfig struct {
+	SQLConfig    *sql_session.Config `yaml:"database,omitempty"`
+	Table        string              `yaml:"table,omitempty"`
+	CreateSchema bool                `yaml:"create_schema,omitempty"`
+}
+
+func (c *SQLTokenStoreConfig) Validate(configKey string) error {
+	if c.SQLConfig == nil {
+		return fmt.Errorf("%s.database is required", configKey)
+	}
+	if err := c.SQLConfig.Validate(configKey); err != nil {
+		return err
+	}
+	if c.Table == "" {
+		c.Table = "tokens"
+	}
+	if err := sql_session.ValidateIdentifier(c.Table); err != nil {
+		return fmt.Errorf("%s: %s", configKey, err)
+	}
+	return nil
+}
+
+type sqlTokenStore struct {
+	config                                    *SQLTokenStoreConfig
+	db                                        *sql.DB
+	getQuery, putQuery, deleteQuery, allQuery string
+}
+
+func NewSQLTokenStore(c *SQLTokenStoreConfig) (TokenStore, error) {
+	db, err := sql_session.New(c.SQLConfig)
+	if err != nil {
+		return nil, err
+	}
+	s := &sqlTokenStore{
+		config:      c,
+		db:          db,
+		getQuery:    c.SQLConfig.Rebind(fmt.Sprintf("SELECT value FROM %s WHERE username = ?", c.Table)),
+		deleteQuery: c.SQLConfig.Rebind(fmt.Sprintf("DELETE FROM %s WHERE username = ?", c.Table)),
+		allQuery:    fmt.Sprintf("SELECT username, value FROM %s", c.Table),
+	}
+	if c.SQLConfig.Driver == "mysql" {
+		s.putQuery = fmt.Sprintf("INSERT INTO %s (username, value) VALUES (?, ?) ON DUPLICATE KEY UPDATE value = VALUES(value)", c.Table)
+	} else {
+		s.putQuery = c.SQLConfig.Rebind(fmt.Sprintf("INSERT INTO %s (username, value) VALUES (?, ?) ON CONFLICT (username) DO UPDATE SET value = excluded.value", c.Table))
+	}
+	if c.CreateSchema {
+		if _, err := db.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (username VARCHAR(255) NOT NULL PRIMARY KEY, value TEXT NOT NULL)", c.Table)); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("failed to create schema: %s", err)
+		}
+	}
+	return s, nil
+}
+
+func (s *sqlTokenStore) context() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), s.config.SQLConfig.Timeout)
+}
+
+func (s *sqlTokenStore) Get(user string) ([]byte, error) {
+	ctx, cancel := s.context()
+	defer cancel()
+	var value string
+	err := s.db.QueryRowContext(ctx, s.getQuery, user).Scan(&value)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return []byte(value), nil
+}
+
+func (s *sqlTokenStore) Put(user string, data []byte) error {
+	ctx, cancel := s.context()
+	defer cancel()
+	_, err := s.db.ExecContext(ctx, s.putQuery, user, string(data))
+	return err
+}
+
+func (s *sqlTokenStore) Delete(user string) error {
+	ctx, cancel := s.context()
+	defer cancel()
+	_, err := s.db.ExecContext(ctx, s.deleteQuery, user)
+	return err
+}
+
+func (s *sqlTokenStore) ForEach(f func(user string, data []byte) error) error {
+	rows, err := s.db.Query(s.allQuery)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var user, value string
+		if err := rows.Scan(&user, &value); err != nil {
+			return err
+		}
+		if err := f(user, []byte(value)); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (s *sqlTokenStore) Close() error {
+	return s.db.Close()
+}
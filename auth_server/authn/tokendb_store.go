@@ -0,0 +1,196 @@
+/*
+   Copyright 2016 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package authn
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// TokenStore is where TokenDB keeps serialized values, keyed by user name.
+// Implementations must be goroutine-safe.
+type TokenStore interface {
+	// Get returns the value stored for the user, nil if there is none.
+	Get(user string) ([]byte, error)
+	Put(user string, data []byte) error
+	Delete(user string) error
+	// ForEach calls f for every stored value, stopping at the first error.
+	ForEach(f func(user string, data []byte) error) error
+	Close() error
+}
+
+// TokenStoreConfig selects the store for tokens, exactly one must be set.
+// A shared store (SQL, MongoDB or Redis) allows running multiple instances of the server.
+type TokenStoreConfig struct {
+	LevelDB string                 `yaml:"leveldb,omitempty"`
+	SQL     *SQLTokenStoreConfig   `yaml:"sql,omitempty"`
+	Mongo   *MongoTokenStoreConfig `yaml:"mongo,omitempty"`
+	Redis   *RedisTokenStoreConfig `yaml:"redis,omitempty"`
+}
+
+func (c *TokenStoreConfig) Validate(configKey string) error {
+	n := 0
+	if c.LevelDB != "" {
+		n++
+	}
+	if c.SQL != nil {
+		n++
+		if err := c.SQL.Validate(configKey + ".sql"); err != nil {
+			return err
+		}
+	}
+	if c.Mongo != nil {
+		n++
+		if err := c.Mongo.Validate(configKey + ".mongo"); err != nil {
+			return err
+		}
+	}
+	if c.Redis != nil {
+		n++
+		if err := c.Redis.Validate(configKey + ".redis"); err != nil {
+			return err
+		}
+	}
+	if n != 1 {
+		return fmt.Errorf("%s: exactly one of leveldb, sql, mongo or redis must be configured", configKey)
+	}
+	return nil
+}
+
+func (c *TokenStoreConfig) String() string {
+	switch {
+	case c.SQL != nil:
+		return fmt.Sprintf("SQL (%s, table %s)", c.SQL.SQLConfig.Driver, c.SQL.Table)
+	case c.Mongo != nil:
+		return fmt.Sprintf("MongoDB (collection %s)", c.Mongo.Collection)
+	case c.Redis != nil:
+		return fmt.Sprintf("Redis (%s)", c.Redis.Addr)
+	}
+	return c.LevelDB
+}
+
+// OpenTokenStore opens the configured store, or LevelDB at file if sc is nil.
+func OpenTokenStore(file string, sc *TokenStoreConfig) (TokenStore, error) {
+	switch {
+	case sc == nil:
+		return NewLevelDBTokenStore(file)
+	case sc.SQL != nil:
+		return NewSQLTokenStore(sc.SQL)
+	case sc.Mongo != nil:
+		return NewMongoTokenStore(sc.Mongo)
+	case sc.Redis != nil:
+		return NewRedisTokenStore(sc.Redis)
+	case sc.LevelDB != "":
+		return NewLevelDBTokenStore(sc.LevelDB)
+	}
+	return nil, errors.New("no token store configured")
+}
+
+const (
+	tokenDBPrefix = "t:" // Keys in the database are t:email@example.com
+)
+
+// LevelDB can only be opened once per process. During config reload the old and the new
+// server are running at the same time, so databases are shared and reference-counted.
+var (
+	openDBsLock sync.Mutex
+	openDBs     = make(map[string]*sharedLevelDB)
+)
+
+type sharedLevelDB struct {
+	db   *leveldb.DB
+	refs int
+}
+
+// levelDBTokenStore keeps tokens in a local LevelDB database.
+type levelDBTokenStore struct {
+	*leveldb.DB
+	file string
+}
+
+func NewLevelDBTokenStore(file string) (TokenStore, error) {
+	openDBsLock.Lock()
+	defer openDBsLock.Unlock()
+	sdb := openDBs[file]
+	if sdb == nil {
+		db, err := leveldb.OpenFile(file, nil)
+		if err != nil {
+			return nil, err
+		}
+		sdb = &sharedLevelDB{db: db}
+		openDBs[file] = sdb
+	}
+	sdb.refs++
+	return &levelDBTokenStore{
+		DB:   sdb.db,
+		file: file,
+	}, nil
+}
+
+func getDBKey(user string) []byte {
+	return []byte(fmt.Sprintf("%s%s", tokenDBPrefix, user))
+}
+
+func (s *levelDBTokenStore) Get(user string) ([]byte, error) {
+	data, err := s.DB.Get(getDBKey(user), nil)
+	if err == leveldb.ErrNotFound {
+		return nil, nil
+	}
+	return data, err
+}
+
+func (s *levelDBTokenStore) Put(user string, data []byte) error {
+	return s.DB.Put(getDBKey(user), data, nil)
+}
+
+func (s *levelDBTokenStore) Delete(user string) error {
+	return s.DB.Delete(getDBKey(user), nil)
+}
+
+func (s *levelDBTokenStore) ForEach(f func(user string, data []byte) error) error {
+	it := s.DB.NewIterator(util.BytesPrefix([]byte(tokenDBPrefix)), nil)
+	defer it.Release()
+	for it.Next() {
+		// Iterator reuses buffers, make a copy.
+		data := append([]byte{}, it.Value()...)
+		if err := f(strings.TrimPrefix(string(it.Key()), tokenDBPrefix), data); err != nil {
+			return err
+		}
+	}
+	return it.Error()
+}
+
+// Close releases the database, it is closed when no longer used by anyone.
+func (s *levelDBTokenStore) Close() error {
+	openDBsLock.Lock()
+	defer openDBsLock.Unlock()
+	sdb := openDBs[s.file]
+	if sdb == nil {
+		return nil
+	}
+	sdb.refs--
+	if sdb.refs > 0 {
+		return nil
+	}
+	delete(openDBs, s.file)
+	return sdb.db.Close()
+}
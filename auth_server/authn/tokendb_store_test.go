@@ -0,0 +1,159 @@
+package authn
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/cesanta/docker_auth/auth_server/sql_session"
+)
+
+func testTokenStore(t *testing.T, name string, s TokenStore) {
+	if data, err := s.Get("john"); data != nil || err != nil {
+		t.Errorf("%s: expected nothing, got %q, %v", name, data, err)
+	}
+	for _, u := range []string{"john", "jane@example.com"} {
+		if err := s.Put(u, []byte("v1:"+u)); err != nil {
+			t.Fatalf("%s: put failed: %s", name, err)
+		}
+	}
+	if err := s.Put("john", []byte("v2")); err != nil {
+		t.Fatalf("%s: overwrite failed: %s", name, err)
+	}
+	if data, err := s.Get("john"); string(data) != "v2" || err != nil {
+		t.Errorf("%s: expected v2, got %q, %v", name, data, err)
+	}
+	all := map[string]string{}
+	if err := s.ForEach(func(user string, data []byte) error {
+		all[user] = string(data)
+		return nil
+	}); err != nil {
+		t.Errorf("%s: iteration failed: %s", name, err)
+	}
+	if expected := map[string]string{"john": "v2", "jane@example.com": "v1:jane@example.com"}; !reflect.DeepEqual(all, expected) {
+		t.Errorf("%s: expected %v, got %v", name, expected, all)
+	}
+	if err := s.Delete("john"); err != nil {
+		t.Errorf("%s: delete failed: %s", name, err)
+	}
+	if data, err := s.Get("john"); data != nil || err != nil {
+		t.Errorf("%s: expected deleted value to be gone, got %q, %v", name, data, err)
+	}
+	if err := s.Delete("nobody"); err != nil {
+		t.Errorf("%s: deleting a missing value should not fail: %s", name, err)
+	}
+
+	db := &TokenDBImpl{store: s}
+	v := &TokenDBValue{TokenType: "Bearer", AccessToken: "at", ValidUntil: time.Now().Add(time.Hour)}
+	dp, err := db.StoreToken("jim", v, true)
+	if err != nil || dp == "" {
+		t.Fatalf("%s: failed to store token: %v", name, err)
+	}
+	if err := db.ValidateToken("jim", PasswordString(dp)); err != nil {
+		t.Errorf("%s: validation failed: %s", name, err)
+	}
+	if err := db.ValidateToken("jim", "wrong"); err != WrongPass {
+		t.Errorf("%s: expected wrong password, got %v", name, err)
+	}
+}
+
+func TestTokenStores(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tokendb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ls, err := NewLevelDBTokenStore(filepath.Join(dir, "tokens.ldb"))
+	if err != nil {
+		t.Fatalf("failed to open LevelDB: %s", err)
+	}
+	testTokenStore(t, "leveldb", ls)
+	ls.Close()
+
+	sc := &SQLTokenStoreConfig{
+		SQLConfig:    &sql_session.Config{Driver: "sqlite3", DSN: filepath.Join(dir, "tokens.db")},
+		CreateSchema: true,
+	}
+	if err := sc.Validate("sql"); err != nil {
+		t.Fatalf("validation failed: %s", err)
+	}
+	ss, err := NewSQLTokenStore(sc)
+	if err != nil {
+		t.Fatalf("failed to open SQL store: %s", err)
+	}
+	testTokenStore(t, "sql", ss)
+	ss.Close()
+
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("failed to start Redis stand-in: %s", err)
+	}
+	defer mr.Close()
+	rc := &RedisTokenStoreConfig{Addr: mr.Addr()}
+	if err := rc.Validate("redis"); err != nil {
+		t.Fatalf("validation failed: %s", err)
+	}
+	rs, err := NewRedisTokenStore(rc)
+	if err != nil {
+		t.Fatalf("failed to open Redis store: %s", err)
+	}
+	testTokenStore(t, "redis", rs)
+	rs.Close()
+}
+
+func TestTokenDBAdmin(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tokendb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := NewTokenDB(filepath.Join(dir, "tokens.ldb"), nil, nil)
+	if err != nil {
+		t.Fatalf("failed to open token DB: %s", err)
+	}
+	defer db.Close()
+	now := time.Now()
+	for user, validUntil := range map[string]time.Time{
+		"active":  now.Add(time.Hour),
+		"expired": now.Add(-time.Hour),
+		"dead":    now.Add(-48 * time.Hour),
+	} {
+		v := &TokenDBValue{TokenType: "Bearer", AccessToken: "at", RefreshToken: "rt", ValidUntil: validUntil}
+		if _, err := db.StoreToken(user, v, true); err != nil {
+			t.Fatalf("failed to store token: %s", err)
+		}
+	}
+	tokens, err := db.ListTokens()
+	if err != nil || len(tokens) != 3 {
+		t.Fatalf("expected 3 tokens, got %v, %v", tokens, err)
+	}
+	if ti := tokens[0]; ti.User != "active" || ti.Expired || !ti.HasRefreshToken || ti.TokenType != "Bearer" {
+		t.Errorf("unexpected token info: %+v", ti)
+	}
+	if !tokens[1].Expired || !tokens[2].Expired {
+		t.Errorf("expected tokens to be expired: %+v", tokens)
+	}
+
+	if err := db.ExpireToken("active"); err != nil {
+		t.Errorf("failed to expire token: %s", err)
+	}
+	if v, _ := db.GetValue("active"); v == nil || !v.Info("active").Expired {
+		t.Errorf("token was not expired: %+v", v)
+	}
+	if err := db.ExpireToken("nobody"); err != NoMatch {
+		t.Errorf("expected no match, got %v", err)
+	}
+
+	// Only tokens that expired long ago are purged, forced expiration does not make them eligible.
+	if n, err := db.PurgeExpired(24 * time.Hour); n != 1 || err != nil {
+		t.Errorf("expected 1 token to be purged, got %d, %v", n, err)
+	}
+	if tokens, _ := db.ListTokens(); len(tokens) != 2 || tokens[0].User != "active" || tokens[1].User != "expired" {
+		t.Errorf("unexpected tokens after purge: %+v", tokens)
+	}
+}
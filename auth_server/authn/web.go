@@ -0,0 +1,248 @@
+/*
+   Copyright 2016 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package authn
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	oauthStateCookieName = "docker_auth_oauth"
+	csrfCookieName       = "docker_auth_csrf"
+	oauthStateTTL        = 10 * time.Minute
+)
+
+// LoginHandler is called by web authenticators (Google, GitHub) once a user has signed in
+// with the provider and has been issued a Docker password.
+type LoginHandler func(rw http.ResponseWriter, req *http.Request, user, password string)
+
+func textLoginHandler(rw http.ResponseWriter, req *http.Request, user, password string) {
+	fmt.Fprintf(rw, `Server logged in; now run "docker login", use %s as login and %s as password.`, user, password)
+}
+
+// redirectURI returns the URL the provider should send the user back to.
+// Unless configured, it is derived from the request.
+func (ws *WebSecurity) redirectURI(req *http.Request, configured, path string) string {
+	if configured != "" {
+		return configured
+	}
+	return fmt.Sprintf("%s://%s%s", ws.Scheme(req), req.Host, path)
+}
+
+// Scheme returns the scheme the client used for the request. X-Forwarded-Proto is only
+// taken into account for requests from trusted proxies, see SetTrustedProxy.
+func (ws *WebSecurity) Scheme(req *http.Request) string {
+	if req.TLS != nil {
+		return "https"
+	}
+	if ws.trustedProxy != nil && ws.trustedProxy(req) && req.Header.Get("X-Forwarded-Proto") == "https" {
+		return "https"
+	}
+	return "http"
+}
+
+// validateRedirectURI checks a configured redirect URI: it must be an absolute https URL
+// (http is only allowed for loopback addresses) of path, without query or fragment.
+func validateRedirectURI(uri, path string) error {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return err
+	}
+	host := u.Hostname()
+	loopback := host == "localhost"
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		loopback = true
+	}
+	switch {
+	case u.Scheme != "https" && !(u.Scheme == "http" && loopback):
+		return fmt.Errorf("%s must use https", uri)
+	case host == "":
+		return fmt.Errorf("%s has no host", uri)
+	case u.RawQuery != "" || u.Fragment != "" || u.User != nil:
+		return fmt.Errorf("%s must not have user info, query or fragment", uri)
+	case !strings.HasSuffix(u.Path, path):
+		return fmt.Errorf("path of %s must end with %s", uri, path)
+	}
+	return nil
+}
+
+// WebSecurity signs OAuth state and CSRF tokens of the web sign in flows.
+// Instances of the server behind a load balancer must use the same key.
+type WebSecurity struct {
+	key           []byte
+	secureCookies bool
+	trustedProxy  func(req *http.Request) bool
+}
+
+// NewWebSecurity creates a WebSecurity with the key. Cookies are marked secure if secureCookies is set
+// or the request was made over TLS.
+func NewWebSecurity(key []byte, secureCookies bool) *WebSecurity {
+	return &WebSecurity{key: key, secureCookies: secureCookies}
+}
+
+// SetTrustedProxy sets the function that tells whether a request comes from a proxy
+// that is trusted to set X-Forwarded-Proto. Without it, the header is ignored.
+func (ws *WebSecurity) SetTrustedProxy(f func(req *http.Request) bool) {
+	ws.trustedProxy = f
+}
+
+func newRandomWebSecurity() *WebSecurity {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return NewWebSecurity(key, false)
+}
+
+// oauthState is passed to the provider and comes back with the code.
+// Nonce must also match the cookie set when the flow was started, which binds the flow to the browser.
+type oauthState struct {
+	Provider    string `json:"p"`
+	Nonce       string `json:"n"`
+	RedirectURI string `json:"r,omitempty"`
+	Expires     int64  `json:"e"`
+}
+
+func randomString() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// mac returns the signature of value for the purpose, so that values are not interchangeable between purposes.
+func (ws *WebSecurity) mac(purpose, value string) string {
+	h := hmac.New(sha256.New, ws.key)
+	h.Write([]byte(purpose + ":" + value))
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
+
+func (ws *WebSecurity) setCookie(rw http.ResponseWriter, req *http.Request, name, value string, maxAge time.Duration) {
+	c := &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   ws.secureCookies || req.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if maxAge > 0 {
+		c.MaxAge = int(maxAge.Seconds())
+	} else if maxAge < 0 {
+		c.MaxAge = -1
+	}
+	http.SetCookie(rw, c)
+}
+
+// pkceVerifier derives the PKCE code verifier of the flow, so that it does not have to be stored.
+func (ws *WebSecurity) pkceVerifier(nonce string) string {
+	return ws.mac("pkce", nonce)
+}
+
+func pkceChallenge(verifier string) string {
+	h := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(h[:])
+}
+
+// startOAuth begins a sign in flow with the provider. It returns the state to pass to the provider
+// and the PKCE code verifier.
+func (ws *WebSecurity) startOAuth(rw http.ResponseWriter, req *http.Request, provider, redirectURI string) (state, verifier string) {
+	s := &oauthState{
+		Provider:    provider,
+		Nonce:       randomString(),
+		RedirectURI: redirectURI,
+		Expires:     time.Now().Add(oauthStateTTL).Unix(),
+	}
+	payload, _ := json.Marshal(s)
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	ws.setCookie(rw, req, oauthStateCookieName, s.Nonce, oauthStateTTL)
+	return encoded + "." + ws.mac("state", encoded), ws.pkceVerifier(s.Nonce)
+}
+
+// finishOAuth checks the state returned by the provider. State can only be used once.
+// If the redirect URI was not configured, the callback must arrive at the host the flow was started at.
+func (ws *WebSecurity) finishOAuth(rw http.ResponseWriter, req *http.Request, provider, configuredRedirectURI string) (*oauthState, error) {
+	parts := strings.Split(req.URL.Query().Get("state"), ".")
+	if len(parts) != 2 || !hmac.Equal([]byte(parts[1]), []byte(ws.mac("state", parts[0]))) {
+		return nil, errors.New("invalid state")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errors.New("invalid state")
+	}
+	var s oauthState
+	if err := json.Unmarshal(payload, &s); err != nil {
+		return nil, errors.New("invalid state")
+	}
+	if s.Provider != provider {
+		return nil, fmt.Errorf("state was issued for %s", s.Provider)
+	}
+	if time.Now().Unix() >= s.Expires {
+		return nil, errors.New("state has expired")
+	}
+	c, err := req.Cookie(oauthStateCookieName)
+	if err != nil || !hmac.Equal([]byte(c.Value), []byte(s.Nonce)) {
+		return nil, errors.New("sign in was started in another browser")
+	}
+	ws.setCookie(rw, req, oauthStateCookieName, "", -1)
+	if s.RedirectURI != "" {
+		u, err := url.Parse(s.RedirectURI)
+		if err != nil || u.Path != req.URL.Path || (configuredRedirectURI == "" && u.Host != req.Host) {
+			return nil, errors.New("callback does not match redirect URI")
+		}
+		if configuredRedirectURI != "" && s.RedirectURI != configuredRedirectURI {
+			return nil, errors.New("redirect URI has changed")
+		}
+	}
+	return &s, nil
+}
+
+// CSRFToken returns the token that requests changing state must carry, e.g. in a form field.
+// The token is tied to a random cookie which is set if the browser does not have it yet.
+func (ws *WebSecurity) CSRFToken(rw http.ResponseWriter, req *http.Request) string {
+	var nonce string
+	if c, err := req.Cookie(csrfCookieName); err == nil && c.Value != "" {
+		nonce = c.Value
+	} else {
+		nonce = randomString()
+		ws.setCookie(rw, req, csrfCookieName, nonce, 0)
+		// Make the cookie visible to code checking the same request later.
+		req.AddCookie(&http.Cookie{Name: csrfCookieName, Value: nonce})
+	}
+	return ws.mac("csrf", nonce)
+}
+
+// CheckCSRFToken verifies the token sent with the request.
+func (ws *WebSecurity) CheckCSRFToken(req *http.Request, token string) bool {
+	c, err := req.Cookie(csrfCookieName)
+	if err != nil || c.Value == "" || token == "" {
+		return false
+	}
+	return hmac.Equal([]byte(token), []byte(ws.mac("csrf", c.Value)))
+}
@@ -0,0 +1,129 @@
+package authn
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestOAuthState(t *testing.T) {
+	ws := newRandomWebSecurity()
+	start := func(provider, ru string) (string, string, *http.Cookie) {
+		rw := httptest.NewRecorder()
+		state, verifier := ws.startOAuth(rw, httptest.NewRequest("GET", "https://auth.example.com/google_auth", nil), provider, ru)
+		return state, verifier, rw.Result().Cookies()[0]
+	}
+	finish := func(target, state string, c *http.Cookie, configured string) (*oauthState, error) {
+		req := httptest.NewRequest("GET", target+"?code=xyz&state="+url.QueryEscape(state), nil)
+		if c != nil {
+			req.AddCookie(c)
+		}
+		return ws.finishOAuth(httptest.NewRecorder(), req, "google_auth", configured)
+	}
+	const ru = "https://auth.example.com/google_auth"
+
+	state, verifier, c := start("google_auth", ru)
+	if !c.HttpOnly || c.SameSite != http.SameSiteLaxMode {
+		t.Errorf("unexpected state cookie: %+v", c)
+	}
+	s, err := finish(ru, state, c, "")
+	if err != nil {
+		t.Fatalf("valid state rejected: %s", err)
+	}
+	if s.RedirectURI != ru || ws.pkceVerifier(s.Nonce) != verifier || len(verifier) < 43 {
+		t.Errorf("unexpected state: %+v, verifier %q", s, verifier)
+	}
+
+	if _, err := finish(ru, state, nil, ""); err == nil {
+		t.Errorf("state accepted without cookie")
+	}
+	_, _, otherCookie := start("google_auth", ru)
+	if _, err := finish(ru, state, otherCookie, ""); err == nil {
+		t.Errorf("state accepted with cookie of another flow")
+	}
+	if _, err := finish(ru, state+"x", c, ""); err == nil {
+		t.Errorf("tampered state accepted")
+	}
+	if _, err := finish("https://evil.example.com/google_auth", state, c, ""); err == nil {
+		t.Errorf("state accepted on another host")
+	}
+	if _, err := finish(ru, state, c, "https://other.example.com/google_auth"); err == nil {
+		t.Errorf("state accepted after redirect URI change")
+	}
+	ghState, _, ghCookie := start("github_auth", "")
+	if _, err := finish(ru, ghState, ghCookie, ""); err == nil {
+		t.Errorf("state of another provider accepted")
+	}
+	if _, err := (&WebSecurity{key: []byte("another key")}).finishOAuth(httptest.NewRecorder(), httptest.NewRequest("GET", ru+"?state="+url.QueryEscape(state), nil), "google_auth", ""); err == nil {
+		t.Errorf("state signed with another key accepted")
+	}
+}
+
+func TestCSRFToken(t *testing.T) {
+	ws := newRandomWebSecurity()
+	rw := httptest.NewRecorder()
+	token := ws.CSRFToken(rw, httptest.NewRequest("GET", "/", nil))
+	c := rw.Result().Cookies()[0]
+
+	req := httptest.NewRequest("POST", "/", nil)
+	if ws.CheckCSRFToken(req, token) {
+		t.Errorf("token accepted without cookie")
+	}
+	req.AddCookie(c)
+	if !ws.CheckCSRFToken(req, token) {
+		t.Errorf("valid token rejected")
+	}
+	if ws.CheckCSRFToken(req, "") || ws.CheckCSRFToken(req, c.Value) {
+		t.Errorf("invalid token accepted")
+	}
+	if again := ws.CSRFToken(httptest.NewRecorder(), req); again != token {
+		t.Errorf("token changed while cookie is set")
+	}
+}
+
+func TestValidateRedirectURI(t *testing.T) {
+	cases := []struct {
+		uri string
+		ok  bool
+	}{
+		{"https://auth.example.com/google_auth", true},
+		{"https://auth.example.com:5001/docker/google_auth", true},
+		{"http://localhost:5001/google_auth", true},
+		{"http://127.0.0.1/google_auth", true},
+		{"http://auth.example.com/google_auth", false},
+		{"https://auth.example.com/github_auth", false},
+		{"https://auth.example.com/google_auth?x=1", false},
+		{"https://auth.example.com/google_auth#x", false},
+		{"/google_auth", false},
+	}
+	for _, c := range cases {
+		err := validateRedirectURI(c.uri, "/google_auth")
+		if c.ok && err != nil {
+			t.Errorf("%s: expected to pass, got %s", c.uri, err)
+		} else if !c.ok && err == nil {
+			t.Errorf("%s: expected to fail, but it passed", c.uri)
+		}
+	}
+}
+
+func TestRedirectURI(t *testing.T) {
+	ws := newRandomWebSecurity()
+	req := httptest.NewRequest("GET", "http://auth.example.com/google_auth", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("X-Forwarded-Proto", "https")
+	if ru := ws.redirectURI(req, "", "/google_auth"); ru != "http://auth.example.com/google_auth" {
+		t.Errorf("X-Forwarded-Proto honoured without trusted proxies: %s", ru)
+	}
+	ws.SetTrustedProxy(func(req *http.Request) bool { return req.RemoteAddr == "10.0.0.1:1234" })
+	if ru := ws.redirectURI(req, "", "/google_auth"); ru != "https://auth.example.com/google_auth" {
+		t.Errorf("X-Forwarded-Proto ignored from a trusted proxy: %s", ru)
+	}
+	req.RemoteAddr = "6.6.6.6:1234"
+	if ru := ws.redirectURI(req, "", "/google_auth"); ru != "http://auth.example.com/google_auth" {
+		t.Errorf("X-Forwarded-Proto honoured from a client: %s", ru)
+	}
+	if ru := ws.redirectURI(req, "https://configured/google_auth", "/google_auth"); ru != "https://configured/google_auth" {
+		t.Errorf("configured URI not used: %s", ru)
+	}
+}
@@ -16,9 +16,9 @@ import (
 type ACL []ACLEntry
 
 type ACLEntry struct {
-	Match   *MatchConditions `yaml:"match"`
-	Actions *[]string        `yaml:"actions,flow"`
-	Comment *string          `yaml:"comment,omitempty"`
+	Match   *MatchConditions `yaml:"match" json:"match"`
+	Actions *[]string        `yaml:"actions,flow" json:"actions"`
+	Comment *string          `yaml:"comment,omitempty" json:"comment,omitempty"`
 }
 
 type MatchConditions struct {
@@ -26,6 +26,8 @@ type MatchConditions struct {
 	Type    *string `yaml:"type,omitempty" json:"type,omitempty"`
 	Name    *string `yaml:"name,omitempty" json:"name,omitempty"`
 	IP      *string `yaml:"ip,omitempty" json:"ip,omitempty"`
+	// Patterns for labels returned by the authenticator, at least one value of each label must match.
+	Labels map[string]string `yaml:"labels,omitempty" json:"labels,omitempty"`
 }
 
 type aclAuthorizer struct {
@@ -71,6 +73,11 @@ func validateMatchConditions(mc *MatchConditions) error {
 			return fmt.Errorf("invalid pattern %q: %s", *p, err)
 		}
 	}
+	for l, p := range mc.Labels {
+		if err := validatePattern(p); err != nil {
+			return fmt.Errorf("invalid pattern %q for label %q: %s", p, l, err)
+		}
+	}
 	if mc.IP != nil {
 		_, err := parseIPPattern(*mc.IP)
 		if err != nil {
@@ -93,17 +100,34 @@ func NewACLAuthorizer(acl ACL) (Authorizer, error) {
 }
 
 func (aa *aclAuthorizer) Authorize(ai *AuthRequestInfo) ([]string, error) {
-	for _, e := range aa.acl {
+	actions, _, err := aa.AuthorizeRule(ai)
+	return actions, err
+}
+
+func (aa *aclAuthorizer) AuthorizeRule(ai *AuthRequestInfo) ([]string, *ACLEntry, error) {
+	for i := range aa.acl {
+		e := &aa.acl[i]
 		matched := e.Matches(ai)
 		if matched {
 			glog.V(2).Infof("%s matched %s (Comment: %s)", ai, e, e.Comment)
 			if len(*e.Actions) == 1 && (*e.Actions)[0] == "*" {
-				return ai.Actions, nil
+				return ai.Actions, e, nil
 			}
-			return StringSetIntersection(ai.Actions, *e.Actions), nil
+			return StringSetIntersection(ai.Actions, *e.Actions), e, nil
+		}
+	}
+	return nil, nil, NoMatch
+}
+
+func (aa *aclAuthorizer) AccountRules(account, authnBackend string) ([]ACLEntry, error) {
+	vars := []string{"${account}", regexp.QuoteMeta(account)}
+	var res []ACLEntry
+	for _, e := range aa.acl {
+		if matchString(e.Match.Account, account, vars) {
+			res = append(res, e)
 		}
 	}
-	return nil, NoMatch
+	return res, nil
 }
 
 func (aa *aclAuthorizer) Stop() {
@@ -151,6 +175,22 @@ func matchIP(ipp *string, ip net.IP) bool {
 	return ipnet.Contains(ip)
 }
 
+func matchLabels(patterns map[string]string, labels map[string][]string, vars []string) bool {
+	for l, p := range patterns {
+		matched := false
+		for _, v := range labels[l] {
+			if matchString(&p, v, vars) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
 var captureGroupRegex = regexp.MustCompile(`\$\{(.+?):(\d+)\}`)
 
 func getField(i interface{}, name string) (string, bool) {
@@ -203,7 +243,8 @@ func (mc *MatchConditions) Matches(ai *AuthRequestInfo) bool {
 	return matchString(mc.Account, ai.Account, vars) &&
 		matchString(mc.Type, ai.Type, vars) &&
 		matchString(mc.Name, ai.Name, vars) &&
-		matchIP(mc.IP, ai.IP)
+		matchIP(mc.IP, ai.IP) &&
+		matchLabels(mc.Labels, ai.Labels, vars)
 }
 
 func (e *ACLEntry) Matches(ai *AuthRequestInfo) bool {
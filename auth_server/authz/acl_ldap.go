@@ -0,0 +1,292 @@
+package authz
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cesanta/docker_auth/auth_server/authn"
+	"github.com/go-ldap/ldap"
+	"github.com/golang/glog"
+)
+
+// ACLLDAPConfig configures authorization based on group membership in an LDAP directory.
+// Connection and user search settings are the same as for LDAP authentication.
+// Groups are either looked up with group_filter under group_base_dn, or taken from user's memberOf attribute.
+type ACLLDAPConfig struct {
+	authn.LDAPAuthConfig `yaml:",inline"`
+	// Attribute of the group entry that holds its name, "cn" by default.
+	GroupAttribute string        `yaml:"group_attribute,omitempty"`
+	CacheTTL       time.Duration `yaml:"cache_ttl,omitempty"`
+	Rules          []ACLLDAPRule `yaml:"rules,omitempty"`
+}
+
+// ACLLDAPRule applies an ACL entry to members of groups with names matching the template.
+// Variables in the template, e.g. "registry-${project}-push", are captured and
+// expanded in the match conditions of the entry.
+type ACLLDAPRule struct {
+	Group    string `yaml:"group"`
+	ACLEntry `yaml:",inline"`
+
+	groupRegex *regexp.Regexp
+	vars       []string
+}
+
+const maxLDAPCacheEntries = 10000
+
+var templateVarRegex = regexp.MustCompile(`\$\{(\w+)\}`)
+
+// compile turns the group name template into a regex with a capture group per variable.
+func (r *ACLLDAPRule) compile() error {
+	re, vars := "^", []string{}
+	last := 0
+	for _, m := range templateVarRegex.FindAllStringSubmatchIndex(r.Group, -1) {
+		re += regexp.QuoteMeta(r.Group[last:m[0]]) + "(.+?)"
+		vars = append(vars, r.Group[m[2]:m[3]])
+		last = m[1]
+	}
+	re += regexp.QuoteMeta(r.Group[last:]) + "$"
+	rx, err := regexp.Compile(re)
+	if err != nil {
+		return err
+	}
+	r.groupRegex, r.vars = rx, vars
+	return nil
+}
+
+// expand returns the entry for the group, nil if the group does not match the rule.
+func (r *ACLLDAPRule) expand(group string) *ACLEntry {
+	m := r.groupRegex.FindStringSubmatch(group)
+	if m == nil {
+		return nil
+	}
+	var repl []string
+	for i, v := range r.vars {
+		repl = append(repl, "${"+v+"}", regexp.QuoteMeta(m[i+1]))
+	}
+	replacer := strings.NewReplacer(repl...)
+	mc := &MatchConditions{}
+	for _, f := range []struct{ src, dst **string }{
+		{&r.Match.Account, &mc.Account},
+		{&r.Match.Type, &mc.Type},
+		{&r.Match.Name, &mc.Name},
+		{&r.Match.IP, &mc.IP},
+	} {
+		if *f.src != nil {
+			v := replacer.Replace(**f.src)
+			*f.dst = &v
+		}
+	}
+	if r.Match.Labels != nil {
+		mc.Labels = make(map[string]string, len(r.Match.Labels))
+		for k, v := range r.Match.Labels {
+			mc.Labels[k] = replacer.Replace(v)
+		}
+	}
+	comment := fmt.Sprintf("LDAP group %s", group)
+	if r.Comment != nil {
+		comment = fmt.Sprintf("%s (%s)", *r.Comment, comment)
+	}
+	return &ACLEntry{Match: mc, Actions: r.Actions, Comment: &comment}
+}
+
+func (c *ACLLDAPConfig) Validate(configKey string) error {
+	if err := c.LDAPAuthConfig.Validate(); err != nil {
+		return fmt.Errorf("%s: %s", configKey, err)
+	}
+	if c.Filter == "" {
+		return fmt.Errorf("%s.filter is required", configKey)
+	}
+	if c.GroupFilter != "" && c.GroupBaseDN == "" {
+		return fmt.Errorf("%s.group_base_dn is required with group_filter", configKey)
+	}
+	if c.GroupAttribute == "" {
+		c.GroupAttribute = "cn"
+	}
+	if c.CacheTTL < 0 {
+		return fmt.Errorf("%s.cache_ttl must not be negative", configKey)
+	}
+	for i := range c.Rules {
+		r := &c.Rules[i]
+		if r.Group == "" || r.Actions == nil {
+			return fmt.Errorf("%s.rules[%d]: group and actions are required", configKey, i)
+		}
+		if r.Match == nil {
+			r.Match = &MatchConditions{}
+		}
+		if err := r.compile(); err != nil {
+			return fmt.Errorf("%s.rules[%d]: invalid group template: %s", configKey, i, err)
+		}
+		// Check the conditions with a placeholder in place of every variable.
+		e := r.expand(templateVarRegex.ReplaceAllString(r.Group, "x"))
+		if err := validateMatchConditions(e.Match); err != nil {
+			return fmt.Errorf("%s.rules[%d]: invalid match conditions: %s", configKey, i, err)
+		}
+	}
+	return nil
+}
+
+type ldapACLCacheEntry struct {
+	acl     *aclAuthorizer
+	expires time.Time
+}
+
+type aclLDAPAuthorizer struct {
+	config *ACLLDAPConfig
+	ldap   *authn.LDAPAuth
+	lock   sync.Mutex
+	cache  map[string]*ldapACLCacheEntry
+}
+
+// NewACLLDAPAuthorizer creates an authorizer that derives ACL from user's groups in LDAP.
+func NewACLLDAPAuthorizer(c *ACLLDAPConfig) (Authorizer, error) {
+	la, err := authn.NewLDAPAuth(&c.LDAPAuthConfig)
+	if err != nil {
+		return nil, err
+	}
+	glog.V(1).Infof("Created LDAP ACL Authorizer with %d rules", len(c.Rules))
+	return &aclLDAPAuthorizer{
+		config: c,
+		ldap:   la,
+		cache:  make(map[string]*ldapACLCacheEntry),
+	}, nil
+}
+
+func (la *aclLDAPAuthorizer) Authorize(ai *AuthRequestInfo) ([]string, error) {
+	actions, _, err := la.AuthorizeRule(ai)
+	return actions, err
+}
+
+func (la *aclLDAPAuthorizer) AuthorizeRule(ai *AuthRequestInfo) ([]string, *ACLEntry, error) {
+	if ai.Account == "" {
+		return nil, nil, NoMatch
+	}
+	acl, err := la.getACL(ai.Account)
+	if err != nil {
+		return nil, nil, err
+	}
+	return acl.AuthorizeRule(ai)
+}
+
+func (la *aclLDAPAuthorizer) AccountRules(account, authnBackend string) ([]ACLEntry, error) {
+	acl, err := la.getACL(account)
+	if err != nil {
+		return nil, err
+	}
+	return acl.AccountRules(account, authnBackend)
+}
+
+func (la *aclLDAPAuthorizer) getACL(account string) (*aclAuthorizer, error) {
+	now := time.Now()
+	la.lock.Lock()
+	e := la.cache[account]
+	la.lock.Unlock()
+	if e != nil && now.Before(e.expires) {
+		return e.acl, nil
+	}
+	groups, err := la.groups(account)
+	if err != nil {
+		return nil, err
+	}
+	acl := &aclAuthorizer{acl: la.buildACL(groups)}
+	glog.V(2).Infof("LDAP ACL for %s (groups: %s): %s", account, groups, acl.acl)
+	if la.config.CacheTTL > 0 {
+		la.lock.Lock()
+		if len(la.cache) >= maxLDAPCacheEntries {
+			for a, e := range la.cache {
+				if !now.Before(e.expires) {
+					delete(la.cache, a)
+				}
+			}
+		}
+		if len(la.cache) < maxLDAPCacheEntries {
+			la.cache[account] = &ldapACLCacheEntry{acl: acl, expires: now.Add(la.config.CacheTTL)}
+		}
+		la.lock.Unlock()
+	}
+	return acl, nil
+}
+
+// groups returns names of the groups account is a member of.
+func (la *aclLDAPAuthorizer) groups(account string) ([]string, error) {
+	c := la.config
+	filter := strings.Replace(c.Filter, "${account}", ldap.EscapeFilter(account), -1)
+	attrs := []string{"memberOf"}
+	if c.GroupFilter != "" {
+		attrs = []string{"1.1"} // No attributes, only DN is needed.
+	}
+	entries, err := la.ldap.Search(c.Base, filter, attrs)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, nil
+	} else if len(entries) > 1 {
+		return nil, fmt.Errorf("too many entries returned for %s", account)
+	}
+	user := entries[0]
+
+	var groups []string
+	if c.GroupFilter != "" {
+		filter := strings.NewReplacer(
+			"${account}", ldap.EscapeFilter(account),
+			"${dn}", ldap.EscapeFilter(user.DN),
+		).Replace(c.GroupFilter)
+		entries, err := la.ldap.Search(c.GroupBaseDN, filter, []string{c.GroupAttribute})
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			groups = append(groups, e.GetAttributeValues(c.GroupAttribute)...)
+		}
+	} else {
+		for _, dn := range user.GetAttributeValues("memberOf") {
+			pdn, err := ldap.ParseDN(dn)
+			if err != nil || len(pdn.RDNs) == 0 || len(pdn.RDNs[0].Attributes) == 0 {
+				glog.Warningf("Invalid group DN %q for %s: %v", dn, account, err)
+				continue
+			}
+			groups = append(groups, pdn.RDNs[0].Attributes[0].Value)
+		}
+	}
+	sort.Strings(groups)
+	return groups, nil
+}
+
+// buildACL produces entries in the order of rules, then groups.
+func (la *aclLDAPAuthorizer) buildACL(groups []string) ACL {
+	acl := ACL{}
+	for i := range la.config.Rules {
+		for _, g := range groups {
+			if e := la.config.Rules[i].expand(g); e != nil {
+				acl = append(acl, *e)
+			}
+		}
+	}
+	return acl
+}
+
+// Refresh drops cached group memberships, they are looked up again on next request.
+func (la *aclLDAPAuthorizer) Refresh() error {
+	la.lock.Lock()
+	defer la.lock.Unlock()
+	la.cache = make(map[string]*ldapACLCacheEntry)
+	glog.Infof("LDAP ACL cache cleared")
+	return nil
+}
+
+// HealthCheck verifies that LDAP servers can be reached.
+func (la *aclLDAPAuthorizer) HealthCheck() error {
+	return la.ldap.HealthCheck()
+}
+
+func (la *aclLDAPAuthorizer) Stop() {
+	la.ldap.Stop()
+}
+
+func (la *aclLDAPAuthorizer) Name() string {
+	return "LDAP ACL"
+}
@@ -0,0 +1,62 @@
+package authz
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/cesanta/docker_auth/auth_server/authn"
+)
+
+func TestACLLDAPRules(t *testing.T) {
+	push, pull := []string{"pull", "push"}, []string{"pull"}
+	c := &ACLLDAPConfig{
+		LDAPAuthConfig: authn.LDAPAuthConfig{Addr: "ldap.example.com:389", Filter: "(uid=${account})"},
+		Rules: []ACLLDAPRule{
+			{Group: "registry-${project}-push", ACLEntry: ACLEntry{Match: &MatchConditions{Name: sp("${project}/*")}, Actions: &push}},
+			{Group: "registry-${project}-pull", ACLEntry: ACLEntry{Match: &MatchConditions{Name: sp("${project}/*")}, Actions: &pull}},
+			{Group: "registry-${project}-ci", ACLEntry: ACLEntry{Match: &MatchConditions{Name: sp("${project}/*"), Labels: map[string]string{"pipeline": "${project}-*"}}, Actions: &push}},
+			{Group: "registry-admins", ACLEntry: ACLEntry{Actions: &[]string{"*"}}},
+		},
+	}
+	if err := c.Validate("acl_ldap"); err != nil {
+		t.Fatalf("validation failed: %s", err)
+	}
+	la := &aclLDAPAuthorizer{config: c}
+	acl := &aclAuthorizer{acl: la.buildACL([]string{"other", "registry-app.x-push", "registry-web-pull", "registry-api-ci"})}
+	cases := []struct {
+		name    string
+		labels  map[string][]string
+		actions []string
+	}{
+		{"app.x/server", nil, push},
+		{"web/frontend", nil, pull},
+		// Group values are matched literally.
+		{"appxx/server", nil, nil},
+		{"db/server", nil, nil},
+		// Label patterns are expanded too.
+		{"api/server", map[string][]string{"pipeline": {"api-deploy"}}, push},
+		{"api/server", map[string][]string{"pipeline": {"web-deploy"}}, nil},
+		{"api/server", nil, nil},
+	}
+	for _, tc := range cases {
+		ai := &AuthRequestInfo{Account: "john", Type: "repository", Name: tc.name, Actions: push, Labels: tc.labels}
+		actions, e, err := acl.AuthorizeRule(ai)
+		if tc.actions == nil {
+			if err != NoMatch {
+				t.Errorf("%s: expected no match, got %v, %v", tc.name, actions, err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(actions, tc.actions) {
+			t.Errorf("%s: expected %v, got %v, %v", tc.name, tc.actions, actions, err)
+		}
+		if e == nil || e.Comment == nil {
+			t.Errorf("%s: matched entry should have a comment", tc.name)
+		}
+	}
+
+	c.Rules = append(c.Rules, ACLLDAPRule{Group: "x", ACLEntry: ACLEntry{Match: &MatchConditions{Name: sp("/${x}(/")}, Actions: &pull}})
+	if err := c.Validate("acl_ldap"); err == nil {
+		t.Errorf("invalid match conditions should not pass validation")
+	}
+}
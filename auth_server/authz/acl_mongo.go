@@ -1,14 +1,19 @@
 package authz
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/cesanta/docker_auth/auth_server/metrics"
 	"github.com/cesanta/docker_auth/auth_server/mgo_session"
 	"github.com/golang/glog"
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 	"io"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -16,22 +21,29 @@ type MongoACL []MongoACLEntry
 
 type MongoACLEntry struct {
 	ACLEntry `bson:",inline"`
-	Seq      *int
+	Seq      *int `json:"seq"`
 }
 
 type ACLMongoConfig struct {
 	MongoConfig *mgo_session.Config `yaml:"dial_info,omitempty"`
 	Collection  string              `yaml:"collection,omitempty"`
 	CacheTTL    time.Duration       `yaml:"cache_ttl,omitempty"`
+	// Only poll every cache_ttl, do not follow changes with a change stream.
+	DisableChangeStream bool `yaml:"disable_change_stream,omitempty"`
 }
 
 type aclMongoAuthorizer struct {
 	lastCacheUpdate  time.Time
 	lock             sync.RWMutex
+	updateLock       sync.Mutex
+	editLock         sync.Mutex // Serializes changes that depend on the order of entries.
 	config           *ACLMongoConfig
 	staticAuthorizer Authorizer
 	session          *mgo.Session
 	updateTicker     *time.Ticker
+	stop             chan struct{}
+	aclHash          string        // Of the entries the current ACL was built from.
+	streaming        int32         // 1 while the ACL is kept current by a change stream, polling is suspended.
 	Collection       string        `yaml:"collection,omitempty"`
 	CacheTTL         time.Duration `yaml:"cache_ttl,omitempty"`
 }
@@ -48,6 +60,7 @@ func NewACLMongoAuthorizer(c *ACLMongoConfig) (Authorizer, error) {
 		config:       c,
 		session:      session,
 		updateTicker: time.NewTicker(c.CacheTTL),
+		stop:         make(chan struct{}),
 	}
 
 	// Initially fetch the ACL from MongoDB
@@ -56,20 +69,37 @@ func NewACLMongoAuthorizer(c *ACLMongoConfig) (Authorizer, error) {
 	}
 
 	go authorizer.continuouslyUpdateACLCache()
+	if !c.DisableChangeStream {
+		go authorizer.watchACL()
+	}
 
 	return authorizer, nil
 }
 
 func (ma *aclMongoAuthorizer) Authorize(ai *AuthRequestInfo) ([]string, error) {
+	actions, _, err := ma.AuthorizeRule(ai)
+	return actions, err
+}
+
+func (ma *aclMongoAuthorizer) AuthorizeRule(ai *AuthRequestInfo) ([]string, *ACLEntry, error) {
 	ma.lock.RLock()
 	defer ma.lock.RUnlock()
 
 	// Test if authorizer has been initialized
 	if ma.staticAuthorizer == nil {
-		return nil, fmt.Errorf("MongoDB authorizer is not ready")
+		return nil, nil, fmt.Errorf("MongoDB authorizer is not ready")
 	}
 
-	return ma.staticAuthorizer.Authorize(ai)
+	return ma.staticAuthorizer.(RuleAuthorizer).AuthorizeRule(ai)
+}
+
+func (ma *aclMongoAuthorizer) AccountRules(account, authnBackend string) ([]ACLEntry, error) {
+	ma.lock.RLock()
+	defer ma.lock.RUnlock()
+	if ma.staticAuthorizer == nil {
+		return nil, fmt.Errorf("MongoDB authorizer is not ready")
+	}
+	return ma.staticAuthorizer.(RuleLister).AccountRules(account, authnBackend)
 }
 
 // Validate ensures that any custom config options
@@ -91,8 +121,25 @@ func (c *ACLMongoConfig) Validate(configKey string) error {
 	return nil
 }
 
+// HealthCheck verifies that the ACL has been loaded, is not stale and MongoDB is reachable.
+func (ma *aclMongoAuthorizer) HealthCheck() error {
+	ma.lock.RLock()
+	ready, lastUpdate := ma.staticAuthorizer != nil, ma.lastCacheUpdate
+	ma.lock.RUnlock()
+	if !ready {
+		return errors.New("ACL has not been loaded yet")
+	}
+	if age := time.Now().Sub(lastUpdate); ma.config.CacheTTL > 0 && age > 2*ma.config.CacheTTL {
+		return fmt.Errorf("ACL is stale (age: %s, TTL: %s)", age, ma.config.CacheTTL)
+	}
+	tmp_session := ma.session.Copy()
+	defer tmp_session.Close()
+	return tmp_session.Ping()
+}
+
 func (ma *aclMongoAuthorizer) Stop() {
-	// This causes the background go routine which updates the ACL to stop
+	// This causes the background go routines which update the ACL to stop
+	close(ma.stop)
 	ma.updateTicker.Stop()
 
 	// Close connection to MongoDB database (if any)
@@ -110,13 +157,24 @@ func (ma *aclMongoAuthorizer) Name() string {
 // The ACL will be stored inside the static authorizer instance which we use
 // to minimize duplication of code and maximize reuse of existing code.
 func (ma *aclMongoAuthorizer) continuouslyUpdateACLCache() {
-	var tick time.Time
-	for ; true; tick = <-ma.updateTicker.C {
+	for {
+		var tick time.Time
+		select {
+		case <-ma.stop:
+			return
+		case tick = <-ma.updateTicker.C:
+		}
+		if atomic.LoadInt32(&ma.streaming) == 1 {
+			continue
+		}
 		aclAge := time.Now().Sub(ma.lastCacheUpdate)
 		glog.V(2).Infof("Updating ACL at %s (ACL age: %s. CacheTTL: %s)", tick, aclAge, ma.config.CacheTTL)
 
 		for true {
 			err := ma.updateACLCache()
+			ma.lock.RLock()
+			metrics.ACLCacheRefreshed(ma.Name(), ma.lastCacheUpdate, err)
+			ma.lock.RUnlock()
 			if err == nil {
 				break
 			} else if err == io.EOF {
@@ -133,6 +191,11 @@ func (ma *aclMongoAuthorizer) continuouslyUpdateACLCache() {
 }
 
 func (ma *aclMongoAuthorizer) updateACLCache() error {
+	// Reloads are triggered by polling, change events, edits and SIGUSR1, one at a time
+	// so that an older result does not replace a newer one.
+	ma.updateLock.Lock()
+	defer ma.updateLock.Unlock()
+
 	// Get ACL from MongoDB
 	var newACL MongoACL
 
@@ -179,6 +242,18 @@ func (ma *aclMongoAuthorizer) updateACLCache() error {
 		retACL = append(retACL, e.ACLEntry)
 	}
 
+	// Only build a new authorizer if something has changed.
+	b, _ := json.Marshal(newACL)
+	sum := sha256.Sum256(b)
+	hash := hex.EncodeToString(sum[:])
+	if hash == ma.aclHash {
+		ma.lock.Lock()
+		ma.lastCacheUpdate = time.Now()
+		ma.lock.Unlock()
+		glog.V(2).Infof("ACL in MongoDB has not changed (%d entries)", len(retACL))
+		return nil
+	}
+
 	newStaticAuthorizer, err := NewACLAuthorizer(retACL)
 	if err != nil {
 		return err
@@ -188,6 +263,7 @@ func (ma *aclMongoAuthorizer) updateACLCache() error {
 	ma.lastCacheUpdate = time.Now()
 	ma.staticAuthorizer = newStaticAuthorizer
 	ma.lock.Unlock()
+	ma.aclHash = hash
 
 	glog.V(2).Infof("Got new ACL from MongoDB: %s", retACL)
 	glog.V(1).Infof("Installed new ACL from MongoDB (%d entries)", len(retACL))
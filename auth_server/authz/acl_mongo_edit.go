@@ -0,0 +1,235 @@
+package authz
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/cesanta/docker_auth/auth_server/metrics"
+	"github.com/golang/glog"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// MongoACLEditor is implemented by the MongoDB authorizer, for the admin API.
+// Entries are identified by seq. Positions are given as the seq of the entry to go before,
+// nil for the end of the list. The cached ACL is reloaded after every change.
+type MongoACLEditor interface {
+	// Entries returns the ACL as stored in MongoDB, in the order it is evaluated.
+	Entries() (MongoACL, error)
+	// AddEntry inserts the entry and returns its seq.
+	AddEntry(e ACLEntry, before *int) (int, error)
+	UpdateEntry(seq int, e ACLEntry) error
+	DeleteEntry(seq int) error
+	MoveEntry(seq int, before *int) error
+}
+
+// Gap between seq values of renumbered entries. Entries are inserted in between, and entries
+// after the position are only renumbered when there is no gap left.
+const aclSeqStep = 100
+
+// ValidateACLEntry checks an entry before it is stored.
+func ValidateACLEntry(e *ACLEntry) error {
+	if e.Match == nil {
+		return errors.New("match is required")
+	}
+	if e.Actions == nil {
+		return errors.New("actions is required")
+	}
+	return validateMatchConditions(e.Match)
+}
+
+func (ma *aclMongoAuthorizer) Entries() (MongoACL, error) {
+	tmp_session := ma.session.Copy()
+	defer tmp_session.Close()
+	return ma.entries(ma.collection(tmp_session))
+}
+
+func (ma *aclMongoAuthorizer) collection(s *mgo.Session) *mgo.Collection {
+	return s.DB(ma.config.MongoConfig.DialInfo.Database).C(ma.config.Collection)
+}
+
+func (ma *aclMongoAuthorizer) entries(collection *mgo.Collection) (MongoACL, error) {
+	acl := MongoACL{}
+	if err := collection.Find(bson.M{}).Sort("seq").All(&acl); err != nil {
+		return nil, err
+	}
+	for _, e := range acl {
+		if e.Seq == nil {
+			return nil, fmt.Errorf("Seq not set for ACL entry: %+v", e)
+		}
+	}
+	return acl, nil
+}
+
+// index returns the position of the entry with seq, or the end of the list if seq is nil.
+func (acl MongoACL) index(seq *int) (int, error) {
+	if seq == nil {
+		return len(acl), nil
+	}
+	for i, e := range acl {
+		if *e.Seq == *seq {
+			return i, nil
+		}
+	}
+	return 0, NoMatch
+}
+
+type seqChange struct {
+	from, to int
+}
+
+// placeSeq returns a free seq for a new entry at position i of acl, maxSeq being the largest seq
+// in the collection. If there is no gap at the position, entries from i on have to be moved after
+// maxSeq first; this is done from the end, which keeps them in order at all times for readers.
+func placeSeq(acl MongoACL, i, maxSeq int) (int, []seqChange) {
+	if i == len(acl) {
+		if len(acl) == 0 {
+			return maxSeq + aclSeqStep, nil
+		}
+		return *acl[i-1].Seq + aclSeqStep, nil
+	}
+	prev := *acl[i].Seq - 2*aclSeqStep
+	if i > 0 {
+		prev = *acl[i-1].Seq
+	}
+	if next := *acl[i].Seq; next-prev > 1 {
+		return prev + (next-prev)/2, nil
+	}
+	var changes []seqChange
+	for j := len(acl) - 1; j >= i; j-- {
+		changes = append(changes, seqChange{*acl[j].Seq, maxSeq + (j-i+1)*aclSeqStep})
+	}
+	return maxSeq + aclSeqStep/2, changes
+}
+
+// seqAt returns a free seq for a new entry at position i of acl, renumbering entries if needed.
+func (ma *aclMongoAuthorizer) seqAt(collection *mgo.Collection, acl MongoACL, i, maxSeq int) (int, error) {
+	seq, changes := placeSeq(acl, i, maxSeq)
+	for _, c := range changes {
+		if err := collection.Update(bson.M{"seq": c.from}, bson.M{"$set": bson.M{"seq": c.to}}); err != nil {
+			return 0, fmt.Errorf("failed to renumber ACL entry %d: %s", c.from, err)
+		}
+	}
+	if len(changes) > 0 {
+		glog.Infof("Renumbered %d MongoDB ACL entries", len(changes))
+	}
+	return seq, nil
+}
+
+func maxACLSeq(acl MongoACL) int {
+	max := 0
+	for _, e := range acl {
+		if *e.Seq > max {
+			max = *e.Seq
+		}
+	}
+	return max
+}
+
+func (ma *aclMongoAuthorizer) AddEntry(e ACLEntry, before *int) (int, error) {
+	if err := ValidateACLEntry(&e); err != nil {
+		return 0, err
+	}
+	ma.editLock.Lock()
+	defer ma.editLock.Unlock()
+	tmp_session := ma.session.Copy()
+	defer tmp_session.Close()
+	collection := ma.collection(tmp_session)
+	acl, err := ma.entries(collection)
+	if err != nil {
+		return 0, err
+	}
+	i, err := acl.index(before)
+	if err != nil {
+		return 0, err
+	}
+	seq, err := ma.seqAt(collection, acl, i, maxACLSeq(acl))
+	if err != nil {
+		return 0, err
+	}
+	if err := collection.Insert(&MongoACLEntry{ACLEntry: e, Seq: &seq}); err != nil {
+		return 0, err
+	}
+	ma.refreshAfterEdit()
+	return seq, nil
+}
+
+func (ma *aclMongoAuthorizer) UpdateEntry(seq int, e ACLEntry) error {
+	if err := ValidateACLEntry(&e); err != nil {
+		return err
+	}
+	tmp_session := ma.session.Copy()
+	defer tmp_session.Close()
+	err := ma.collection(tmp_session).Update(bson.M{"seq": seq}, &MongoACLEntry{ACLEntry: e, Seq: &seq})
+	if err == mgo.ErrNotFound {
+		return NoMatch
+	} else if err != nil {
+		return err
+	}
+	ma.refreshAfterEdit()
+	return nil
+}
+
+func (ma *aclMongoAuthorizer) DeleteEntry(seq int) error {
+	tmp_session := ma.session.Copy()
+	defer tmp_session.Close()
+	err := ma.collection(tmp_session).Remove(bson.M{"seq": seq})
+	if err == mgo.ErrNotFound {
+		return NoMatch
+	} else if err != nil {
+		return err
+	}
+	ma.refreshAfterEdit()
+	return nil
+}
+
+func (ma *aclMongoAuthorizer) MoveEntry(seq int, before *int) error {
+	ma.editLock.Lock()
+	defer ma.editLock.Unlock()
+	tmp_session := ma.session.Copy()
+	defer tmp_session.Close()
+	collection := ma.collection(tmp_session)
+	acl, err := ma.entries(collection)
+	if err != nil {
+		return err
+	}
+	from, err := acl.index(&seq)
+	if err != nil {
+		return err
+	}
+	if before != nil && *before == seq {
+		return nil
+	}
+	maxSeq := maxACLSeq(acl)
+	rest := append(append(MongoACL{}, acl[:from]...), acl[from+1:]...)
+	to, err := rest.index(before)
+	if err != nil {
+		return err
+	}
+	newSeq, err := ma.seqAt(collection, rest, to, maxSeq)
+	if err != nil {
+		return err
+	}
+	if err := collection.Update(bson.M{"seq": seq}, bson.M{"$set": bson.M{"seq": newSeq}}); err != nil {
+		return err
+	}
+	ma.refreshAfterEdit()
+	return nil
+}
+
+// refreshAfterEdit reloads the ACL, so that changes apply right away. The change has been made
+// at this point, if reloading fails it is picked up by the next periodic update.
+func (ma *aclMongoAuthorizer) refreshAfterEdit() {
+	if err := ma.Refresh(); err != nil {
+		glog.Errorf("Failed to reload ACL after change: %s", err)
+	}
+}
+
+// Refresh reloads the ACL immediately.
+func (ma *aclMongoAuthorizer) Refresh() error {
+	err := ma.updateACLCache()
+	ma.lock.RLock()
+	metrics.ACLCacheRefreshed(ma.Name(), ma.lastCacheUpdate, err)
+	ma.lock.RUnlock()
+	return err
+}
@@ -0,0 +1,63 @@
+package authz
+
+import (
+	"reflect"
+	"testing"
+)
+
+func mongoACL(seqs ...int) MongoACL {
+	var acl MongoACL
+	for i := range seqs {
+		acl = append(acl, MongoACLEntry{Seq: &seqs[i]})
+	}
+	return acl
+}
+
+func TestPlaceSeq(t *testing.T) {
+	cases := []struct {
+		acl     MongoACL
+		i       int
+		seq     int
+		changes []seqChange
+	}{
+		{mongoACL(), 0, 100, nil},
+		{mongoACL(1, 2), 2, 102, nil},
+		{mongoACL(10, 20), 0, -90, nil},
+		{mongoACL(10, 20), 1, 15, nil},
+		{mongoACL(10, 11, 12), 1, 62, []seqChange{{12, 212}, {11, 112}}},
+	}
+	for i, c := range cases {
+		max := maxACLSeq(c.acl)
+		seq, changes := placeSeq(c.acl, c.i, max)
+		if seq != c.seq || !reflect.DeepEqual(changes, c.changes) {
+			t.Errorf("%d: expected %d, %v, got %d, %v", i, c.seq, c.changes, seq, changes)
+		}
+		// The new seq must fit between the neighbours after renumbering.
+		after := map[int]int{}
+		for _, ch := range changes {
+			after[ch.from] = ch.to
+		}
+		seqOf := func(j int) int {
+			if s, ok := after[*c.acl[j].Seq]; ok {
+				return s
+			}
+			return *c.acl[j].Seq
+		}
+		if c.i > 0 && seqOf(c.i-1) >= seq || c.i < len(c.acl) && seqOf(c.i) <= seq {
+			t.Errorf("%d: seq %d out of order", i, seq)
+		}
+	}
+}
+
+func TestMongoUserACLOtherBackend(t *testing.T) {
+	// Users of other authenticators do not get entries of a MongoDB user with the same name,
+	// the database is not even queried.
+	ma := &mongoUserACLAuthorizer{}
+	ai := &AuthRequestInfo{Account: "alice", Type: "repository", Name: "alice/app", Actions: []string{"push"}, AuthnBackend: "LDAP"}
+	if _, _, err := ma.AuthorizeRule(ai); err != NoMatch {
+		t.Errorf("expected NoMatch, got %v", err)
+	}
+	if entries, err := ma.AccountRules("alice", "LDAP"); entries != nil || err != nil {
+		t.Errorf("expected no entries, got %v, %v", entries, err)
+	}
+}
@@ -0,0 +1,128 @@
+package authz
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/cesanta/docker_auth/auth_server/authn"
+	"github.com/cesanta/docker_auth/auth_server/mgo_session"
+	"github.com/golang/glog"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Per-user ACL embedded in documents of the mongo_auth user collection, e.g.
+//
+//	{username: "alice", password: "...", acl: [{match: {name: "alice/*"}, actions: ["*"]}]}
+//
+// Entries apply to the account of the document if it was authenticated by mongo_auth and is neither
+// disabled nor expired. They are evaluated before any other ACL.
+// Like mongo_auth, nothing is cached: users are looked up on every request.
+
+type mongoUserACL struct {
+	ACL       ACL        `bson:"acl"`
+	Disabled  bool       `bson:"disabled"`
+	ExpiresAt *time.Time `bson:"expires_at"`
+}
+
+type mongoUserACLAuthorizer struct {
+	config  *authn.MongoAuthConfig
+	session *mgo.Session
+}
+
+// NewMongoUserACLAuthorizer creates an authorizer for ACL entries in user documents of mongo_auth.
+func NewMongoUserACLAuthorizer(c *authn.MongoAuthConfig) (Authorizer, error) {
+	session, err := mgo_session.New(c.MongoConfig)
+	if err != nil {
+		return nil, err
+	}
+	return &mongoUserACLAuthorizer{config: c, session: session}, nil
+}
+
+func (ma *mongoUserACLAuthorizer) Authorize(ai *AuthRequestInfo) ([]string, error) {
+	actions, _, err := ma.AuthorizeRule(ai)
+	return actions, err
+}
+
+func (ma *mongoUserACLAuthorizer) AuthorizeRule(ai *AuthRequestInfo) ([]string, *ACLEntry, error) {
+	if ai.AuthnBackend != authn.MongoAuthName {
+		return nil, nil, NoMatch
+	}
+	acl, err := ma.userACL(ai.Account)
+	if err != nil {
+		return nil, nil, err
+	} else if acl == nil {
+		return nil, nil, NoMatch
+	}
+	return acl.(RuleAuthorizer).AuthorizeRule(ai)
+}
+
+func (ma *mongoUserACLAuthorizer) AccountRules(account, authnBackend string) ([]ACLEntry, error) {
+	if authnBackend != authn.MongoAuthName {
+		return nil, nil
+	}
+	acl, err := ma.userACL(account)
+	if err != nil || acl == nil {
+		return nil, err
+	}
+	return acl.(RuleLister).AccountRules(account, authnBackend)
+}
+
+// userACL returns an authorizer for the ACL of the account, nil if there is none.
+func (ma *mongoUserACLAuthorizer) userACL(account string) (Authorizer, error) {
+	for true {
+		acl, err := ma.findUserACL(account)
+		if err == io.EOF {
+			glog.Warningf("EOF error received from Mongo. Retrying connection")
+			time.Sleep(time.Second)
+			continue
+		}
+		return acl, err
+	}
+	return nil, errors.New("Unable to communicate with Mongo.")
+}
+
+func (ma *mongoUserACLAuthorizer) findUserACL(account string) (Authorizer, error) {
+	tmp_session := ma.session.Copy()
+	defer tmp_session.Close()
+
+	var user mongoUserACL
+	collection := tmp_session.DB(ma.config.MongoConfig.DialInfo.Database).C(ma.config.Collection)
+	err := collection.Find(bson.M{"username": account}).Select(bson.M{"acl": 1, "disabled": 1, "expires_at": 1}).One(&user)
+	if err == mgo.ErrNotFound || (err == nil && len(user.ACL) == 0) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if user.Disabled || (user.ExpiresAt != nil && time.Now().After(*user.ExpiresAt)) {
+		return nil, nil
+	}
+	for i, e := range user.ACL {
+		if e.Match == nil || e.Actions == nil {
+			return nil, fmt.Errorf("ACL of user %s: entry %d must have match and actions", account, i)
+		}
+	}
+	acl, err := NewACLAuthorizer(user.ACL)
+	if err != nil {
+		return nil, fmt.Errorf("ACL of user %s: %s", account, err)
+	}
+	return acl, nil
+}
+
+func (ma *mongoUserACLAuthorizer) HealthCheck() error {
+	tmp_session := ma.session.Copy()
+	defer tmp_session.Close()
+	return tmp_session.Ping()
+}
+
+func (ma *mongoUserACLAuthorizer) Stop() {
+	if ma.session != nil {
+		ma.session.Close()
+	}
+}
+
+func (ma *mongoUserACLAuthorizer) Name() string {
+	return "MongoDB user ACL"
+}
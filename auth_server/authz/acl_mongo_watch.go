@@ -0,0 +1,127 @@
+package authz
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/cesanta/docker_auth/auth_server/metrics"
+	"github.com/golang/glog"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Changes to the ACL collection are followed with a change stream (MongoDB 3.6+, replica sets and sharded
+// clusters), so they apply within a second. Polling is suspended while the stream is open and resumes every
+// cache_ttl while reconnecting, or for good if the server does not support change streams. The ACL is reloaded
+// whenever the stream is opened, to catch up on changes made in the meantime.
+
+const (
+	// How long the server waits for changes before returning an empty batch.
+	changeStreamAwait = 10 * time.Second
+	// Delay before reconnecting after the stream failed.
+	changeStreamRetry = 5 * time.Second
+)
+
+type changeStreamCursor struct {
+	Cursor struct {
+		ID         int64      `bson:"id"`
+		FirstBatch []bson.Raw `bson:"firstBatch"`
+		NextBatch  []bson.Raw `bson:"nextBatch"`
+	} `bson:"cursor"`
+}
+
+// watchACL reloads the ACL when the collection changes, until Stop is called.
+func (ma *aclMongoAuthorizer) watchACL() {
+	for {
+		opened, err := ma.followChanges()
+		select {
+		case <-ma.stop:
+			return
+		default:
+		}
+		if _, ok := err.(*mgo.QueryError); ok && !opened {
+			// The server refused, e.g. because it is not a replica set. Retrying would not help.
+			glog.Warningf("Cannot watch ACL collection (%s), polling every %s", err, ma.config.CacheTTL)
+			return
+		}
+		glog.Warningf("ACL change stream failed: %s, reconnecting in %s", err, changeStreamRetry)
+		select {
+		case <-ma.stop:
+			return
+		case <-time.After(changeStreamRetry):
+		}
+	}
+}
+
+// followChanges opens a change stream and reloads the ACL after each batch of changes.
+// It returns an error when the stream or a reload fails, or nil when Stop is called.
+// opened is false if the stream could not be opened.
+func (ma *aclMongoAuthorizer) followChanges() (opened bool, err error) {
+	tmp_session := ma.session.Copy()
+	defer tmp_session.Close()
+	db := tmp_session.DB(ma.config.MongoConfig.DialInfo.Database)
+
+	var res changeStreamCursor
+	err = db.Run(bson.D{
+		{Name: "aggregate", Value: ma.config.Collection},
+		{Name: "pipeline", Value: []bson.M{{"$changeStream": bson.M{}}}},
+		{Name: "cursor", Value: bson.M{}},
+	}, &res)
+	if err != nil {
+		return false, err
+	}
+	id := res.Cursor.ID
+	defer func() {
+		if id != 0 {
+			db.Run(bson.D{{Name: "killCursors", Value: ma.config.Collection}, {Name: "cursors", Value: []int64{id}}}, nil)
+		}
+	}()
+	glog.V(1).Infof("Watching %s for ACL changes", ma.config.Collection)
+	atomic.StoreInt32(&ma.streaming, 1)
+	defer atomic.StoreInt32(&ma.streaming, 0)
+	// Catch up on changes made before the stream was opened.
+	if err := ma.Refresh(); err != nil {
+		return true, fmt.Errorf("failed to update ACL: %s", err)
+	}
+	batch := res.Cursor.FirstBatch
+	for {
+		if len(batch) > 0 {
+			glog.V(2).Infof("%d changes to ACL in MongoDB", len(batch))
+			if err := ma.Refresh(); err != nil {
+				return true, fmt.Errorf("failed to update ACL: %s", err)
+			}
+		} else {
+			ma.markCurrent()
+		}
+		select {
+		case <-ma.stop:
+			return true, nil
+		default:
+		}
+		if id == 0 {
+			// Closed by the server, e.g. the collection was dropped.
+			return true, errors.New("change stream closed")
+		}
+		res = changeStreamCursor{}
+		err := db.Run(bson.D{
+			{Name: "getMore", Value: id},
+			{Name: "collection", Value: ma.config.Collection},
+			{Name: "maxTimeMS", Value: int64(changeStreamAwait / time.Millisecond)},
+		}, &res)
+		if err != nil {
+			return true, err
+		}
+		id, batch = res.Cursor.ID, res.Cursor.NextBatch
+	}
+}
+
+// markCurrent records that the ACL is up to date, the change stream has not reported any changes.
+func (ma *aclMongoAuthorizer) markCurrent() {
+	now := time.Now()
+	ma.lock.Lock()
+	ma.lastCacheUpdate = now
+	ma.lock.Unlock()
+	metrics.ACLCacheRefreshed(ma.Name(), now, nil)
+}
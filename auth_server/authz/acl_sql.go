@@ -0,0 +1,242 @@
+package authz
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cesanta/docker_auth/auth_server/metrics"
+	"github.com/cesanta/docker_auth/auth_server/sql_session"
+	"github.com/golang/glog"
+)
+
+// ACLSQLConfig configures loading of the ACL from a SQL database.
+// Entries are read from the table ordered by seq. Match columns (account, type, name, ip) and comment
+// may be NULL, actions is a comma-separated list. A custom query must return the same columns in the same order.
+type ACLSQLConfig struct {
+	SQLConfig    *sql_session.Config `yaml:"database,omitempty"`
+	Table        string              `yaml:"table,omitempty"`
+	Query        string              `yaml:"query,omitempty"`
+	CacheTTL     time.Duration       `yaml:"cache_ttl,omitempty"`
+	CreateSchema bool                `yaml:"create_schema,omitempty"`
+}
+
+type aclSQLAuthorizer struct {
+	lastCacheUpdate  time.Time
+	lock             sync.RWMutex
+	config           *ACLSQLConfig
+	staticAuthorizer Authorizer
+	db               *sql.DB
+	query            string
+	updateTicker     *time.Ticker
+	stop             chan struct{}
+}
+
+// Validate ensures that any custom config options
+// in a Config are set correctly.
+func (c *ACLSQLConfig) Validate(configKey string) error {
+	if c.SQLConfig == nil {
+		return fmt.Errorf("%s.database is required", configKey)
+	}
+	if err := c.SQLConfig.Validate(configKey); err != nil {
+		return err
+	}
+	if c.Query == "" && c.Table == "" {
+		return fmt.Errorf("%s.{table,query} is required", configKey)
+	}
+	if c.Table != "" {
+		if err := sql_session.ValidateIdentifier(c.Table); err != nil {
+			return fmt.Errorf("%s: %s", configKey, err)
+		}
+	} else if c.CreateSchema {
+		return fmt.Errorf("%s.create_schema requires table", configKey)
+	}
+	if c.CacheTTL < 0 {
+		return fmt.Errorf("%s.cache_ttl must not be negative", configKey)
+	}
+	if c.CacheTTL == 0 {
+		c.CacheTTL = time.Minute
+	}
+	return nil
+}
+
+// NewACLSQLAuthorizer creates a new ACL SQL authorizer
+func NewACLSQLAuthorizer(c *ACLSQLConfig) (Authorizer, error) {
+	db, err := sql_session.New(c.SQLConfig)
+	if err != nil {
+		return nil, err
+	}
+	authorizer := &aclSQLAuthorizer{
+		config: c,
+		db:     db,
+		query:  c.Query,
+		stop:   make(chan struct{}),
+	}
+	if authorizer.query == "" {
+		authorizer.query = fmt.Sprintf("SELECT seq, account, type, name, ip, actions, comment FROM %s ORDER BY seq", c.Table)
+	}
+	if c.CreateSchema {
+		if _, err := db.Exec(fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+			seq INTEGER NOT NULL PRIMARY KEY,
+			account VARCHAR(255), type VARCHAR(255), name VARCHAR(255), ip VARCHAR(255),
+			actions VARCHAR(1024) NOT NULL,
+			comment VARCHAR(1024))`, c.Table)); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("failed to create schema: %s", err)
+		}
+	}
+
+	// Initially fetch the ACL from the database
+	if err := authorizer.updateACLCache(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	metrics.ACLCacheRefreshed(authorizer.Name(), authorizer.lastCacheUpdate, nil)
+
+	authorizer.updateTicker = time.NewTicker(c.CacheTTL)
+	go authorizer.continuouslyUpdateACLCache()
+
+	return authorizer, nil
+}
+
+func (sa *aclSQLAuthorizer) Authorize(ai *AuthRequestInfo) ([]string, error) {
+	actions, _, err := sa.AuthorizeRule(ai)
+	return actions, err
+}
+
+func (sa *aclSQLAuthorizer) AuthorizeRule(ai *AuthRequestInfo) ([]string, *ACLEntry, error) {
+	sa.lock.RLock()
+	defer sa.lock.RUnlock()
+
+	// Test if authorizer has been initialized
+	if sa.staticAuthorizer == nil {
+		return nil, nil, fmt.Errorf("SQL authorizer is not ready")
+	}
+
+	return sa.staticAuthorizer.(RuleAuthorizer).AuthorizeRule(ai)
+}
+
+func (sa *aclSQLAuthorizer) AccountRules(account, authnBackend string) ([]ACLEntry, error) {
+	sa.lock.RLock()
+	defer sa.lock.RUnlock()
+	if sa.staticAuthorizer == nil {
+		return nil, fmt.Errorf("SQL authorizer is not ready")
+	}
+	return sa.staticAuthorizer.(RuleLister).AccountRules(account, authnBackend)
+}
+
+// continuouslyUpdateACLCache reloads the ACL every cache_ttl.
+// On failure, the stale ACL remains in effect until the next attempt.
+func (sa *aclSQLAuthorizer) continuouslyUpdateACLCache() {
+	for {
+		select {
+		case <-sa.stop:
+			return
+		case <-sa.updateTicker.C:
+		}
+		err := sa.updateACLCache()
+		sa.lock.RLock()
+		lastUpdate := sa.lastCacheUpdate
+		sa.lock.RUnlock()
+		metrics.ACLCacheRefreshed(sa.Name(), lastUpdate, err)
+		if err != nil {
+			glog.Errorf("Failed to update ACL. ERROR: %s", err)
+			glog.Warningf("Using stale ACL (Age: %s, TTL: %s)", time.Now().Sub(lastUpdate), sa.config.CacheTTL)
+		}
+	}
+}
+
+func nullStringPtr(ns sql.NullString) *string {
+	if !ns.Valid {
+		return nil
+	}
+	return &ns.String
+}
+
+func (sa *aclSQLAuthorizer) updateACLCache() error {
+	ctx, cancel := context.WithTimeout(context.Background(), sa.config.SQLConfig.Timeout)
+	defer cancel()
+	rows, err := sa.db.QueryContext(ctx, sa.query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var newACL ACL
+	for rows.Next() {
+		var seq int64
+		var account, typ, name, ip, comment sql.NullString
+		var actions string
+		if err := rows.Scan(&seq, &account, &typ, &name, &ip, &actions, &comment); err != nil {
+			return err
+		}
+		acts := []string{}
+		for _, a := range strings.Split(actions, ",") {
+			if a = strings.TrimSpace(a); a != "" {
+				acts = append(acts, a)
+			}
+		}
+		newACL = append(newACL, ACLEntry{
+			Match: &MatchConditions{
+				Account: nullStringPtr(account),
+				Type:    nullStringPtr(typ),
+				Name:    nullStringPtr(name),
+				IP:      nullStringPtr(ip),
+			},
+			Actions: &acts,
+			Comment: nullStringPtr(comment),
+		})
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	newStaticAuthorizer, err := NewACLAuthorizer(newACL)
+	if err != nil {
+		return err
+	}
+
+	sa.lock.Lock()
+	sa.lastCacheUpdate = time.Now()
+	sa.staticAuthorizer = newStaticAuthorizer
+	sa.lock.Unlock()
+
+	glog.V(2).Infof("Got new ACL from SQL database: %s", newACL)
+	glog.V(1).Infof("Installed new ACL from SQL database (%d entries)", len(newACL))
+	return nil
+}
+
+// Refresh reloads the ACL immediately.
+func (sa *aclSQLAuthorizer) Refresh() error {
+	err := sa.updateACLCache()
+	sa.lock.RLock()
+	metrics.ACLCacheRefreshed(sa.Name(), sa.lastCacheUpdate, err)
+	sa.lock.RUnlock()
+	return err
+}
+
+// HealthCheck verifies that the ACL is not stale and the database is reachable.
+func (sa *aclSQLAuthorizer) HealthCheck() error {
+	sa.lock.RLock()
+	lastUpdate := sa.lastCacheUpdate
+	sa.lock.RUnlock()
+	if age := time.Now().Sub(lastUpdate); age > 2*sa.config.CacheTTL {
+		return fmt.Errorf("ACL is stale (age: %s, TTL: %s)", age, sa.config.CacheTTL)
+	}
+	return sa.db.Ping()
+}
+
+func (sa *aclSQLAuthorizer) Stop() {
+	// This causes the background go routine which updates the ACL to stop
+	sa.updateTicker.Stop()
+	close(sa.stop)
+	sa.db.Close()
+}
+
+func (sa *aclSQLAuthorizer) Name() string {
+	return "SQL ACL"
+}
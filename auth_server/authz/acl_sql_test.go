@@ -0,0 +1,69 @@
+package authz
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/cesanta/docker_auth/auth_server/sql_session"
+)
+
+func TestACLSQL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "acl_sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c := &ACLSQLConfig{
+		SQLConfig:    &sql_session.Config{Driver: "sqlite3", DSN: filepath.Join(dir, "acl.db")},
+		Table:        "acl",
+		CacheTTL:     time.Hour,
+		CreateSchema: true,
+	}
+	if err := c.Validate("acl_sql"); err != nil {
+		t.Fatalf("validation failed: %s", err)
+	}
+	a, err := NewACLSQLAuthorizer(c)
+	if err != nil {
+		t.Fatalf("failed to create authorizer: %s", err)
+	}
+	defer a.Stop()
+	sa := a.(*aclSQLAuthorizer)
+
+	ai := &AuthRequestInfo{Account: "john", Type: "repository", Name: "john/app", IP: net.ParseIP("10.0.0.1"), Actions: []string{"pull", "push"}}
+	if _, err := a.Authorize(ai); err != NoMatch {
+		t.Errorf("empty ACL should not match, got %v", err)
+	}
+	for _, q := range []string{
+		"INSERT INTO acl (seq, account, name, actions) VALUES (20, '${account}', '${account}/*', 'push, pull')",
+		"INSERT INTO acl (seq, ip, actions, comment) VALUES (10, '10.0.0.0/8', 'pull', 'internal')",
+		"INSERT INTO acl (seq, actions) VALUES (30, '')",
+	} {
+		if _, err := sa.db.Exec(q); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Not visible until refreshed.
+	if _, err := a.Authorize(ai); err != NoMatch {
+		t.Errorf("ACL should have been cached, got %v", err)
+	}
+	if err := sa.Refresh(); err != nil {
+		t.Fatalf("refresh failed: %s", err)
+	}
+	actions, e, err := sa.AuthorizeRule(ai)
+	if err != nil || !reflect.DeepEqual(actions, []string{"pull"}) || e.Comment == nil || *e.Comment != "internal" {
+		t.Errorf("expected entries to be ordered by seq, got %v, %v, %v", actions, e, err)
+	}
+	ai.IP = net.ParseIP("1.2.3.4")
+	if actions, err := a.Authorize(ai); err != nil || !reflect.DeepEqual(actions, []string{"pull", "push"}) {
+		t.Errorf("expected pull and push, got %v, %v", actions, err)
+	}
+	ai.Account = "jane"
+	if actions, err := a.Authorize(ai); err != nil || len(actions) != 0 {
+		t.Errorf("expected deny, got %v, %v", actions, err)
+	}
+}
@@ -29,6 +29,7 @@ func TestValidation(t *testing.T) {
 		{MatchConditions{IP: sp("192.168.0.0/16")}, true},
 		{MatchConditions{IP: sp("2001:db8::1")}, true},
 		{MatchConditions{IP: sp("2001:db8::/48")}, true},
+		{MatchConditions{Labels: map[string]string{"groups": "/^dev-.*$/"}}, true},
 		// Invalid stuff
 		{MatchConditions{Account: sp("/foo?*/")}, false},
 		{MatchConditions{Type: sp("/foo?*/")}, false},
@@ -37,13 +38,14 @@ func TestValidation(t *testing.T) {
 		{MatchConditions{IP: sp("192.168.0.*")}, false},
 		{MatchConditions{IP: sp("foo")}, false},
 		{MatchConditions{IP: sp("2001:db8::/222")}, false},
+		{MatchConditions{Labels: map[string]string{"groups": "/dev-?*/"}}, false},
 	}
 	for i, c := range cases {
 		result := validateMatchConditions(&c.mc)
 		if c.ok && result != nil {
-			t.Errorf("%d: %q: expected to pass, got %s", i, c.mc, result)
+			t.Errorf("%d: %+v: expected to pass, got %s", i, c.mc, result)
 		} else if !c.ok && result == nil {
-			t.Errorf("%d: %q: expected to fail, but it passed", i, c.mc)
+			t.Errorf("%d: %+v: expected to fail, but it passed", i, c.mc)
 		}
 	}
 }
@@ -80,6 +82,11 @@ func TestMatching(t *testing.T) {
 		{MatchConditions{IP: sp("2001:db8::2")}, AuthRequestInfo{IP: net.ParseIP("2001:db8::1")}, false},
 		{MatchConditions{IP: sp("2001:db8::/48")}, AuthRequestInfo{IP: net.ParseIP("2001:db8::1")}, true},
 		{MatchConditions{IP: sp("2001:db8::/48")}, AuthRequestInfo{IP: net.ParseIP("2001:db8::2")}, true},
+		// Label matching
+		{MatchConditions{Labels: map[string]string{"groups": "dev-*"}}, AuthRequestInfo{}, false},
+		{MatchConditions{Labels: map[string]string{"groups": "dev-*"}}, AuthRequestInfo{Labels: map[string][]string{"groups": {"ops", "dev-web"}}}, true},
+		{MatchConditions{Labels: map[string]string{"groups": "dev-*", "team": "web"}}, AuthRequestInfo{Labels: map[string][]string{"groups": {"dev-web"}}}, false},
+		{MatchConditions{Labels: map[string]string{"team": "${account}"}}, AuthRequestInfo{Account: "web", Labels: map[string][]string{"team": {"web"}}}, true},
 	}
 	for i, c := range cases {
 		if result := c.mc.Matches(&c.ai); result != c.matches {
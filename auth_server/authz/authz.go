@@ -30,6 +30,24 @@ type Authorizer interface {
 	Name() string
 }
 
+// RuleAuthorizer is implemented by authorizers that can report which rule reached the decision.
+type RuleAuthorizer interface {
+	// AuthorizeRule is like Authorize, but also returns the matched entry.
+	AuthorizeRule(ai *AuthRequestInfo) ([]string, *ACLEntry, error)
+}
+
+// RuleLister is implemented by authorizers that can list rules applying to an account, e.g. for display.
+type RuleLister interface {
+	// AccountRules returns entries whose account condition matches, in the order they are evaluated.
+	// authnBackend is the name of the authenticator the account belongs to, see AuthRequestInfo.
+	AccountRules(account, authnBackend string) ([]ACLEntry, error)
+}
+
+// Refresher is implemented by authorizers that cache data from a backend and can reload it on demand.
+type Refresher interface {
+	Refresh() error
+}
+
 var NoMatch = errors.New("did not match any rule")
 
 type AuthRequestInfo struct {
@@ -39,6 +57,10 @@ type AuthRequestInfo struct {
 	Service string
 	IP      net.IP
 	Actions []string
+	// Labels returned by the authenticator, e.g. groups.
+	Labels map[string][]string
+	// Name of the authenticator the account belongs to, e.g. "MongoDB".
+	AuthnBackend string
 }
 
 func (ai AuthRequestInfo) String() string {
@@ -0,0 +1,267 @@
+/*
+   Copyright 2016 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+)
+
+const loginTimeout = 5 * time.Minute
+
+var httpClient = &http.Client{Timeout: 30 * time.Second}
+
+type tokenResponse struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Error    string `json:"error"`
+}
+
+type deviceCodeResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int    `json:"interval"`
+}
+
+// logf talks to the user. Stdout belongs to Docker, so the terminal is used if there is one.
+func logf(format string, args ...interface{}) {
+	var w io.Writer = os.Stderr
+	if tty, err := os.OpenFile("/dev/tty", os.O_WRONLY, 0); err == nil {
+		defer tty.Close()
+		w = tty
+	}
+	fmt.Fprintf(w, format+"\n", args...)
+}
+
+func randomString() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// discover finds the token realm and service of a registry from the challenge of its API endpoint.
+func discover(serverURL string) (realm, service string, err error) {
+	if !strings.Contains(serverURL, "://") {
+		serverURL = "https://" + serverURL
+	}
+	resp, err := httpClient.Get(strings.TrimSuffix(serverURL, "/") + "/v2/")
+	if err != nil {
+		return "", "", err
+	}
+	resp.Body.Close()
+	challenge := resp.Header.Get("WWW-Authenticate")
+	if !strings.HasPrefix(strings.ToLower(challenge), "bearer ") {
+		return "", "", fmt.Errorf("%s does not use token authentication", serverURL)
+	}
+	for _, param := range strings.Split(challenge[len("bearer "):], ",") {
+		kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch v := strings.Trim(kv[1], `"`); kv[0] {
+		case "realm":
+			realm = v
+		case "service":
+			service = v
+		}
+	}
+	if realm == "" {
+		return "", "", fmt.Errorf("no realm in the challenge of %s", serverURL)
+	}
+	return realm, service, nil
+}
+
+// login signs in through the auth server of the registry and returns newly issued credentials.
+func login(serverURL string) (*cachedCredentials, error) {
+	realm, service, err := discover(serverURL)
+	base := strings.TrimSuffix(os.Getenv("DOCKER_AUTH_URL"), "/")
+	if base == "" {
+		if err != nil {
+			return nil, fmt.Errorf("failed to find the auth server of %s: %s", serverURL, err)
+		}
+		base = strings.TrimSuffix(realm, "/auth")
+	} else if err != nil {
+		realm = base + "/auth"
+	}
+	var tr *tokenResponse
+	if os.Getenv("DOCKER_AUTH_NO_BROWSER") == "" {
+		tr, err = loopbackLogin(base)
+	}
+	if tr == nil {
+		if err != nil {
+			logf("Browser sign in is not possible (%s), using a device code.", err)
+		}
+		tr, err = deviceLogin(base)
+	}
+	if err != nil {
+		return nil, err
+	}
+	logf("Signed in to %s as %s.", base, tr.Username)
+	return &cachedCredentials{Username: tr.Username, Secret: tr.Password, Realm: realm, Service: service, CheckedAt: time.Now()}, nil
+}
+
+func openBrowser(u string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("open", u)
+	case "windows":
+		cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", u)
+	default:
+		if os.Getenv("DISPLAY") == "" && os.Getenv("WAYLAND_DISPLAY") == "" {
+			return errors.New("no display")
+		}
+		cmd = exec.Command("xdg-open", u)
+	}
+	return cmd.Run()
+}
+
+// loopbackLogin opens /cli_login in the browser, which sends a code back to a local listener.
+// It returns nil without an error only if the browser could not be opened.
+func loopbackLogin(base string) (*tokenResponse, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	defer l.Close()
+	state, verifier := randomString(), randomString()
+	h := sha256.Sum256([]byte(verifier))
+	redirectURI := fmt.Sprintf("http://%s/callback", l.Addr())
+	loginURL := base + "/cli_login?" + url.Values{
+		"redirect_uri":   {redirectURI},
+		"state":          {state},
+		"code_challenge": {base64.RawURLEncoding.EncodeToString(h[:])},
+	}.Encode()
+
+	type result struct {
+		code string
+		err  error
+	}
+	results := make(chan result, 1)
+	go http.Serve(l, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		q := req.URL.Query()
+		if req.URL.Path != "/callback" || q.Get("state") != state {
+			http.NotFound(rw, req)
+			return
+		}
+		var res result
+		if e := q.Get("error"); e != "" {
+			res.err = fmt.Errorf("sign in failed: %s", e)
+			fmt.Fprintf(rw, "Sign in failed: %s. You can close this window.\n", e)
+		} else {
+			res.code = q.Get("code")
+			fmt.Fprintf(rw, "Signed in, you can close this window and return to Docker.\n")
+		}
+		select {
+		case results <- res:
+		default:
+		}
+	}))
+
+	if err := openBrowser(loginURL); err != nil {
+		return nil, err
+	}
+	logf("Sign in to %s in your browser to continue. If it did not open, visit:\n\n  %s\n", base, loginURL)
+	var res result
+	select {
+	case res = <-results:
+	case <-time.After(loginTimeout):
+		return nil, errors.New("timed out waiting for sign in")
+	}
+	if res.err != nil {
+		return nil, res.err
+	}
+	body, _ := json.Marshal(map[string]string{"code": res.code, "code_verifier": verifier})
+	resp, err := httpClient.Post(base+"/cli_login/token", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	return decodeTokenResponse(resp)
+}
+
+func decodeTokenResponse(resp *http.Response) (*tokenResponse, error) {
+	defer resp.Body.Close()
+	var tr tokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&tr); err != nil {
+		return nil, fmt.Errorf("invalid response from %s: %s (%s)", resp.Request.URL, resp.Status, err)
+	}
+	if tr.Error != "" {
+		return &tr, errors.New(tr.Error)
+	}
+	if tr.Username == "" || tr.Password == "" {
+		return nil, fmt.Errorf("invalid response from %s: no credentials", resp.Request.URL)
+	}
+	return &tr, nil
+}
+
+// deviceLogin shows a code to enter on the device page of the auth server and waits for approval.
+func deviceLogin(base string) (*tokenResponse, error) {
+	resp, err := httpClient.PostForm(base+"/device/code", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("device login is not available at %s: %s", base, resp.Status)
+	}
+	var dc deviceCodeResponse
+	if err := json.NewDecoder(resp.Body).Decode(&dc); err != nil {
+		return nil, fmt.Errorf("invalid response from %s: %s", base, err)
+	}
+	logf("To sign in, visit %s and enter the code %s\n\n  %s\n", dc.VerificationURI, dc.UserCode, dc.VerificationURIComplete)
+	interval := time.Duration(dc.Interval) * time.Second
+	deadline := time.Now().Add(time.Duration(dc.ExpiresIn) * time.Second)
+	for time.Now().Before(deadline) {
+		time.Sleep(interval)
+		resp, err := httpClient.PostForm(base+"/device/token", url.Values{"device_code": {dc.DeviceCode}})
+		if err != nil {
+			return nil, err
+		}
+		tr, err := decodeTokenResponse(resp)
+		switch {
+		case err == nil:
+			return tr, nil
+		case tr == nil:
+			return nil, err
+		case tr.Error == "authorization_pending":
+		case tr.Error == "slow_down":
+			interval += 5 * time.Second
+		default:
+			return nil, fmt.Errorf("sign in failed: %s", tr.Error)
+		}
+	}
+	return nil, errors.New("the code has expired")
+}
@@ -0,0 +1,255 @@
+/*
+   Copyright 2016 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// docker-credential-docker_auth is a Docker credential helper for registries using docker_auth
+// with Google or GitHub sign in. Configure it in ~/.docker/config.json:
+//
+//	{"credHelpers": {"registry.example.com": "docker_auth"}}
+//
+// When Docker needs credentials, the helper signs in through the web login of the auth server,
+// in the browser or with the device flow when there is none, and caches the issued password in
+// ~/.docker/docker_auth_credentials.json until the server stops accepting it.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// Docker recognizes this message and treats the credentials as missing.
+	credentialsNotFound = "credentials not found in native keychain"
+	cacheFileName       = "docker_auth_credentials.json"
+	// Cached passwords are checked against the auth server at most this often.
+	revalidateAfter = time.Hour
+)
+
+// credentials are exchanged with Docker on stdin and stdout.
+type credentials struct {
+	ServerURL string `json:"ServerURL"`
+	Username  string `json:"Username"`
+	Secret    string `json:"Secret"`
+}
+
+type cachedCredentials struct {
+	Username  string    `json:"username"`
+	Secret    string    `json:"secret"`
+	Realm     string    `json:"realm,omitempty"`
+	Service   string    `json:"service,omitempty"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// credentialsCache maps registry server URLs to credentials.
+type credentialsCache map[string]*cachedCredentials
+
+func cacheFile() (string, error) {
+	dir := os.Getenv("DOCKER_CONFIG")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		dir = filepath.Join(home, ".docker")
+	}
+	return filepath.Join(dir, cacheFileName), nil
+}
+
+func loadCache() (credentialsCache, error) {
+	fn, err := cacheFile()
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(fn)
+	if os.IsNotExist(err) {
+		return credentialsCache{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	cache := credentialsCache{}
+	if err := json.Unmarshal(data, &cache); err != nil {
+		return nil, fmt.Errorf("invalid %s: %s", fn, err)
+	}
+	return cache, nil
+}
+
+// save replaces the cache file atomically. It holds passwords, so only the user can read it.
+func (cache credentialsCache) save() error {
+	fn, err := cacheFile()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(fn), 0700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(cache, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := fn + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, fn)
+}
+
+// checkCredentials asks the auth server whether cached credentials are still valid.
+// Network errors are returned as such, so that the cache survives being offline.
+func checkCredentials(c *cachedCredentials) (bool, error) {
+	req, err := http.NewRequest("GET", c.Realm+"?service="+url.QueryEscape(c.Service), nil)
+	if err != nil {
+		return false, err
+	}
+	req.SetBasicAuth(c.Username, c.Secret)
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusUnauthorized:
+		return false, nil
+	}
+	return false, fmt.Errorf("unexpected status from %s: %s", c.Realm, resp.Status)
+}
+
+func get(serverURL string) (*credentials, error) {
+	cache, err := loadCache()
+	if err != nil {
+		return nil, err
+	}
+	if c := cache[serverURL]; c != nil {
+		if c.Realm == "" || time.Since(c.CheckedAt) < revalidateAfter {
+			return &credentials{ServerURL: serverURL, Username: c.Username, Secret: c.Secret}, nil
+		}
+		ok, err := checkCredentials(c)
+		if err != nil {
+			logf("Failed to check cached credentials, using them anyway: %s", err)
+			return &credentials{ServerURL: serverURL, Username: c.Username, Secret: c.Secret}, nil
+		}
+		if ok {
+			c.CheckedAt = time.Now()
+			if err := cache.save(); err != nil {
+				logf("Failed to update %s: %s", cacheFileName, err)
+			}
+			return &credentials{ServerURL: serverURL, Username: c.Username, Secret: c.Secret}, nil
+		}
+		delete(cache, serverURL)
+	}
+	c, err := login(serverURL)
+	if err != nil {
+		return nil, err
+	}
+	cache[serverURL] = c
+	if err := cache.save(); err != nil {
+		return nil, err
+	}
+	return &credentials{ServerURL: serverURL, Username: c.Username, Secret: c.Secret}, nil
+}
+
+// store keeps credentials of a docker login. They are not revalidated, as the auth server is unknown.
+func store(c *credentials) error {
+	cache, err := loadCache()
+	if err != nil {
+		return err
+	}
+	cache[c.ServerURL] = &cachedCredentials{Username: c.Username, Secret: c.Secret, CheckedAt: time.Now()}
+	return cache.save()
+}
+
+func erase(serverURL string) error {
+	cache, err := loadCache()
+	if err != nil {
+		return err
+	}
+	if cache[serverURL] == nil {
+		return errors.New(credentialsNotFound)
+	}
+	delete(cache, serverURL)
+	return cache.save()
+}
+
+func list() (map[string]string, error) {
+	cache, err := loadCache()
+	if err != nil {
+		return nil, err
+	}
+	res := map[string]string{}
+	for serverURL, c := range cache {
+		res[serverURL] = c.Username
+	}
+	return res, nil
+}
+
+// fatal reports an error the way Docker expects from credential helpers: on stdout, with exit code 1.
+func fatal(err error) {
+	fmt.Fprintln(os.Stdout, err)
+	os.Exit(1)
+}
+
+func main() {
+	if len(os.Args) != 2 {
+		fmt.Fprintf(os.Stderr, "Usage: %s get|store|erase|list\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Docker credential helper, see https://github.com/cesanta/docker_auth.\n")
+		fmt.Fprintf(os.Stderr, "DOCKER_AUTH_URL overrides the auth server URL, DOCKER_AUTH_NO_BROWSER=1 always uses the device flow.\n")
+		os.Exit(1)
+	}
+	var res interface{}
+	var err error
+	switch os.Args[1] {
+	case "get", "erase":
+		var data []byte
+		if data, err = ioutil.ReadAll(os.Stdin); err != nil {
+			break
+		}
+		serverURL := strings.TrimSpace(string(data))
+		if serverURL == "" {
+			err = errors.New("no server URL")
+		} else if os.Args[1] == "get" {
+			res, err = get(serverURL)
+		} else {
+			err = erase(serverURL)
+		}
+	case "store":
+		var data []byte
+		if data, err = ioutil.ReadAll(os.Stdin); err != nil {
+			break
+		}
+		var c credentials
+		if err = json.Unmarshal(data, &c); err == nil {
+			err = store(&c)
+		}
+	case "list":
+		res, err = list()
+	default:
+		err = fmt.Errorf("unknown command %q", os.Args[1])
+	}
+	if err != nil {
+		fatal(err)
+	}
+	if res != nil {
+		json.NewEncoder(os.Stdout).Encode(res)
+	}
+}
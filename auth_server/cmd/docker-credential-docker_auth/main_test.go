@@ -0,0 +1,105 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDiscover(t *testing.T) {
+	var challenge string
+	s := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/v2/" {
+			http.NotFound(rw, req)
+			return
+		}
+		if challenge != "" {
+			rw.Header().Set("WWW-Authenticate", challenge)
+		}
+		rw.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer s.Close()
+
+	challenge = `Bearer realm="https://auth.example.com/auth",service="Docker registry"`
+	realm, service, err := discover(s.URL + "/")
+	if err != nil || realm != "https://auth.example.com/auth" || service != "Docker registry" {
+		t.Errorf("unexpected result: %q %q %v", realm, service, err)
+	}
+	challenge = `Basic realm="registry"`
+	if _, _, err := discover(s.URL); err == nil {
+		t.Errorf("basic auth challenge accepted")
+	}
+	challenge = `Bearer service="Docker registry"`
+	if _, _, err := discover(s.URL); err == nil {
+		t.Errorf("challenge without realm accepted")
+	}
+}
+
+func TestCredentialsCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "credential_helper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer os.Setenv("DOCKER_CONFIG", os.Getenv("DOCKER_CONFIG"))
+	os.Setenv("DOCKER_CONFIG", filepath.Join(dir, "docker"))
+
+	if _, err := loadCache(); err != nil {
+		t.Fatalf("missing cache file is an error: %s", err)
+	}
+	if err := store(&credentials{ServerURL: "registry.example.com", Username: "octocat", Secret: "s3cr3t"}); err != nil {
+		t.Fatal(err)
+	}
+	fn := filepath.Join(dir, "docker", cacheFileName)
+	if fi, err := os.Stat(fn); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("cache file must only be readable by the user: %v %v", fi, err)
+	}
+	// Stored credentials have no realm and are returned without asking the server.
+	c, err := get("registry.example.com")
+	if err != nil || c.Username != "octocat" || c.Secret != "s3cr3t" {
+		t.Errorf("unexpected credentials: %+v, %v", c, err)
+	}
+	if l, err := list(); err != nil || len(l) != 1 || l["registry.example.com"] != "octocat" {
+		t.Errorf("unexpected list: %v, %v", l, err)
+	}
+	if err := erase("registry.example.com"); err != nil {
+		t.Errorf("failed to erase: %s", err)
+	}
+	if err := erase("registry.example.com"); err == nil || err.Error() != credentialsNotFound {
+		t.Errorf("expected %q, got %v", credentialsNotFound, err)
+	}
+
+	if err := ioutil.WriteFile(fn, []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadCache(); err == nil {
+		t.Errorf("invalid cache file accepted")
+	}
+}
+
+func TestDecodeTokenResponse(t *testing.T) {
+	decode := func(status int, body string) (*tokenResponse, error) {
+		req := httptest.NewRequest("POST", "https://auth.example.com/device/token", nil)
+		return decodeTokenResponse(&http.Response{
+			StatusCode: status, Status: http.StatusText(status), Request: req,
+			Body: ioutil.NopCloser(strings.NewReader(body)),
+		})
+	}
+	if tr, err := decode(http.StatusOK, `{"username":"octocat","password":"s3cr3t"}`); err != nil || tr.Username != "octocat" || tr.Password != "s3cr3t" {
+		t.Errorf("unexpected result: %+v, %v", tr, err)
+	}
+	// Errors are returned with the response, the device flow keeps polling on some of them.
+	if tr, err := decode(http.StatusBadRequest, `{"error":"authorization_pending"}`); err == nil || tr == nil || tr.Error != "authorization_pending" {
+		t.Errorf("unexpected result: %+v, %v", tr, err)
+	}
+	if tr, err := decode(http.StatusOK, `{}`); err == nil || tr != nil {
+		t.Errorf("response without credentials accepted: %+v", tr)
+	}
+	if tr, err := decode(http.StatusBadGateway, `<html>`); err == nil || tr != nil || !strings.Contains(err.Error(), "Bad Gateway") {
+		t.Errorf("unexpected result for invalid JSON: %+v, %v", tr, err)
+	}
+}
@@ -0,0 +1,226 @@
+/*
+   Copyright 2016 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// tokendb manages token databases of the Google and GitHub authenticators.
+//
+//	tokendb -config auth_config.yml -backend google_auth list
+//
+// lists users holding tokens, see usage for other commands. Secrets are never printed.
+// LevelDB databases cannot be used while the server is running, use the admin API instead.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/cesanta/docker_auth/auth_server/authn"
+	"github.com/cesanta/docker_auth/auth_server/server"
+)
+
+var (
+	configFile = flag.String("config", "", "Server config file.")
+	backend    = flag.String("backend", "", "Authenticator whose token DB to use: google_auth or github_auth.")
+	overwrite  = flag.Bool("overwrite", false, "migrate: replace tokens that already exist in the destination.")
+	dryRun     = flag.Bool("dry_run", false, "migrate: only report what would be copied.")
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s -config auth_config.yml -backend google_auth|github_auth <command> [args]\n\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "Commands:\n")
+	fmt.Fprintf(os.Stderr, "  list                    List users holding tokens.\n")
+	fmt.Fprintf(os.Stderr, "  show <user>             Show token information of a user.\n")
+	fmt.Fprintf(os.Stderr, "  revoke <user>           Delete the token of a user, they will have to sign in again.\n")
+	fmt.Fprintf(os.Stderr, "  expire <user>           Force revalidation with the provider on the next login.\n")
+	fmt.Fprintf(os.Stderr, "  purge <max age>         Delete tokens that expired more than max age (e.g. 720h) ago.\n")
+	fmt.Fprintf(os.Stderr, "  reencrypt               Encrypt all tokens with the current key of token_encryption.\n")
+	fmt.Fprintf(os.Stderr, "  migrate <leveldb path>  Copy tokens from a LevelDB database into the configured store.\n\n")
+	flag.PrintDefaults()
+}
+
+func fatalf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+	os.Exit(1)
+}
+
+// backendStore returns the token DB settings of the backend.
+func backendStore(c *server.Config) (string, *authn.TokenStoreConfig, *authn.TokenEncryptionConfig, error) {
+	switch *backend {
+	case "google_auth":
+		if c.GoogleAuth == nil {
+			return "", nil, nil, fmt.Errorf("google_auth is not configured")
+		}
+		return c.GoogleAuth.TokenDB, c.GoogleAuth.TokenStore, c.GoogleAuth.TokenEncryption, nil
+	case "github_auth":
+		if c.GitHubAuth == nil {
+			return "", nil, nil, fmt.Errorf("github_auth is not configured")
+		}
+		return c.GitHubAuth.TokenDB, c.GitHubAuth.TokenStore, c.GitHubAuth.TokenEncryption, nil
+	}
+	return "", nil, nil, fmt.Errorf("unknown backend %q", *backend)
+}
+
+func printTokens(tokens []authn.TokenInfo) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "USER\tTYPE\tVALID UNTIL\tEXPIRED\tREFRESH TOKEN")
+	for _, ti := range tokens {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%t\t%t\n", ti.User, ti.TokenType, ti.ValidUntil.Format(time.RFC3339), ti.Expired, ti.HasRefreshToken)
+	}
+	w.Flush()
+}
+
+func run(db authn.TokenDB, cmd string, args []string) error {
+	switch cmd {
+	case "list":
+		tokens, err := db.ListTokens()
+		if err != nil {
+			return err
+		}
+		printTokens(tokens)
+	case "show":
+		v, err := db.GetValue(args[0])
+		if err != nil {
+			return err
+		} else if v == nil {
+			return fmt.Errorf("no token for %s", args[0])
+		}
+		printTokens([]authn.TokenInfo{v.Info(args[0])})
+	case "revoke":
+		v, err := db.GetValue(args[0])
+		if err != nil {
+			return err
+		} else if v == nil {
+			return fmt.Errorf("no token for %s", args[0])
+		}
+		if err := db.DeleteToken(args[0]); err != nil {
+			return err
+		}
+		fmt.Printf("%s: revoked\n", args[0])
+	case "expire":
+		if err := db.ExpireToken(args[0]); err == authn.NoMatch {
+			return fmt.Errorf("no token for %s", args[0])
+		} else if err != nil {
+			return err
+		}
+		fmt.Printf("%s: expired\n", args[0])
+	case "purge":
+		maxAge, err := time.ParseDuration(args[0])
+		if err != nil || maxAge < 0 {
+			return fmt.Errorf("invalid max age %q", args[0])
+		}
+		n, err := db.PurgeExpired(maxAge)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%d purged\n", n)
+	case "reencrypt":
+		n, err := db.Reencrypt()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%d re-encrypted\n", n)
+	}
+	return nil
+}
+
+func migrate(dst authn.TokenStore, srcFile string) error {
+	// LevelDB can only be opened by one process, the server must not be using it.
+	src, err := authn.NewLevelDBTokenStore(srcFile)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %s", srcFile, err)
+	}
+	defer src.Close()
+	copied, skipped := 0, 0
+	err = src.ForEach(func(user string, data []byte) error {
+		if !*overwrite {
+			existing, err := dst.Get(user)
+			if err != nil {
+				return err
+			}
+			if existing != nil {
+				fmt.Printf("%s: exists, skipped\n", user)
+				skipped++
+				return nil
+			}
+		}
+		if !*dryRun {
+			if err := dst.Put(user, data); err != nil {
+				return fmt.Errorf("failed to store %s: %s", user, err)
+			}
+		}
+		fmt.Printf("%s: copied\n", user)
+		copied++
+		return nil
+	})
+	fmt.Printf("%d copied, %d skipped\n", copied, skipped)
+	return err
+}
+
+// Number of arguments of each command.
+var commands = map[string]int{
+	"list":      0,
+	"show":      1,
+	"revoke":    1,
+	"expire":    1,
+	"purge":     1,
+	"reencrypt": 0,
+	"migrate":   1,
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if *configFile == "" || *backend == "" || flag.NArg() < 1 {
+		usage()
+		os.Exit(2)
+	}
+	cmd := flag.Arg(0)
+	if nargs, ok := commands[cmd]; !ok || flag.NArg() != nargs+1 {
+		usage()
+		os.Exit(2)
+	}
+	c, err := server.LoadConfig(*configFile)
+	if err != nil {
+		fatalf("Failed to load config: %s", err)
+	}
+	file, sc, ec, err := backendStore(c)
+	if err != nil {
+		fatalf("%s", err)
+	}
+	if cmd == "migrate" {
+		store, err := authn.OpenTokenStore(file, sc)
+		if err != nil {
+			fatalf("Failed to open token store: %s", err)
+		}
+		err = migrate(store, flag.Arg(1))
+		store.Close()
+		if err != nil {
+			fatalf("%s", err)
+		}
+		return
+	}
+	db, err := authn.NewTokenDB(file, sc, ec)
+	if err != nil {
+		fatalf("Failed to open token DB: %s", err)
+	}
+	err = run(db, cmd, flag.Args()[1:])
+	db.Close()
+	if err != nil {
+		fatalf("%s", err)
+	}
+}
@@ -21,13 +21,18 @@ package main // import "github.com/cesanta/docker_auth/auth_server"
 import (
 	"crypto/tls"
 	"flag"
+	"fmt"
 	"math/rand"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
+	"github.com/cesanta/docker_auth/auth_server/metrics"
 	"github.com/cesanta/docker_auth/auth_server/server"
 	"github.com/facebookgo/httpdown"
 	"github.com/golang/glog"
@@ -37,67 +42,219 @@ import (
 type RestartableServer struct {
 	configFile string
 	hd         *httpdown.HTTP
-	authServer *server.AuthServer
+	config     *server.Config
+	current    atomic.Value // *authServerHandle
+	cert       atomic.Value // *tls.Certificate
 	hs         httpdown.Server
+	l          *mainListener
+	ms         httpdown.Server
+	msPath     atomic.Value // string
 }
 
-func ServeOnce(c *server.Config, cf string, hd *httpdown.HTTP) (*server.AuthServer, httpdown.Server) {
-	glog.Infof("Config from %s (%d users, %d ACL static entries)", cf, len(c.Users), len(c.ACL))
-	as, err := server.NewAuthServer(c)
+// mainListener applies TLS and PROXY protocol to accepted connections if they are enabled,
+// so that they can be changed on reload without reopening the socket.
+type mainListener struct {
+	*server.ProxyProtocolListener
+	tlsConfig atomic.Value // *tls.Config, nil without TLS
+}
+
+func (l *mainListener) Accept() (net.Conn, error) {
+	c, err := l.ProxyProtocolListener.Accept()
 	if err != nil {
-		glog.Exitf("Failed to create auth server: %s", err)
+		return nil, err
+	}
+	if tc := l.tlsConfig.Load().(*tls.Config); tc != nil {
+		c = tls.Server(c, tc)
 	}
+	return c, nil
+}
 
-	var tlsConfig *tls.Config
-	if c.Server.CertFile != "" || c.Server.KeyFile != "" {
-		// Check for partial configuration.
-		if c.Server.CertFile == "" || c.Server.KeyFile == "" {
-			glog.Exitf("Failed to load certificate and key: both were not provided")
-		}
-		tlsConfig = &tls.Config{
-			MinVersion:               tls.VersionTLS10,
-			PreferServerCipherSuites: true,
-			CipherSuites: []uint16{
-				tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
-				tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
-				tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
-				tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
-				tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
-				tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
-				tls.TLS_RSA_WITH_AES_128_CBC_SHA,
-				tls.TLS_RSA_WITH_AES_256_CBC_SHA,
-			},
-			NextProtos:   []string{"http/1.1"},
-			Certificates: make([]tls.Certificate, 1),
+// authServerHandle tracks requests in flight so that an auth server is only stopped
+// once it is no longer in use.
+type authServerHandle struct {
+	as      *server.AuthServer
+	lock    sync.RWMutex
+	stopped bool
+}
+
+func (h *authServerHandle) stop() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.stopped = true
+	h.as.Stop()
+}
+
+func (rs *RestartableServer) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	for {
+		h := rs.current.Load().(*authServerHandle)
+		h.lock.RLock()
+		if !h.stopped {
+			defer h.lock.RUnlock()
+			h.as.ServeHTTP(rw, req)
+			return
 		}
-		glog.Infof("Cert file: %s", c.Server.CertFile)
-		glog.Infof("Key file : %s", c.Server.KeyFile)
-		tlsConfig.Certificates[0], err = tls.LoadX509KeyPair(c.Server.CertFile, c.Server.KeyFile)
-		if err != nil {
-			glog.Exitf("Failed to load certificate and key: %s", err)
+		h.lock.RUnlock()
+		if rs.current.Load().(*authServerHandle) == h {
+			// Shutting down.
+			http.Error(rw, "Service unavailable", http.StatusServiceUnavailable)
+			return
 		}
-	} else {
+		// Server has been swapped while we were waiting, retry with the new one.
+	}
+}
+
+func loadServerCert(c *server.Config) (*tls.Certificate, error) {
+	if c.Server.CertFile == "" && c.Server.KeyFile == "" {
+		return nil, nil
+	}
+	// Check for partial configuration.
+	if c.Server.CertFile == "" || c.Server.KeyFile == "" {
+		return nil, fmt.Errorf("failed to load certificate and key: both were not provided")
+	}
+	glog.Infof("Cert file: %s", c.Server.CertFile)
+	glog.Infof("Key file : %s", c.Server.KeyFile)
+	cert, err := tls.LoadX509KeyPair(c.Server.CertFile, c.Server.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load certificate and key: %s", err)
+	}
+	return &cert, nil
+}
+
+// tlsConfig returns the TLS settings of the main listener, nil if TLS is not configured.
+// Certificate is looked up on every handshake so that it can be replaced without reopening the socket.
+func (rs *RestartableServer) tlsConfig(c *server.Config) *tls.Config {
+	if c.Server.CertFile == "" {
 		glog.Warning("Running without TLS")
+		return nil
 	}
-	hs := &http.Server{
-		Addr:      c.Server.ListenAddress,
-		Handler:   as,
-		TLSConfig: tlsConfig,
+	return &tls.Config{
+		MinVersion:               tls.VersionTLS10,
+		PreferServerCipherSuites: true,
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+			tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+			tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+		},
+		NextProtos: []string{"http/1.1"},
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return rs.cert.Load().(*tls.Certificate), nil
+		},
 	}
+}
 
-	s, err := hd.ListenAndServe(hs)
+// listen opens the main listener.
+func (rs *RestartableServer) listen(c *server.Config) (httpdown.Server, *mainListener, error) {
+	hs := &http.Server{
+		Addr:    c.Server.ListenAddress,
+		Handler: rs,
+	}
+	l, err := net.Listen("tcp", c.Server.ListenAddress)
 	if err != nil {
-		glog.Exitf("Failed to set up listener: %s", err)
+		return nil, nil, fmt.Errorf("failed to set up listener: %s", err)
 	}
+	ml := &mainListener{ProxyProtocolListener: server.WrapListener(l, c)}
+	ml.tlsConfig.Store(rs.tlsConfig(c))
+	s := rs.hd.Serve(hs, ml)
 	glog.Infof("Serving on %s", c.Server.ListenAddress)
-	return as, s
+	return s, ml, nil
+}
+
+// listenMetrics starts a separate metrics listener, if one is configured.
+// Path is looked up on every request, it can be changed without reopening the socket.
+func (rs *RestartableServer) listenMetrics(c *server.Config) (httpdown.Server, error) {
+	if c.Metrics == nil || c.Metrics.ListenAddress == "" {
+		return nil, nil
+	}
+	h := metrics.Handler()
+	handler := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != rs.msPath.Load().(string) {
+			http.NotFound(rw, req)
+			return
+		}
+		h.ServeHTTP(rw, req)
+	})
+	s, err := rs.hd.ListenAndServe(&http.Server{Addr: c.Metrics.ListenAddress, Handler: handler})
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up metrics listener: %s", err)
+	}
+	glog.Infof("Serving metrics on %s%s", c.Metrics.ListenAddress, c.Metrics.Path)
+	return s, nil
+}
+
+// listenerChanged tells whether the main listener has to be reopened for the new config.
+// TLS and PROXY protocol settings are switched on the open listener.
+func listenerChanged(oc, nc *server.Config) bool {
+	return oc.Server.ListenAddress != nc.Server.ListenAddress
+}
+
+func metricsListenerChanged(oc, nc *server.Config) bool {
+	oa, na := "", ""
+	if oc.Metrics != nil {
+		oa = oc.Metrics.ListenAddress
+	}
+	if nc.Metrics != nil {
+		na = nc.Metrics.ListenAddress
+	}
+	return oa != na
+}
+
+func metricsPath(c *server.Config) string {
+	if c.Metrics == nil {
+		return ""
+	}
+	return c.Metrics.Path
+}
+
+// newAuthServer creates an auth server and checks that all of its backends are ready.
+func newAuthServer(c *server.Config, cf string) (*server.AuthServer, error) {
+	glog.Infof("Config from %s (%d users, %d ACL static entries)", cf, len(c.Users), len(c.ACL))
+	as, err := server.NewAuthServer(c)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create auth server: %s", err)
+	}
+	if err = as.CheckReady(); err != nil {
+		as.Stop()
+		return nil, fmt.Errorf("auth server is not ready: %s", err)
+	}
+	return as, nil
 }
 
 func (rs *RestartableServer) Serve(c *server.Config) {
-	rs.authServer, rs.hs = ServeOnce(c, rs.configFile, rs.hd)
+	cert, err := loadServerCert(c)
+	if err != nil {
+		glog.Exitf("%s", err)
+	}
+	rs.cert.Store(cert)
+	glog.Infof("Config from %s (%d users, %d ACL static entries)", rs.configFile, len(c.Users), len(c.ACL))
+	as, err := server.NewAuthServer(c)
+	if err != nil {
+		glog.Exitf("Failed to create auth server: %s", err)
+	}
+	rs.current.Store(&authServerHandle{as: as})
+	rs.config = c
+	if rs.hs, rs.l, err = rs.listen(c); err != nil {
+		glog.Exitf("%s", err)
+	}
+	rs.msPath.Store(metricsPath(c))
+	if rs.ms, err = rs.listenMetrics(c); err != nil {
+		glog.Exitf("%s", err)
+	}
 	rs.WatchConfig()
 }
 
+func (rs *RestartableServer) stop() {
+	rs.hs.Stop()
+	if rs.ms != nil {
+		rs.ms.Stop()
+	}
+	rs.current.Load().(*authServerHandle).stop()
+}
+
 func (rs *RestartableServer) WatchConfig() {
 	w, err := fsnotify.NewWatcher()
 	if err != nil {
@@ -107,6 +264,10 @@ func (rs *RestartableServer) WatchConfig() {
 
 	stopSignals := make(chan os.Signal, 1)
 	signal.Notify(stopSignals, syscall.SIGTERM, syscall.SIGINT)
+	reloadSignals := make(chan os.Signal, 1)
+	signal.Notify(reloadSignals, syscall.SIGHUP)
+	refreshSignals := make(chan os.Signal, 1)
+	signal.Notify(refreshSignals, syscall.SIGUSR1)
 
 	err = w.Add(rs.configFile)
 	watching, needRestart := (err == nil), false
@@ -132,27 +293,103 @@ func (rs *RestartableServer) WatchConfig() {
 			} else if ev.Op == fsnotify.Write {
 				needRestart = true
 			}
+		case <-reloadSignals:
+			glog.Infof("Got SIGHUP")
+			rs.MaybeRestart()
+			needRestart = false
+		case <-refreshSignals:
+			glog.Infof("Got SIGUSR1")
+			rs.refreshACLs()
 		case s := <-stopSignals:
 			signal.Stop(stopSignals)
 			glog.Infof("Signal: %s", s)
-			rs.hs.Stop()
-			rs.authServer.Stop()
+			rs.stop()
 			glog.Exitf("Exiting")
 		}
 	}
 }
 
+// refreshACLs makes the current server reload cached ACL data.
+func (rs *RestartableServer) refreshACLs() {
+	h := rs.current.Load().(*authServerHandle)
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	if !h.stopped {
+		h.as.RefreshACLs()
+	}
+}
+
+// MaybeRestart reloads the config. The new auth server is created and checked before
+// it replaces the current one, if anything goes wrong the current one keeps serving.
 func (rs *RestartableServer) MaybeRestart() {
-	glog.Infof("Restarting server")
+	glog.Infof("Reloading config")
+	if err := rs.reload(); err != nil {
+		metrics.ConfigReloads.WithLabelValues("failure").Inc()
+		glog.Errorf("Failed to reload config (serving continues with the old one): %s", err)
+		return
+	}
+	metrics.ConfigReloads.WithLabelValues("success").Inc()
+	glog.Infof("New config is in effect")
+}
+
+func (rs *RestartableServer) reload() error {
 	c, err := server.LoadConfig(rs.configFile)
 	if err != nil {
-		glog.Errorf("Failed to reload config (server not restarted): %s", err)
-		return
+		return err
 	}
 	glog.Infof("New config loaded")
-	rs.hs.Stop()
-	rs.authServer.Stop()
-	rs.authServer, rs.hs = ServeOnce(c, rs.configFile, rs.hd)
+	cert, err := loadServerCert(c)
+	if err != nil {
+		return err
+	}
+	as, err := newAuthServer(c, rs.configFile)
+	if err != nil {
+		return err
+	}
+	oldCert := rs.cert.Load().(*tls.Certificate)
+	rs.cert.Store(cert)
+	var hs, ms httpdown.Server
+	var l *mainListener
+	metricsChanged := metricsListenerChanged(rs.config, c)
+	if listenerChanged(rs.config, c) {
+		if hs, l, err = rs.listen(c); err != nil {
+			rs.cert.Store(oldCert)
+			as.Stop()
+			return err
+		}
+	}
+	if metricsChanged {
+		if ms, err = rs.listenMetrics(c); err != nil {
+			if hs != nil {
+				hs.Stop()
+			}
+			rs.cert.Store(oldCert)
+			as.Stop()
+			return err
+		}
+	}
+	// Point of no return, swap the servers.
+	old := rs.current.Load().(*authServerHandle)
+	rs.current.Store(&authServerHandle{as: as})
+	if hs != nil {
+		rs.hs.Stop()
+		rs.hs, rs.l = hs, l
+	} else {
+		if (rs.config.Server.CertFile == "") != (c.Server.CertFile == "") {
+			rs.l.tlsConfig.Store(rs.tlsConfig(c))
+		}
+		rs.l.Update(c)
+	}
+	rs.msPath.Store(metricsPath(c))
+	if metricsChanged {
+		if rs.ms != nil {
+			rs.ms.Stop()
+		}
+		rs.ms = ms
+	}
+	rs.config = c
+	old.stop()
+	return nil
 }
 
 func main() {
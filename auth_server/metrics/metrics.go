@@ -0,0 +1,195 @@
+/*
+   Copyright 2016 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package metrics holds Prometheus metrics exported by the auth server.
+package metrics
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "docker_auth"
+
+// Outcomes of an /auth request.
+const (
+	OutcomeOK         = "ok"
+	OutcomeBadRequest = "bad_request"
+	OutcomeRateLimit  = "rate_limited"
+	OutcomeAuthnFail  = "authn_fail"
+	OutcomeAuthnError = "authn_error"
+	OutcomeAuthzError = "authz_error"
+	OutcomeTokenError = "token_error"
+)
+
+var (
+	Requests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "requests_total",
+		Help:      "Auth requests by outcome.",
+	}, []string{"outcome"})
+
+	AuthnDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "authn_duration_seconds",
+		Help:      "Time spent in authenticators.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"backend"})
+
+	AuthnErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "authn_errors_total",
+		Help:      "Errors returned by authenticators.",
+	}, []string{"backend"})
+
+	AuthzDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "authz_duration_seconds",
+		Help:      "Time spent in authorizers.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"backend"})
+
+	AuthzErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "authz_errors_total",
+		Help:      "Errors returned by authorizers.",
+	}, []string{"backend"})
+
+	TokensIssued = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "tokens_issued_total",
+		Help:      "Tokens issued by service, services not listed in the config are counted as \"other\".",
+	}, []string{"service"})
+
+	ActionsRequested = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "actions_requested_total",
+		Help:      "Actions requested in token scopes, unknown actions are counted as \"other\".",
+	}, []string{"action"})
+
+	ActionsGranted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "actions_granted_total",
+		Help:      "Actions granted in issued tokens, unknown actions are counted as \"other\".",
+	}, []string{"action"})
+
+	TokenDBOps = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "tokendb_operations_total",
+		Help:      "Token DB operations by type and result.",
+	}, []string{"op", "result"})
+
+	ConfigReloads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "config_reloads_total",
+		Help:      "Config reload attempts by result.",
+	}, []string{"result"})
+
+	WeakPasswordHashes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "weak_password_hashes_total",
+		Help:      "Successful logins with a password hash weaker than the policy, by backend and scheme.",
+	}, []string{"backend", "scheme"})
+
+	ACLCacheRefreshOK = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "acl_cache_last_refresh_success",
+		Help:      "Whether the last ACL cache refresh succeeded (1) or failed (0).",
+	}, []string{"backend"})
+
+	aclCache = &aclCacheCollector{
+		desc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "acl_cache_age_seconds"),
+			"Time since the ACL cache was last successfully updated.",
+			[]string{"backend"}, nil),
+		updated: make(map[string]time.Time),
+	}
+)
+
+func init() {
+	prometheus.MustRegister(
+		Requests, AuthnDuration, AuthnErrors, AuthzDuration, AuthzErrors,
+		TokensIssued, ActionsRequested, ActionsGranted, TokenDBOps, ConfigReloads,
+		WeakPasswordHashes, ACLCacheRefreshOK, aclCache)
+}
+
+// aclCacheCollector reports ACL cache age at scrape time.
+type aclCacheCollector struct {
+	desc    *prometheus.Desc
+	lock    sync.Mutex
+	updated map[string]time.Time
+}
+
+func (c *aclCacheCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *aclCacheCollector) Collect(ch chan<- prometheus.Metric) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for backend, t := range c.updated {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, time.Since(t).Seconds(), backend)
+	}
+}
+
+// ACLCacheRefreshed records the result of an ACL cache refresh.
+// lastUpdate is the time of the last successful update.
+func ACLCacheRefreshed(backend string, lastUpdate time.Time, err error) {
+	if err == nil {
+		ACLCacheRefreshOK.WithLabelValues(backend).Set(1)
+	} else {
+		ACLCacheRefreshOK.WithLabelValues(backend).Set(0)
+	}
+	if !lastUpdate.IsZero() {
+		aclCache.lock.Lock()
+		aclCache.updated[backend] = lastUpdate
+		aclCache.lock.Unlock()
+	}
+}
+
+// Actions reported by name, anything else a client asks for is counted as "other",
+// so that requests cannot create new time series.
+var knownActions = map[string]bool{"pull": true, "push": true, "delete": true, "*": true}
+
+// Other is the label value for services and actions that are not reported by name.
+const Other = "other"
+
+// ActionLabel returns the label value for an action.
+func ActionLabel(action string) string {
+	if knownActions[action] {
+		return action
+	}
+	return Other
+}
+
+// TokenDBOp records the result of a token DB operation.
+func TokenDBOp(op, result string) {
+	TokenDBOps.WithLabelValues(op, result).Inc()
+}
+
+// WeakPasswordHash records a login with a password hash weaker than the policy.
+func WeakPasswordHash(backend, scheme string) {
+	WeakPasswordHashes.WithLabelValues(backend, scheme).Inc()
+}
+
+// Handler returns the HTTP handler that serves metrics.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
@@ -0,0 +1,248 @@
+/*
+   Copyright 2016 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cesanta/docker_auth/auth_server/authn"
+	"github.com/golang/glog"
+)
+
+// AdminConfig enables the admin API on the main listener under Path.
+// Requests must carry the contents of TokenFile as a bearer token.
+type AdminConfig struct {
+	Path      string `yaml:"path,omitempty"`
+	TokenFile string `yaml:"token_file,omitempty"`
+
+	token string
+}
+
+func (c *AdminConfig) Validate() error {
+	if c.Path == "" {
+		c.Path = "/admin"
+	}
+	if !strings.HasPrefix(c.Path, "/") || strings.HasSuffix(c.Path, "/") {
+		return fmt.Errorf("path must start and not end with /, got %q", c.Path)
+	}
+	if c.TokenFile == "" {
+		return errors.New("token_file is required")
+	}
+	contents, err := ioutil.ReadFile(c.TokenFile)
+	if err != nil {
+		return fmt.Errorf("could not read %s: %s", c.TokenFile, err)
+	}
+	c.token = strings.TrimSpace(string(contents))
+	if len(c.token) < 16 {
+		return fmt.Errorf("token in %s is too short, use at least 16 characters", c.TokenFile)
+	}
+	return nil
+}
+
+func (c *AdminConfig) authorized(req *http.Request) bool {
+	auth := req.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(c.token)) == 1
+}
+
+// remoteAddr returns the address of the client, for logging.
+func (as *AuthServer) remoteAddr(req *http.Request) string {
+	if as.config.Server.RealIPHeader != "" {
+		if ra, err := realClientAddr(req, &as.config.Server); err == nil {
+			return ra
+		}
+	}
+	return req.RemoteAddr
+}
+
+func writeAdminResponse(rw http.ResponseWriter, v interface{}) {
+	result, err := json.Marshal(v)
+	if err != nil {
+		http.Error(rw, fmt.Sprintf("Failed to marshal response: %s", err), http.StatusInternalServerError)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Write(result)
+}
+
+// doAdmin serves the admin API.
+func (as *AuthServer) doAdmin(rw http.ResponseWriter, req *http.Request) {
+	ac := as.config.Admin
+	if !ac.authorized(req) {
+		glog.Warningf("Unauthorized admin request from %s: %s %s", as.remoteAddr(req), req.Method, req.URL.Path)
+		rw.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+		http.Error(rw, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	glog.Infof("Admin request from %s: %s %s", as.remoteAddr(req), req.Method, req.URL.Path)
+	parts := strings.Split(strings.TrimPrefix(req.URL.Path, ac.Path+"/"), "/")
+	switch parts[0] {
+	case "tokens":
+		as.doAdminTokens(rw, req, parts[1:])
+	case "mfa":
+		as.doAdminMFA(rw, req, parts[1:])
+	case "users":
+		as.doAdminUsers(rw, req, parts[1:])
+	case "acl":
+		as.doAdminACL(rw, req, parts[1:])
+	default:
+		http.Error(rw, "Not found", http.StatusNotFound)
+	}
+}
+
+// doAdminTokens manages token DBs of the Google and GitHub authenticators and MFA:
+//
+//	GET    tokens/<backend>                 list tokens
+//	POST   tokens/<backend>/_purge          delete tokens that expired more than max_age (default: purge_expired_after) ago
+//	POST   tokens/<backend>/_reencrypt      encrypt tokens in plain text or with an old key with the current key
+//	GET    tokens/<backend>/<user>          show token information
+//	DELETE tokens/<backend>/<user>          revoke the token
+//	POST   tokens/<backend>/<user>/expire   force revalidation on next login
+//
+// Secrets (tokens and password hashes) are never returned.
+func (as *AuthServer) doAdminTokens(rw http.ResponseWriter, req *http.Request, parts []string) {
+	if len(parts) == 0 || len(parts) > 3 {
+		http.Error(rw, "Not found", http.StatusNotFound)
+		return
+	}
+	db := as.tokenDBs[parts[0]]
+	if db == nil {
+		http.Error(rw, fmt.Sprintf("No token DB for %q", parts[0]), http.StatusNotFound)
+		return
+	}
+	route := req.Method + " "
+	if len(parts) > 1 {
+		if parts[1] == "_purge" || parts[1] == "_reencrypt" {
+			route += parts[1]
+		} else {
+			route += "user"
+		}
+	}
+	if len(parts) > 2 {
+		route += "/" + parts[2]
+	}
+	switch route {
+	case "GET ":
+		tokens, err := db.ListTokens()
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if tokens == nil {
+			tokens = []authn.TokenInfo{}
+		}
+		writeAdminResponse(rw, tokens)
+	case "POST _purge":
+		maxAge := as.purgeExpiredAfter(parts[0])
+		if s := req.URL.Query().Get("max_age"); s != "" {
+			d, err := time.ParseDuration(s)
+			if err != nil || d < 0 {
+				http.Error(rw, fmt.Sprintf("Invalid max_age %q", s), http.StatusBadRequest)
+				return
+			}
+			maxAge = d
+		} else if maxAge < 0 {
+			http.Error(rw, "Purging is disabled, max_age is required", http.StatusBadRequest)
+			return
+		}
+		n, err := db.PurgeExpired(maxAge)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		glog.Infof("Admin: purged %d tokens from %s", n, parts[0])
+		writeAdminResponse(rw, map[string]int{"purged": n})
+	case "POST _reencrypt":
+		n, err := db.Reencrypt()
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		glog.Infof("Admin: re-encrypted %d tokens in %s", n, parts[0])
+		writeAdminResponse(rw, map[string]int{"reencrypted": n})
+	case "GET user":
+		v, err := db.GetValue(parts[1])
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		} else if v == nil {
+			http.Error(rw, "Not found", http.StatusNotFound)
+			return
+		}
+		writeAdminResponse(rw, v.Info(parts[1]))
+	case "DELETE user":
+		v, err := db.GetValue(parts[1])
+		if err == nil && v == nil {
+			http.Error(rw, "Not found", http.StatusNotFound)
+			return
+		}
+		if err == nil {
+			err = db.DeleteToken(parts[1])
+		}
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		as.forgetCachedAuthn(parts[1])
+		glog.Infof("Admin: revoked %s token of %s", parts[0], parts[1])
+		writeAdminResponse(rw, map[string]string{"status": "revoked"})
+	case "POST user/expire":
+		err := db.ExpireToken(parts[1])
+		if err == authn.NoMatch {
+			http.Error(rw, "Not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		as.forgetCachedAuthn(parts[1])
+		glog.Infof("Admin: expired %s token of %s", parts[0], parts[1])
+		writeAdminResponse(rw, map[string]string{"status": "expired"})
+	default:
+		http.Error(rw, "Not found", http.StatusNotFound)
+	}
+}
+
+// forgetCachedAuthn drops cached authentication results of the user.
+func (as *AuthServer) forgetCachedAuthn(user string) {
+	for _, a := range as.authenticators {
+		if f, ok := a.(interface {
+			Forget(user string)
+		}); ok {
+			f.Forget(user)
+		}
+	}
+}
+
+func (as *AuthServer) purgeExpiredAfter(backend string) time.Duration {
+	switch backend {
+	case "google_auth":
+		return as.config.GoogleAuth.PurgeExpiredAfter
+	case "mfa":
+		return as.config.MFA.PurgeExpiredAfter
+	}
+	return as.config.GitHubAuth.PurgeExpiredAfter
+}
@@ -0,0 +1,292 @@
+/*
+   Copyright 2016 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/cesanta/docker_auth/auth_server/authn"
+	"github.com/cesanta/docker_auth/auth_server/authz"
+	"github.com/golang/glog"
+)
+
+// Limit on request bodies of the admin API.
+const maxAdminRequestSize = 1 << 20
+
+// adminUser is the request body for user changes. The password is in plain text and hashed by the server.
+type adminUser struct {
+	authn.MongoUser
+	Password string `json:"password,omitempty"`
+}
+
+func readAdminRequest(rw http.ResponseWriter, req *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(http.MaxBytesReader(rw, req.Body, maxAdminRequestSize)).Decode(v); err != nil {
+		http.Error(rw, fmt.Sprintf("Invalid request: %s", err), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// hashPassword hashes a password according to password_hash, or its defaults if it is not configured.
+func (as *AuthServer) hashPassword(password string) (string, error) {
+	policy := as.config.PasswordHash
+	if policy == nil {
+		policy = &authn.PasswordHashConfig{}
+		if err := policy.Validate("password_hash"); err != nil {
+			return "", err
+		}
+	}
+	return policy.Hash(authn.PasswordString(password))
+}
+
+// revokeMFAPassword deletes the Docker password the user got after MFA sign in, so that changes
+// of the account take effect immediately.
+func (as *AuthServer) revokeMFAPassword(user string) error {
+	db := as.tokenDBs["mfa"]
+	if db == nil {
+		return nil
+	}
+	if err := db.DeleteToken(user); err != nil {
+		return fmt.Errorf("failed to revoke MFA password: %s", err)
+	}
+	return nil
+}
+
+// doAdminUsers manages users of mongo_auth:
+//
+//	GET    users          list users
+//	POST   users          create a user, password is required
+//	GET    users/<name>   show the user
+//	PUT    users/<name>   replace attributes of the user, and the password if given
+//	DELETE users/<name>   delete the user
+//
+// Password hashes are never returned. Deleting a user, disabling it, setting an expiry or changing the password
+// revokes the Docker password the user got after MFA sign in.
+func (as *AuthServer) doAdminUsers(rw http.ResponseWriter, req *http.Request, parts []string) {
+	if as.mongoAuth == nil || len(parts) > 1 {
+		http.Error(rw, "Not found", http.StatusNotFound)
+		return
+	}
+	route := req.Method + " "
+	if len(parts) == 1 && parts[0] != "" {
+		route += "user"
+	}
+	switch route {
+	case "GET ":
+		users, err := as.mongoAuth.ListUsers()
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeAdminResponse(rw, users)
+	case "POST ", "PUT user":
+		var u adminUser
+		if !readAdminRequest(rw, req, &u) {
+			return
+		}
+		if route == "PUT user" {
+			u.Username = parts[0]
+		} else if u.Username == "" || u.Password == "" {
+			http.Error(rw, "username and password are required", http.StatusBadRequest)
+			return
+		}
+		var hash string
+		if u.Password != "" {
+			var err error
+			if hash, err = as.hashPassword(u.Password); err != nil {
+				http.Error(rw, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		var err error
+		if route == "POST " {
+			err = as.mongoAuth.CreateUser(&u.MongoUser, hash)
+		} else {
+			err = as.mongoAuth.UpdateUser(&u.MongoUser, hash)
+		}
+		switch err {
+		case nil:
+		case authn.UserExists:
+			http.Error(rw, err.Error(), http.StatusConflict)
+			return
+		case authn.NoMatch:
+			http.Error(rw, "Not found", http.StatusNotFound)
+			return
+		default:
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		as.forgetCachedAuthn(u.Username)
+		if route == "PUT user" && (u.Disabled || u.ExpiresAt != nil || hash != "") {
+			if err := as.revokeMFAPassword(u.Username); err != nil {
+				http.Error(rw, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		if route == "POST " {
+			glog.Infof("Admin: created user %s", u.Username)
+		} else {
+			glog.Infof("Admin: updated user %s (password changed: %t)", u.Username, hash != "")
+		}
+		writeAdminResponse(rw, &u.MongoUser)
+	case "GET user":
+		u, err := as.mongoAuth.GetUser(parts[0])
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		} else if u == nil {
+			http.Error(rw, "Not found", http.StatusNotFound)
+			return
+		}
+		writeAdminResponse(rw, u)
+	case "DELETE user":
+		err := as.mongoAuth.DeleteUser(parts[0])
+		if err == authn.NoMatch {
+			http.Error(rw, "Not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		as.forgetCachedAuthn(parts[0])
+		if err := as.revokeMFAPassword(parts[0]); err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		glog.Infof("Admin: deleted user %s", parts[0])
+		writeAdminResponse(rw, map[string]string{"status": "deleted"})
+	default:
+		http.Error(rw, "Not found", http.StatusNotFound)
+	}
+}
+
+// doAdminACL manages entries of acl_mongo, identified by seq. Positions are given with
+// ?before=<seq>, entries go to the end of the list without it.
+//
+//	GET    acl              list entries in the order they are evaluated
+//	POST   acl              add an entry
+//	GET    acl/<seq>        show the entry
+//	PUT    acl/<seq>        replace the entry
+//	DELETE acl/<seq>        delete the entry
+//	POST   acl/<seq>/move   move the entry
+//	POST   acl/_refresh     reload cached ACLs of all backends now, like SIGUSR1
+//
+// seq values are assigned by the server and may change when entries are moved or added.
+func (as *AuthServer) doAdminACL(rw http.ResponseWriter, req *http.Request, parts []string) {
+	if len(parts) == 1 && parts[0] == "_refresh" && req.Method == "POST" {
+		as.RefreshACLs()
+		glog.Infof("Admin: refreshed ACLs")
+		writeAdminResponse(rw, map[string]string{"status": "refreshed"})
+		return
+	}
+	if as.aclMongo == nil || len(parts) > 2 {
+		http.Error(rw, "Not found", http.StatusNotFound)
+		return
+	}
+	route := req.Method + " "
+	var seq int
+	if len(parts) > 0 && parts[0] != "" {
+		var err error
+		if seq, err = strconv.Atoi(parts[0]); err != nil {
+			http.Error(rw, "Not found", http.StatusNotFound)
+			return
+		}
+		route += "entry"
+	}
+	if len(parts) > 1 {
+		route += "/" + parts[1]
+	}
+	var before *int
+	if s := req.URL.Query().Get("before"); s != "" {
+		b, err := strconv.Atoi(s)
+		if err != nil {
+			http.Error(rw, fmt.Sprintf("Invalid before %q", s), http.StatusBadRequest)
+			return
+		}
+		before = &b
+	}
+	switch route {
+	case "GET ", "GET entry":
+		acl, err := as.aclMongo.Entries()
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if route == "GET " {
+			writeAdminResponse(rw, acl)
+			return
+		}
+		for _, e := range acl {
+			if *e.Seq == seq {
+				writeAdminResponse(rw, e)
+				return
+			}
+		}
+		http.Error(rw, "Not found", http.StatusNotFound)
+	case "POST ", "PUT entry":
+		var e authz.ACLEntry
+		if !readAdminRequest(rw, req, &e) {
+			return
+		}
+		if err := authz.ValidateACLEntry(&e); err != nil {
+			http.Error(rw, fmt.Sprintf("Invalid entry: %s", err), http.StatusBadRequest)
+			return
+		}
+		var err error
+		if route == "POST " {
+			seq, err = as.aclMongo.AddEntry(e, before)
+		} else {
+			err = as.aclMongo.UpdateEntry(seq, e)
+		}
+		if err == authz.NoMatch {
+			http.Error(rw, "Not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		glog.Infof("Admin: stored ACL entry %d: %s", seq, e)
+		writeAdminResponse(rw, &authz.MongoACLEntry{ACLEntry: e, Seq: &seq})
+	case "DELETE entry":
+		err := as.aclMongo.DeleteEntry(seq)
+		if err == authz.NoMatch {
+			http.Error(rw, "Not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		glog.Infof("Admin: deleted ACL entry %d", seq)
+		writeAdminResponse(rw, map[string]string{"status": "deleted"})
+	case "POST entry/move":
+		err := as.aclMongo.MoveEntry(seq, before)
+		if err == authz.NoMatch {
+			http.Error(rw, "Not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		glog.Infof("Admin: moved ACL entry %d", seq)
+		writeAdminResponse(rw, map[string]string{"status": "moved"})
+	default:
+		http.Error(rw, "Not found", http.StatusNotFound)
+	}
+}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cesanta/docker_auth/auth_server/authn"
+)
+
+func TestAdminTokens(t *testing.T) {
+	dir, err := ioutil.TempDir("", "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := authn.NewTokenDB(filepath.Join(dir, "tokens.ldb"), nil, nil)
+	if err != nil {
+		t.Fatalf("failed to open token DB: %s", err)
+	}
+	defer db.Close()
+	as := &AuthServer{
+		config: &Config{
+			GitHubAuth: &authn.GitHubAuthConfig{PurgeExpiredAfter: -1},
+			Admin:      &AdminConfig{Path: "/admin", token: "0123456789abcdef"},
+		},
+		tokenDBs: map[string]authn.TokenDB{"github_auth": db},
+	}
+	v := &authn.TokenDBValue{TokenType: "bearer", AccessToken: "s3cr3t-access", ValidUntil: time.Now().Add(time.Hour)}
+	if _, err := db.StoreToken("octocat", v, true); err != nil {
+		t.Fatalf("failed to store token: %s", err)
+	}
+
+	do := func(method, path, token string) (int, string) {
+		req := httptest.NewRequest(method, path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rw := httptest.NewRecorder()
+		as.ServeHTTP(rw, req)
+		return rw.Code, rw.Body.String()
+	}
+	const token = "0123456789abcdef"
+
+	if code, _ := do("GET", "/admin/tokens/github_auth", ""); code != http.StatusUnauthorized {
+		t.Errorf("expected 401 without token, got %d", code)
+	}
+	if code, _ := do("GET", "/admin/tokens/github_auth", "wrong"); code != http.StatusUnauthorized {
+		t.Errorf("expected 401 with wrong token, got %d", code)
+	}
+	if code, _ := do("GET", "/admin/tokens/google_auth", token); code != http.StatusNotFound {
+		t.Errorf("expected 404 for unconfigured backend, got %d", code)
+	}
+	for _, path := range []string{"/admin/users", "/admin/acl"} {
+		if code, _ := do("GET", path, token); code != http.StatusNotFound {
+			t.Errorf("expected 404 for %s without MongoDB, got %d", path, code)
+		}
+	}
+	if code, body := do("POST", "/admin/acl/_refresh", token); code != http.StatusOK || !strings.Contains(body, "refreshed") {
+		t.Errorf("unexpected response to refresh: %d %s", code, body)
+	}
+
+	code, body := do("GET", "/admin/tokens/github_auth", token)
+	var tokens []authn.TokenInfo
+	if code != http.StatusOK || json.Unmarshal([]byte(body), &tokens) != nil || len(tokens) != 1 || tokens[0].User != "octocat" {
+		t.Fatalf("unexpected list response: %d %s", code, body)
+	}
+	if strings.Contains(body, "s3cr3t") || strings.Contains(body, "password") {
+		t.Errorf("secrets leaked: %s", body)
+	}
+
+	if code, body := do("POST", "/admin/tokens/github_auth/octocat/expire", token); code != http.StatusOK {
+		t.Errorf("failed to expire: %d %s", code, body)
+	}
+	if code, body := do("GET", "/admin/tokens/github_auth/octocat", token); code != http.StatusOK || !strings.Contains(body, `"expired":true`) {
+		t.Errorf("token was not expired: %d %s", code, body)
+	}
+	if code, _ := do("POST", "/admin/tokens/github_auth/_purge", token); code != http.StatusBadRequest {
+		t.Errorf("purge without max_age should fail when disabled, got %d", code)
+	}
+	if code, body := do("POST", "/admin/tokens/github_auth/_purge?max_age=24h", token); code != http.StatusOK || body != `{"purged":0}` {
+		t.Errorf("unexpected purge response: %d %s", code, body)
+	}
+	if code, body := do("POST", "/admin/tokens/github_auth/_reencrypt", token); code != http.StatusOK || body != `{"reencrypted":0}` {
+		t.Errorf("unexpected reencrypt response: %d %s", code, body)
+	}
+	if code, body := do("DELETE", "/admin/tokens/github_auth/octocat", token); code != http.StatusOK {
+		t.Errorf("failed to revoke: %d %s", code, body)
+	}
+	if code, _ := do("DELETE", "/admin/tokens/github_auth/octocat", token); code != http.StatusNotFound {
+		t.Errorf("expected 404 for revoked token, got %d", code)
+	}
+}
+
+func TestRevokeMFAPassword(t *testing.T) {
+	dir, err := ioutil.TempDir("", "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	as := &AuthServer{tokenDBs: map[string]authn.TokenDB{}}
+	if err := as.revokeMFAPassword("alice"); err != nil {
+		t.Errorf("revoking without MFA failed: %s", err)
+	}
+	db, err := authn.NewTokenDB(filepath.Join(dir, "tokens.ldb"), nil, nil)
+	if err != nil {
+		t.Fatalf("failed to open token DB: %s", err)
+	}
+	defer db.Close()
+	as.tokenDBs["mfa"] = db
+	v := &authn.TokenDBValue{TokenType: "mfa", ValidUntil: time.Now().Add(time.Hour)}
+	if _, err := db.StoreToken("alice", v, true); err != nil {
+		t.Fatalf("failed to store token: %s", err)
+	}
+	if err := as.revokeMFAPassword("alice"); err != nil {
+		t.Fatalf("failed to revoke: %s", err)
+	}
+	if v, err := db.GetValue("alice"); v != nil || err != nil {
+		t.Errorf("MFA password not revoked: %v, %v", v, err)
+	}
+}
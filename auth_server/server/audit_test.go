@@ -0,0 +1,92 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/cesanta/docker_auth/auth_server/audit"
+	"github.com/cesanta/docker_auth/auth_server/metrics"
+	"github.com/docker/distribution/registry/auth/token"
+)
+
+func TestRecordOutcome(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+	al, err := audit.New(&audit.Config{File: &audit.FileConfig{Path: path}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	as := &AuthServer{config: &Config{}, audit: al}
+
+	req := httptest.NewRequest("GET", "/auth", nil)
+	pull := authScope{Type: "repository", Name: "library/alpine", Actions: []string{"pull", "push"}}
+	ar := &authRequest{
+		User: "john", Account: "john", Service: "registry", RemoteIP: net.ParseIP("10.0.0.1"),
+		AuthnBackend: "static", Scopes: []authScope{pull},
+	}
+	ares := []authzResult{{scope: pull, autorizedActions: []string{"pull"}, authorizer: "static ACL", comment: "readers"}}
+	exp := time.Now().Add(time.Hour).Truncate(time.Second)
+	claims := &token.ClaimSet{JWTID: "abc123", Expiration: exp.Unix()}
+	as.recordOutcome(req, ar, ares, claims, metrics.OutcomeOK, nil)
+
+	failed := &authRequest{User: "john", Account: "john", Service: "registry", Scopes: []authScope{pull}}
+	as.recordOutcome(req, failed, nil, nil, metrics.OutcomeAuthnFail, nil)
+	as.recordOutcome(req, failed, nil, nil, metrics.OutcomeRateLimit, nil)
+	al.Close()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var recs []audit.Record
+	for s := bufio.NewScanner(f); s.Scan(); {
+		var r audit.Record
+		if err := json.Unmarshal(s.Bytes(), &r); err != nil {
+			t.Fatalf("line %q: %s", s.Text(), err)
+		}
+		recs = append(recs, r)
+	}
+	if len(recs) != 3 {
+		t.Fatalf("expected 3 records, got %+v", recs)
+	}
+
+	ok := recs[0]
+	if ok.Outcome != metrics.OutcomeOK || ok.Account != "john" || ok.Login != "" || ok.Service != "registry" ||
+		ok.RealIP != "10.0.0.1" || ok.Authn != "static" {
+		t.Errorf("unexpected record: %+v", ok)
+	}
+	expected := []audit.ScopeRecord{{
+		Type: "repository", Name: "library/alpine", Requested: []string{"pull", "push"},
+		Granted: []string{"pull"}, Authorizer: "static ACL", Comment: "readers",
+	}}
+	if !reflect.DeepEqual(ok.Scopes, expected) {
+		t.Errorf("expected scopes %+v, got %+v", expected, ok.Scopes)
+	}
+	if ok.TokenID != "abc123" || ok.TokenExpiry == nil || !ok.TokenExpiry.Equal(exp) {
+		t.Errorf("unexpected token: %s %v", ok.TokenID, ok.TokenExpiry)
+	}
+
+	for i, outcome := range []string{metrics.OutcomeAuthnFail, metrics.OutcomeRateLimit} {
+		r := recs[i+1]
+		if r.Outcome != outcome || r.Account != "john" || r.TokenID != "" || r.TokenExpiry != nil {
+			t.Errorf("%s: unexpected record: %+v", outcome, r)
+		}
+		expected := []audit.ScopeRecord{{Type: "repository", Name: "library/alpine", Requested: []string{"pull", "push"}, Granted: []string{}}}
+		if !reflect.DeepEqual(r.Scopes, expected) {
+			t.Errorf("%s: expected scopes %+v, got %+v", outcome, expected, r.Scopes)
+		}
+	}
+}
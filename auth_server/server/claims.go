@@ -0,0 +1,134 @@
+/*
+   Copyright 2016 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+const defaultMaxExtraClaimsSize = 4096
+
+// Claims that are set by the server itself and cannot be overridden.
+var reservedClaims = map[string]bool{
+	"iss": true, "sub": true, "aud": true, "exp": true,
+	"nbf": true, "iat": true, "jti": true, "access": true,
+}
+
+var (
+	labelVarRegex = regexp.MustCompile(`\$\{labels:([^}]+)\}`)
+	claimVarRegex = regexp.MustCompile(`\$\{(account|service|client_ip|authn_backend|labels:[^}]+)\}`)
+)
+
+func validateExtraClaims(tc *TokenConfig) error {
+	for name := range tc.ExtraClaims {
+		if name == "" {
+			return errors.New("claim name must not be empty")
+		}
+		if reservedClaims[name] {
+			return fmt.Errorf("%q is a reserved claim", name)
+		}
+	}
+	if tc.MaxExtraClaimsSize < 0 {
+		return fmt.Errorf("max_extra_claims_size must not be negative, got %d", tc.MaxExtraClaimsSize)
+	}
+	if tc.MaxExtraClaimsSize == 0 {
+		tc.MaxExtraClaimsSize = defaultMaxExtraClaimsSize
+	}
+	return nil
+}
+
+// expandClaimValue substitutes request variables in a claim value.
+// A value consisting of just "${labels}" or "${labels:name}" produces an object or a list
+// respectively, anything else produces a string.
+func expandClaimValue(v string, ar *authRequest) interface{} {
+	if v == "${labels}" {
+		if ar.Labels == nil {
+			return map[string][]string{}
+		}
+		return ar.Labels
+	}
+	if m := labelVarRegex.FindStringSubmatch(v); m != nil && m[0] == v {
+		if l := ar.Labels[m[1]]; l != nil {
+			return l
+		}
+		return []string{}
+	}
+	clientIP := ""
+	if ar.RemoteIP != nil {
+		clientIP = ar.RemoteIP.String()
+	}
+	vars := map[string]string{
+		"account":       ar.Account,
+		"service":       ar.Service,
+		"client_ip":     clientIP,
+		"authn_backend": ar.AuthnBackend,
+	}
+	// One pass, values are inserted as they are: a label containing "${account}" stays that way.
+	return claimVarRegex.ReplaceAllStringFunc(v, func(m string) string {
+		name := claimVarRegex.FindStringSubmatch(m)[1]
+		if strings.HasPrefix(name, "labels:") {
+			return strings.Join(ar.Labels[strings.TrimPrefix(name, "labels:")], ",")
+		}
+		return vars[name]
+	})
+}
+
+// buildExtraClaims evaluates configured extra claims for the request.
+// Claims are added in name order, those that do not fit within the size limit are dropped.
+func buildExtraClaims(tc *TokenConfig, ar *authRequest) map[string]json.RawMessage {
+	names := make([]string, 0, len(tc.ExtraClaims))
+	for name := range tc.ExtraClaims {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	res := make(map[string]json.RawMessage)
+	size := 0
+	for _, name := range names {
+		vj, err := json.Marshal(expandClaimValue(tc.ExtraClaims[name], ar))
+		if err != nil {
+			glog.Errorf("Failed to marshal claim %q: %s", name, err)
+			continue
+		}
+		// "name":value,
+		cs := len(name) + len(vj) + 4
+		if size+cs > tc.MaxExtraClaimsSize {
+			glog.Warningf("Claim %q for %s dropped: size limit (%d) exceeded", name, ar.Account, tc.MaxExtraClaimsSize)
+			continue
+		}
+		size += cs
+		res[name] = vj
+	}
+	return res
+}
+
+func addExtraClaims(claimsJSON []byte, extra map[string]json.RawMessage) ([]byte, error) {
+	var claims map[string]json.RawMessage
+	if err := json.Unmarshal(claimsJSON, &claims); err != nil {
+		return nil, err
+	}
+	for name, v := range extra {
+		claims[name] = v
+	}
+	return json.Marshal(claims)
+}
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"net"
+	"testing"
+
+	"github.com/cesanta/docker_auth/auth_server/authn"
+)
+
+func TestExtraClaims(t *testing.T) {
+	ar := &authRequest{
+		Account:      "john",
+		Service:      "registry",
+		RemoteIP:     net.IPv4(10, 0, 0, 1),
+		AuthnBackend: "LDAP",
+		Labels:       authn.Labels{"groups": []string{"dev", "ops"}, "team": []string{"${account}"}},
+	}
+	tc := &TokenConfig{
+		ExtraClaims: map[string]string{
+			"authn_backend": "${authn_backend}",
+			"client_ip":     "${client_ip}",
+			"groups":        "${labels:groups}",
+			"labels":        "${labels}",
+			"missing":       "${labels:missing}",
+			"who":           "${account}@${service} in ${labels:groups}",
+			"team":          "team ${labels:team} of ${account}",
+		},
+	}
+	if err := validateExtraClaims(tc); err != nil {
+		t.Fatalf("validation failed: %s", err)
+	}
+	expected := map[string]string{
+		"authn_backend": `"LDAP"`,
+		"client_ip":     `"10.0.0.1"`,
+		"groups":        `["dev","ops"]`,
+		"labels":        `{"groups":["dev","ops"],"team":["${account}"]}`,
+		"missing":       `[]`,
+		"who":           `"john@registry in dev,ops"`,
+		"team":          `"team ${account} of john"`,
+	}
+	claims := buildExtraClaims(tc, ar)
+	for name, v := range expected {
+		if string(claims[name]) != v {
+			t.Errorf("%s: expected %s, got %s", name, v, claims[name])
+		}
+	}
+
+	tc.MaxExtraClaimsSize = 50
+	claims = buildExtraClaims(tc, ar)
+	if len(claims) != 2 || claims["authn_backend"] == nil || claims["client_ip"] == nil {
+		t.Errorf("size limit not enforced: %s", claims)
+	}
+
+	for _, name := range []string{"sub", "access", ""} {
+		if validateExtraClaims(&TokenConfig{ExtraClaims: map[string]string{name: "x"}}) == nil {
+			t.Errorf("claim %q should not be allowed", name)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+/*
+   Copyright 2016 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package server
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Login from the credential helper (cmd/docker-credential-docker_auth): the helper opens /cli_login
+// in the browser with a loopback redirect URI, the user confirms, and the browser is sent back to
+// the helper with a one-time code, which the helper exchanges for a password at /cli_login/token.
+// As in OAuth, the code is bound to the helper with PKCE (S256).
+
+const cliCodeTTL = time.Minute
+
+// cliGrant is a code issued to the credential helper, stored under a hash of the code.
+type cliGrant struct {
+	User      string    `json:"user"`
+	Provider  string    `json:"provider"`
+	Challenge string    `json:"challenge"`
+	Expires   time.Time `json:"expires"`
+}
+
+type cliLoginPage struct {
+	Issuer        string
+	CSRFToken     string
+	User          string
+	RedirectURI   string
+	State         string
+	CodeChallenge string
+}
+
+type cliTokenRequest struct {
+	Code         string `json:"code"`
+	CodeVerifier string `json:"code_verifier"`
+}
+
+// validateLoopbackRedirect only allows sending codes to a port on this machine.
+func validateLoopbackRedirect(uri string) error {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(u.Hostname())
+	if u.Scheme != "http" || (u.Hostname() != "localhost" && (ip == nil || !ip.IsLoopback())) || u.Port() == "" || u.User != nil || u.RawQuery != "" || u.Fragment != "" {
+		return errors.New("redirect_uri must be a loopback http URL with a port, without query")
+	}
+	return nil
+}
+
+func cliCodeKey(code string) string {
+	h := sha256.Sum256([]byte(code))
+	return "c:" + hex.EncodeToString(h[:])
+}
+
+// doCLILogin asks the signed in user to confirm login of the credential helper.
+func (as *AuthServer) doCLILogin(rw http.ResponseWriter, req *http.Request) {
+	page := &cliLoginPage{
+		Issuer:        as.config.Token.Issuer,
+		RedirectURI:   req.FormValue("redirect_uri"),
+		State:         req.FormValue("state"),
+		CodeChallenge: req.FormValue("code_challenge"),
+	}
+	if err := validateLoopbackRedirect(page.RedirectURI); err != nil || page.State == "" || len(page.CodeChallenge) != 43 {
+		as.renderError(rw, http.StatusBadRequest, "Invalid login request, redirect_uri, state and code_challenge are required.")
+		return
+	}
+	if req.Method == "GET" && as.config.Portal.getSession(req) == nil {
+		as.config.Portal.setReturnTo(rw, req, req.URL.RequestURI())
+		http.Redirect(rw, req, "/", http.StatusFound)
+		return
+	}
+	s, _ := as.sessionTokenDB(rw, req)
+	if s == nil {
+		return
+	}
+	page.User = s.User
+	page.CSRFToken = as.web.CSRFToken(rw, req)
+	switch req.Method {
+	case "GET":
+		as.renderPage(rw, http.StatusOK, "cli_login", page)
+		return
+	case "POST":
+	default:
+		http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !as.web.CheckCSRFToken(req, req.PostFormValue("csrf_token")) {
+		as.renderError(rw, http.StatusForbidden, "Invalid request, please reload the page and try again.")
+		return
+	}
+	params := url.Values{"state": {page.State}}
+	if req.PostFormValue("action") != "allow" {
+		params.Set("error", "access_denied")
+	} else {
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			as.renderError(rw, http.StatusInternalServerError, "Failed to issue a code, please try again.")
+			return
+		}
+		code := base64.RawURLEncoding.EncodeToString(b)
+		g := &cliGrant{User: s.User, Provider: s.Provider, Challenge: page.CodeChallenge, Expires: time.Now().Add(cliCodeTTL)}
+		data, _ := json.Marshal(g)
+		if err := as.devices.Put(cliCodeKey(code), data); err != nil {
+			glog.Errorf("Failed to store credential helper grant: %s", err)
+			as.renderError(rw, http.StatusInternalServerError, "Failed to issue a code, please try again later.")
+			return
+		}
+		params.Set("code", code)
+		glog.Infof("Portal: %s allowed credential helper login from %s", s.User, as.remoteAddr(req))
+	}
+	http.Redirect(rw, req, page.RedirectURI+"?"+params.Encode(), http.StatusSeeOther)
+}
+
+// doCLIToken exchanges a code for a Docker password. Codes can only be used once.
+func (as *AuthServer) doCLIToken(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var tr cliTokenRequest
+	if err := json.NewDecoder(req.Body).Decode(&tr); err != nil || tr.Code == "" || tr.CodeVerifier == "" {
+		writeDeviceError(rw, http.StatusBadRequest, "invalid_request")
+		return
+	}
+	key := cliCodeKey(tr.Code)
+	data, err := as.devices.Get(key)
+	if err != nil {
+		glog.Errorf("Failed to get credential helper grant: %s", err)
+		writeDeviceError(rw, http.StatusInternalServerError, "server_error")
+		return
+	}
+	var g cliGrant
+	if data == nil || json.Unmarshal(data, &g) != nil {
+		writeDeviceError(rw, http.StatusBadRequest, "invalid_grant")
+		return
+	}
+	as.devices.Delete(key)
+	h := sha256.Sum256([]byte(tr.CodeVerifier))
+	challenge := base64.RawURLEncoding.EncodeToString(h[:])
+	if time.Now().After(g.Expires) || subtle.ConstantTimeCompare([]byte(challenge), []byte(g.Challenge)) != 1 {
+		writeDeviceError(rw, http.StatusBadRequest, "invalid_grant")
+		return
+	}
+	password, err := as.issuePassword(g.User, g.Provider)
+	if err != nil {
+		glog.Errorf("Failed to issue credential helper password for %s: %s", g.User, err)
+		writeDeviceError(rw, http.StatusInternalServerError, "server_error")
+		return
+	}
+	glog.Infof("Credential helper password of %s delivered to %s", g.User, as.remoteAddr(req))
+	rw.Header().Set("Cache-Control", "no-store")
+	writeAdminResponse(rw, &deviceTokenResponse{Username: g.User, Password: password})
+}
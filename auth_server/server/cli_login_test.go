@@ -0,0 +1,88 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cesanta/docker_auth/auth_server/authn"
+)
+
+func TestCLILogin(t *testing.T) {
+	pt := newPortalTest(t, &Config{DeviceAuth: &DeviceAuthConfig{}})
+	defer pt.close()
+	as, db, csrfToken, do := pt.as, pt.db, pt.csrfToken, pt.do
+	if _, err := db.StoreToken("octocat", &authn.TokenDBValue{TokenType: "bearer", ValidUntil: time.Now().Add(time.Hour)}, true); err != nil {
+		t.Fatalf("failed to store token: %s", err)
+	}
+	pt.signIn("octocat", "github_auth")
+	exchange := func(code, verifier string) (int, string) {
+		body, _ := json.Marshal(&cliTokenRequest{Code: code, CodeVerifier: verifier})
+		req := httptest.NewRequest("POST", "/cli_login/token", strings.NewReader(string(body)))
+		rw := httptest.NewRecorder()
+		as.ServeHTTP(rw, req)
+		return rw.Code, strings.TrimSpace(rw.Body.String())
+	}
+	const verifier = "dBjftJeZ4CVP-mJ92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	h := sha256.Sum256([]byte(verifier))
+	params := url.Values{
+		"redirect_uri":   {"http://127.0.0.1:41234/callback"},
+		"state":          {"xyz"},
+		"code_challenge": {base64.RawURLEncoding.EncodeToString(h[:])},
+	}
+
+	for _, ru := range []string{"https://127.0.0.1:41234/", "http://127.0.0.1/", "http://evil.example.com:41234/", "http://127.0.0.1:41234/callback?code=forged", ""} {
+		bad := url.Values{"redirect_uri": {ru}, "state": {"xyz"}, "code_challenge": params["code_challenge"]}
+		if rw := do("GET", "/cli_login?"+bad.Encode(), nil, true); rw.Code != http.StatusBadRequest {
+			t.Errorf("%q: expected redirect URI to be rejected, got %d", ru, rw.Code)
+		}
+	}
+	if rw := do("GET", "/cli_login?"+params.Encode(), nil, false); rw.Code != http.StatusFound || !strings.Contains(rw.Header().Get("Set-Cookie"), returnToCookieName) {
+		t.Errorf("anonymous user was not sent to sign in: %d %v", rw.Code, rw.Header())
+	}
+	if rw := do("GET", "/cli_login?"+params.Encode(), nil, true); rw.Code != http.StatusOK || !strings.Contains(rw.Body.String(), "Allow") {
+		t.Errorf("unexpected confirmation page: %d %s", rw.Code, rw.Body)
+	}
+	params.Set("action", "allow")
+	if rw := do("POST", "/cli_login", params, true); rw.Code != http.StatusForbidden {
+		t.Errorf("allowed without CSRF token: %d", rw.Code)
+	}
+	params.Set("csrf_token", csrfToken)
+	rw := do("POST", "/cli_login", params, true)
+	loc, err := url.Parse(rw.Header().Get("Location"))
+	if rw.Code != http.StatusSeeOther || err != nil || loc.Host != "127.0.0.1:41234" || loc.Query().Get("state") != "xyz" || loc.Query().Get("code") == "" {
+		t.Fatalf("unexpected redirect: %d %s", rw.Code, rw.Header().Get("Location"))
+	}
+	code := loc.Query().Get("code")
+
+	if status, body := exchange(code, "wrong-verifier"); status != http.StatusBadRequest || body != `{"error":"invalid_grant"}` {
+		t.Errorf("expected invalid_grant for wrong verifier, got %d %s", status, body)
+	}
+	if _, body := exchange(code, verifier); body != `{"error":"invalid_grant"}` {
+		t.Errorf("code usable after a failed exchange: %s", body)
+	}
+
+	rw = do("POST", "/cli_login", params, true)
+	loc, _ = url.Parse(rw.Header().Get("Location"))
+	status, body := exchange(loc.Query().Get("code"), verifier)
+	var dtr deviceTokenResponse
+	if status != http.StatusOK || json.Unmarshal([]byte(body), &dtr) != nil || dtr.Username != "octocat" {
+		t.Fatalf("failed to get password: %d %s", status, body)
+	}
+	if err := db.ValidateToken("octocat", authn.PasswordString(dtr.Password)); err != nil {
+		t.Errorf("helper password is invalid: %s", err)
+	}
+
+	params.Set("action", "deny")
+	rw = do("POST", "/cli_login", params, true)
+	loc, _ = url.Parse(rw.Header().Get("Location"))
+	if loc.Query().Get("error") != "access_denied" || loc.Query().Get("code") != "" {
+		t.Errorf("unexpected redirect on deny: %s", rw.Header().Get("Location"))
+	}
+}
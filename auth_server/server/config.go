@@ -22,9 +22,11 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"strings"
 	"time"
 
+	"github.com/cesanta/docker_auth/auth_server/audit"
 	"github.com/cesanta/docker_auth/auth_server/authn"
 	"github.com/cesanta/docker_auth/auth_server/authz"
 	"github.com/docker/libtrust"
@@ -32,26 +34,49 @@ import (
 )
 
 type Config struct {
-	Server     ServerConfig                   `yaml:"server"`
-	Token      TokenConfig                    `yaml:"token"`
-	Users      map[string]*authn.Requirements `yaml:"users,omitempty"`
-	GoogleAuth *authn.GoogleAuthConfig        `yaml:"google_auth,omitempty"`
-	GitHubAuth *authn.GitHubAuthConfig        `yaml:"github_auth,omitempty"`
-	LDAPAuth   *authn.LDAPAuthConfig          `yaml:"ldap_auth,omitempty"`
-	MongoAuth  *authn.MongoAuthConfig         `yaml:"mongo_auth,omitempty"`
-	ExtAuth    *authn.ExtAuthConfig           `yaml:"ext_auth,omitempty"`
-	ACL        authz.ACL                      `yaml:"acl,omitempty"`
-	ACLMongo   *authz.ACLMongoConfig          `yaml:"acl_mongo,omitempty"`
+	Server       ServerConfig                   `yaml:"server"`
+	Token        TokenConfig                    `yaml:"token"`
+	Users        map[string]*authn.Requirements `yaml:"users,omitempty"`
+	GoogleAuth   *authn.GoogleAuthConfig        `yaml:"google_auth,omitempty"`
+	GitHubAuth   *authn.GitHubAuthConfig        `yaml:"github_auth,omitempty"`
+	LDAPAuth     *authn.LDAPAuthConfig          `yaml:"ldap_auth,omitempty"`
+	MongoAuth    *authn.MongoAuthConfig         `yaml:"mongo_auth,omitempty"`
+	ExtAuth      *authn.ExtAuthConfig           `yaml:"ext_auth,omitempty"`
+	SQLAuth      *authn.SQLAuthConfig           `yaml:"sql_auth,omitempty"`
+	AuthnCache   map[string]*authn.CacheConfig  `yaml:"authn_cache,omitempty"`
+	ACL          authz.ACL                      `yaml:"acl,omitempty"`
+	ACLMongo     *authz.ACLMongoConfig          `yaml:"acl_mongo,omitempty"`
+	ACLLDAP      *authz.ACLLDAPConfig           `yaml:"acl_ldap,omitempty"`
+	ACLSQL       *authz.ACLSQLConfig            `yaml:"acl_sql,omitempty"`
+	Metrics      *MetricsConfig                 `yaml:"metrics,omitempty"`
+	Audit        *audit.Config                  `yaml:"audit,omitempty"`
+	RateLimit    *RateLimitConfig               `yaml:"rate_limit,omitempty"`
+	Admin        *AdminConfig                   `yaml:"admin,omitempty"`
+	Portal       *PortalConfig                  `yaml:"portal,omitempty"`
+	DeviceAuth   *DeviceAuthConfig              `yaml:"device_auth,omitempty"`
+	MFA          *authn.MFAConfig               `yaml:"mfa,omitempty"`
+	PasswordHash *authn.PasswordHashConfig      `yaml:"password_hash,omitempty"`
 }
 
 type ServerConfig struct {
-	ListenAddress string `yaml:"addr,omitempty"`
-	RealIPHeader  string `yaml:"real_ip_header,omitempty"`
-	CertFile      string `yaml:"certificate,omitempty"`
-	KeyFile       string `yaml:"key,omitempty"`
+	ListenAddress  string   `yaml:"addr,omitempty"`
+	RealIPHeader   string   `yaml:"real_ip_header,omitempty"`
+	TrustedProxies []string `yaml:"trusted_proxies,omitempty"`
+	ProxyProtocol  bool     `yaml:"proxy_protocol,omitempty"`
+	CertFile       string   `yaml:"certificate,omitempty"`
+	KeyFile        string   `yaml:"key,omitempty"`
 
-	publicKey  libtrust.PublicKey
-	privateKey libtrust.PrivateKey
+	publicKey      libtrust.PublicKey
+	privateKey     libtrust.PrivateKey
+	trustedProxies []*net.IPNet
+}
+
+type MetricsConfig struct {
+	// If set, metrics are served on a separate listener, otherwise on the main one.
+	ListenAddress string `yaml:"addr,omitempty"`
+	Path          string `yaml:"path,omitempty"`
+	// Services reported by name in tokens_issued_total, others are counted as "other".
+	Services []string `yaml:"services,omitempty"`
 }
 
 type TokenConfig struct {
@@ -60,6 +85,10 @@ type TokenConfig struct {
 	KeyFile    string `yaml:"key,omitempty"`
 	Expiration int64  `yaml:"expiration,omitempty"`
 
+	// Additional claims to put into issued tokens, values may contain variables.
+	ExtraClaims        map[string]string `yaml:"extra_claims,omitempty"`
+	MaxExtraClaimsSize int               `yaml:"max_extra_claims_size,omitempty"`
+
 	publicKey  libtrust.PublicKey
 	privateKey libtrust.PrivateKey
 }
@@ -68,6 +97,11 @@ func validate(c *Config) error {
 	if c.Server.ListenAddress == "" {
 		return errors.New("server.addr is required")
 	}
+	tps, err := parseTrustedProxies(c.Server.TrustedProxies)
+	if err != nil {
+		return fmt.Errorf("invalid server.trusted_proxies: %s", err)
+	}
+	c.Server.trustedProxies = tps
 
 	if c.Token.Issuer == "" {
 		return errors.New("token.issuer is required")
@@ -75,7 +109,10 @@ func validate(c *Config) error {
 	if c.Token.Expiration <= 0 {
 		return fmt.Errorf("expiration must be positive, got %d", c.Token.Expiration)
 	}
-	if c.Users == nil && c.ExtAuth == nil && c.GoogleAuth == nil && c.GitHubAuth == nil && c.LDAPAuth == nil && c.MongoAuth == nil {
+	if err := validateExtraClaims(&c.Token); err != nil {
+		return fmt.Errorf("bad token.extra_claims: %s", err)
+	}
+	if c.Users == nil && c.ExtAuth == nil && c.GoogleAuth == nil && c.GitHubAuth == nil && c.LDAPAuth == nil && c.MongoAuth == nil && c.SQLAuth == nil {
 		return errors.New("no auth methods are configured, this is probably a mistake. Use an empty user map if you really want to deny everyone.")
 	}
 	if c.MongoAuth != nil {
@@ -83,6 +120,11 @@ func validate(c *Config) error {
 			return err
 		}
 	}
+	if c.SQLAuth != nil {
+		if err := c.SQLAuth.Validate("sql_auth"); err != nil {
+			return err
+		}
+	}
 	if gac := c.GoogleAuth; gac != nil {
 		if gac.ClientSecretFile != "" {
 			contents, err := ioutil.ReadFile(gac.ClientSecretFile)
@@ -91,12 +133,32 @@ func validate(c *Config) error {
 			}
 			gac.ClientSecret = strings.TrimSpace(string(contents))
 		}
-		if gac.ClientId == "" || gac.ClientSecret == "" || gac.TokenDB == "" {
+		if gac.ClientId == "" || gac.ClientSecret == "" || (gac.TokenDB == "" && gac.TokenStore == nil) {
 			return errors.New("google_auth.{client_id,client_secret,token_db} are required.")
 		}
+		if gac.TokenStore != nil {
+			if gac.TokenDB != "" {
+				return errors.New("google_auth.token_db and google_auth.token_store are mutually exclusive")
+			}
+			if err := gac.TokenStore.Validate("google_auth.token_store"); err != nil {
+				return err
+			}
+		}
+		if gac.TokenEncryption != nil {
+			if err := gac.TokenEncryption.Validate("google_auth.token_encryption"); err != nil {
+				return err
+			}
+		}
+		if err := gac.Validate("google_auth"); err != nil {
+			return err
+		}
 		if gac.HTTPTimeout <= 0 {
 			gac.HTTPTimeout = 10
 		}
+		if gac.PurgeExpiredAfter == 0 {
+			// Unused refresh tokens expire after 6 months.
+			gac.PurgeExpiredAfter = 180 * 24 * time.Hour
+		}
 	}
 	if ghac := c.GitHubAuth; ghac != nil {
 		if ghac.ClientSecretFile != "" {
@@ -106,9 +168,25 @@ func validate(c *Config) error {
 			}
 			ghac.ClientSecret = strings.TrimSpace(string(contents))
 		}
-		if ghac.ClientId == "" || ghac.ClientSecret == "" || ghac.TokenDB == "" {
+		if ghac.ClientId == "" || ghac.ClientSecret == "" || (ghac.TokenDB == "" && ghac.TokenStore == nil) {
 			return errors.New("github_auth.{client_id,client_secret,token_db} are required.")
 		}
+		if ghac.TokenStore != nil {
+			if ghac.TokenDB != "" {
+				return errors.New("github_auth.token_db and github_auth.token_store are mutually exclusive")
+			}
+			if err := ghac.TokenStore.Validate("github_auth.token_store"); err != nil {
+				return err
+			}
+		}
+		if ghac.TokenEncryption != nil {
+			if err := ghac.TokenEncryption.Validate("github_auth.token_encryption"); err != nil {
+				return err
+			}
+		}
+		if err := ghac.Validate("github_auth"); err != nil {
+			return err
+		}
 		if ghac.HTTPTimeout <= 0 {
 			ghac.HTTPTimeout = time.Duration(10 * time.Second)
 		}
@@ -116,13 +194,35 @@ func validate(c *Config) error {
 			// Token expires after 1 hour by default
 			ghac.RevalidateAfter = time.Duration(1 * time.Hour)
 		}
+		if ghac.PurgeExpiredAfter == 0 {
+			// Unused OAuth tokens are revoked after a year.
+			ghac.PurgeExpiredAfter = 365 * 24 * time.Hour
+		}
+	}
+	if c.LDAPAuth != nil {
+		if err := c.LDAPAuth.Validate(); err != nil {
+			return fmt.Errorf("bad ldap_auth config: %s", err)
+		}
 	}
 	if c.ExtAuth != nil {
 		if err := c.ExtAuth.Validate(); err != nil {
 			return fmt.Errorf("bad ext_auth config: %s", err)
 		}
 	}
-	if c.ACL == nil && c.ACLMongo == nil {
+	for section, cc := range c.AuthnCache {
+		switch section {
+		case "users", "ext_auth", "google_auth", "github_auth", "ldap_auth", "mongo_auth", "sql_auth":
+		default:
+			return fmt.Errorf("bad authn_cache config: unknown authenticator %q", section)
+		}
+		if cc == nil {
+			return fmt.Errorf("bad authn_cache.%s config: empty", section)
+		}
+		if err := cc.Validate(); err != nil {
+			return fmt.Errorf("bad authn_cache.%s config: %s", section, err)
+		}
+	}
+	if c.ACL == nil && c.ACLMongo == nil && c.ACLLDAP == nil && c.ACLSQL == nil {
 		return errors.New("ACL is empty, this is probably a mistake. Use an empty list if you really want to deny all actions")
 	}
 	if c.ACLMongo != nil {
@@ -130,6 +230,69 @@ func validate(c *Config) error {
 			return err
 		}
 	}
+	if c.ACLLDAP != nil {
+		if err := c.ACLLDAP.Validate("acl_ldap"); err != nil {
+			return err
+		}
+	}
+	if c.ACLSQL != nil {
+		if err := c.ACLSQL.Validate("acl_sql"); err != nil {
+			return err
+		}
+	}
+	if c.RateLimit != nil {
+		if err := c.RateLimit.Validate(); err != nil {
+			return fmt.Errorf("bad rate_limit config: %s", err)
+		}
+	}
+	if c.Audit != nil {
+		if err := c.Audit.Validate(); err != nil {
+			return fmt.Errorf("bad audit config: %s", err)
+		}
+	}
+	if c.Admin != nil {
+		if err := c.Admin.Validate(); err != nil {
+			return fmt.Errorf("bad admin config: %s", err)
+		}
+	}
+	if c.Portal == nil {
+		c.Portal = &PortalConfig{}
+	}
+	if err := c.Portal.Validate(); err != nil {
+		return fmt.Errorf("bad portal config: %s", err)
+	}
+	if c.PasswordHash != nil {
+		if err := c.PasswordHash.Validate("password_hash"); err != nil {
+			return err
+		}
+	}
+	if c.MFA != nil {
+		if c.Users == nil && c.MongoAuth == nil && c.SQLAuth == nil {
+			return errors.New("mfa requires users, mongo_auth or sql_auth")
+		}
+		if c.MFA.Issuer == "" {
+			c.MFA.Issuer = c.Token.Issuer
+		}
+		if err := c.MFA.Validate("mfa"); err != nil {
+			return err
+		}
+	}
+	if c.DeviceAuth != nil {
+		if c.GoogleAuth == nil && c.GitHubAuth == nil && c.MFA == nil {
+			return errors.New("device_auth requires google_auth, github_auth or mfa")
+		}
+		if err := c.DeviceAuth.Validate(); err != nil {
+			return fmt.Errorf("bad device_auth config: %s", err)
+		}
+	}
+	if mc := c.Metrics; mc != nil {
+		if mc.Path == "" {
+			mc.Path = "/metrics"
+		}
+		if !strings.HasPrefix(mc.Path, "/") {
+			return fmt.Errorf("metrics.path must start with /, got %q", mc.Path)
+		}
+	}
 	return nil
 }
 
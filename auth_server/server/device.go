@@ -0,0 +1,467 @@
+/*
+   Copyright 2016 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package server
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cesanta/docker_auth/auth_server/authn"
+	"github.com/golang/glog"
+)
+
+// DeviceAuthConfig enables the device authorization flow (RFC 8628) for hosts without a browser:
+// the host gets a short code, the user approves it in the portal and the host receives a Docker password.
+type DeviceAuthConfig struct {
+	// Where pending authorizations are kept. In memory if not set, which only works with a single instance.
+	Store *authn.TokenStoreConfig `yaml:"store,omitempty"`
+	// URL of /device as seen by the browser. Derived from requests if not set.
+	VerificationURI string        `yaml:"verification_uri,omitempty"`
+	CodeTTL         time.Duration `yaml:"code_ttl,omitempty"`
+	PollInterval    time.Duration `yaml:"poll_interval,omitempty"`
+	// Limit on pending authorizations, new ones are refused when it is reached.
+	MaxPending int `yaml:"max_pending,omitempty"`
+}
+
+func (c *DeviceAuthConfig) Validate() error {
+	if c.CodeTTL == 0 {
+		c.CodeTTL = 10 * time.Minute
+	}
+	if c.PollInterval == 0 {
+		c.PollInterval = 5 * time.Second
+	}
+	if c.MaxPending == 0 {
+		c.MaxPending = 1000
+	}
+	if c.CodeTTL < time.Minute || c.PollInterval < time.Second {
+		return errors.New("code_ttl must be at least 1m and poll_interval at least 1s")
+	}
+	if c.MaxPending < 0 {
+		return errors.New("max_pending must not be negative")
+	}
+	if c.VerificationURI != "" {
+		if u, err := url.Parse(c.VerificationURI); err != nil || !u.IsAbs() {
+			return fmt.Errorf("verification_uri must be an absolute URL, got %q", c.VerificationURI)
+		}
+	}
+	if c.Store != nil {
+		return c.Store.Validate("device_auth.store")
+	}
+	return nil
+}
+
+const (
+	deviceStatusPending  = "pending"
+	deviceStatusApproved = "approved"
+	deviceStatusDenied   = "denied"
+
+	// Ambiguous letters and vowels (to avoid words) are left out.
+	userCodeAlphabet = "BCDFGHJKLMNPQRSTVWXZ"
+
+	deviceGrantPurgeInterval = time.Minute
+)
+
+// deviceGrant is a pending device authorization, stored under a hash of the device code.
+// No secrets are stored: the password is issued when the device polls after approval.
+type deviceGrant struct {
+	UserCode string    `json:"user_code"`
+	Expires  time.Time `json:"expires"`
+	Status   string    `json:"status"`
+	User     string    `json:"user,omitempty"`
+	Provider string    `json:"provider,omitempty"` // Config section of the authenticator that issues the password.
+	LastPoll time.Time `json:"last_poll,omitempty"`
+}
+
+type deviceCodeResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int    `json:"interval"`
+}
+
+type deviceTokenResponse struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type devicePage struct {
+	Issuer    string
+	CSRFToken string
+	User      string
+	UserCode  string
+	Status    string // Empty until the code is approved or denied.
+	Error     string
+}
+
+// memTokenStore keeps values in memory.
+type memTokenStore struct {
+	mu     sync.Mutex
+	values map[string][]byte
+}
+
+func newMemTokenStore() *memTokenStore {
+	return &memTokenStore{values: make(map[string][]byte)}
+}
+
+func (ms *memTokenStore) Get(key string) ([]byte, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return ms.values[key], nil
+}
+
+func (ms *memTokenStore) Put(key string, data []byte) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.values[key] = data
+	return nil
+}
+
+func (ms *memTokenStore) Delete(key string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	delete(ms.values, key)
+	return nil
+}
+
+func (ms *memTokenStore) ForEach(f func(key string, data []byte) error) error {
+	ms.mu.Lock()
+	values := make(map[string][]byte, len(ms.values))
+	for k, v := range ms.values {
+		values[k] = v
+	}
+	ms.mu.Unlock()
+	for k, v := range values {
+		if err := f(k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ms *memTokenStore) Close() error {
+	return nil
+}
+
+func openDeviceStore(c *DeviceAuthConfig) (authn.TokenStore, error) {
+	if c.Store == nil {
+		return newMemTokenStore(), nil
+	}
+	return authn.OpenTokenStore("", c.Store)
+}
+
+func newUserCode() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	code := make([]byte, 0, 9)
+	for i, c := range b {
+		if i == 4 {
+			code = append(code, '-')
+		}
+		// 256 is not a multiple of 20, the bias is negligible for a short-lived code.
+		code = append(code, userCodeAlphabet[int(c)%len(userCodeAlphabet)])
+	}
+	return string(code)
+}
+
+// normalizeUserCode accepts codes typed in lower case, without or with extra separators.
+func normalizeUserCode(s string) string {
+	s = strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(s))
+	if len(s) != 8 {
+		return ""
+	}
+	return s[:4] + "-" + s[4:]
+}
+
+func deviceStoreKey(deviceCode string) string {
+	h := sha256.Sum256([]byte(deviceCode))
+	return "d:" + hex.EncodeToString(h[:])
+}
+
+func (as *AuthServer) getDeviceGrant(key string) (*deviceGrant, error) {
+	data, err := as.devices.Get(key)
+	if err != nil || data == nil {
+		return nil, err
+	}
+	var g deviceGrant
+	if err := json.Unmarshal(data, &g); err != nil {
+		return nil, fmt.Errorf("bad device grant: %s", err)
+	}
+	return &g, nil
+}
+
+func (as *AuthServer) putDeviceGrant(key string, g *deviceGrant) error {
+	data, err := json.Marshal(g)
+	if err != nil {
+		return err
+	}
+	return as.devices.Put(key, data)
+}
+
+func (as *AuthServer) deleteDeviceGrant(key string, g *deviceGrant) {
+	as.devices.Delete("u:" + g.UserCode)
+	as.devices.Delete(key)
+}
+
+// purgeDeviceGrantsLoop purges expired grants periodically, until Stop is called.
+func (as *AuthServer) purgeDeviceGrantsLoop() {
+	as.purgeDeviceGrants()
+	for {
+		select {
+		case <-as.deviceStop:
+			return
+		case <-time.After(deviceGrantPurgeInterval):
+			as.purgeDeviceGrants()
+		}
+	}
+}
+
+// purgeDeviceGrants deletes expired device and credential helper grants and counts the ones left.
+func (as *AuthServer) purgeDeviceGrants() {
+	now := time.Now()
+	var expired []string
+	var pending int64
+	as.devices.ForEach(func(key string, data []byte) error {
+		var g deviceGrant
+		if strings.HasPrefix(key, "u:") || json.Unmarshal(data, &g) != nil {
+			return nil
+		}
+		if !now.After(g.Expires) {
+			pending++
+			return nil
+		}
+		expired = append(expired, key)
+		if g.UserCode != "" {
+			expired = append(expired, "u:"+g.UserCode)
+		}
+		return nil
+	})
+	for _, key := range expired {
+		as.devices.Delete(key)
+	}
+	atomic.StoreInt64(&as.devicePending, pending)
+}
+
+func writeDeviceError(rw http.ResponseWriter, status int, code string) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.WriteHeader(status)
+	json.NewEncoder(rw).Encode(map[string]string{"error": code})
+}
+
+func (as *AuthServer) verificationURI(req *http.Request) string {
+	if vu := as.config.DeviceAuth.VerificationURI; vu != "" {
+		return vu
+	}
+	return fmt.Sprintf("%s://%s/device", as.web.Scheme(req), req.Host)
+}
+
+// doDeviceCode starts a device authorization.
+func (as *AuthServer) doDeviceCode(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	dc := as.config.DeviceAuth
+	if as.limiter != nil {
+		if wait := as.limiter.Check(newRateLimitKey(&authRequest{RemoteIP: parseRemoteAddr(as.remoteAddr(req))})); wait > 0 {
+			rw.Header().Set("Retry-After", fmt.Sprintf("%d", int(math.Ceil(wait.Seconds()))))
+			writeDeviceError(rw, http.StatusTooManyRequests, "slow_down")
+			return
+		}
+	}
+	// Counted by the periodic purge, and as grants are added in between.
+	if atomic.LoadInt64(&as.devicePending) >= int64(dc.MaxPending) {
+		glog.Warningf("Refusing device authorization from %s: %d are pending", as.remoteAddr(req), dc.MaxPending)
+		writeDeviceError(rw, http.StatusServiceUnavailable, "temporarily_unavailable")
+		return
+	}
+	deviceCode := make([]byte, 32)
+	if _, err := rand.Read(deviceCode); err != nil {
+		writeDeviceError(rw, http.StatusInternalServerError, "server_error")
+		return
+	}
+	resp := &deviceCodeResponse{
+		DeviceCode:      base64.RawURLEncoding.EncodeToString(deviceCode),
+		UserCode:        newUserCode(),
+		VerificationURI: as.verificationURI(req),
+		ExpiresIn:       int(dc.CodeTTL.Seconds()),
+		Interval:        int(dc.PollInterval.Seconds()),
+	}
+	resp.VerificationURIComplete = resp.VerificationURI + "?user_code=" + url.QueryEscape(resp.UserCode)
+	key := deviceStoreKey(resp.DeviceCode)
+	g := &deviceGrant{UserCode: resp.UserCode, Expires: time.Now().Add(dc.CodeTTL), Status: deviceStatusPending}
+	err := as.putDeviceGrant(key, g)
+	if err == nil {
+		err = as.devices.Put("u:"+g.UserCode, []byte(key))
+	}
+	if err != nil {
+		glog.Errorf("Failed to store device grant: %s", err)
+		writeDeviceError(rw, http.StatusInternalServerError, "server_error")
+		return
+	}
+	atomic.AddInt64(&as.devicePending, 1)
+	glog.Infof("Device authorization %s requested from %s", g.UserCode, as.remoteAddr(req))
+	writeAdminResponse(rw, resp)
+}
+
+// doDeviceToken is polled by the device until the user approves or denies the code.
+// Errors are reported as in RFC 8628, the password is handed out once.
+func (as *AuthServer) doDeviceToken(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	deviceCode := req.PostFormValue("device_code")
+	key := deviceStoreKey(deviceCode)
+	g, err := as.getDeviceGrant(key)
+	if err != nil {
+		glog.Errorf("Failed to get device grant: %s", err)
+		writeDeviceError(rw, http.StatusInternalServerError, "server_error")
+		return
+	}
+	switch {
+	case deviceCode == "" || g == nil:
+		writeDeviceError(rw, http.StatusBadRequest, "invalid_grant")
+	case time.Now().After(g.Expires):
+		as.deleteDeviceGrant(key, g)
+		writeDeviceError(rw, http.StatusBadRequest, "expired_token")
+	case g.Status == deviceStatusDenied:
+		as.deleteDeviceGrant(key, g)
+		writeDeviceError(rw, http.StatusBadRequest, "access_denied")
+	case g.Status == deviceStatusApproved:
+		as.deleteDeviceGrant(key, g)
+		password, err := as.issuePassword(g.User, g.Provider)
+		if err != nil {
+			glog.Errorf("Failed to issue device password for %s: %s", g.User, err)
+			writeDeviceError(rw, http.StatusInternalServerError, "server_error")
+			return
+		}
+		glog.Infof("Device authorization %s: password of %s delivered to %s", g.UserCode, g.User, as.remoteAddr(req))
+		rw.Header().Set("Cache-Control", "no-store")
+		writeAdminResponse(rw, &deviceTokenResponse{Username: g.User, Password: password})
+	case time.Since(g.LastPoll) < as.config.DeviceAuth.PollInterval:
+		g.LastPoll = time.Now()
+		as.putDeviceGrant(key, g)
+		writeDeviceError(rw, http.StatusBadRequest, "slow_down")
+	default:
+		g.LastPoll = time.Now()
+		as.putDeviceGrant(key, g)
+		writeDeviceError(rw, http.StatusBadRequest, "authorization_pending")
+	}
+}
+
+// doDevice is the portal page where signed in users approve device codes.
+func (as *AuthServer) doDevice(rw http.ResponseWriter, req *http.Request) {
+	if as.config.Portal.getSession(req) == nil {
+		// Come back here after signing in.
+		as.config.Portal.setReturnTo(rw, req, "/device?user_code="+url.QueryEscape(req.FormValue("user_code")))
+		http.Redirect(rw, req, "/", http.StatusFound)
+		return
+	}
+	s, _ := as.sessionTokenDB(rw, req)
+	if s == nil {
+		return
+	}
+	page := &devicePage{
+		Issuer:    as.config.Token.Issuer,
+		CSRFToken: as.web.CSRFToken(rw, req),
+		User:      s.User,
+		UserCode:  req.FormValue("user_code"),
+	}
+	switch req.Method {
+	case "GET":
+	case "POST":
+		if !as.web.CheckCSRFToken(req, req.PostFormValue("csrf_token")) {
+			as.renderError(rw, http.StatusForbidden, "Invalid request, please reload the page and try again.")
+			return
+		}
+		page.Status, page.Error = as.decideDevice(s, normalizeUserCode(page.UserCode), req.PostFormValue("action") == "approve")
+		if page.Error == "" {
+			glog.Infof("Portal: %s %s device authorization %s from %s", s.User, page.Status, page.UserCode, as.remoteAddr(req))
+		}
+	default:
+		http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	as.renderPage(rw, http.StatusOK, "device", page)
+}
+
+// decideDevice approves or denies the device code on behalf of the user.
+func (as *AuthServer) decideDevice(s *portalSession, userCode string, approve bool) (status, errMsg string) {
+	const notFound = "Unknown or expired code, please check it and try again."
+	if userCode == "" {
+		return "", notFound
+	}
+	key, err := as.devices.Get("u:" + userCode)
+	var g *deviceGrant
+	if err == nil && key != nil {
+		g, err = as.getDeviceGrant(string(key))
+	}
+	if err != nil {
+		glog.Errorf("Failed to get device grant: %s", err)
+		return "", "Failed to look up the code, please try again later."
+	}
+	if g == nil || time.Now().After(g.Expires) || g.Status != deviceStatusPending {
+		return "", notFound
+	}
+	g.Status = deviceStatusDenied
+	if approve {
+		g.Status, g.User, g.Provider = deviceStatusApproved, s.User, s.Provider
+	}
+	if err := as.putDeviceGrant(string(key), g); err != nil {
+		glog.Errorf("Failed to store device grant: %s", err)
+		return "", "Failed to store the decision, please try again later."
+	}
+	return g.Status, ""
+}
+
+// issuePassword issues a new Docker password to a user who signed in with the provider.
+// As with signing in again, the previous password stops working.
+func (as *AuthServer) issuePassword(user, provider string) (string, error) {
+	db := as.tokenDBs[provider]
+	if db == nil {
+		return "", fmt.Errorf("no token DB for %q", provider)
+	}
+	v, err := db.GetValue(user)
+	if err != nil {
+		return "", err
+	} else if v == nil {
+		return "", errors.New("user has signed out")
+	}
+	dp, err := db.StoreToken(user, v, true)
+	if err != nil {
+		return "", err
+	}
+	as.forgetCachedAuthn(user)
+	return dp, nil
+}
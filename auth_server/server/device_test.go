@@ -0,0 +1,126 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cesanta/docker_auth/auth_server/authn"
+)
+
+func TestDeviceAuth(t *testing.T) {
+	dc := &DeviceAuthConfig{PollInterval: time.Second}
+	pt := newPortalTest(t, &Config{DeviceAuth: dc})
+	defer pt.close()
+	as, db, csrfToken, do := pt.as, pt.db, pt.csrfToken, pt.do
+	v := &authn.TokenDBValue{TokenType: "bearer", AccessToken: "s3cr3t-access", ValidUntil: time.Now().Add(time.Hour)}
+	oldPassword, err := db.StoreToken("octocat", v, true)
+	if err != nil {
+		t.Fatalf("failed to store token: %s", err)
+	}
+	pt.signIn("octocat", "github_auth")
+	start := func() *deviceCodeResponse {
+		rw := do("POST", "/device/code", nil, false)
+		var dcr deviceCodeResponse
+		if rw.Code != http.StatusOK || json.Unmarshal(rw.Body.Bytes(), &dcr) != nil || len(dcr.UserCode) != 9 {
+			t.Fatalf("failed to get device code: %d %s", rw.Code, rw.Body)
+		}
+		return &dcr
+	}
+	poll := func(deviceCode string) (int, string) {
+		rw := do("POST", "/device/token", url.Values{"device_code": {deviceCode}}, false)
+		return rw.Code, strings.TrimSpace(rw.Body.String())
+	}
+
+	dcr := start()
+	if dcr.VerificationURIComplete != "http://example.com/device?user_code="+dcr.UserCode {
+		t.Errorf("unexpected verification URI: %s", dcr.VerificationURIComplete)
+	}
+	if code, body := poll(dcr.DeviceCode); code != http.StatusBadRequest || body != `{"error":"authorization_pending"}` {
+		t.Errorf("expected authorization_pending, got %d %s", code, body)
+	}
+	if _, body := poll(dcr.DeviceCode); body != `{"error":"slow_down"}` {
+		t.Errorf("expected slow_down, got %s", body)
+	}
+	if _, body := poll("bogus"); body != `{"error":"invalid_grant"}` {
+		t.Errorf("expected invalid_grant, got %s", body)
+	}
+
+	if rw := do("GET", "/device?user_code="+dcr.UserCode, nil, false); rw.Code != http.StatusFound || !strings.Contains(rw.Header().Get("Set-Cookie"), returnToCookieName) {
+		t.Errorf("anonymous user was not sent to sign in: %d %v", rw.Code, rw.Header())
+	}
+	if rw := do("GET", "/device?user_code="+dcr.UserCode, nil, true); rw.Code != http.StatusOK || !strings.Contains(rw.Body.String(), dcr.UserCode) {
+		t.Errorf("unexpected device page: %d %s", rw.Code, rw.Body)
+	}
+	approve := url.Values{"user_code": {strings.ToLower(strings.Replace(dcr.UserCode, "-", "", 1))}, "action": {"approve"}}
+	if rw := do("POST", "/device", approve, true); rw.Code != http.StatusForbidden {
+		t.Errorf("approved without CSRF token: %d", rw.Code)
+	}
+	approve.Set("csrf_token", csrfToken)
+	if rw := do("POST", "/device", approve, true); rw.Code != http.StatusOK || !strings.Contains(rw.Body.String(), "has been approved") {
+		t.Errorf("failed to approve: %d %s", rw.Code, rw.Body)
+	}
+	if rw := do("POST", "/device", approve, true); !strings.Contains(rw.Body.String(), "Unknown or expired code") {
+		t.Errorf("code approved twice: %s", rw.Body)
+	}
+
+	code, body := poll(dcr.DeviceCode)
+	var dtr deviceTokenResponse
+	if code != http.StatusOK || json.Unmarshal([]byte(body), &dtr) != nil || dtr.Username != "octocat" {
+		t.Fatalf("failed to get password: %d %s", code, body)
+	}
+	if err := db.ValidateToken("octocat", authn.PasswordString(dtr.Password)); err != nil {
+		t.Errorf("device password is invalid: %s", err)
+	}
+	if err := db.ValidateToken("octocat", authn.PasswordString(oldPassword)); err == nil {
+		t.Errorf("old password still valid")
+	}
+	if _, body := poll(dcr.DeviceCode); body != `{"error":"invalid_grant"}` {
+		t.Errorf("password delivered twice: %s", body)
+	}
+
+	dcr = start()
+	deny := url.Values{"user_code": {dcr.UserCode}, "action": {"deny"}, "csrf_token": {csrfToken}}
+	if rw := do("POST", "/device", deny, true); !strings.Contains(rw.Body.String(), "denied") {
+		t.Errorf("failed to deny: %s", rw.Body)
+	}
+	if _, body := poll(dcr.DeviceCode); body != `{"error":"access_denied"}` {
+		t.Errorf("expected access_denied, got %s", body)
+	}
+
+	dcr = start()
+	key := deviceStoreKey(dcr.DeviceCode)
+	g, _ := as.getDeviceGrant(key)
+	g.Expires = time.Now().Add(-time.Second)
+	as.putDeviceGrant(key, g)
+	if _, body := poll(dcr.DeviceCode); body != `{"error":"expired_token"}` {
+		t.Errorf("expected expired_token, got %s", body)
+	}
+
+	// Pending authorizations are capped.
+	start()
+	as.purgeDeviceGrants()
+	if as.devicePending != 1 {
+		t.Errorf("expected 1 pending authorization, got %d", as.devicePending)
+	}
+	dc.MaxPending = 1
+	if rw := do("POST", "/device/code", nil, false); rw.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 with too many pending authorizations, got %d %s", rw.Code, rw.Body)
+	}
+	dc.MaxPending = 1000
+
+	// Codes are rate limited by client address.
+	rc := &RateLimitConfig{PerIP: &TokenBucketConfig{Rate: 0.001, Burst: 1}}
+	if err := rc.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	as.limiter = newRateLimiter(rc)
+	defer as.limiter.Stop()
+	start()
+	if rw := do("POST", "/device/code", nil, false); rw.Code != http.StatusTooManyRequests || rw.Header().Get("Retry-After") == "" {
+		t.Errorf("expected 429, got %d %s", rw.Code, rw.Body)
+	}
+}
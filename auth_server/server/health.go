@@ -0,0 +1,159 @@
+/*
+   Copyright 2016 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	healthCheckTimeout = 10 * time.Second
+	// How long /readyz serves the result of a check, so that frequent probes do not load the backends.
+	readyzCacheTTL = 5 * time.Second
+)
+
+// healthChecker is implemented by authenticators and authorizers that depend on
+// external services and can probe them.
+type healthChecker interface {
+	// HealthCheck returns an error if the backend is not able to serve requests.
+	HealthCheck() error
+}
+
+type componentStatus struct {
+	Name   string `json:"name"`
+	Kind   string `json:"kind"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type healthStatus struct {
+	Status     string            `json:"status"`
+	Components []componentStatus `json:"components,omitempty"`
+}
+
+func writeHealthStatus(rw http.ResponseWriter, hs *healthStatus) {
+	result, _ := json.Marshal(hs)
+	rw.Header().Set("Content-Type", "application/json")
+	if hs.Status != "ok" {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	}
+	rw.Write(result)
+}
+
+// doHealthz reports that the process is up.
+func (as *AuthServer) doHealthz(rw http.ResponseWriter, req *http.Request) {
+	writeHealthStatus(rw, &healthStatus{Status: "ok"})
+}
+
+type readyzCache struct {
+	lock    sync.Mutex
+	checked time.Time
+	status  *healthStatus
+}
+
+// doReadyz reports whether all the backends are ready. Errors are only logged, the response
+// is public and tells the status of each component.
+func (as *AuthServer) doReadyz(rw http.ResponseWriter, req *http.Request) {
+	rc := &as.readyz
+	rc.lock.Lock()
+	if rc.status == nil || time.Since(rc.checked) > readyzCacheTTL {
+		hs := as.readiness()
+		for i, cs := range hs.Components {
+			if cs.Status != "ok" {
+				glog.Warningf("Readiness check failed for %s %s: %s", cs.Kind, cs.Name, cs.Error)
+				hs.Components[i].Error = ""
+			}
+		}
+		rc.status, rc.checked = hs, time.Now()
+	}
+	hs := rc.status
+	rc.lock.Unlock()
+	writeHealthStatus(rw, hs)
+}
+
+// CheckReady returns an error if any of the backends is not ready.
+func (as *AuthServer) CheckReady() error {
+	hs := as.readiness()
+	if hs.Status == "ok" {
+		return nil
+	}
+	var errs []string
+	for _, cs := range hs.Components {
+		if cs.Status != "ok" {
+			errs = append(errs, fmt.Sprintf("%s %s: %s", cs.Kind, cs.Name, cs.Error))
+		}
+	}
+	return errors.New(strings.Join(errs, "; "))
+}
+
+// readiness probes all the configured backends that support it, in parallel.
+func (as *AuthServer) readiness() *healthStatus {
+	type check struct {
+		name, kind string
+		hc         healthChecker
+	}
+	var checks []check
+	for _, a := range as.authenticators {
+		if hc, ok := a.(healthChecker); ok {
+			checks = append(checks, check{a.Name(), "authn", hc})
+		}
+	}
+	for _, a := range as.authorizers {
+		if hc, ok := a.(healthChecker); ok {
+			checks = append(checks, check{a.Name(), "authz", hc})
+		}
+	}
+	hs := &healthStatus{Status: "ok", Components: make([]componentStatus, len(checks))}
+	var wg sync.WaitGroup
+	for i, c := range checks {
+		wg.Add(1)
+		go func(i int, c check) {
+			defer wg.Done()
+			cs := componentStatus{Name: c.name, Kind: c.kind, Status: "ok"}
+			if err := runHealthCheck(c.hc); err != nil {
+				cs.Status, cs.Error = "fail", err.Error()
+			}
+			hs.Components[i] = cs
+		}(i, c)
+	}
+	wg.Wait()
+	for _, cs := range hs.Components {
+		if cs.Status != "ok" {
+			hs.Status = "fail"
+		}
+	}
+	return hs
+}
+
+func runHealthCheck(hc healthChecker) error {
+	res := make(chan error, 1)
+	go func() { res <- hc.HealthCheck() }()
+	select {
+	case err := <-res:
+		return err
+	case <-time.After(healthCheckTimeout):
+		return fmt.Errorf("timed out after %s", healthCheckTimeout)
+	}
+}
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/cesanta/docker_auth/auth_server/authn"
+)
+
+type failingBackend struct {
+	checks int
+}
+
+func (fb *failingBackend) Authenticate(user string, password authn.PasswordString) (bool, authn.Labels, error) {
+	return false, nil, authn.NoMatch
+}
+
+func (fb *failingBackend) HealthCheck() error {
+	fb.checks++
+	return errors.New("dial tcp 10.0.0.5:389: connection refused")
+}
+
+func (fb *failingBackend) Stop() {}
+
+func (fb *failingBackend) Name() string {
+	return "failing"
+}
+
+func TestReadyz(t *testing.T) {
+	fb := &failingBackend{}
+	as := &AuthServer{config: &Config{}, authenticators: []authn.Authenticator{fb}}
+	for i := 0; i < 3; i++ {
+		rw := httptest.NewRecorder()
+		as.doReadyz(rw, httptest.NewRequest("GET", "/readyz", nil))
+		if rw.Code != http.StatusServiceUnavailable {
+			t.Errorf("expected 503, got %d", rw.Code)
+		}
+		body := rw.Body.String()
+		if !strings.Contains(body, `"status":"fail"`) || strings.Contains(body, "10.0.0.5") {
+			t.Errorf("unexpected response: %s", body)
+		}
+	}
+	if fb.checks != 1 {
+		t.Errorf("expected the result to be cached, checked %d times", fb.checks)
+	}
+	if err := as.CheckReady(); err == nil || !strings.Contains(err.Error(), "10.0.0.5") {
+		t.Errorf("CheckReady should report the error: %v", err)
+	}
+}
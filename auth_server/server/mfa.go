@@ -0,0 +1,298 @@
+/*
+   Copyright 2016 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package server
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+
+	"github.com/cesanta/docker_auth/auth_server/authn"
+	"github.com/golang/glog"
+)
+
+// Sign in with a password and a TOTP code: the user posts their password to /login, then enters
+// a code at /login/mfa, enrolling an authenticator app first if they have none. The Docker password
+// issued afterwards is short-lived and the session works like that of the OAuth providers.
+
+type mfaPage struct {
+	Issuer    string
+	CSRFToken string
+	User      string
+	Error     string
+	// Set if the user has to enroll an authenticator app.
+	Enroll bool
+	URI    string
+	Secret string
+}
+
+// mfaRequired returns true if the account has used its password with an authenticator it may not use directly.
+func (as *AuthServer) mfaRequired(a authn.Authenticator, account string) bool {
+	if as.mfa == nil || !as.mfa.Required(account) {
+		return false
+	}
+	for _, pa := range as.passwordAuthenticators {
+		if pa == a {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticatePassword checks the password of a user of the password authenticators.
+func (as *AuthServer) authenticatePassword(user string, password authn.PasswordString) (bool, authn.Labels, error) {
+	for _, a := range as.passwordAuthenticators {
+		result, labels, err := a.Authenticate(user, password)
+		if err == authn.NoMatch {
+			continue
+		} else if err == authn.WrongPass {
+			return false, nil, nil
+		} else if err != nil {
+			return false, nil, fmt.Errorf("%s: %s", a.Name(), err)
+		}
+		return result, labels, nil
+	}
+	return false, nil, nil
+}
+
+// mfaAccount finds the password authenticator the user of a password issued after MFA sign in belongs to,
+// like authenticatePassword does, and tells whether the account may still be used.
+func (as *AuthServer) mfaAccount(user string) (string, bool, error) {
+	for _, a := range as.passwordAuthenticators {
+		ac, ok := a.(authn.AccountChecker)
+		if !ok {
+			continue
+		}
+		active, err := ac.CheckAccount(user)
+		if err == authn.NoMatch {
+			continue
+		} else if err != nil {
+			return "", false, fmt.Errorf("%s: %s", a.Name(), err)
+		}
+		return a.Name(), active, nil
+	}
+	return "", false, nil
+}
+
+// portalRateLimitKey describes a sign in attempt to the rate limiter.
+func (as *AuthServer) portalRateLimitKey(req *http.Request, user string) *rateLimitKey {
+	ra := as.remoteAddr(req)
+	return newRateLimitKey(&authRequest{RemoteConnAddr: req.RemoteAddr, RemoteAddr: ra, RemoteIP: parseRemoteAddr(ra), User: user, Account: user})
+}
+
+// rateLimited renders an error and returns true if the client has to wait before trying again.
+func (as *AuthServer) rateLimited(rw http.ResponseWriter, k *rateLimitKey) bool {
+	if as.limiter == nil {
+		return false
+	}
+	wait := as.limiter.Check(k)
+	if wait <= 0 {
+		return false
+	}
+	rw.Header().Set("Retry-After", fmt.Sprintf("%d", int(math.Ceil(wait.Seconds()))))
+	as.renderError(rw, http.StatusTooManyRequests, "Too many attempts, please try again later.")
+	return true
+}
+
+// doPasswordLogin checks the password and sends the user on to enter their code.
+func (as *AuthServer) doPasswordLogin(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !as.web.CheckCSRFToken(req, req.PostFormValue("csrf_token")) {
+		as.renderError(rw, http.StatusForbidden, "Invalid request, please reload the page and try again.")
+		return
+	}
+	user := req.PostFormValue("username")
+	limitKey := as.portalRateLimitKey(req, user)
+	if as.rateLimited(rw, limitKey) {
+		return
+	}
+	ok, labels, err := as.authenticatePassword(user, authn.PasswordString(req.PostFormValue("password")))
+	if err != nil {
+		glog.Errorf("Portal: failed to check password of %s: %s", user, err)
+		as.renderError(rw, http.StatusInternalServerError, "Failed to sign in, please try again later.")
+		return
+	}
+	if as.limiter != nil {
+		as.limiter.Record(limitKey, ok)
+	}
+	if !ok {
+		glog.Warningf("Portal: wrong password for %q from %s", user, as.remoteAddr(req))
+		as.renderPage(rw, http.StatusUnauthorized, "login", &loginPage{
+			Issuer:    as.config.Token.Issuer,
+			CSRFToken: as.web.CSRFToken(rw, req),
+			Providers: as.webProviders(),
+			Password:  true,
+			User:      user,
+			Error:     "Wrong user name or password.",
+		})
+		return
+	}
+	as.config.Portal.setMFAPending(rw, req, user, labels)
+	http.Redirect(rw, req, "/login/mfa", http.StatusSeeOther)
+}
+
+// doMFALogin asks for a code (GET) and checks it (POST). Users without an authenticator app enroll one.
+func (as *AuthServer) doMFALogin(rw http.ResponseWriter, req *http.Request) {
+	p := as.config.Portal.getMFAPending(req)
+	if p == nil {
+		http.Redirect(rw, req, "/", http.StatusFound)
+		return
+	}
+	page := &mfaPage{Issuer: as.config.Token.Issuer, CSRFToken: as.web.CSRFToken(rw, req), User: p.User}
+	enrolled, err := as.mfa.Enrolled(p.User)
+	if err == nil && !enrolled {
+		page.Enroll = true
+		page.URI, page.Secret, err = as.mfa.BeginEnrollment(p.User)
+	}
+	if err != nil {
+		glog.Errorf("Portal: failed to get MFA enrollment of %s: %s", p.User, err)
+		as.renderError(rw, http.StatusInternalServerError, "Failed to sign in, please try again later.")
+		return
+	}
+	switch req.Method {
+	case "GET":
+		as.renderPage(rw, http.StatusOK, "mfa", page)
+		return
+	case "POST":
+	default:
+		http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !as.web.CheckCSRFToken(req, req.PostFormValue("csrf_token")) {
+		as.renderError(rw, http.StatusForbidden, "Invalid request, please reload the page and try again.")
+		return
+	}
+	limitKey := as.portalRateLimitKey(req, p.User)
+	if as.rateLimited(rw, limitKey) {
+		return
+	}
+	var recoveryCodes []string
+	if page.Enroll {
+		recoveryCodes, err = as.mfa.ConfirmEnrollment(p.User, req.PostFormValue("code"))
+	} else {
+		err = as.mfa.Verify(p.User, req.PostFormValue("code"))
+	}
+	if as.limiter != nil && (err == nil || err == authn.WrongPass) {
+		as.limiter.Record(limitKey, err == nil)
+	}
+	switch err {
+	case nil:
+	case authn.WrongPass:
+		glog.Warningf("Portal: wrong MFA code for %s from %s", p.User, as.remoteAddr(req))
+		page.Error = "Wrong code, please try again."
+		as.renderPage(rw, http.StatusUnauthorized, "mfa", page)
+		return
+	case authn.MFALocked:
+		as.renderError(rw, http.StatusTooManyRequests, "Too many wrong codes, please try again later.")
+		return
+	case authn.NotEnrolled:
+		// Reset or enrolled concurrently.
+		http.Redirect(rw, req, "/login/mfa", http.StatusSeeOther)
+		return
+	default:
+		glog.Errorf("Portal: failed to check MFA code of %s: %s", p.User, err)
+		as.renderError(rw, http.StatusInternalServerError, "Failed to sign in, please try again later.")
+		return
+	}
+	as.config.Portal.clearMFAPending(rw, req)
+	password, err := as.mfa.IssuePassword(p.User, p.Labels)
+	if err != nil {
+		glog.Errorf("Portal: failed to issue password for %s: %s", p.User, err)
+		as.renderError(rw, http.StatusInternalServerError, "Failed to sign in, please try again later.")
+		return
+	}
+	if recoveryCodes == nil {
+		as.portalLogin("mfa")(rw, req, p.User, password)
+		return
+	}
+	// Recovery codes are only shown once, so the user cannot be sent elsewhere right away.
+	glog.Infof("Portal: %s signed in with mfa from %s", p.User, as.remoteAddr(req))
+	as.forgetCachedAuthn(p.User)
+	as.config.Portal.setSession(rw, req, p.User, "mfa")
+	cp := as.newCredentialsPage(rw, req, p.User, "mfa", password)
+	cp.RecoveryCodes = recoveryCodes
+	cp.RecoveryCodesLeft = len(recoveryCodes)
+	cp.ReturnTo = as.config.Portal.takeReturnTo(rw, req)
+	as.renderPage(rw, http.StatusOK, "credentials", cp)
+}
+
+// doRecoveryCodes replaces recovery codes of a user signed in with MFA.
+func (as *AuthServer) doRecoveryCodes(rw http.ResponseWriter, req *http.Request, s *portalSession) {
+	if s.Provider != "mfa" || as.mfa == nil {
+		as.renderError(rw, http.StatusBadRequest, "Recovery codes are only available when signed in with a password and an authenticator app.")
+		return
+	}
+	codes, err := as.mfa.NewRecoveryCodes(s.User)
+	if err != nil {
+		glog.Errorf("Portal: failed to generate recovery codes of %s: %s", s.User, err)
+		as.renderError(rw, http.StatusInternalServerError, "Failed to generate recovery codes, please try again later.")
+		return
+	}
+	glog.Infof("Portal: %s generated new recovery codes from %s", s.User, as.remoteAddr(req))
+	cp := as.newCredentialsPage(rw, req, s.User, s.Provider, "")
+	cp.RecoveryCodes = codes
+	cp.RecoveryCodesLeft = len(codes)
+	as.renderPage(rw, http.StatusOK, "credentials", cp)
+}
+
+// doAdminMFA manages MFA enrollments:
+//
+//	GET    mfa/<user>   show whether the user has enrolled and how many recovery codes are left
+//	DELETE mfa/<user>   reset enrollment, e.g. after loss of the device; also revokes the password
+func (as *AuthServer) doAdminMFA(rw http.ResponseWriter, req *http.Request, parts []string) {
+	if as.mfa == nil || len(parts) != 1 || parts[0] == "" {
+		http.Error(rw, "Not found", http.StatusNotFound)
+		return
+	}
+	user := parts[0]
+	switch req.Method {
+	case "GET":
+		enrolled, err := as.mfa.Enrolled(user)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		left, err := as.mfa.RecoveryCodesLeft(user)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeAdminResponse(rw, map[string]interface{}{
+			"user":                user,
+			"enrolled":            enrolled,
+			"required":            as.mfa.Required(user),
+			"recovery_codes_left": left,
+		})
+	case "DELETE":
+		err := as.mfa.Reset(user)
+		if err == authn.NoMatch {
+			http.Error(rw, "Not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		as.forgetCachedAuthn(user)
+		glog.Infof("Admin: reset MFA enrollment of %s", user)
+		writeAdminResponse(rw, map[string]string{"status": "reset"})
+	default:
+		http.Error(rw, "Not found", http.StatusNotFound)
+	}
+}
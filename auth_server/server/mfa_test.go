@@ -0,0 +1,217 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cesanta/docker_auth/auth_server/authn"
+	"github.com/cesanta/docker_auth/auth_server/authz"
+	"github.com/cesanta/docker_auth/auth_server/sql_session"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func totpNow(t *testing.T, secret string) string {
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(time.Now().Unix()/30))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0xf
+	return fmt.Sprintf("%06d", (binary.BigEndian.Uint32(sum[offset:])&0x7fffffff)%1000000)
+}
+
+func TestMFALogin(t *testing.T) {
+	pt := newPortalTest(t, &Config{})
+	defer pt.close()
+	hash, _ := bcrypt.GenerateFromPassword([]byte("s3cr3t"), bcrypt.MinCost)
+	pw := authn.PasswordString(hash)
+	mc := &authn.MFAConfig{
+		RequiredAccounts: []string{"admin"},
+		TokenDB:          filepath.Join(pt.dir, "mfa_tokens.ldb"),
+		EnrollmentDB:     filepath.Join(pt.dir, "enrollments.ldb"),
+		Issuer:           "Acme auth",
+	}
+	if err := mc.Validate("mfa"); err != nil {
+		t.Fatal(err)
+	}
+	m, err := authn.NewMFA(mc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+	static := authn.NewStaticUserAuth(map[string]*authn.Requirements{
+		"admin": {Password: &pw, Labels: authn.Labels{"group": {"ops"}}},
+		"alice": {Password: &pw},
+	})
+	as, csrfToken := pt.as, pt.csrfToken
+	as.config.MFA = mc
+	as.authenticators = []authn.Authenticator{m, static}
+	as.passwordAuthenticators = []authn.Authenticator{static}
+	as.tokenDBs["mfa"] = m.TokenDB()
+	as.mfa = m
+	authenticate := func(user, password string) (bool, authn.Labels) {
+		ar := &authRequest{User: user, Account: user, Password: authn.PasswordString(password)}
+		ok, err := as.Authenticate(ar)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ok, ar.Labels
+	}
+	if ok, _ := authenticate("alice", "s3cr3t"); !ok {
+		t.Errorf("password of alice rejected, MFA is not required for her")
+	}
+	if ok, _ := authenticate("admin", "s3cr3t"); ok {
+		t.Errorf("password of admin accepted, MFA is required")
+	}
+
+	// Cookies set by responses are kept, sign in goes through several pages.
+	do := func(method, path string, form url.Values) *httptest.ResponseRecorder {
+		rw := pt.do(method, path, form, true)
+		pt.cookies = append(pt.cookies, rw.Result().Cookies()...)
+		return rw
+	}
+	if rw := do("GET", "/", nil); !strings.Contains(rw.Body.String(), `action="/login"`) {
+		t.Errorf("no password form on login page: %s", rw.Body)
+	}
+	if rw := do("GET", "/login/mfa", nil); rw.Code != http.StatusFound {
+		t.Errorf("code page shown without password: %d", rw.Code)
+	}
+	login := url.Values{"username": {"admin"}, "password": {"wrong"}, "csrf_token": {csrfToken}}
+	if rw := do("POST", "/login", login); rw.Code != http.StatusUnauthorized || !strings.Contains(rw.Body.String(), "Wrong user name or password") {
+		t.Errorf("wrong password accepted: %d", rw.Code)
+	}
+	login.Set("password", "s3cr3t")
+	if rw := do("POST", "/login", login); rw.Code != http.StatusSeeOther || rw.Header().Get("Location") != "/login/mfa" {
+		t.Fatalf("password rejected: %d %s", rw.Code, rw.Body)
+	}
+	var pending *http.Cookie
+	for _, c := range pt.cookies {
+		if c.Name == mfaPendingCookieName {
+			pending = c
+		}
+	}
+	forged := httptest.NewRequest("GET", "/credentials", nil)
+	forged.AddCookie(&http.Cookie{Name: sessionCookieName, Value: pending.Value})
+	rw := httptest.NewRecorder()
+	if as.ServeHTTP(rw, forged); rw.Code != http.StatusFound {
+		t.Errorf("pending MFA cookie accepted as session: %d", rw.Code)
+	}
+
+	rw = do("GET", "/login/mfa", nil)
+	_, secret, _ := m.BeginEnrollment("admin")
+	if rw.Code != http.StatusOK || !strings.Contains(rw.Body.String(), secret) {
+		t.Fatalf("unexpected enrollment page: %d %s", rw.Code, rw.Body)
+	}
+	if rw := do("POST", "/login/mfa", url.Values{"code": {"000000"}, "csrf_token": {csrfToken}}); rw.Code != http.StatusUnauthorized {
+		t.Errorf("wrong code accepted: %d", rw.Code)
+	}
+	rw = do("POST", "/login/mfa", url.Values{"code": {totpNow(t, secret)}, "csrf_token": {csrfToken}})
+	body := rw.Body.String()
+	if rw.Code != http.StatusOK || !strings.Contains(body, "recovery codes") {
+		t.Fatalf("failed to enroll: %d %s", rw.Code, body)
+	}
+	password := regexp.MustCompile(`<th>Password</th><td><code>([^<]+)</code>`).FindStringSubmatch(body)
+	if password == nil {
+		t.Fatalf("no password on page: %s", body)
+	}
+	if ok, labels := authenticate("admin", password[1]); !ok || labels["group"][0] != "ops" {
+		t.Errorf("issued password rejected: %t %v", ok, labels)
+	}
+	if rw := do("GET", "/credentials", nil); rw.Code != http.StatusOK || !strings.Contains(rw.Body.String(), "password and authenticator app") {
+		t.Errorf("no session after MFA sign in: %d", rw.Code)
+	}
+	if rw := do("POST", "/credentials", url.Values{"action": {"recovery_codes"}, "csrf_token": {csrfToken}}); !strings.Contains(rw.Body.String(), "10 left") {
+		t.Errorf("failed to regenerate recovery codes: %s", rw.Body)
+	}
+}
+
+func TestMFARequiredSQLAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mfa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c := &Config{
+		Server: ServerConfig{ListenAddress: ":5001"},
+		Token:  TokenConfig{Issuer: "Acme auth", Expiration: 900},
+		MFA: &authn.MFAConfig{
+			RequiredAccounts: []string{"admin"},
+			TokenDB:          filepath.Join(dir, "tokens.ldb"),
+			EnrollmentDB:     filepath.Join(dir, "enrollments.ldb"),
+		},
+		SQLAuth: &authn.SQLAuthConfig{
+			SQLConfig:      &sql_session.Config{Driver: "sqlite3", DSN: filepath.Join(dir, "users.db")},
+			Table:          "users",
+			DisabledColumn: "disabled",
+			CreateSchema:   true,
+		},
+		ACL: authz.ACL{},
+	}
+	// sql_auth is the only password authenticator.
+	if err := validate(c); err != nil {
+		t.Fatal(err)
+	}
+	as, err := NewAuthServer(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer as.Stop()
+	db, err := sql_session.New(c.SQLAuth.SQLConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	hash, _ := bcrypt.GenerateFromPassword([]byte("s3cr3t"), bcrypt.MinCost)
+	for _, user := range []string{"admin", "alice"} {
+		if _, err := db.Exec("INSERT INTO users (username, password) VALUES (?, ?)", user, string(hash)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for user, expected := range map[string]bool{"admin": false, "alice": true} {
+		ok, err := as.Authenticate(&authRequest{User: user, Account: user, Password: "s3cr3t"})
+		if err != nil || ok != expected {
+			t.Errorf("%s: expected %t, got %t, %v", user, expected, ok, err)
+		}
+	}
+	if ok, _, err := as.authenticatePassword("admin", "s3cr3t"); !ok || err != nil {
+		t.Errorf("admin cannot sign in to the portal: %t, %v", ok, err)
+	}
+
+	// Passwords issued after MFA sign in stop working when the account is disabled or deleted.
+	password, err := as.mfa.IssuePassword("admin", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ar := &authRequest{User: "admin", Account: "admin", Password: authn.PasswordString(password)}
+	if ok, err := as.Authenticate(ar); !ok || err != nil {
+		t.Fatalf("MFA password rejected: %t, %v", ok, err)
+	}
+	if ar.AuthnBackend != "MFA" || ar.AccountBackend != "SQL" {
+		t.Errorf("expected MFA password of a SQL account, got %q, %q", ar.AuthnBackend, ar.AccountBackend)
+	}
+	for _, stmt := range []string{"UPDATE users SET disabled = TRUE WHERE username = ?", "DELETE FROM users WHERE username = ?"} {
+		if _, err := db.Exec(stmt, "admin"); err != nil {
+			t.Fatal(err)
+		}
+		if ok, err := as.Authenticate(&authRequest{User: "admin", Account: "admin", Password: authn.PasswordString(password)}); ok || err != nil {
+			t.Errorf("%s: MFA password accepted: %t, %v", stmt, ok, err)
+		}
+	}
+}
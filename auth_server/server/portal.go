@@ -0,0 +1,425 @@
+/*
+   Copyright 2016 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package server
+
+//go:generate go-bindata -pkg server -modtime 1 -mode 420 data/...
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/cesanta/docker_auth/auth_server/authn"
+	"github.com/cesanta/docker_auth/auth_server/authz"
+	"github.com/golang/glog"
+)
+
+// PortalConfig configures the web login portal. Templates and static assets are looked up
+// in TemplateDir first (templates/*.tmpl, static/*), built-in ones are used for missing files.
+type PortalConfig struct {
+	SessionKeyFile string        `yaml:"session_key_file,omitempty"`
+	SessionTTL     time.Duration `yaml:"session_ttl,omitempty"`
+	SecureCookies  bool          `yaml:"secure_cookies,omitempty"`
+	TemplateDir    string        `yaml:"template_dir,omitempty"`
+
+	sessionKey []byte
+}
+
+var portalPages = []string{"login", "credentials", "device", "cli_login", "mfa", "error"}
+
+func (c *PortalConfig) Validate() error {
+	if c.SessionTTL == 0 {
+		c.SessionTTL = 12 * time.Hour
+	} else if c.SessionTTL < 0 {
+		return fmt.Errorf("session_ttl must be positive, got %s", c.SessionTTL)
+	}
+	if c.SessionKeyFile != "" {
+		contents, err := ioutil.ReadFile(c.SessionKeyFile)
+		if err != nil {
+			return fmt.Errorf("could not read %s: %s", c.SessionKeyFile, err)
+		}
+		c.sessionKey = bytes.TrimSpace(contents)
+		if len(c.sessionKey) < 32 {
+			return fmt.Errorf("key in %s is too short, use at least 32 characters", c.SessionKeyFile)
+		}
+	} else {
+		// Sessions do not survive restarts.
+		c.sessionKey = randomSessionKey()
+	}
+	if c.TemplateDir != "" {
+		if fi, err := os.Stat(c.TemplateDir); err != nil {
+			return err
+		} else if !fi.IsDir() {
+			return fmt.Errorf("%s is not a directory", c.TemplateDir)
+		}
+	}
+	return nil
+}
+
+// portalFile returns contents of an asset, name is relative to data/.
+func (c *PortalConfig) portalFile(name string) ([]byte, error) {
+	if c.TemplateDir != "" {
+		contents, err := ioutil.ReadFile(filepath.Join(c.TemplateDir, filepath.FromSlash(name)))
+		if err == nil || !os.IsNotExist(err) {
+			return contents, err
+		}
+	}
+	return Asset("data/" + name)
+}
+
+func (c *PortalConfig) loadTemplates() (map[string]*template.Template, error) {
+	layout, err := c.portalFile("templates/layout.tmpl")
+	if err != nil {
+		return nil, err
+	}
+	pages := make(map[string]*template.Template)
+	for _, page := range portalPages {
+		content, err := c.portalFile("templates/" + page + ".tmpl")
+		if err != nil {
+			return nil, err
+		}
+		t, err := template.New(page).Parse(string(layout))
+		if err == nil {
+			_, err = t.Parse(string(content))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("bad %s template: %s", page, err)
+		}
+		pages[page] = t
+	}
+	return pages, nil
+}
+
+type portalProvider struct {
+	Section string
+	Name    string
+}
+
+func (p portalProvider) URL() string {
+	return "/" + p.Section
+}
+
+// CSRFToken must be sent with POST requests to the portal and JSON requests to /google_auth,
+// as the csrf_token form field or JSON property.
+type loginPage struct {
+	Issuer    string
+	CSRFToken string
+	Providers []portalProvider
+	// Password sign in with a second factor, see mfa.go.
+	Password bool
+	User     string
+	Error    string
+}
+
+type credentialsPage struct {
+	Issuer    string
+	CSRFToken string
+	User      string
+	Provider  portalProvider
+	// Only set right after the password has been issued, it cannot be shown again.
+	Password          string
+	Repositories      []repositoryAccess
+	RepositoriesError string
+	// Only for users signed in with MFA: when the password expires and their recovery codes.
+	// Codes are only set right after they have been generated.
+	MFA               bool
+	Expires           time.Time
+	RecoveryCodes     []string
+	RecoveryCodesLeft int
+	ReturnTo          string
+}
+
+type errorPage struct {
+	Issuer  string
+	Status  int
+	Message string
+}
+
+// repositoryAccess is an ACL entry that applies to repositories of the user.
+type repositoryAccess struct {
+	Authorizer string
+	Name       string
+	Actions    string
+	IP         string
+	Comment    string
+}
+
+// webProviders returns the configured authenticators users sign in with through the portal.
+func (as *AuthServer) webProviders() []portalProvider {
+	var providers []portalProvider
+	if as.ga != nil {
+		providers = append(providers, portalProvider{Section: "google_auth", Name: as.ga.Name()})
+	}
+	if as.gha != nil {
+		providers = append(providers, portalProvider{Section: "github_auth", Name: as.gha.Name()})
+	}
+	return providers
+}
+
+func (as *AuthServer) webProvider(section string) portalProvider {
+	if section == "mfa" {
+		return portalProvider{Section: section, Name: "password and authenticator app"}
+	}
+	for _, p := range as.webProviders() {
+		if p.Section == section {
+			return p
+		}
+	}
+	return portalProvider{Section: section, Name: section}
+}
+
+// accountBackend returns the name of the authenticator the account of a portal user belongs to.
+func (as *AuthServer) accountBackend(user, section string) string {
+	switch {
+	case section == "google_auth" && as.ga != nil:
+		return as.ga.Name()
+	case section == "github_auth" && as.gha != nil:
+		return as.gha.Name()
+	case section == "mfa" && as.mfa != nil:
+		backend, _, err := as.mfaAccount(user)
+		if err != nil {
+			glog.Errorf("Portal: failed to check account of %s: %s", user, err)
+		}
+		return backend
+	}
+	return ""
+}
+
+func (as *AuthServer) renderPage(rw http.ResponseWriter, status int, page string, data interface{}) {
+	var buf bytes.Buffer
+	if err := as.templates[page].ExecuteTemplate(&buf, "layout", data); err != nil {
+		glog.Errorf("Failed to render %s page: %s", page, err)
+		http.Error(rw, "Failed to render page", http.StatusInternalServerError)
+		return
+	}
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.WriteHeader(status)
+	rw.Write(buf.Bytes())
+}
+
+func (as *AuthServer) renderError(rw http.ResponseWriter, status int, msg string) {
+	as.renderPage(rw, status, "error", &errorPage{Issuer: as.config.Token.Issuer, Status: status, Message: msg})
+}
+
+// doIndex serves the login page, or sends signed in users to their credentials.
+func (as *AuthServer) doIndex(rw http.ResponseWriter, req *http.Request) {
+	if s := as.config.Portal.getSession(req); s != nil && as.tokenDBs[s.Provider] != nil {
+		http.Redirect(rw, req, "/credentials", http.StatusFound)
+		return
+	}
+	as.renderPage(rw, http.StatusOK, "login", &loginPage{
+		Issuer:    as.config.Token.Issuer,
+		CSRFToken: as.web.CSRFToken(rw, req),
+		Providers: as.webProviders(),
+		Password:  as.mfa != nil,
+	})
+}
+
+// portalLogin returns the login handler of the authenticator in section.
+// It starts a session and shows the newly issued password.
+func (as *AuthServer) portalLogin(section string) authn.LoginHandler {
+	return func(rw http.ResponseWriter, req *http.Request, user, password string) {
+		glog.Infof("Portal: %s signed in with %s from %s", user, section, as.remoteAddr(req))
+		as.forgetCachedAuthn(user)
+		as.config.Portal.setSession(rw, req, user, section)
+		if rt := as.config.Portal.takeReturnTo(rw, req); rt != "" {
+			// Signed in to do something else, e.g. approve a device, which issues its own password.
+			http.Redirect(rw, req, rt, http.StatusSeeOther)
+			return
+		}
+		as.renderCredentials(rw, req, user, section, password)
+	}
+}
+
+// sessionTokenDB returns the session of a signed in user and the token DB of their provider.
+// If there is none, the user is sent back to the login page.
+func (as *AuthServer) sessionTokenDB(rw http.ResponseWriter, req *http.Request) (*portalSession, authn.TokenDB) {
+	s := as.config.Portal.getSession(req)
+	if s == nil || as.tokenDBs[s.Provider] == nil {
+		as.config.Portal.clearSession(rw, req)
+		http.Redirect(rw, req, "/", http.StatusFound)
+		return nil, nil
+	}
+	return s, as.tokenDBs[s.Provider]
+}
+
+// doCredentials shows the Docker credentials of the signed in user (GET) and regenerates the password (POST).
+func (as *AuthServer) doCredentials(rw http.ResponseWriter, req *http.Request) {
+	s, db := as.sessionTokenDB(rw, req)
+	if s == nil {
+		return
+	}
+	v, err := db.GetValue(s.User)
+	if err != nil {
+		glog.Errorf("Portal: failed to get token of %s: %s", s.User, err)
+		as.renderError(rw, http.StatusInternalServerError, "Failed to look up your credentials, please try again later.")
+		return
+	} else if v == nil {
+		// Revoked since the user signed in.
+		as.config.Portal.clearSession(rw, req)
+		http.Redirect(rw, req, "/", http.StatusFound)
+		return
+	}
+	switch req.Method {
+	case "GET":
+		as.renderCredentials(rw, req, s.User, s.Provider, "")
+	case "POST":
+		if !as.web.CheckCSRFToken(req, req.PostFormValue("csrf_token")) {
+			as.renderError(rw, http.StatusForbidden, "Invalid request, please reload the page and try again.")
+			return
+		}
+		switch req.FormValue("action") {
+		case "regenerate":
+		case "recovery_codes":
+			as.doRecoveryCodes(rw, req, s)
+			return
+		default:
+			as.renderError(rw, http.StatusBadRequest, "Unknown action.")
+			return
+		}
+		dp, err := db.StoreToken(s.User, v, true)
+		if err != nil {
+			glog.Errorf("Portal: failed to regenerate password of %s: %s", s.User, err)
+			as.renderError(rw, http.StatusInternalServerError, "Failed to regenerate your password, please try again later.")
+			return
+		}
+		as.forgetCachedAuthn(s.User)
+		glog.Infof("Portal: %s regenerated their password from %s", s.User, as.remoteAddr(req))
+		as.renderCredentials(rw, req, s.User, s.Provider, dp)
+	default:
+		http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// doSignOut revokes the Docker password of the user and ends the session.
+func (as *AuthServer) doSignOut(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s, db := as.sessionTokenDB(rw, req)
+	if s == nil {
+		return
+	}
+	if !as.web.CheckCSRFToken(req, req.PostFormValue("csrf_token")) {
+		as.renderError(rw, http.StatusForbidden, "Invalid request, please reload the page and try again.")
+		return
+	}
+	if err := db.DeleteToken(s.User); err != nil {
+		glog.Errorf("Portal: failed to delete token of %s: %s", s.User, err)
+		as.renderError(rw, http.StatusInternalServerError, "Failed to sign out, please try again later.")
+		return
+	}
+	as.forgetCachedAuthn(s.User)
+	glog.Infof("Portal: %s signed out from %s", s.User, as.remoteAddr(req))
+	as.config.Portal.clearSession(rw, req)
+	http.Redirect(rw, req, "/", http.StatusSeeOther)
+}
+
+func (as *AuthServer) renderCredentials(rw http.ResponseWriter, req *http.Request, user, section, password string) {
+	as.renderPage(rw, http.StatusOK, "credentials", as.newCredentialsPage(rw, req, user, section, password))
+}
+
+func (as *AuthServer) newCredentialsPage(rw http.ResponseWriter, req *http.Request, user, section, password string) *credentialsPage {
+	page := &credentialsPage{
+		Issuer:    as.config.Token.Issuer,
+		CSRFToken: as.web.CSRFToken(rw, req),
+		User:      user,
+		Provider:  as.webProvider(section),
+		Password:  password,
+	}
+	var err error
+	if page.Repositories, err = as.repositoryAccess(user, as.accountBackend(user, section)); err != nil {
+		glog.Errorf("Portal: failed to list ACL entries of %s: %s", user, err)
+		page.RepositoriesError = "Failed to list your repositories."
+	}
+	if section == "mfa" && as.mfa != nil {
+		page.MFA = true
+		if v, err := as.mfa.TokenDB().GetValue(user); err == nil && v != nil {
+			page.Expires = v.ValidUntil
+		}
+		if page.RecoveryCodesLeft, err = as.mfa.RecoveryCodesLeft(user); err != nil {
+			glog.Errorf("Portal: failed to get MFA enrollment of %s: %s", user, err)
+		}
+	}
+	return page
+}
+
+// repositoryAccess returns ACL entries for repositories that apply to the account, in order of evaluation.
+func (as *AuthServer) repositoryAccess(account, authnBackend string) ([]repositoryAccess, error) {
+	var result []repositoryAccess
+	for _, a := range as.authorizers {
+		rl, ok := a.(authz.RuleLister)
+		if !ok {
+			continue
+		}
+		entries, err := rl.AccountRules(account, authnBackend)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", a.Name(), err)
+		}
+		for _, e := range entries {
+			if t := e.Match.Type; t != nil && *t != "repository" && *t != "*" {
+				continue
+			}
+			ra := repositoryAccess{Authorizer: a.Name(), Name: "*", Actions: "none"}
+			if e.Match.Name != nil {
+				ra.Name = strings.Replace(*e.Match.Name, "${account}", account, -1)
+			}
+			if e.Actions != nil && len(*e.Actions) > 0 {
+				ra.Actions = strings.Join(*e.Actions, ", ")
+				if ra.Actions == "*" {
+					ra.Actions = "all"
+				}
+			}
+			if e.Match.IP != nil {
+				ra.IP = *e.Match.IP
+			}
+			if e.Comment != nil {
+				ra.Comment = *e.Comment
+			}
+			result = append(result, ra)
+		}
+	}
+	return result, nil
+}
+
+// doStatic serves static assets of the portal.
+func (as *AuthServer) doStatic(rw http.ResponseWriter, req *http.Request) {
+	name := path.Clean(req.URL.Path)
+	if !strings.HasPrefix(name, "/static/") {
+		http.NotFound(rw, req)
+		return
+	}
+	contents, err := as.config.Portal.portalFile(name[1:])
+	if err != nil {
+		http.NotFound(rw, req)
+		return
+	}
+	if ct := mime.TypeByExtension(path.Ext(name)); ct != "" {
+		rw.Header().Set("Content-Type", ct)
+	}
+	rw.Write(contents)
+}
@@ -0,0 +1,237 @@
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cesanta/docker_auth/auth_server/authn"
+	"github.com/cesanta/docker_auth/auth_server/authz"
+)
+
+// portalTest is a server with the portal and a token DB for github_auth, for tests of portal pages.
+// Requests carry the CSRF cookie and, after signIn, a session cookie.
+type portalTest struct {
+	as        *AuthServer
+	dir       string        // Temporary directory, removed by close.
+	db        authn.TokenDB // Token DB of github_auth.
+	csrfToken string
+	cookies   []*http.Cookie
+}
+
+// newPortalTest creates a portal test server with config c. Portal defaults to the built-in pages.
+func newPortalTest(t *testing.T, c *Config) *portalTest {
+	dir, err := ioutil.TempDir("", "portal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pt := &portalTest{dir: dir}
+	if pt.db, err = authn.NewTokenDB(filepath.Join(dir, "tokens.ldb"), nil, nil); err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("failed to open token DB: %s", err)
+	}
+	if c.Token.Issuer == "" {
+		c.Token.Issuer = "Acme auth"
+	}
+	if c.Portal == nil {
+		c.Portal = &PortalConfig{}
+	}
+	if err := c.Portal.Validate(); err != nil {
+		pt.close()
+		t.Fatalf("invalid portal config: %s", err)
+	}
+	if c.DeviceAuth != nil {
+		if err := c.DeviceAuth.Validate(); err != nil {
+			pt.close()
+			t.Fatalf("invalid device_auth config: %s", err)
+		}
+	}
+	templates, err := c.Portal.loadTemplates()
+	if err != nil {
+		pt.close()
+		t.Fatalf("failed to load templates: %s", err)
+	}
+	pt.as = &AuthServer{
+		config:    c,
+		tokenDBs:  map[string]authn.TokenDB{"github_auth": pt.db},
+		templates: templates,
+		web:       authn.NewWebSecurity(c.Portal.sessionKey, false),
+		devices:   newMemTokenStore(),
+	}
+	rw := httptest.NewRecorder()
+	pt.csrfToken = pt.as.web.CSRFToken(rw, httptest.NewRequest("GET", "/", nil))
+	pt.cookies = rw.Result().Cookies()
+	return pt
+}
+
+// signIn adds a session cookie of the user signed in with the authenticator in section, and returns it.
+func (pt *portalTest) signIn(user, section string) *http.Cookie {
+	rw := httptest.NewRecorder()
+	pt.as.config.Portal.setSession(rw, httptest.NewRequest("GET", "/", nil), user, section)
+	c := rw.Result().Cookies()[0]
+	pt.cookies = append(pt.cookies, c)
+	return c
+}
+
+// do makes a request, with the cookies if withCookies is set. Forms are posted URL-encoded.
+func (pt *portalTest) do(method, path string, form url.Values, withCookies bool) *httptest.ResponseRecorder {
+	var req *http.Request
+	if form != nil {
+		req = httptest.NewRequest(method, path, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		req = httptest.NewRequest(method, path, nil)
+	}
+	if withCookies {
+		for _, c := range pt.cookies {
+			req.AddCookie(c)
+		}
+	}
+	rw := httptest.NewRecorder()
+	pt.as.ServeHTTP(rw, req)
+	return rw
+}
+
+func (pt *portalTest) close() {
+	pt.db.Close()
+	os.RemoveAll(pt.dir)
+}
+
+func TestSessionCookie(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	s := &portalSession{User: "octocat", Provider: "github_auth", Expires: time.Now().Add(time.Hour).Unix()}
+	value := encodeSession(key, s)
+	if ds := decodeSession(key, value); ds == nil || !reflect.DeepEqual(ds, s) {
+		t.Fatalf("failed to decode session: %+v", ds)
+	}
+	if decodeSession([]byte("another key, another key, another"), value) != nil {
+		t.Errorf("session signed with another key accepted")
+	}
+	forged := encodeSession(key, &portalSession{User: "admin", Provider: "github_auth", Expires: s.Expires})
+	tampered := strings.Split(forged, ".")[0] + "." + strings.Split(value, ".")[1]
+	if decodeSession(key, tampered) != nil {
+		t.Errorf("tampered session accepted")
+	}
+	s.Expires = time.Now().Add(-time.Second).Unix()
+	if decodeSession(key, encodeSession(key, s)) != nil {
+		t.Errorf("expired session accepted")
+	}
+	if decodeSession(key, "garbage") != nil {
+		t.Errorf("garbage accepted")
+	}
+}
+
+func TestPortal(t *testing.T) {
+	// Override one template, the others are built in.
+	dir, err := ioutil.TempDir("", "portal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.MkdirAll(filepath.Join(dir, "templates"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, "templates", "login.tmpl"), []byte(`{{define "title"}}Hi{{end}}{{define "content"}}Custom login{{end}}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pt := newPortalTest(t, &Config{Portal: &PortalConfig{TemplateDir: dir}})
+	defer pt.close()
+	acl := authz.ACL{
+		{Match: &authz.MatchConditions{Account: sp("octocat")}, Actions: &[]string{"*"}},
+		{Match: &authz.MatchConditions{Account: sp("/.+/"), Name: sp("${account}/*")}, Actions: &[]string{"pull", "push"}},
+		{Match: &authz.MatchConditions{Account: sp("someone")}, Actions: &[]string{"pull"}},
+		{Match: &authz.MatchConditions{Type: sp("registry")}, Actions: &[]string{"*"}},
+		{Match: &authz.MatchConditions{Name: sp("library/*")}, Actions: &[]string{"pull"}, Comment: sp("Public images")},
+	}
+	aclAuthorizer, err := authz.NewACLAuthorizer(acl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	as, db, csrfToken, do := pt.as, pt.db, pt.csrfToken, pt.do
+	as.authorizers = []authz.Authorizer{aclAuthorizer}
+	v := &authn.TokenDBValue{TokenType: "bearer", AccessToken: "s3cr3t-access", ValidUntil: time.Now().Add(time.Hour)}
+	password, err := db.StoreToken("octocat", v, true)
+	if err != nil {
+		t.Fatalf("failed to store token: %s", err)
+	}
+	if cookie := pt.signIn("octocat", "github_auth"); !cookie.HttpOnly || cookie.Secure {
+		t.Errorf("unexpected cookie flags: %+v", cookie)
+	}
+
+	if rw := do("GET", "/", nil, false); rw.Code != http.StatusOK || !strings.Contains(rw.Body.String(), "Custom login") {
+		t.Errorf("unexpected login page: %d %s", rw.Code, rw.Body)
+	}
+	if rw := do("GET", "/", nil, true); rw.Code != http.StatusFound || rw.Header().Get("Location") != "/credentials" {
+		t.Errorf("signed in user was not sent to credentials: %d", rw.Code)
+	}
+	if rw := do("GET", "/credentials", nil, false); rw.Code != http.StatusFound || rw.Header().Get("Location") != "/" {
+		t.Errorf("anonymous user was not sent to login: %d", rw.Code)
+	}
+	if rw := do("GET", "/static/portal.css", nil, false); rw.Code != http.StatusOK || !strings.HasPrefix(rw.Header().Get("Content-Type"), "text/css") {
+		t.Errorf("failed to get stylesheet: %d %s", rw.Code, rw.Header().Get("Content-Type"))
+	}
+	if rw := do("GET", "/static/../templates/layout.tmpl", nil, false); rw.Code != http.StatusNotFound {
+		t.Errorf("expected 404 outside of static, got %d", rw.Code)
+	}
+
+	rw := do("GET", "/credentials", nil, true)
+	body := rw.Body.String()
+	if rw.Code != http.StatusOK || !strings.Contains(body, "octocat") {
+		t.Fatalf("unexpected credentials page: %d %s", rw.Code, body)
+	}
+	if strings.Contains(body, password) || strings.Contains(body, "s3cr3t") {
+		t.Errorf("secrets leaked: %s", body)
+	}
+	for _, s := range []string{"<code>*</code></td><td>all</td>", "<code>octocat/*</code></td><td>pull, push</td>", "Public images"} {
+		if !strings.Contains(body, s) {
+			t.Errorf("%q not in repository list: %s", s, body)
+		}
+	}
+	if strings.Contains(body, "<td>pull</td><td>anywhere</td><td></td>") {
+		t.Errorf("entry of another account listed: %s", body)
+	}
+
+	if !strings.Contains(body, `name="csrf_token" value="`+csrfToken+`"`) {
+		t.Errorf("no CSRF token in forms: %s", body)
+	}
+	if rw := do("POST", "/credentials", url.Values{"action": {"regenerate"}}, true); rw.Code != http.StatusForbidden {
+		t.Errorf("expected 403 without CSRF token, got %d", rw.Code)
+	}
+	if err := db.ValidateToken("octocat", authn.PasswordString(password)); err != nil {
+		t.Errorf("password regenerated without CSRF token: %s", err)
+	}
+	if rw := do("POST", "/credentials", url.Values{"action": {"regenerate"}, "csrf_token": {csrfToken}}, true); rw.Code != http.StatusOK || strings.Contains(rw.Body.String(), password) {
+		t.Errorf("failed to regenerate password: %d", rw.Code)
+	}
+	if err := db.ValidateToken("octocat", authn.PasswordString(password)); err == nil {
+		t.Errorf("old password still valid after regeneration")
+	}
+
+	if rw := do("GET", "/sign_out", nil, true); rw.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected 405 for GET sign out, got %d", rw.Code)
+	}
+	if rw := do("POST", "/sign_out", url.Values{"csrf_token": {"bogus"}}, true); rw.Code != http.StatusForbidden {
+		t.Errorf("expected 403 with bad CSRF token, got %d", rw.Code)
+	}
+	if rw := do("POST", "/sign_out", url.Values{"csrf_token": {csrfToken}}, true); rw.Code != http.StatusSeeOther {
+		t.Errorf("failed to sign out: %d %s", rw.Code, rw.Body)
+	}
+	if v, err := db.GetValue("octocat"); err != nil || v != nil {
+		t.Errorf("token not deleted on sign out: %v %v", v, err)
+	}
+	if rw := do("GET", "/credentials", nil, true); rw.Code != http.StatusFound {
+		t.Errorf("credentials shown after sign out: %d", rw.Code)
+	}
+}
+
+func sp(s string) *string {
+	return &s
+}
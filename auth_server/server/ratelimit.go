@@ -0,0 +1,266 @@
+/*
+   Copyright 2016 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/time/rate"
+)
+
+type RateLimitConfig struct {
+	PerIP      *TokenBucketConfig `yaml:"per_ip,omitempty"`
+	PerAccount *TokenBucketConfig `yaml:"per_account,omitempty"`
+	Lockout    *LockoutConfig     `yaml:"lockout,omitempty"`
+	// Clients from these addresses or subnets are not limited.
+	Allow []string `yaml:"allow,omitempty"`
+
+	allow []*net.IPNet
+}
+
+type TokenBucketConfig struct {
+	// Requests per second.
+	Rate  float64 `yaml:"rate,omitempty"`
+	Burst int     `yaml:"burst,omitempty"`
+}
+
+// LockoutConfig configures handling of failed authentication attempts, tracked per account and per client IP.
+// After every failure, further attempts are rejected for Delay, doubling with every consecutive failure
+// up to MaxDelay. After MaxFailures consecutive failures, attempts are rejected for Duration.
+type LockoutConfig struct {
+	MaxFailures int           `yaml:"max_failures,omitempty"`
+	Duration    time.Duration `yaml:"duration,omitempty"`
+	Delay       time.Duration `yaml:"delay,omitempty"`
+	MaxDelay    time.Duration `yaml:"max_delay,omitempty"`
+}
+
+func (c *RateLimitConfig) Validate() error {
+	for _, tb := range []*TokenBucketConfig{c.PerIP, c.PerAccount} {
+		if tb != nil && (tb.Rate <= 0 || tb.Burst <= 0) {
+			return errors.New("rate and burst must be positive")
+		}
+	}
+	if lc := c.Lockout; lc != nil {
+		if lc.MaxFailures <= 0 {
+			return errors.New("lockout.max_failures must be positive")
+		}
+		if lc.Duration <= 0 {
+			lc.Duration = 15 * time.Minute
+		}
+		if lc.MaxDelay <= 0 {
+			lc.MaxDelay = 30 * time.Second
+		}
+	}
+	allow, err := parseTrustedProxies(c.Allow)
+	if err != nil {
+		return fmt.Errorf("invalid allow list: %s", err)
+	}
+	c.allow = allow
+	return nil
+}
+
+type failureRecord struct {
+	failures    int
+	lastFailure time.Time
+}
+
+type limiterEntry struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+type rateLimiter struct {
+	config   *RateLimitConfig
+	lock     sync.Mutex
+	buckets  map[string]*limiterEntry
+	failures map[string]*failureRecord
+	stop     chan struct{}
+}
+
+func newRateLimiter(c *RateLimitConfig) *rateLimiter {
+	rl := &rateLimiter{
+		config:   c,
+		buckets:  make(map[string]*limiterEntry),
+		failures: make(map[string]*failureRecord),
+		stop:     make(chan struct{}),
+	}
+	go rl.cleanup()
+	return rl
+}
+
+// rateLimitKey identifies the client and the login of a request. It is computed once, before
+// authentication, and used for both Check and Record: authenticators may change the account
+// (e.g. map it to a canonical name), failures must count against the buckets that were checked.
+type rateLimitKey struct {
+	ip         net.IP
+	ipKey      string
+	accountKey string
+}
+
+func newRateLimitKey(ar *authRequest) *rateLimitKey {
+	k := &rateLimitKey{ip: ar.RemoteIP, ipKey: "ip:" + ar.RemoteIP.String()}
+	// Spelling variations of a login must not get buckets of their own.
+	if login := strings.ToLower(strings.TrimSpace(ar.Account)); login != "" {
+		k.accountKey = "account:" + login
+	}
+	// Anonymous requests are limited by IP only.
+	return k
+}
+
+func (k *rateLimitKey) String() string {
+	if k.accountKey == "" {
+		return k.ipKey
+	}
+	return k.ipKey + " " + k.accountKey
+}
+
+// Check returns how long the client should wait before retrying, 0 if the request may proceed.
+func (rl *rateLimiter) Check(k *rateLimitKey) time.Duration {
+	if isTrusted(rl.config.allow, k.ip) {
+		return 0
+	}
+	ipKey, accountKey := k.ipKey, k.accountKey
+	now := time.Now()
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	for _, key := range []string{ipKey, accountKey} {
+		if key == "" {
+			continue
+		}
+		if wait := rl.lockedOut(key, now); wait > 0 {
+			glog.Warningf("Rejecting %s: %s is locked out for %s", k, key, wait)
+			return wait
+		}
+	}
+	if wait := rl.take(ipKey, rl.config.PerIP, now); wait > 0 {
+		glog.Warningf("Rejecting %s: %s is rate limited", k, ipKey)
+		return wait
+	}
+	if accountKey != "" {
+		if wait := rl.take(accountKey, rl.config.PerAccount, now); wait > 0 {
+			glog.Warningf("Rejecting %s: %s is rate limited", k, accountKey)
+			return wait
+		}
+	}
+	return 0
+}
+
+func (rl *rateLimiter) take(key string, tb *TokenBucketConfig, now time.Time) time.Duration {
+	if tb == nil {
+		return 0
+	}
+	e := rl.buckets[key]
+	if e == nil {
+		e = &limiterEntry{limiter: rate.NewLimiter(rate.Limit(tb.Rate), tb.Burst)}
+		rl.buckets[key] = e
+	}
+	e.lastSeen = now
+	r := e.limiter.ReserveN(now, 1)
+	if wait := r.DelayFrom(now); wait > 0 {
+		r.CancelAt(now)
+		return wait
+	}
+	return 0
+}
+
+func (rl *rateLimiter) lockedOut(key string, now time.Time) time.Duration {
+	lc := rl.config.Lockout
+	fr := rl.failures[key]
+	if lc == nil || fr == nil {
+		return 0
+	}
+	var until time.Time
+	if fr.failures >= lc.MaxFailures {
+		until = fr.lastFailure.Add(lc.Duration)
+	} else if lc.Delay > 0 {
+		delay := lc.Delay << uint(fr.failures-1)
+		if delay > lc.MaxDelay || delay <= 0 {
+			delay = lc.MaxDelay
+		}
+		until = fr.lastFailure.Add(delay)
+	}
+	if now.Before(until) {
+		return until.Sub(now)
+	}
+	return 0
+}
+
+// Record updates failure counters with the result of authentication.
+func (rl *rateLimiter) Record(k *rateLimitKey, success bool) {
+	lc := rl.config.Lockout
+	if lc == nil || isTrusted(rl.config.allow, k.ip) {
+		return
+	}
+	ipKey, accountKey := k.ipKey, k.accountKey
+	now := time.Now()
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	for _, key := range []string{ipKey, accountKey} {
+		if key == "" {
+			continue
+		}
+		if success {
+			delete(rl.failures, key)
+			continue
+		}
+		fr := rl.failures[key]
+		if fr == nil || now.Sub(fr.lastFailure) > lc.Duration {
+			fr = &failureRecord{}
+			rl.failures[key] = fr
+		}
+		fr.failures++
+		fr.lastFailure = now
+		if fr.failures == lc.MaxFailures {
+			glog.Warningf("%s locked out for %s after %d failed attempts", key, lc.Duration, fr.failures)
+		}
+	}
+}
+
+// cleanup periodically removes entries that have not been used for a while, to bound memory usage.
+func (rl *rateLimiter) cleanup() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-rl.stop:
+			return
+		case now := <-ticker.C:
+			rl.lock.Lock()
+			for key, e := range rl.buckets {
+				if now.Sub(e.lastSeen) > 10*time.Minute {
+					delete(rl.buckets, key)
+				}
+			}
+			for key, fr := range rl.failures {
+				if now.Sub(fr.lastFailure) > rl.config.Lockout.Duration {
+					delete(rl.failures, key)
+				}
+			}
+			rl.lock.Unlock()
+		}
+	}
+}
+
+func (rl *rateLimiter) Stop() {
+	close(rl.stop)
+}
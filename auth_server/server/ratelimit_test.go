@@ -0,0 +1,69 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRateLimit(t *testing.T) {
+	c := &RateLimitConfig{
+		PerIP:   &TokenBucketConfig{Rate: 0.001, Burst: 3},
+		Lockout: &LockoutConfig{MaxFailures: 2, Duration: time.Hour},
+		Allow:   []string{"10.0.0.0/8"},
+	}
+	if err := c.Validate(); err != nil {
+		t.Fatalf("validation failed: %s", err)
+	}
+	rl := newRateLimiter(c)
+	defer rl.Stop()
+
+	ar := &authRequest{Account: "john", RemoteIP: net.ParseIP("1.2.3.4")}
+	for i := 0; i < 3; i++ {
+		if wait := rl.Check(newRateLimitKey(ar)); wait != 0 {
+			t.Fatalf("%d: request should have been allowed, got %s", i, wait)
+		}
+	}
+	if wait := rl.Check(newRateLimitKey(ar)); wait == 0 {
+		t.Errorf("burst exceeded, request should have been limited")
+	}
+
+	ci := &authRequest{Account: "ci", RemoteIP: net.ParseIP("10.1.2.3")}
+	for i := 0; i < 5; i++ {
+		rl.Record(newRateLimitKey(ci), false)
+		if wait := rl.Check(newRateLimitKey(ci)); wait != 0 {
+			t.Fatalf("%d: allowed address should not be limited, got %s", i, wait)
+		}
+	}
+
+	// Failures from different addresses add up for the account.
+	jane1 := &authRequest{Account: "jane", RemoteIP: net.ParseIP("1.1.1.1")}
+	jane2 := &authRequest{Account: "jane", RemoteIP: net.ParseIP("2.2.2.2")}
+	rl.Record(newRateLimitKey(jane1), false)
+	if wait := rl.Check(newRateLimitKey(jane2)); wait != 0 {
+		t.Errorf("account should not be locked out yet, got %s", wait)
+	}
+	rl.Record(newRateLimitKey(jane2), false)
+	if wait := rl.Check(newRateLimitKey(jane2)); wait < 59*time.Minute {
+		t.Errorf("account should be locked out, got %s", wait)
+	}
+	rl.Record(newRateLimitKey(jane2), true)
+	if wait := rl.Check(newRateLimitKey(jane2)); wait != 0 {
+		t.Errorf("lockout should be reset by successful login, got %s", wait)
+	}
+
+	c.Lockout.Delay = time.Minute
+	bob := &authRequest{Account: "bob", RemoteIP: net.ParseIP("3.3.3.3")}
+	rl.Record(newRateLimitKey(bob), false)
+	if wait := rl.Check(newRateLimitKey(bob)); wait <= 0 || wait > time.Minute {
+		t.Errorf("expected a delay of up to a minute, got %s", wait)
+	}
+
+	// Spelling variations of the account share its failure count.
+	mallory := &authRequest{Account: "mallory", RemoteIP: net.ParseIP("4.4.4.4")}
+	rl.Record(newRateLimitKey(&authRequest{Account: "Mallory ", RemoteIP: net.ParseIP("5.5.5.5")}), false)
+	rl.Record(newRateLimitKey(&authRequest{Account: "MALLORY", RemoteIP: net.ParseIP("6.6.6.6")}), false)
+	if wait := rl.Check(newRateLimitKey(mallory)); wait < 59*time.Minute {
+		t.Errorf("account should be locked out regardless of spelling, got %s", wait)
+	}
+}
@@ -0,0 +1,299 @@
+/*
+   Copyright 2016 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const proxyHeaderTimeout = 5 * time.Second
+
+func parseTrustedProxies(tps []string) ([]*net.IPNet, error) {
+	var res []*net.IPNet
+	for _, tp := range tps {
+		if !strings.Contains(tp, "/") {
+			ip := net.ParseIP(tp)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", tp)
+			}
+			if ip.To4() != nil {
+				tp += "/32"
+			} else {
+				tp += "/128"
+			}
+		}
+		_, ipnet, err := net.ParseCIDR(tp)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, ipnet)
+	}
+	return res, nil
+}
+
+func isTrusted(trusted []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, ipnet := range trusted {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseForwarded extracts the addresses in "for" parameters from RFC 7239 Forwarded header values,
+// e.g. 2001:db8::1 from for="[2001:db8::1]:4711". Hidden identifiers (unknown, _name) are returned as "".
+func parseForwarded(values []string) []string {
+	var res []string
+	for _, hv := range values {
+		for _, elem := range strings.Split(hv, ",") {
+			for _, pair := range strings.Split(elem, ";") {
+				kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+				if len(kv) == 2 && strings.EqualFold(kv[0], "for") {
+					res = append(res, forwardedNode(strings.Trim(kv[1], `"`)))
+				}
+			}
+		}
+	}
+	return res
+}
+
+// forwardedNode returns the IP address of a node in a Forwarded header, without port and brackets.
+func forwardedNode(node string) string {
+	if host, _, err := net.SplitHostPort(node); err == nil {
+		node = host
+	}
+	node = strings.TrimSuffix(strings.TrimPrefix(node, "["), "]")
+	if net.ParseIP(node) == nil {
+		return ""
+	}
+	return node
+}
+
+// realClientAddr determines client's address from the configured header.
+// If trusted proxies are configured, the header is only taken into account for requests coming from them
+// and is walked from right to left, skipping trusted hops. Otherwise, the first address is used.
+func realClientAddr(req *http.Request, sc *ServerConfig) (string, error) {
+	var hops []string
+	if strings.EqualFold(sc.RealIPHeader, "Forwarded") {
+		hops = parseForwarded(req.Header["Forwarded"])
+	} else {
+		for _, hv := range req.Header[http.CanonicalHeaderKey(sc.RealIPHeader)] {
+			for _, hop := range strings.Split(hv, ",") {
+				hops = append(hops, strings.TrimSpace(hop))
+			}
+		}
+	}
+	glog.V(3).Infof("Conn addr %s, %s: %s", req.RemoteAddr, sc.RealIPHeader, hops)
+	if len(sc.trustedProxies) == 0 {
+		if len(hops) == 0 || hops[0] == "" {
+			return "", errors.New("client address not provided")
+		}
+		return hops[0], nil
+	}
+	if !isTrusted(sc.trustedProxies, parseRemoteAddr(req.RemoteAddr)) {
+		// Not coming from a proxy, header cannot be trusted.
+		return req.RemoteAddr, nil
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		if i > 0 && isTrusted(sc.trustedProxies, parseRemoteAddr(hops[i])) {
+			continue
+		}
+		if hops[i] == "" {
+			break
+		}
+		return hops[i], nil
+	}
+	return "", errors.New("client address not provided")
+}
+
+// WrapListener adds PROXY protocol support to the listener, if enabled in c.
+func WrapListener(l net.Listener, c *Config) *ProxyProtocolListener {
+	pl := &ProxyProtocolListener{Listener: l}
+	pl.Update(c)
+	return pl
+}
+
+// ProxyProtocolListener accepts connections that start with a PROXY protocol (v1 or v2) header.
+// https://www.haproxy.org/download/1.8/doc/proxy-protocol.txt
+// The header is required from trusted proxies (all peers if none are configured) and is not accepted from anyone else.
+type ProxyProtocolListener struct {
+	net.Listener
+	settings atomic.Value // *proxyProtocolSettings
+}
+
+type proxyProtocolSettings struct {
+	enabled bool
+	trusted []*net.IPNet
+}
+
+// Update applies PROXY protocol settings of c to connections accepted from now on.
+func (l *ProxyProtocolListener) Update(c *Config) {
+	l.settings.Store(&proxyProtocolSettings{enabled: c.Server.ProxyProtocol, trusted: c.Server.trustedProxies})
+}
+
+func (l *ProxyProtocolListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	s := l.settings.Load().(*proxyProtocolSettings)
+	if !s.enabled {
+		return c, nil
+	}
+	if len(s.trusted) > 0 {
+		if ta, ok := c.RemoteAddr().(*net.TCPAddr); !ok || !isTrusted(s.trusted, ta.IP) {
+			return c, nil
+		}
+	}
+	return &proxyProtocolConn{Conn: c, r: bufio.NewReader(c)}, nil
+}
+
+// proxyProtocolConn reads the header lazily, on first use, so that Accept is not held up by slow peers.
+type proxyProtocolConn struct {
+	net.Conn
+	r       *bufio.Reader
+	once    sync.Once
+	srcAddr net.Addr
+	err     error
+}
+
+func (c *proxyProtocolConn) readHeader() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		c.srcAddr, c.err = readProxyHeader(c.r)
+		c.Conn.SetReadDeadline(time.Time{})
+		if c.err != nil {
+			glog.Warningf("Bad PROXY protocol header from %s: %s", c.Conn.RemoteAddr(), c.err)
+		}
+	})
+}
+
+func (c *proxyProtocolConn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.srcAddr != nil {
+		return c.srcAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// readProxyHeader consumes the PROXY protocol header and returns the source address.
+// nil address is returned if the header does not carry one (UNKNOWN or LOCAL).
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	if sig, err := r.Peek(len(proxyV2Signature)); err == nil && bytes.Equal(sig, proxyV2Signature) {
+		return readProxyHeaderV2(r)
+	}
+	sig, err := r.Peek(6)
+	if err != nil {
+		return nil, err
+	}
+	if string(sig) != "PROXY " {
+		return nil, errors.New("no PROXY protocol header")
+	}
+	return readProxyHeaderV1(r)
+}
+
+func readProxyHeaderV1(r *bufio.Reader) (net.Addr, error) {
+	// Maximum length of a v1 header is 107 bytes, including CRLF.
+	var line []byte
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("v1 header is too long")
+	}
+	parts := strings.Split(string(line[:len(line)-2]), " ")
+	if len(parts) >= 2 && parts[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(parts) != 6 || (parts[1] != "TCP4" && parts[1] != "TCP6") {
+		return nil, fmt.Errorf("invalid v1 header %q", line)
+	}
+	ip := net.ParseIP(parts[2])
+	port, err := strconv.Atoi(parts[4])
+	if ip == nil || err != nil || port < 0 || port > 65535 {
+		return nil, fmt.Errorf("invalid v1 header %q", line)
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+func readProxyHeaderV2(r *bufio.Reader) (net.Addr, error) {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, err
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported v2 version %d", hdr[12]>>4)
+	}
+	data := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	switch hdr[12] & 0xf {
+	case 0: // LOCAL, e.g. health checks from the proxy itself.
+		return nil, nil
+	case 1: // PROXY
+	default:
+		return nil, fmt.Errorf("unsupported v2 command %d", hdr[12]&0xf)
+	}
+	switch hdr[13] >> 4 {
+	case 1: // AF_INET
+		if len(data) < 12 {
+			return nil, errors.New("v2 address block is too short")
+		}
+		return &net.TCPAddr{IP: net.IP(data[0:4]), Port: int(binary.BigEndian.Uint16(data[8:10]))}, nil
+	case 2: // AF_INET6
+		if len(data) < 36 {
+			return nil, errors.New("v2 address block is too short")
+		}
+		return &net.TCPAddr{IP: net.IP(data[0:16]), Port: int(binary.BigEndian.Uint16(data[32:34]))}, nil
+	}
+	return nil, nil
+}
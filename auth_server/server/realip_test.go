@@ -0,0 +1,158 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestRealClientAddr(t *testing.T) {
+	trusted, err := parseTrustedProxies([]string{"10.0.0.0/8", "192.168.1.1", "fd00::/8"})
+	if err != nil {
+		t.Fatalf("failed to parse trusted proxies: %s", err)
+	}
+	xff := &ServerConfig{RealIPHeader: "X-Forwarded-For", trustedProxies: trusted}
+	fwd := &ServerConfig{RealIPHeader: "Forwarded", trustedProxies: trusted}
+	legacy := &ServerConfig{RealIPHeader: "X-Forwarded-For"}
+	cases := []struct {
+		sc       *ServerConfig
+		connAddr string
+		header   []string
+		result   string
+		ok       bool
+	}{
+		{legacy, "1.1.1.1:1234", []string{"6.6.6.6, 2.2.2.2"}, "6.6.6.6", true},
+		{legacy, "1.1.1.1:1234", nil, "", false},
+		// Not from a trusted proxy, header is ignored.
+		{xff, "1.1.1.1:1234", []string{"6.6.6.6"}, "1.1.1.1:1234", true},
+		{xff, "1.1.1.1:1234", nil, "1.1.1.1:1234", true},
+		// Forged first hop is skipped.
+		{xff, "10.1.1.1:1234", []string{"6.6.6.6, 2.2.2.2"}, "2.2.2.2", true},
+		{xff, "10.1.1.1:1234", []string{"6.6.6.6, 2.2.2.2, 10.2.2.2, 192.168.1.1"}, "2.2.2.2", true},
+		{xff, "10.1.1.1:1234", []string{"6.6.6.6", "2.2.2.2, 10.2.2.2"}, "2.2.2.2", true},
+		// All hops are trusted, the leftmost one is the client.
+		{xff, "10.1.1.1:1234", []string{"10.3.3.3, 10.2.2.2"}, "10.3.3.3", true},
+		{xff, "10.1.1.1:1234", nil, "", false},
+		{xff, "10.1.1.1:1234", []string{""}, "", false},
+		{fwd, "10.1.1.1:1234", []string{`for=6.6.6.6, for="[2001:db8::1]:4711";proto=https, for=10.2.2.2`}, "2001:db8::1", true},
+		{fwd, "10.1.1.1:1234", []string{`for=6.6.6.6, for="[2001:db8::1]:4711", for="[fd00::2]:80"`}, "2001:db8::1", true},
+		{fwd, "10.1.1.1:1234", []string{`for="[2001:db8::1]", for="2001:db8::2"`}, "2001:db8::2", true},
+		{fwd, "10.1.1.1:1234", []string{`for=6.6.6.6:4711`}, "6.6.6.6", true},
+		// Hidden nodes are not addresses.
+		{fwd, "10.1.1.1:1234", []string{`for=6.6.6.6, for=unknown, for=10.2.2.2`}, "", false},
+		{fwd, "10.1.1.1:1234", []string{`for=6.6.6.6, for="_hidden:_port"`}, "", false},
+		{fwd, "1.1.1.1:1234", []string{"for=6.6.6.6"}, "1.1.1.1:1234", true},
+	}
+	for i, c := range cases {
+		req := &http.Request{RemoteAddr: c.connAddr, Header: http.Header{}}
+		for _, hv := range c.header {
+			req.Header.Add(c.sc.RealIPHeader, hv)
+		}
+		result, err := realClientAddr(req, c.sc)
+		if c.ok && (err != nil || result != c.result) {
+			t.Errorf("%d: expected %q, got %q, %v", i, c.result, result, err)
+		} else if !c.ok && err == nil {
+			t.Errorf("%d: expected to fail, got %q", i, result)
+		}
+	}
+}
+
+func TestParseRemoteAddr(t *testing.T) {
+	cases := map[string]string{
+		"1.2.3.4":            "1.2.3.4",
+		"1.2.3.4:80":         "1.2.3.4",
+		"2001:db8::1":        "2001:db8::1",
+		"2001:db8::1:80":     "2001:db8::1:80",
+		"[2001:db8::1]":      "2001:db8::1",
+		"[2001:db8::1]:4711": "2001:db8::1",
+		"":                   "<nil>",
+		"unknown":            "<nil>",
+	}
+	for ra, expected := range cases {
+		if ip := parseRemoteAddr(ra); ip.String() != expected {
+			t.Errorf("%q: expected %s, got %s", ra, expected, ip)
+		}
+	}
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	v2 := func(cmd, fam byte, addr []byte) string {
+		b := append([]byte{}, proxyV2Signature...)
+		b = append(b, 0x20|cmd, fam, 0, byte(len(addr)))
+		return string(append(b, addr...))
+	}
+	cases := []struct {
+		data string
+		addr string
+		ok   bool
+	}{
+		{"PROXY TCP4 1.2.3.4 5.6.7.8 1111 80\r\nGET", "1.2.3.4:1111", true},
+		{"PROXY TCP6 2001:db8::1 2001:db8::2 1111 80\r\nGET", "[2001:db8::1]:1111", true},
+		{"PROXY UNKNOWN\r\nGET", "", true},
+		{"PROXY TCP4 1.2.3.4 5.6.7.8 1111\r\nGET", "", false},
+		{"PROXY TCP4 " + strings.Repeat("1", 100) + "\r\n", "", false},
+		{"GET / HTTP/1.1\r\n", "", false},
+		{v2(1, 0x11, []byte{1, 2, 3, 4, 5, 6, 7, 8, 0x04, 0x57, 0, 80}) + "GET", "1.2.3.4:1111", true},
+		{v2(0, 0x00, nil) + "GET", "", true},
+		{v2(1, 0x11, []byte{1, 2, 3}) + "GET", "", false},
+	}
+	for i, c := range cases {
+		r := bufio.NewReader(bytes.NewBufferString(c.data))
+		addr, err := readProxyHeader(r)
+		if !c.ok {
+			if err == nil {
+				t.Errorf("%d: expected to fail, got %s", i, addr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%d: unexpected error: %s", i, err)
+			continue
+		}
+		if (addr == nil && c.addr != "") || (addr != nil && addr.(*net.TCPAddr).String() != c.addr) {
+			t.Errorf("%d: expected %q, got %s", i, c.addr, addr)
+		}
+		if rest, _ := r.Peek(3); string(rest) != "GET" {
+			t.Errorf("%d: header not consumed correctly, rest: %q", i, rest)
+		}
+	}
+}
+
+func TestProxyProtocolListenerUpdate(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Config{Server: ServerConfig{ProxyProtocol: true}}
+	pl := WrapListener(l, c)
+	defer pl.Close()
+	accept := func() net.Conn {
+		cc, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cc.Close()
+		sc, err := pl.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		sc.Close()
+		return sc
+	}
+	if _, ok := accept().(*proxyProtocolConn); !ok {
+		t.Errorf("PROXY protocol is not applied")
+	}
+	// Connections from peers other than trusted proxies are not expected to send the header.
+	c.Server.trustedProxies, _ = parseTrustedProxies([]string{"10.0.0.0/8"})
+	pl.Update(c)
+	if _, ok := accept().(*proxyProtocolConn); ok {
+		t.Errorf("PROXY protocol is applied to an untrusted peer")
+	}
+	pl.Update(&Config{})
+	if _, ok := accept().(*proxyProtocolConn); ok {
+		t.Errorf("PROXY protocol is applied after it was disabled")
+	}
+}
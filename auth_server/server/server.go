@@ -20,6 +20,8 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"html/template"
+	"math"
 	"math/rand"
 	"net"
 	"net/http"
@@ -27,8 +29,10 @@ import (
 	"strings"
 	"time"
 
+	"github.com/cesanta/docker_auth/auth_server/audit"
 	"github.com/cesanta/docker_auth/auth_server/authn"
 	"github.com/cesanta/docker_auth/auth_server/authz"
+	"github.com/cesanta/docker_auth/auth_server/metrics"
 	"github.com/docker/distribution/registry/auth/token"
 	"github.com/golang/glog"
 )
@@ -39,64 +43,214 @@ type AuthServer struct {
 	authorizers    []authz.Authorizer
 	ga             *authn.GoogleAuth
 	gha            *authn.GitHubAuth
+	tokenDBs       map[string]authn.TokenDB // By config section, for the admin API and the portal.
+	templates      map[string]*template.Template
+	web            *authn.WebSecurity
+	devices        authn.TokenStore // Pending device authorizations, nil if disabled.
+	devicePending  int64            // Number of pending device authorizations, updated atomically.
+	deviceStop     chan struct{}
+	mfa            *authn.MFA
+	mongoAuth      *authn.MongoAuth     // For the admin API.
+	aclMongo       authz.MongoACLEditor // For the admin API.
+	audit          *audit.Logger
+	limiter        *rateLimiter
+	readyz         readyzCache
+
+	// Authenticators of users, mongo_auth and sql_auth, users sign in to the portal with their passwords when MFA is enabled.
+	passwordAuthenticators []authn.Authenticator
 }
 
 func NewAuthServer(c *Config) (*AuthServer, error) {
 	as := &AuthServer{
 		config:      c,
 		authorizers: []authz.Authorizer{},
+		tokenDBs:    make(map[string]authn.TokenDB),
+	}
+	if err := as.init(c); err != nil {
+		// Release backends that have been set up so far, a failed reload must not leave connections behind.
+		as.Stop()
+		return nil, err
+	}
+	return as, nil
+}
+
+func (as *AuthServer) init(c *Config) error {
+	templates, err := c.Portal.loadTemplates()
+	if err != nil {
+		return fmt.Errorf("failed to load portal templates: %s", err)
+	}
+	as.templates = templates
+	as.web = authn.NewWebSecurity(c.Portal.sessionKey, c.Portal.SecureCookies)
+	as.web.SetTrustedProxy(as.fromTrustedProxy)
+	if c.Server.RealIPHeader != "" && len(c.Server.TrustedProxies) == 0 {
+		glog.Warningf("%s is trusted from any client, consider setting server.trusted_proxies", c.Server.RealIPHeader)
+	}
+	if c.MongoAuth != nil {
+		// Goes first, entries in user documents take precedence over the global ACL.
+		userAuthorizer, err := authz.NewMongoUserACLAuthorizer(c.MongoAuth)
+		if err != nil {
+			return err
+		}
+		as.authorizers = append(as.authorizers, userAuthorizer)
 	}
 	if c.ACL != nil {
 		staticAuthorizer, err := authz.NewACLAuthorizer(c.ACL)
 		if err != nil {
-			return nil, err
+			return err
 		}
 		as.authorizers = append(as.authorizers, staticAuthorizer)
 	}
 	if c.ACLMongo != nil {
 		mongoAuthorizer, err := authz.NewACLMongoAuthorizer(c.ACLMongo)
 		if err != nil {
-			return nil, err
+			return err
 		}
 		as.authorizers = append(as.authorizers, mongoAuthorizer)
+		as.aclMongo, _ = mongoAuthorizer.(authz.MongoACLEditor)
+	}
+	if c.ACLSQL != nil {
+		sqlAuthorizer, err := authz.NewACLSQLAuthorizer(c.ACLSQL)
+		if err != nil {
+			return err
+		}
+		as.authorizers = append(as.authorizers, sqlAuthorizer)
+	}
+	if c.ACLLDAP != nil {
+		ldapAuthorizer, err := authz.NewACLLDAPAuthorizer(c.ACLLDAP)
+		if err != nil {
+			return err
+		}
+		as.authorizers = append(as.authorizers, ldapAuthorizer)
+	}
+	if c.DeviceAuth != nil {
+		devices, err := openDeviceStore(c.DeviceAuth)
+		if err != nil {
+			return fmt.Errorf("failed to open device authorization store: %s", err)
+		}
+		as.devices = devices
+		as.deviceStop = make(chan struct{})
+		go as.purgeDeviceGrantsLoop()
+	}
+	if c.MFA != nil {
+		m, err := authn.NewMFA(c.MFA)
+		if err != nil {
+			return err
+		}
+		// Goes first, passwords issued after MFA sign in are accepted before other authenticators get to apply the policy.
+		if err := as.addAuthenticator("mfa", m); err != nil {
+			return err
+		}
+		as.mfa = m
+		as.tokenDBs["mfa"] = m.TokenDB()
 	}
 	if c.Users != nil {
-		as.authenticators = append(as.authenticators, authn.NewStaticUserAuth(c.Users))
+		sua := authn.NewStaticUserAuth(c.Users)
+		sua.SetPasswordHashPolicy(c.PasswordHash)
+		if err := as.addPasswordAuthenticator("users", sua); err != nil {
+			return err
+		}
 	}
 	if c.ExtAuth != nil {
-		as.authenticators = append(as.authenticators, authn.NewExtAuth(c.ExtAuth))
+		if err := as.addAuthenticator("ext_auth", authn.NewExtAuth(c.ExtAuth)); err != nil {
+			return err
+		}
 	}
 	if c.GoogleAuth != nil {
 		ga, err := authn.NewGoogleAuth(c.GoogleAuth)
 		if err != nil {
-			return nil, err
+			return err
+		}
+		if err := as.addAuthenticator("google_auth", ga); err != nil {
+			return err
 		}
-		as.authenticators = append(as.authenticators, ga)
+		ga.SetLoginHandler(as.portalLogin("google_auth"))
+		ga.SetWebSecurity(as.web)
 		as.ga = ga
+		as.tokenDBs["google_auth"] = ga.TokenDB()
 	}
 	if c.GitHubAuth != nil {
 		gha, err := authn.NewGitHubAuth(c.GitHubAuth)
 		if err != nil {
-			return nil, err
+			return err
+		}
+		if err := as.addAuthenticator("github_auth", gha); err != nil {
+			return err
 		}
-		as.authenticators = append(as.authenticators, gha)
+		gha.SetLoginHandler(as.portalLogin("github_auth"))
+		gha.SetWebSecurity(as.web)
 		as.gha = gha
+		as.tokenDBs["github_auth"] = gha.TokenDB()
 	}
 	if c.LDAPAuth != nil {
 		la, err := authn.NewLDAPAuth(c.LDAPAuth)
 		if err != nil {
-			return nil, err
+			return err
+		}
+		if err := as.addAuthenticator("ldap_auth", la); err != nil {
+			return err
 		}
-		as.authenticators = append(as.authenticators, la)
 	}
 	if c.MongoAuth != nil {
 		ma, err := authn.NewMongoAuth(c.MongoAuth)
 		if err != nil {
-			return nil, err
+			return err
 		}
-		as.authenticators = append(as.authenticators, ma)
+		ma.SetPasswordHashPolicy(c.PasswordHash)
+		if err := as.addPasswordAuthenticator("mongo_auth", ma); err != nil {
+			return err
+		}
+		as.mongoAuth = ma
 	}
-	return as, nil
+	if c.SQLAuth != nil {
+		sa, err := authn.NewSQLAuth(c.SQLAuth)
+		if err != nil {
+			return err
+		}
+		sa.SetPasswordHashPolicy(c.PasswordHash)
+		if err := as.addPasswordAuthenticator("sql_auth", sa); err != nil {
+			return err
+		}
+	}
+	if c.RateLimit != nil {
+		as.limiter = newRateLimiter(c.RateLimit)
+	}
+	if c.Audit != nil {
+		al, err := audit.New(c.Audit)
+		if err != nil {
+			return err
+		}
+		as.audit = al
+	}
+	return nil
+}
+
+// fromTrustedProxy tells whether the request comes directly from one of server.trusted_proxies.
+func (as *AuthServer) fromTrustedProxy(req *http.Request) bool {
+	return isTrusted(as.config.Server.trustedProxies, parseRemoteAddr(req.RemoteAddr))
+}
+
+// addAuthenticator adds an authenticator, putting a result cache in front of it if configured for its section.
+// Caches live as long as the server, so they are discarded on config reload.
+func (as *AuthServer) addAuthenticator(section string, a authn.Authenticator) error {
+	if cc := as.config.AuthnCache[section]; cc != nil {
+		ca, err := authn.NewCachingAuthenticator(a, cc)
+		if err != nil {
+			a.Stop()
+			return err
+		}
+		a = ca
+	}
+	as.authenticators = append(as.authenticators, a)
+	return nil
+}
+
+// addPasswordAuthenticator adds an authenticator that MFA applies to.
+func (as *AuthServer) addPasswordAuthenticator(section string, a authn.Authenticator) error {
+	if err := as.addAuthenticator(section, a); err != nil {
+		return err
+	}
+	as.passwordAuthenticators = append(as.passwordAuthenticators, as.authenticators[len(as.authenticators)-1])
+	return nil
 }
 
 type authRequest struct {
@@ -108,6 +262,11 @@ type authRequest struct {
 	Account        string
 	Service        string
 	Scopes         []authScope
+	Labels         authn.Labels
+	AuthnBackend   string
+	// Authenticator the account belongs to, the password authenticator the user signed in with
+	// for passwords issued after MFA sign in, otherwise AuthnBackend.
+	AccountBackend string
 }
 
 type authScope struct {
@@ -119,33 +278,33 @@ type authScope struct {
 type authzResult struct {
 	scope            authScope
 	autorizedActions []string
+	authorizer       string
+	comment          string
 }
 
 func (ar authRequest) String() string {
 	return fmt.Sprintf("{%s:%s@%s %s}", ar.User, ar.Password, ar.RemoteAddr, ar.Scopes)
 }
 
+// parseRemoteAddr returns the IP of an address with or without port, e.g. 1.2.3.4:80, [2001:db8::1]:80 or 2001:db8::1.
 func parseRemoteAddr(ra string) net.IP {
-	colonIndex := strings.LastIndex(ra, ":")
-	if colonIndex > 0 && ra[colonIndex-1] >= 0x30 && ra[colonIndex-1] <= 0x39 {
-		ra = ra[:colonIndex]
+	if host, _, err := net.SplitHostPort(ra); err == nil {
+		ra = host
 	}
-	if ra[0] == '[' && ra[len(ra)-1] == ']' { // IPv6
+	if len(ra) > 1 && ra[0] == '[' && ra[len(ra)-1] == ']' { // IPv6
 		ra = ra[1 : len(ra)-1]
 	}
-	res := net.ParseIP(ra)
-	return res
+	return net.ParseIP(ra)
 }
 
 func (as *AuthServer) ParseRequest(req *http.Request) (*authRequest, error) {
 	ar := &authRequest{RemoteConnAddr: req.RemoteAddr, RemoteAddr: req.RemoteAddr}
 	if as.config.Server.RealIPHeader != "" {
-		hv := req.Header.Get(as.config.Server.RealIPHeader)
-		ar.RemoteAddr = strings.TrimSpace(strings.Split(hv, ",")[0])
-		glog.V(3).Infof("Conn ip %s, %s: %s, addr: %s", ar.RemoteAddr, as.config.Server.RealIPHeader, hv, ar.RemoteAddr)
-		if ar.RemoteAddr == "" {
-			return nil, fmt.Errorf("client address not provided")
+		ra, err := realClientAddr(req, &as.config.Server)
+		if err != nil {
+			return nil, err
 		}
+		ar.RemoteAddr = ra
 	}
 	ar.RemoteIP = parseRemoteAddr(ar.RemoteAddr)
 	if ar.RemoteIP == nil {
@@ -184,8 +343,10 @@ func (as *AuthServer) ParseRequest(req *http.Request) (*authRequest, error) {
 
 func (as *AuthServer) Authenticate(ar *authRequest) (bool, error) {
 	for i, a := range as.authenticators {
-		result, err := a.Authenticate(ar.Account, ar.Password)
-		glog.V(2).Infof("Authn %s %s -> %t, %v", a.Name(), ar.Account, result, err)
+		start := time.Now()
+		result, labels, err := a.Authenticate(ar.Account, ar.Password)
+		metrics.AuthnDuration.WithLabelValues(a.Name()).Observe(time.Since(start).Seconds())
+		glog.V(2).Infof("Authn %s %s -> %t, %+v, %v", a.Name(), ar.Account, result, labels, err)
 		if err != nil {
 			if err == authn.NoMatch {
 				continue
@@ -193,10 +354,36 @@ func (as *AuthServer) Authenticate(ar *authRequest) (bool, error) {
 				glog.Warningf("Failed authentication with %s: %s", err)
 				return false, nil
 			}
+			metrics.AuthnErrors.WithLabelValues(a.Name()).Inc()
 			err = fmt.Errorf("authn #%d returned error: %s", i+1, err)
 			glog.Errorf("%s: %s", ar, err)
 			return false, err
 		}
+		if result && as.mfaRequired(a, ar.Account) {
+			glog.Warningf("%s: %s requires MFA, password must be issued by the portal", a.Name(), ar.Account)
+			return false, nil
+		}
+		accountBackend := a.Name()
+		if result && as.mfa != nil && a == authn.Authenticator(as.mfa) {
+			var active bool
+			accountBackend, active, err = as.mfaAccount(ar.Account)
+			if err != nil {
+				glog.Errorf("%s: failed to check account of %s: %s", a.Name(), ar.Account, err)
+				return false, err
+			} else if !active {
+				glog.Warningf("%s: account %s is disabled, expired or deleted", a.Name(), ar.Account)
+				return false, nil
+			}
+		}
+		if result {
+			ar.Labels = labels
+			ar.AuthnBackend = a.Name()
+			ar.AccountBackend = accountBackend
+			if acct := labels[authn.AccountLabel]; len(acct) == 1 && acct[0] != "" && acct[0] != ar.Account {
+				glog.V(2).Infof("%s: account %q is known as %q", a.Name(), ar.Account, acct[0])
+				ar.Account = acct[0]
+			}
+		}
 		return result, nil
 	}
 	// Deny by default.
@@ -204,23 +391,38 @@ func (as *AuthServer) Authenticate(ar *authRequest) (bool, error) {
 	return false, nil
 }
 
-func (as *AuthServer) authorizeScope(ai *authz.AuthRequestInfo) ([]string, error) {
+func (as *AuthServer) authorizeScope(ai *authz.AuthRequestInfo, res *authzResult) error {
 	for i, a := range as.authorizers {
-		result, err := a.Authorize(ai)
+		var result []string
+		var entry *authz.ACLEntry
+		var err error
+		start := time.Now()
+		if ra, ok := a.(authz.RuleAuthorizer); ok {
+			result, entry, err = ra.AuthorizeRule(ai)
+		} else {
+			result, err = a.Authorize(ai)
+		}
+		metrics.AuthzDuration.WithLabelValues(a.Name()).Observe(time.Since(start).Seconds())
 		glog.V(2).Infof("Authz %s %s -> %s, %s", a.Name(), *ai, result, err)
 		if err != nil {
 			if err == authz.NoMatch {
 				continue
 			}
+			metrics.AuthzErrors.WithLabelValues(a.Name()).Inc()
 			err = fmt.Errorf("authz #%d returned error: %s", i+1, err)
 			glog.Errorf("%s: %s", *ai, err)
-			return nil, err
+			return err
 		}
-		return result, nil
+		res.autorizedActions = result
+		res.authorizer = a.Name()
+		if entry != nil && entry.Comment != nil {
+			res.comment = *entry.Comment
+		}
+		return nil
 	}
 	// Deny by default.
 	glog.Warningf("%s did not match any authz rule", *ai)
-	return nil, nil
+	return nil
 }
 
 func (as *AuthServer) Authorize(ar *authRequest) ([]authzResult, error) {
@@ -233,25 +435,28 @@ func (as *AuthServer) Authorize(ar *authRequest) ([]authzResult, error) {
 			Service: ar.Service,
 			IP:      ar.RemoteIP,
 			Actions: scope.Actions,
+			Labels:  ar.Labels,
+
+			AuthnBackend: ar.AccountBackend,
 		}
-		actions, err := as.authorizeScope(ai)
-		if err != nil {
+		res := authzResult{scope: scope}
+		if err := as.authorizeScope(ai, &res); err != nil {
 			return nil, err
 		}
-		ares = append(ares, authzResult{scope: scope, autorizedActions: actions})
+		ares = append(ares, res)
 	}
 	return ares, nil
 }
 
 // https://github.com/docker/distribution/blob/master/docs/spec/auth/token.md#example
-func (as *AuthServer) CreateToken(ar *authRequest, ares []authzResult) (string, error) {
+func (as *AuthServer) CreateToken(ar *authRequest, ares []authzResult) (string, *token.ClaimSet, error) {
 	now := time.Now().Unix()
 	tc := &as.config.Token
 
 	// Sign something dummy to find out which algorithm is used.
 	_, sigAlg, err := tc.privateKey.Sign(strings.NewReader("dummy"), 0)
 	if err != nil {
-		return "", fmt.Errorf("failed to sign: %s", err)
+		return "", nil, fmt.Errorf("failed to sign: %s", err)
 	}
 	header := token.Header{
 		Type:       "JWT",
@@ -260,7 +465,7 @@ func (as *AuthServer) CreateToken(ar *authRequest, ares []authzResult) (string,
 	}
 	headerJSON, err := json.Marshal(header)
 	if err != nil {
-		return "", fmt.Errorf("failed to marshal header: %s", err)
+		return "", nil, fmt.Errorf("failed to marshal header: %s", err)
 	}
 
 	claims := token.ClaimSet{
@@ -287,30 +492,65 @@ func (as *AuthServer) CreateToken(ar *authRequest, ares []authzResult) (string,
 	}
 	claimsJSON, err := json.Marshal(claims)
 	if err != nil {
-		return "", fmt.Errorf("failed to marshal claims: %s", err)
+		return "", nil, fmt.Errorf("failed to marshal claims: %s", err)
+	}
+	if len(tc.ExtraClaims) > 0 {
+		claimsJSON, err = addExtraClaims(claimsJSON, buildExtraClaims(tc, ar))
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to add extra claims: %s", err)
+		}
 	}
 
 	payload := fmt.Sprintf("%s%s%s", joseBase64UrlEncode(headerJSON), token.TokenSeparator, joseBase64UrlEncode(claimsJSON))
 
 	sig, sigAlg2, err := tc.privateKey.Sign(strings.NewReader(payload), 0)
 	if err != nil || sigAlg2 != sigAlg {
-		return "", fmt.Errorf("failed to sign token: %s", err)
+		return "", nil, fmt.Errorf("failed to sign token: %s", err)
 	}
 	glog.Infof("New token for %s: %s", *ar, claimsJSON)
-	return fmt.Sprintf("%s%s%s", payload, token.TokenSeparator, joseBase64UrlEncode(sig)), nil
+	return fmt.Sprintf("%s%s%s", payload, token.TokenSeparator, joseBase64UrlEncode(sig)), &claims, nil
 }
 
 func (as *AuthServer) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	glog.V(3).Infof("Request: %+v", req)
+	mc := as.config.Metrics
 	switch {
 	case req.URL.Path == "/":
 		as.doIndex(rw, req)
+	case req.URL.Path == "/credentials":
+		as.doCredentials(rw, req)
+	case req.URL.Path == "/sign_out":
+		as.doSignOut(rw, req)
+	case strings.HasPrefix(req.URL.Path, "/static/"):
+		as.doStatic(rw, req)
+	case req.URL.Path == "/device" && as.devices != nil:
+		as.doDevice(rw, req)
+	case req.URL.Path == "/device/code" && as.devices != nil:
+		as.doDeviceCode(rw, req)
+	case req.URL.Path == "/device/token" && as.devices != nil:
+		as.doDeviceToken(rw, req)
+	case req.URL.Path == "/login" && as.mfa != nil:
+		as.doPasswordLogin(rw, req)
+	case req.URL.Path == "/login/mfa" && as.mfa != nil:
+		as.doMFALogin(rw, req)
+	case req.URL.Path == "/cli_login" && as.devices != nil:
+		as.doCLILogin(rw, req)
+	case req.URL.Path == "/cli_login/token" && as.devices != nil:
+		as.doCLIToken(rw, req)
 	case req.URL.Path == "/auth":
 		as.doAuth(rw, req)
+	case req.URL.Path == "/healthz":
+		as.doHealthz(rw, req)
+	case req.URL.Path == "/readyz":
+		as.doReadyz(rw, req)
 	case req.URL.Path == "/google_auth" && as.ga != nil:
 		as.ga.DoGoogleAuth(rw, req)
 	case req.URL.Path == "/github_auth" && as.gha != nil:
 		as.gha.DoGitHubAuth(rw, req)
+	case as.config.Admin != nil && strings.HasPrefix(req.URL.Path, as.config.Admin.Path+"/"):
+		as.doAdmin(rw, req)
+	case mc != nil && mc.ListenAddress == "" && req.URL.Path == mc.Path:
+		metrics.Handler().ServeHTTP(rw, req)
 	default:
 		http.Error(rw, "Not found", http.StatusNotFound)
 		return
@@ -318,33 +558,37 @@ func (as *AuthServer) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 }
 
 // https://developers.google.com/identity/sign-in/web/server-side-flow
-func (as *AuthServer) doIndex(rw http.ResponseWriter, req *http.Request) {
-	rw.Header().Set("Content-Type", "text-html; charset=utf-8")
-	fmt.Fprintf(rw, "<h1>%s</h1>\n", as.config.Token.Issuer)
-	if as.ga != nil {
-		fmt.Fprint(rw, `<p><a href="/google_auth">Login with Google account</a></p>`)
-	}
-	if as.gha != nil {
-		fmt.Fprint(rw, `<p><a href="/github_auth">Login with GitHub account</a></p>`)
-	}
-}
-
 func (as *AuthServer) doAuth(rw http.ResponseWriter, req *http.Request) {
 	ar, err := as.ParseRequest(req)
 	ares := []authzResult{}
 	if err != nil {
+		as.recordOutcome(req, nil, nil, nil, metrics.OutcomeBadRequest, err)
 		glog.Warningf("Bad request: %s", err)
 		http.Error(rw, fmt.Sprintf("Bad request: %s", err), http.StatusBadRequest)
 		return
 	}
 	glog.V(2).Infof("Auth request: %+v", ar)
+	limitKey := newRateLimitKey(ar)
+	if as.limiter != nil {
+		if wait := as.limiter.Check(limitKey); wait > 0 {
+			as.recordOutcome(req, ar, nil, nil, metrics.OutcomeRateLimit, nil)
+			rw.Header().Set("Retry-After", fmt.Sprintf("%d", int(math.Ceil(wait.Seconds()))))
+			http.Error(rw, "Too many requests.", http.StatusTooManyRequests)
+			return
+		}
+	}
 	{
 		authnResult, err := as.Authenticate(ar)
+		if err == nil && as.limiter != nil {
+			as.limiter.Record(limitKey, authnResult)
+		}
 		if err != nil {
+			as.recordOutcome(req, ar, nil, nil, metrics.OutcomeAuthnError, err)
 			http.Error(rw, fmt.Sprintf("Authentication failed (%s)", err), http.StatusInternalServerError)
 			return
 		}
 		if !authnResult {
+			as.recordOutcome(req, ar, nil, nil, metrics.OutcomeAuthnFail, nil)
 			glog.Warningf("Auth failed: %s", *ar)
 			http.Error(rw, "Auth failed.", http.StatusUnauthorized)
 			return
@@ -353,32 +597,130 @@ func (as *AuthServer) doAuth(rw http.ResponseWriter, req *http.Request) {
 	if len(ar.Scopes) > 0 {
 		ares, err = as.Authorize(ar)
 		if err != nil {
+			as.recordOutcome(req, ar, nil, nil, metrics.OutcomeAuthzError, err)
 			http.Error(rw, fmt.Sprintf("Authorization failed (%s)", err), http.StatusInternalServerError)
 			return
 		}
 	} else {
 		// Authentication-only request ("docker login"), pass through.
 	}
-	token, err := as.CreateToken(ar, ares)
+	token, claims, err := as.CreateToken(ar, ares)
 	if err != nil {
+		as.recordOutcome(req, ar, ares, nil, metrics.OutcomeTokenError, err)
 		msg := fmt.Sprintf("Failed to generate token %s", err)
 		http.Error(rw, msg, http.StatusInternalServerError)
 		glog.Errorf("%s: %s", ar, msg)
 		return
 	}
+	as.recordOutcome(req, ar, ares, claims, metrics.OutcomeOK, nil)
 	result, _ := json.Marshal(&map[string]string{"token": token})
 	glog.V(3).Infof("%s", result)
 	rw.Header().Set("Content-Type", "application/json")
 	rw.Write(result)
 }
 
+// serviceLabel returns the metric label for a service: its name if listed in metrics.services, "other" otherwise.
+func (as *AuthServer) serviceLabel(service string) string {
+	if mc := as.config.Metrics; mc != nil {
+		for _, s := range mc.Services {
+			if s == service {
+				return service
+			}
+		}
+	}
+	return metrics.Other
+}
+
+// recordOutcome updates metrics and writes the audit record for an auth request.
+// ar, ares and claims are filled in as far as processing of the request got.
+func (as *AuthServer) recordOutcome(req *http.Request, ar *authRequest, ares []authzResult, claims *token.ClaimSet, outcome string, err error) {
+	metrics.Requests.WithLabelValues(outcome).Inc()
+	if claims != nil {
+		metrics.TokensIssued.WithLabelValues(as.serviceLabel(ar.Service)).Inc()
+		for _, a := range ares {
+			for _, action := range a.scope.Actions {
+				metrics.ActionsRequested.WithLabelValues(metrics.ActionLabel(action)).Inc()
+			}
+			for _, action := range a.autorizedActions {
+				metrics.ActionsGranted.WithLabelValues(metrics.ActionLabel(action)).Inc()
+			}
+		}
+	}
+	if as.audit == nil {
+		return
+	}
+	rec := &audit.Record{
+		Time:       time.Now(),
+		RemoteAddr: req.RemoteAddr,
+		Outcome:    outcome,
+	}
+	if err != nil {
+		rec.Error = err.Error()
+	}
+	if ar != nil {
+		if ar.RemoteIP != nil {
+			rec.RealIP = ar.RemoteIP.String()
+		}
+		rec.Account = ar.Account
+		if ar.User != ar.Account {
+			rec.Login = ar.User
+		}
+		rec.Service = ar.Service
+		rec.Authn = ar.AuthnBackend
+		for _, scope := range ar.Scopes {
+			sr := audit.ScopeRecord{Type: scope.Type, Name: scope.Name, Requested: scope.Actions, Granted: []string{}}
+			for _, a := range ares {
+				if a.scope.Type == scope.Type && a.scope.Name == scope.Name {
+					if a.autorizedActions != nil {
+						sr.Granted = a.autorizedActions
+					}
+					sr.Authorizer = a.authorizer
+					sr.Comment = a.comment
+				}
+			}
+			rec.Scopes = append(rec.Scopes, sr)
+		}
+	}
+	if claims != nil {
+		exp := time.Unix(claims.Expiration, 0)
+		rec.TokenID = claims.JWTID
+		rec.TokenExpiry = &exp
+	}
+	as.audit.Log(rec)
+}
+
+// RefreshACLs makes authorizers that cache data from their backends reload it.
+func (as *AuthServer) RefreshACLs() {
+	for _, az := range as.authorizers {
+		if r, ok := az.(authz.Refresher); ok {
+			if err := r.Refresh(); err != nil {
+				glog.Errorf("Failed to refresh %s: %s", az.Name(), err)
+			}
+		}
+	}
+}
+
+// Stop releases all backends. It may be called on a partially initialized or nil server.
 func (as *AuthServer) Stop() {
+	if as == nil {
+		return
+	}
 	for _, an := range as.authenticators {
 		an.Stop()
 	}
 	for _, az := range as.authorizers {
 		az.Stop()
 	}
+	if as.audit != nil {
+		as.audit.Close()
+	}
+	if as.limiter != nil {
+		as.limiter.Stop()
+	}
+	if as.devices != nil {
+		close(as.deviceStop)
+		as.devices.Close()
+	}
 	glog.Infof("Server stopped")
 }
 
@@ -0,0 +1,192 @@
+/*
+   Copyright 2016 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cesanta/docker_auth/auth_server/authn"
+)
+
+const (
+	sessionCookieName    = "docker_auth_session"
+	returnToCookieName   = "docker_auth_return_to"
+	mfaPendingCookieName = "docker_auth_mfa"
+	mfaPendingTTL        = 5 * time.Minute
+)
+
+// portalSession is kept in a cookie signed with the session key.
+type portalSession struct {
+	User     string `json:"u"`
+	Provider string `json:"p"` // Config section of the authenticator, e.g. google_auth.
+	Expires  int64  `json:"e"`
+	// Labels from the password authenticator, only kept while MFA sign in is pending.
+	Labels authn.Labels `json:"l,omitempty"`
+}
+
+var (
+	defaultSessionKeyOnce sync.Once
+	defaultSessionKey     []byte
+)
+
+// randomSessionKey returns a key generated once per process, so that sessions survive config reloads.
+func randomSessionKey() []byte {
+	defaultSessionKeyOnce.Do(func() {
+		defaultSessionKey = make([]byte, 32)
+		if _, err := rand.Read(defaultSessionKey); err != nil {
+			panic(err)
+		}
+	})
+	return defaultSessionKey
+}
+
+func signSession(key, payload []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+func encodeSession(key []byte, s *portalSession) string {
+	payload, _ := json.Marshal(s)
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(signSession(key, payload))
+}
+
+func decodeSession(key []byte, value string) *portalSession {
+	parts := strings.Split(value, ".")
+	if len(parts) != 2 {
+		return nil
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || !hmac.Equal(sig, signSession(key, payload)) {
+		return nil
+	}
+	var s portalSession
+	if err := json.Unmarshal(payload, &s); err != nil || s.User == "" || time.Now().Unix() >= s.Expires {
+		return nil
+	}
+	return &s
+}
+
+func (pc *PortalConfig) secureCookie(req *http.Request) bool {
+	return pc.SecureCookies || req.TLS != nil
+}
+
+// setSession starts a session for the user signed in with the provider.
+func (pc *PortalConfig) setSession(rw http.ResponseWriter, req *http.Request, user, provider string) {
+	expires := time.Now().Add(pc.SessionTTL)
+	s := &portalSession{User: user, Provider: provider, Expires: expires.Unix()}
+	http.SetCookie(rw, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    encodeSession(pc.sessionKey, s),
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   pc.secureCookie(req),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// getSession returns the session of the request, nil if there is no valid one.
+func (pc *PortalConfig) getSession(req *http.Request) *portalSession {
+	c, err := req.Cookie(sessionCookieName)
+	if err != nil {
+		return nil
+	}
+	return decodeSession(pc.sessionKey, c.Value)
+}
+
+// setReturnTo remembers a local path to send the user to after signing in.
+func (pc *PortalConfig) setReturnTo(rw http.ResponseWriter, req *http.Request, path string) {
+	http.SetCookie(rw, &http.Cookie{
+		Name:     returnToCookieName,
+		Value:    path,
+		Path:     "/",
+		MaxAge:   600,
+		HttpOnly: true,
+		Secure:   pc.secureCookie(req),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// takeReturnTo returns the path set by setReturnTo and forgets it. Anything but a local path is ignored.
+func (pc *PortalConfig) takeReturnTo(rw http.ResponseWriter, req *http.Request) string {
+	c, err := req.Cookie(returnToCookieName)
+	if err != nil {
+		return ""
+	}
+	http.SetCookie(rw, &http.Cookie{Name: returnToCookieName, Value: "", Path: "/", MaxAge: -1})
+	if !strings.HasPrefix(c.Value, "/") || strings.HasPrefix(c.Value, "//") || strings.Contains(c.Value, "\\") {
+		return ""
+	}
+	return c.Value
+}
+
+// mfaPendingKey signs cookies of users who entered their password but not their code yet,
+// so that they cannot be passed off as sessions.
+func (pc *PortalConfig) mfaPendingKey() []byte {
+	return signSession(pc.sessionKey, []byte(mfaPendingCookieName))
+}
+
+// setMFAPending remembers that the user has signed in with their password and labels they got.
+func (pc *PortalConfig) setMFAPending(rw http.ResponseWriter, req *http.Request, user string, labels authn.Labels) {
+	s := &portalSession{User: user, Provider: "mfa", Labels: labels, Expires: time.Now().Add(mfaPendingTTL).Unix()}
+	http.SetCookie(rw, &http.Cookie{
+		Name:     mfaPendingCookieName,
+		Value:    encodeSession(pc.mfaPendingKey(), s),
+		Path:     "/login",
+		MaxAge:   int(mfaPendingTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   pc.secureCookie(req),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func (pc *PortalConfig) getMFAPending(req *http.Request) *portalSession {
+	c, err := req.Cookie(mfaPendingCookieName)
+	if err != nil {
+		return nil
+	}
+	return decodeSession(pc.mfaPendingKey(), c.Value)
+}
+
+func (pc *PortalConfig) clearMFAPending(rw http.ResponseWriter, req *http.Request) {
+	http.SetCookie(rw, &http.Cookie{Name: mfaPendingCookieName, Value: "", Path: "/login", MaxAge: -1, HttpOnly: true, Secure: pc.secureCookie(req)})
+}
+
+func (pc *PortalConfig) clearSession(rw http.ResponseWriter, req *http.Request) {
+	http.SetCookie(rw, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   pc.secureCookie(req),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
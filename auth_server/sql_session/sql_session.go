@@ -0,0 +1,118 @@
+/*
+	Copyright 2016 Cesanta Software Ltd.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		 https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package sql_session
+
+import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+
+	// Supported drivers.
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Config stores how to connect to the database.
+type Config struct {
+	// One of "postgres", "mysql" or "sqlite3".
+	Driver string `yaml:"driver,omitempty"`
+	// Driver-specific data source name. Since it usually contains credentials, it can be read from a file instead.
+	DSN          string        `yaml:"dsn,omitempty"`
+	DSNFile      string        `yaml:"dsn_file,omitempty"`
+	MaxOpenConns int           `yaml:"max_open_conns,omitempty"`
+	Timeout      time.Duration `yaml:"timeout,omitempty"`
+}
+
+var identifierRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.]*$`)
+
+// ValidateIdentifier checks that a table or column name from the config can be safely put into a query.
+func ValidateIdentifier(name string) error {
+	if !identifierRegex.MatchString(name) {
+		return fmt.Errorf("invalid identifier %q", name)
+	}
+	return nil
+}
+
+// Validate ensures the connection settings are complete.
+func (c *Config) Validate(configKey string) error {
+	switch c.Driver {
+	case "postgres", "mysql", "sqlite3":
+	case "":
+		return fmt.Errorf("%s.database.driver is required", configKey)
+	default:
+		return fmt.Errorf("%s.database.driver: unsupported driver %q", configKey, c.Driver)
+	}
+	if c.DSN == "" && c.DSNFile == "" {
+		return fmt.Errorf("%s.database.{dsn,dsn_file} is required", configKey)
+	}
+	if c.MaxOpenConns <= 0 {
+		c.MaxOpenConns = 10
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = 10 * time.Second
+	}
+	return nil
+}
+
+// Rebind converts "?" placeholders to the style used by the driver.
+func (c *Config) Rebind(query string) string {
+	if c.Driver != "postgres" {
+		return query
+	}
+	var res strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			res.WriteString("$" + strconv.Itoa(n))
+		} else {
+			res.WriteRune(r)
+		}
+	}
+	return res.String()
+}
+
+func New(c *Config) (*sql.DB, error) {
+	dsn := c.DSN
+	if c.DSNFile != "" {
+		dsnBuf, err := ioutil.ReadFile(c.DSNFile)
+		if err != nil {
+			return nil, fmt.Errorf(`Failed to read DSN file "%s": %s`, c.DSNFile, err)
+		}
+		dsn = strings.TrimSpace(string(dsnBuf))
+	}
+
+	glog.V(2).Infof("Opening %s database (operation timeout %s)", c.Driver, c.Timeout)
+
+	db, err := sql.Open(c.Driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(c.MaxOpenConns)
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}